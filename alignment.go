@@ -0,0 +1,43 @@
+package rmailer
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// organizationalDomain returns the registrable part of domain (RFC 7489
+// section 3.2), e.g. "example.co.uk" for "mail.example.co.uk".
+func organizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
+
+// aligned reports whether two domains are aligned in the DMARC sense: equal
+// in strict mode, sharing their organizational domain in relaxed mode.
+func aligned(a string, b string, strict bool) bool {
+	a = strings.ToLower(strings.TrimSuffix(a, "."))
+	b = strings.ToLower(strings.TrimSuffix(b, "."))
+
+	if strict {
+		return a == b
+	}
+
+	return organizationalDomain(a) == organizationalDomain(b)
+}
+
+// addressDomain returns the domain part of an email address.
+func addressDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return address[at+1:]
+}
@@ -0,0 +1,187 @@
+package rmailer
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ChainValidation is the cv= status of an ARC-Seal.
+type ChainValidation string
+
+const (
+	ChainNone ChainValidation = "none"
+	ChainPass ChainValidation = "pass"
+	ChainFail ChainValidation = "fail"
+)
+
+// maxARCInstance is the highest instance allowed by RFC 8617.
+const maxARCInstance = 50
+
+// DefaultARCHeaders are the headers covered by the ARC-Message-Signature when
+// present in the message.
+var DefaultARCHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "List-Unsubscribe", "DKIM-Signature",
+}
+
+// ARCSealer adds an ARC set (RFC 8617) to messages forwarded through this
+// library, so that downstream receivers can trust the authentication results
+// observed before forwarding.
+type ARCSealer struct {
+	Domain   string
+	Selector string
+	// Signer is an *rsa.PrivateKey or an ed25519.PrivateKey.
+	Signer crypto.Signer
+	// AuthServID identifies this forwarder in ARC-Authentication-Results.
+	AuthServID string
+	// Headers lists the headers signed by the ARC-Message-Signature,
+	// DefaultARCHeaders when nil.
+	Headers []string
+	// Clock gives the t= timestamp of the signatures, SystemClock when nil.
+	Clock Clock
+}
+
+// Seal prepends a new ARC set to the rendered message raw. results are the
+// authentication results observed for the message (e.g. "spf=pass
+// smtp.mailfrom=example.com; dkim=pass header.d=example.com") and cv the
+// validation status of the existing chain, ignored for the first instance.
+// results and AuthServID must not contain line breaks.
+func (s *ARCSealer) Seal(raw []byte, results string, cv ChainValidation) ([]byte, error) {
+	if strings.ContainsAny(s.AuthServID, "\r\n") {
+		return nil, fmt.Errorf("rmailer: ARC AuthServID %q contains a line break", s.AuthServID)
+	}
+	if strings.ContainsAny(results, "\r\n") {
+		return nil, fmt.Errorf("rmailer: ARC authentication results %q contain a line break", results)
+	}
+
+	fields, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := signatureAlgorithm(s.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	sets, err := arcSets(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := len(sets) + 1
+	if instance > maxARCInstance {
+		return nil, errors.New("rmailer: ARC chain is too long")
+	}
+
+	if instance == 1 {
+		cv = ChainNone
+	} else if cv == ChainNone {
+		return nil, errors.New("rmailer: cv must be pass or fail when an ARC chain exists")
+	}
+
+	timestamp := clockOf(s.Clock).Now().Unix()
+
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s\r\n", instance, s.AuthServID, results)
+
+	// ARC-Message-Signature, computed like a DKIM-Signature
+	headers := s.Headers
+	if headers == nil {
+		headers = DefaultARCHeaders
+	}
+	signed := presentHeaders(fields, headers)
+
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		instance, algorithm, s.Domain, s.Selector, timestamp, strings.Join(signed, ":"), bodyHash(body))
+
+	data := bytes.NewBuffer(nil)
+	for _, f := range selectHeaders(fields, signed) {
+		data.WriteString(relaxedHeader(f.raw))
+	}
+	data.WriteString(strings.TrimSuffix(relaxedHeader(ams), "\r\n"))
+
+	b, err := sign(s.Signer, data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	ams += b + "\r\n"
+
+	// ARC-Seal over all the sets, oldest first
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s; b=",
+		instance, algorithm, timestamp, cv, s.Domain, s.Selector)
+
+	data.Reset()
+	for _, set := range sets {
+		data.WriteString(relaxedHeader(set[0].raw))
+		data.WriteString(relaxedHeader(set[1].raw))
+		data.WriteString(relaxedHeader(set[2].raw))
+	}
+	data.WriteString(relaxedHeader(aar))
+	data.WriteString(relaxedHeader(ams))
+	data.WriteString(strings.TrimSuffix(relaxedHeader(seal), "\r\n"))
+
+	if b, err = sign(s.Signer, data.Bytes()); err != nil {
+		return nil, err
+	}
+	seal += b + "\r\n"
+
+	out := bytes.NewBuffer(make([]byte, 0, len(seal)+len(ams)+len(aar)+len(raw)))
+	out.WriteString(seal)
+	out.WriteString(ams)
+	out.WriteString(aar)
+	out.Write(raw)
+
+	return out.Bytes(), nil
+}
+
+// arcSets returns the existing ARC sets ordered by instance, each holding the
+// ARC-Authentication-Results, ARC-Message-Signature and ARC-Seal fields.
+func arcSets(fields []headerField) ([][3]headerField, error) {
+	byInstance := make(map[int]*[3]headerField)
+
+	for _, f := range fields {
+		var slot int
+
+		switch strings.ToLower(f.name) {
+		case "arc-authentication-results":
+			slot = 0
+		case "arc-message-signature":
+			slot = 1
+		case "arc-seal":
+			slot = 2
+		default:
+			continue
+		}
+
+		_, value, _ := strings.Cut(f.raw, ":")
+		instance, err := strconv.Atoi(parseTags(value)["i"])
+		if err != nil || instance < 1 || instance > maxARCInstance {
+			return nil, fmt.Errorf("rmailer: invalid ARC instance in %s", f.name)
+		}
+
+		if byInstance[instance] == nil {
+			byInstance[instance] = &[3]headerField{}
+		}
+		if len(byInstance[instance][slot].raw) > 0 {
+			return nil, fmt.Errorf("rmailer: duplicate %s in ARC set %d", f.name, instance)
+		}
+		byInstance[instance][slot] = f
+	}
+
+	sets := make([][3]headerField, len(byInstance))
+
+	for i := 1; i <= len(byInstance); i++ {
+		set := byInstance[i]
+		if set == nil || len(set[0].raw) == 0 || len(set[1].raw) == 0 || len(set[2].raw) == 0 {
+			return nil, fmt.Errorf("rmailer: ARC set %d is incomplete", i)
+		}
+		sets[i-1] = *byInstance[i]
+	}
+
+	return sets, nil
+}
@@ -0,0 +1,224 @@
+package rmailer_test
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// arcHeader is a header field of a sealed message, folding included.
+type arcHeader struct {
+	name, raw string
+}
+
+// arcMessage splits raw into its header fields and body.
+func arcMessage(t *testing.T, raw []byte) ([]arcHeader, string) {
+	t.Helper()
+
+	header, body, ok := strings.Cut(string(raw), "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no end of header in %q", raw)
+	}
+
+	var fields []arcHeader
+	for _, line := range strings.SplitAfter(header+"\r\n", "\r\n") {
+		switch {
+		case len(line) == 0:
+		case line[0] == ' ' || line[0] == '\t':
+			fields[len(fields)-1].raw += line
+		default:
+			name, _, _ := strings.Cut(line, ":")
+			fields = append(fields, arcHeader{name: name, raw: line})
+		}
+	}
+
+	return fields, body
+}
+
+// relaxed canonicalizes a header field as RFC 6376 section 3.4.2 does.
+func relaxed(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ") + "\r\n"
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// relaxedBody canonicalizes a body as RFC 6376 section 3.4.4 does.
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(wsp.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// arcTags parses the tag=value list of a header field.
+func arcTags(raw string) map[string]string {
+	_, value, _ := strings.Cut(raw, ":")
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		if name, v, ok := strings.Cut(tag, "="); ok {
+			tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(v), "")
+		}
+	}
+	return tags
+}
+
+// withoutSignature returns the canonical form of a signature field with its
+// b= value emptied and no trailing CRLF, as it is signed.
+func withoutSignature(raw string) string {
+	i := strings.LastIndex(raw, "b=")
+	return strings.TrimSuffix(relaxed(raw[:i+2]), "\r\n")
+}
+
+func verifyARCSignature(t *testing.T, public ed25519.PublicKey, field, data string) {
+	t.Helper()
+
+	sig, err := base64.StdEncoding.DecodeString(arcTags(field)["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(data))
+	if !ed25519.Verify(public, digest[:], sig) {
+		t.Errorf("signature of %q does not verify", field)
+	}
+}
+
+// verifyARCSet checks the signatures of the ARC set of instance, the newest
+// of the message.
+func verifyARCSet(t *testing.T, public ed25519.PublicKey, raw []byte, instance int, cv string, timestamp time.Time) {
+	t.Helper()
+
+	fields, body := arcMessage(t, raw)
+
+	sets := make(map[int]map[string]string)
+	for _, f := range fields {
+		name := strings.ToLower(f.name)
+		if !strings.HasPrefix(name, "arc-") {
+			continue
+		}
+		i, err := strconv.Atoi(arcTags(f.raw)["i"])
+		if err != nil {
+			t.Fatalf("%q: %v", f.raw, err)
+		}
+		if sets[i] == nil {
+			sets[i] = make(map[string]string)
+		}
+		sets[i][name] = f.raw
+	}
+	if len(sets) != instance {
+		t.Fatalf("%d ARC set(s), want %d", len(sets), instance)
+	}
+
+	// the new set is prepended to the message
+	set := sets[instance]
+	if fields[0].raw != set["arc-seal"] || fields[1].raw != set["arc-message-signature"] || fields[2].raw != set["arc-authentication-results"] {
+		t.Errorf("header starts with %q, %q, %q", fields[0].name, fields[1].name, fields[2].name)
+	}
+
+	ams, seal := set["arc-message-signature"], set["arc-seal"]
+	for _, field := range []string{ams, seal} {
+		if tags := arcTags(field); tags["t"] != strconv.FormatInt(timestamp.Unix(), 10) || tags["d"] != "toto.fr" || tags["s"] != "arc" {
+			t.Errorf("tags of %q", field)
+		}
+	}
+	if got := arcTags(seal)["cv"]; got != cv {
+		t.Errorf("cv = %s, want %s", got, cv)
+	}
+
+	// ARC-Message-Signature, like a DKIM-Signature
+	bh := sha256.Sum256([]byte(relaxedBody(body)))
+	if got := arcTags(ams)["bh"]; got != base64.StdEncoding.EncodeToString(bh[:]) {
+		t.Errorf("bh = %s", got)
+	}
+
+	var data strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(arcTags(ams)["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				data.WriteString(relaxed(fields[i].raw))
+				break
+			}
+		}
+	}
+	data.WriteString(withoutSignature(ams))
+	verifyARCSignature(t, public, ams, data.String())
+
+	// ARC-Seal, over all the sets oldest first
+	data.Reset()
+	for i := 1; i <= instance; i++ {
+		data.WriteString(relaxed(sets[i]["arc-authentication-results"]))
+		data.WriteString(relaxed(sets[i]["arc-message-signature"]))
+		if i < instance {
+			data.WriteString(relaxed(sets[i]["arc-seal"]))
+		}
+	}
+	data.WriteString(withoutSignature(seal))
+	verifyARCSignature(t, public, seal, data.String())
+}
+
+func TestARCSealerSignsVerifiableSets(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	raw := []byte("From: me@toto.fr\r\nTo: a@toto.fr\r\nSubject:  Hello\r\n\tworld\r\n\r\nHello  world\r\n")
+
+	sealer := &rmailer.ARCSealer{Domain: "toto.fr", Selector: "arc", Signer: private, AuthServID: "mx.toto.fr", Clock: clock}
+
+	first, err := sealer.Seal(raw, "spf=pass smtp.mailfrom=toto.fr", rmailer.ChainFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first instance ignores the given cv
+	verifyARCSet(t, public, first, 1, "none", clock.Now())
+
+	clock.Advance(time.Hour)
+
+	second, err := sealer.Seal(first, "arc=pass header.oldest-pass=1", rmailer.ChainPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyARCSet(t, public, second, 2, "pass", clock.Now())
+
+	if _, err := sealer.Seal(second, "arc=pass", rmailer.ChainNone); err == nil {
+		t.Error("chain extended with cv=none")
+	}
+}
+
+func TestARCSealerRejectsLineBreaks(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte("From: me@toto.fr\r\nSubject: Hello\r\n\r\nHello\r\n")
+
+	for _, c := range []struct{ authServID, results string }{
+		{"mx.toto.fr", "spf=pass\r\nBcc: victim@toto.fr"},
+		{"mx.toto.fr", "spf=pass\n"},
+		{"mx.toto.fr\r\nX-Injected: 1", "spf=pass"},
+	} {
+		sealer := &rmailer.ARCSealer{Domain: "toto.fr", Selector: "arc", Signer: private, AuthServID: c.authServID}
+		if out, err := sealer.Seal(raw, c.results, rmailer.ChainNone); err == nil {
+			t.Errorf("Seal with AuthServID %q and results %q = %q, want an error", c.authServID, c.results, out)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package rmailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type Attachment struct {
+	Name    string
+	Content []byte
+	// ContentID identifies embedded content, referenced from HTML as
+	// "cid:" + ContentID.
+	ContentID string
+	// Inline asks clients to display the attachment in the message body
+	// rather than offering it as a download.
+	Inline bool
+	// Encoding defaults to base64. With PreEncoded, Content is already in
+	// that encoding and is written verbatim, e.g. for signed content.
+	Encoding   TransferEncoding
+	PreEncoded bool
+	// Path, when Content is nil, names the file streamed into the message
+	// as it is rendered, so that it is never held in memory. 7bit and 8bit
+	// are then written as is, without checking the content.
+	Path string
+}
+
+// sniffLength is the content read by http.DetectContentType.
+const sniffLength = 512
+
+// streamed reports whether the content of a is read from Path.
+func (a *Attachment) streamed() bool {
+	return a.Content == nil && len(a.Path) > 0
+}
+
+// head returns the content of a, or its first bytes when it is streamed, for
+// content type detection.
+func (a *Attachment) head() []byte {
+	if !a.streamed() {
+		return a.Content
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	b := make([]byte, sniffLength)
+	n, _ := io.ReadFull(file, b)
+	return b[:n]
+}
+
+// size returns the length of the content of a, -1 when a streamed file
+// cannot be read.
+func (a *Attachment) size() int64 {
+	if !a.streamed() {
+		return int64(len(a.Content))
+	}
+
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return -1
+	}
+
+	return info.Size()
+}
+
+func (m *Message) AttachFile(path string) error {
+	fileName, b, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	return m.Attach(fileName, b)
+}
+
+// AttachFileStream attaches the file at path, which is read when the message
+// is rendered instead of now, so that large files are streamed into the
+// message without being loaded in memory. The file must stay in place until
+// the message is sent.
+func (m *Message) AttachFileStream(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("rmailer: %s is not a regular file", path)
+	}
+
+	a := Attachment{Name: filepath.Base(path), Path: path}
+	if err = m.checkAttachment(a.Name, a.head()); err != nil {
+		return err
+	}
+
+	m.Attachments = append(m.Attachments, a)
+	return nil
+}
+
+// Attach appends an attachment after checking it against the message
+// AttachmentPolicy, returning an *AttachmentError when it is refused.
+func (m *Message) Attach(name string, content []byte) error {
+	if err := m.checkAttachment(name, content); err != nil {
+		return err
+	}
+
+	m.AttachBytes(name, content)
+	return nil
+}
+
+// AttachFileInline attaches the file with an inline disposition.
+func (m *Message) AttachFileInline(path string) error {
+	fileName, b, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err = m.checkAttachment(fileName, b); err != nil {
+		return err
+	}
+
+	m.Attachments = append(m.Attachments, Attachment{Name: fileName, Content: b, Inline: true})
+	return nil
+}
+
+// AttachBytes appends an attachment without checking the AttachmentPolicy.
+// Attachments are rendered in insertion order and several may share the same
+// name.
+func (m *Message) AttachBytes(name string, content []byte) {
+	m.Attachments = append(m.Attachments, Attachment{Name: name, Content: content})
+}
+
+// SetAttachmentsFromMap replaces the attachments with the entries of the
+// map, ordered by name.
+func (m *Message) SetAttachmentsFromMap(attachments map[string][]byte) {
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.Attachments = make([]Attachment, len(names))
+
+	for i, name := range names {
+		m.Attachments[i] = Attachment{Name: name, Content: attachments[name]}
+	}
+}
+
+// EmbedFile attaches the file as embedded content and returns its Content-ID.
+func (m *Message) EmbedFile(path string) (string, error) {
+	fileName, b, err := readFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err = m.checkAttachment(fileName, b); err != nil {
+		return "", err
+	}
+
+	return m.EmbedBytes(fileName, b), nil
+}
+
+// EmbedBytes attaches content to be referenced from the HTML body and
+// returns its generated Content-ID.
+func (m *Message) EmbedBytes(name string, content []byte) string {
+	id := newContentID()
+	m.Attachments = append(m.Attachments, Attachment{Name: name, Content: content, ContentID: id, Inline: true})
+	return id
+}
+
+// CID returns the "cid:" URL of the first embedded attachment named name, for
+// use in src attributes of the HTML body, or an empty string if there is none.
+func (m *Message) CID(name string) string {
+	for _, a := range m.Attachments {
+		if a.Name == name && len(a.ContentID) > 0 {
+			return "cid:" + a.ContentID
+		}
+	}
+
+	return ""
+}
+
+func (m *Message) checkAttachment(name string, content []byte) error {
+	if m.AttachmentPolicy == nil {
+		return nil
+	}
+
+	return m.AttachmentPolicy.Check(name, content)
+}
+
+func newContentID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "@rmailer"
+}
+
+func readFile(path string) (string, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, fileName := filepath.Split(path)
+	return fileName, b, nil
+}
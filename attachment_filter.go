@@ -0,0 +1,82 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// AttachmentFilter inspects each attachment of a message being sent, e.g.
+// to scan it for malware or flatten PDF forms. Returning an error vetoes the
+// send, otherwise the returned reader replaces the content; returning
+// content itself keeps it unchanged.
+type AttachmentFilter interface {
+	FilterAttachment(name string, contentType string, content io.Reader) (io.Reader, error)
+}
+
+// AttachmentFilterFunc adapts a function to the AttachmentFilter interface.
+type AttachmentFilterFunc func(name string, contentType string, content io.Reader) (io.Reader, error)
+
+func (f AttachmentFilterFunc) FilterAttachment(name string, contentType string, content io.Reader) (io.Reader, error) {
+	return f(name, contentType, content)
+}
+
+// filterAttachments runs the filters over the attachments of m, which must
+// be a copy owned by the caller. Pre-encoded attachments are not filtered.
+func filterAttachments(m *Message, filters []AttachmentFilter) error {
+	if len(filters) == 0 || len(m.Attachments) == 0 {
+		return nil
+	}
+
+	attachments := make([]Attachment, len(m.Attachments))
+	copy(attachments, m.Attachments)
+
+	for i := range attachments {
+		a := &attachments[i]
+		if a.PreEncoded {
+			continue
+		}
+
+		for _, f := range filters {
+			if err := filterAttachment(m, a, f); err != nil {
+				return fmt.Errorf("rmailer: attachment %s: %w", a.Name, err)
+			}
+		}
+	}
+
+	m.Attachments = attachments
+	return nil
+}
+
+// filterAttachment runs f over a. A streamed attachment is read from its
+// file, and stays streamed when f returns the content unchanged.
+func filterAttachment(m *Message, a *Attachment, f AttachmentFilter) error {
+	var content io.Reader = bytes.NewReader(a.Content)
+
+	if a.streamed() {
+		file, err := os.Open(a.Path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		content = file
+	}
+
+	r, err := f.FilterAttachment(a.Name, m.contentType(a.Name, a.head()), content)
+	if err != nil {
+		return err
+	}
+
+	if a.streamed() && r == content {
+		return nil
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	a.Content, a.Path = b, ""
+	return nil
+}
@@ -0,0 +1,118 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDeniedExtensions are executable, script and macro-enabled document
+// extensions commonly blocked by receivers.
+var DefaultDeniedExtensions = []string{
+	".exe", ".com", ".scr", ".pif", ".bat", ".cmd", ".msi", ".dll", ".cpl",
+	".js", ".jse", ".vbs", ".vbe", ".wsf", ".wsh", ".hta", ".ps1", ".jar", ".lnk",
+	".docm", ".dotm", ".xlsm", ".xltm", ".xlam", ".pptm", ".potm", ".ppsm",
+}
+
+// DefaultDeniedTypes are the detected media types of executables.
+var DefaultDeniedTypes = []string{
+	"application/x-msdownload", "application/x-executable", "application/java-archive",
+}
+
+// AttachmentError reports an attachment refused by an AttachmentPolicy.
+type AttachmentError struct {
+	Name   string
+	Reason string
+}
+
+func (e *AttachmentError) Error() string {
+	return fmt.Sprintf("rmailer: attachment %s refused: %s", e.Name, e.Reason)
+}
+
+// AttachmentPolicy accepts attachments by extension and detected media type.
+// When the Allow lists are set, only the matching attachments are accepted.
+type AttachmentPolicy struct {
+	DeniedExtensions  []string
+	DeniedTypes       []string
+	AllowedExtensions []string
+	AllowedTypes      []string
+}
+
+// NewAttachmentPolicy returns a policy refusing DefaultDeniedExtensions and
+// DefaultDeniedTypes.
+func NewAttachmentPolicy() *AttachmentPolicy {
+	return &AttachmentPolicy{
+		DeniedExtensions: append([]string{}, DefaultDeniedExtensions...),
+		DeniedTypes:      append([]string{}, DefaultDeniedTypes...),
+	}
+}
+
+// Check returns an *AttachmentError if the attachment is refused.
+func (p *AttachmentPolicy) Check(name string, content []byte) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	contentType := detectedType(name, content)
+
+	if containsFold(p.DeniedExtensions, ext) {
+		return &AttachmentError{Name: name, Reason: "extension " + ext + " is denied"}
+	}
+
+	if containsFold(p.DeniedTypes, contentType) {
+		return &AttachmentError{Name: name, Reason: "type " + contentType + " is denied"}
+	}
+
+	if len(p.AllowedExtensions) > 0 && !containsFold(p.AllowedExtensions, ext) {
+		return &AttachmentError{Name: name, Reason: "extension " + ext + " is not allowed"}
+	}
+
+	if len(p.AllowedTypes) > 0 && !containsFold(p.AllowedTypes, contentType) {
+		return &AttachmentError{Name: name, Reason: "type " + contentType + " is not allowed"}
+	}
+
+	return nil
+}
+
+// FilterAttachment makes the policy usable as a Mailer AttachmentFilter, so
+// that it is also enforced on attachments added without being checked.
+func (p *AttachmentPolicy) FilterAttachment(name string, contentType string, content io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Check(name, b); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// detectedType returns the media type of content without its parameters,
+// recognizing the executable formats content sniffing does not know.
+func detectedType(name string, content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(content, []byte("\x7fELF")):
+		return "application/x-executable"
+	}
+
+	mediaType, _, err := mime.ParseMediaType(getContentType(name, content))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package rmailer
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one attempt at sending a message.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Host is the relay attempted.
+	Host string `json:"host"`
+	// Attempt counts the attempts of the message, from 1.
+	Attempt   int      `json:"attempt"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+	MessageID string   `json:"message_id,omitempty"`
+	// Recipients holds the status of each recipient after the attempt.
+	Recipients []RecipientStatus `json:"recipients,omitempty"`
+	// Response is the final response of the relay to the message.
+	Response string `json:"response,omitempty"`
+	QueueID  string `json:"queue_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AuditSink receives a record of every attempt made by a Sender, e.g. to
+// keep evidence of the mail sent.
+type AuditSink interface {
+	Audit(record AuditRecord) error
+}
+
+// AuditFunc adapts a function to an AuditSink.
+type AuditFunc func(record AuditRecord) error
+
+func (f AuditFunc) Audit(record AuditRecord) error {
+	return f(record)
+}
+
+// FileAudit is an AuditSink appending one JSON record per line to a file.
+type FileAudit struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAudit opens the file at path for appending, creating it when it does
+// not exist.
+func NewFileAudit(path string) (*FileAudit, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAudit{file: file}, nil
+}
+
+func (a *FileAudit) Audit(record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(append(b, '\n'))
+	return err
+}
+
+func (a *FileAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// audit records an attempt to the Audit sink, if any. Failures to record are
+// logged, the attempt being made already.
+func (s *Sender) audit(attempt int, from string, rcpts []string, messageID string, result *SendResult, err error) {
+	if s.Audit == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:      clockOf(s.Clock).Now(),
+		Host:      s.Host,
+		Attempt:   attempt,
+		From:      from,
+		To:        rcpts,
+		MessageID: messageID,
+	}
+
+	if result != nil {
+		record.Recipients = result.Recipients
+		record.Response, record.QueueID = result.Response, result.QueueID
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if auditErr := s.Audit.Audit(record); auditErr != nil {
+		logf("SMTP audit failed: %s", auditErr)
+	}
+}
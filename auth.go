@@ -0,0 +1,93 @@
+package rmailer
+
+import (
+	"errors"
+	"net/smtp"
+	"net/textproto"
+)
+
+// Credentials are the secrets used to authenticate a single connection. When
+// Token is set it is sent as an OAuth 2.0 bearer token with XOAUTH2 instead
+// of Password.
+type Credentials struct {
+	UserName string
+	Password string
+	Token    string
+}
+
+// CredentialsProvider is asked for credentials on every new connection, so
+// rotated passwords and short-lived tokens are picked up without recreating
+// the Sender.
+type CredentialsProvider interface {
+	Credentials() (*Credentials, error)
+}
+
+// CredentialsFunc adapts a function to a CredentialsProvider.
+type CredentialsFunc func() (*Credentials, error)
+
+func (f CredentialsFunc) Credentials() (*Credentials, error) {
+	return f()
+}
+
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+// XOAuth2Auth returns an smtp.Auth implementing the XOAUTH2 mechanism used
+// by Gmail and Microsoft 365.
+func XOAuth2Auth(username, token string) smtp.Auth {
+	return &xoauth2Auth{username: username, token: token}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sent an error challenge, answer empty to get the final status
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *Sender) auth(host string) (smtp.Auth, error) {
+	if s.Auth != nil {
+		return s.Auth, nil
+	}
+
+	if s.Credentials == nil {
+		return smtp.PlainAuth("", s.UserName, s.Password, host), nil
+	}
+
+	creds, err := s.Credentials.Credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.credentialsAuth(creds, host), nil
+}
+
+// credentialsAuth returns the mechanism authenticating with creds, XOAUTH2
+// for a token and PLAIN otherwise.
+func (s *Sender) credentialsAuth(creds *Credentials, host string) smtp.Auth {
+	username := creds.UserName
+	if len(username) == 0 {
+		username = s.UserName
+	}
+
+	if len(creds.Token) > 0 {
+		return XOAuth2Auth(username, creds.Token)
+	}
+
+	return smtp.PlainAuth("", username, creds.Password, host)
+}
+
+// isCredentialError reports whether err is the rejection of the credentials
+// (535, RFC 4954).
+func isCredentialError(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code == 535
+}
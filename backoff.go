@@ -0,0 +1,149 @@
+package rmailer
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// BackoffClass is the retry schedule of a class of temporary failures.
+type BackoffClass struct {
+	// Name identifies the class in the logs.
+	Name string
+	// Match reports whether a failure belongs to the class, code and msg
+	// being the reply of the relay, code 0 when it could not be reached.
+	// A nil Match matches everything.
+	Match func(code int, msg string, err error) bool
+	// Delay is the wait before the first retry.
+	Delay time.Duration
+	// Multiplier scales the delay after each retry, 1 when zero.
+	Multiplier float64
+	// MaxDelay caps the delay when positive.
+	MaxDelay time.Duration
+	// Jitter randomizes each delay by up to that fraction of it either way,
+	// e.g. 0.2 for ±20%, so that retries do not arrive in bursts.
+	Jitter float64
+}
+
+// Backoff chooses the delay of each retry after the class of the failure,
+// e.g. waiting out greylisting for longer than a refused connection.
+type Backoff struct {
+	// Attempts is the total number of attempts, the first one included, 1
+	// when zero.
+	Attempts int
+	// Classes are matched in order against each failure.
+	Classes []BackoffClass
+	// Default is the schedule of the failures no class matches.
+	Default BackoffClass
+}
+
+// MatchGreylisting matches the 451 replies of greylisting relays, and the
+// other 4xx replies mentioning it.
+func MatchGreylisting(code int, msg string, err error) bool {
+	return code == 451 || (code/100 == 4 && strings.Contains(strings.ToLower(msg), "greylist"))
+}
+
+// MatchConnectionRefused matches the relays refusing the connection.
+func MatchConnectionRefused(code int, msg string, err error) bool {
+	return isConnectionRefused(err)
+}
+
+// DefaultBackoff returns a Backoff of 8 attempts retrying greylisted
+// messages every 15 minutes, refused connections after a minute doubled on
+// each retry, and the other failures after 5 minutes doubled up to an hour.
+func DefaultBackoff() *Backoff {
+	return &Backoff{
+		Attempts: 8,
+		Classes: []BackoffClass{
+			{Name: "greylisting", Match: MatchGreylisting, Delay: 15 * time.Minute, Jitter: 0.1},
+			{Name: "connection refused", Match: MatchConnectionRefused, Delay: time.Minute, Multiplier: 2, MaxDelay: 30 * time.Minute, Jitter: 0.2},
+		},
+		Default: BackoffClass{Name: "default", Delay: 5 * time.Minute, Multiplier: 2, MaxDelay: time.Hour, Jitter: 0.1},
+	}
+}
+
+// warmUpClass, throttleClass and circuitClass are the classes of the
+// messages deferred by a WarmUp, a DomainThrottle and an open
+// CircuitBreaker, which wait until the Until of their error.
+var (
+	warmUpClass   = BackoffClass{Name: "warm-up"}
+	throttleClass = BackoffClass{Name: "throttle"}
+	circuitClass  = BackoffClass{Name: "circuit open"}
+)
+
+// deferralClass returns the class of a message deferred with err, see
+// deferredUntil.
+func deferralClass(err error) *BackoffClass {
+	var throttleErr *ThrottleError
+	if errors.As(err, &throttleErr) {
+		return &throttleClass
+	}
+
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		return &circuitClass
+	}
+
+	return &warmUpClass
+}
+
+func (b *Backoff) attempts() int {
+	return max(1, b.Attempts)
+}
+
+// Delay returns the wait before retrying after the attempt-th attempt ended
+// with result and err, and the class the failure belongs to. The failure is
+// that of the first recipient deferred, or err when the attempt got no
+// result. A *WarmUpError, a *ThrottleError or a *CircuitOpenError waits
+// until its Until, measured on the SystemClock: the Sender and the Mailer
+// queue measure it on their own Clock instead.
+func (b *Backoff) Delay(attempt int, result *SendResult, err error) (time.Duration, *BackoffClass) {
+	if until, ok := deferredUntil(err); ok {
+		return max(0, time.Until(until)), deferralClass(err)
+	}
+
+	code, msg := 0, ""
+	if err != nil {
+		code, msg = replyCode(err)
+	}
+
+	if result != nil {
+		for _, status := range result.Recipients {
+			if !status.Accepted() && status.Temporary() {
+				code, msg = status.Code, status.Message
+				break
+			}
+		}
+	}
+
+	class := &b.Default
+	for i := range b.Classes {
+		if match := b.Classes[i].Match; match == nil || match(code, msg, err) {
+			class = &b.Classes[i]
+			break
+		}
+	}
+
+	return class.delay(attempt), class
+}
+
+// delay returns the wait after the attempt-th attempt.
+func (c *BackoffClass) delay(attempt int) time.Duration {
+	multiplier := c.Multiplier
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+
+	d := float64(c.Delay) * math.Pow(multiplier, float64(max(0, attempt-1)))
+	if c.MaxDelay > 0 {
+		d = math.Min(d, float64(c.MaxDelay))
+	}
+
+	if c.Jitter > 0 {
+		d += d * c.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
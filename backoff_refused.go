@@ -0,0 +1,12 @@
+//go:build !plan9
+
+package rmailer
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
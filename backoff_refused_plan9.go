@@ -0,0 +1,8 @@
+package rmailer
+
+import "strings"
+
+// isConnectionRefused matches the error string, plan9 having no errno.
+func isConnectionRefused(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection refused")
+}
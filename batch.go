@@ -0,0 +1,64 @@
+package rmailer
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+)
+
+// BatchRecipient is a recipient of a Batch, with the data and the locale its
+// message is rendered with.
+type BatchRecipient struct {
+	To mail.Address
+	// Locale selects the template variant and the translations, e.g. "fr"
+	// or "de-CH", the default ones when empty.
+	Locale string
+	Data   any
+}
+
+// Batch describes the messages rendered from the template called Template
+// of Templates, one per recipient in the locale of the recipient, so that a
+// single code path sends the same notification in several languages.
+type Batch struct {
+	Templates  *TemplateStore
+	Template   string
+	Recipients []BatchRecipient
+	// Prepare, when set, completes each rendered message before it is
+	// queued, e.g. with its sender or metadata.
+	Prepare func(m *Message, rcpt BatchRecipient) error
+}
+
+// EnqueueBatch renders the message of each recipient of batch and queues it
+// with EnqueueWait, returning the number of messages queued. It stops at the
+// first recipient whose message cannot be rendered or queued.
+func (ml *Mailer) EnqueueBatch(ctx context.Context, batch Batch) (int, error) {
+	for i, rcpt := range batch.Recipients {
+		m, err := batch.render(rcpt)
+		if err != nil {
+			return i, fmt.Errorf("rmailer: batch recipient %s: %w", rcpt.To.Address, err)
+		}
+
+		if err := ml.EnqueueWait(ctx, m); err != nil {
+			return i, err
+		}
+	}
+
+	return len(batch.Recipients), nil
+}
+
+func (batch Batch) render(rcpt BatchRecipient) (*Message, error) {
+	m, err := batch.Templates.RenderLocale(batch.Template, rcpt.Locale, rcpt.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	m.To = []mail.Address{rcpt.To}
+
+	if batch.Prepare != nil {
+		if err := batch.Prepare(m, rcpt); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,87 @@
+package rmailer_test
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestEnqueueBatchRendersEachLocale(t *testing.T) {
+	srv := newTestServer(t)
+
+	store := rmailer.NewTemplateStore(fstest.MapFS{
+		"welcome/subject.tmpl":    {Data: []byte(`{{ t "welcome" .Name }}`)},
+		"welcome/text.tmpl":       {Data: []byte(`Hello {{ .Name }}`)},
+		"welcome/fr/subject.tmpl": {Data: []byte(`Bienvenue {{ .Name }}`)},
+		"welcome/fr/text.tmpl":    {Data: []byte(`Bonjour {{ .Name }}`)},
+	})
+	store.Catalog = rmailer.MapCatalog{
+		"":   {"welcome": "Welcome %s"},
+		"de": {"welcome": "Willkommen %s"},
+	}
+
+	ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+	done := newCompletions(ml)
+
+	recipient := func(name string, locale string) rmailer.BatchRecipient {
+		return rmailer.BatchRecipient{
+			To:     mail.Address{Address: strings.ToLower(name) + "@toto.fr"},
+			Locale: locale,
+			Data:   map[string]string{"Name": name},
+		}
+	}
+	batch := rmailer.Batch{
+		Templates: store,
+		Template:  "welcome",
+		// fr-CA falls back to the fr variant, de to the catalog
+		Recipients: []rmailer.BatchRecipient{recipient("En", ""), recipient("Fr", "fr-CA"), recipient("De", "de")},
+		Prepare: func(m *rmailer.Message, rcpt rmailer.BatchRecipient) error {
+			m.SetFromFromString("me@toto.fr")
+			return nil
+		},
+	}
+	want := map[string]string{
+		"en@toto.fr": "Subject: Welcome En",
+		"fr@toto.fr": "Subject: Bienvenue Fr",
+		"de@toto.fr": "Subject: Willkommen De",
+	}
+
+	if n, err := ml.EnqueueBatch(context.Background(), batch); err != nil || n != 3 {
+		t.Fatalf("EnqueueBatch = %d, %v, want 3", n, err)
+	}
+	for _, c := range done.wait(t, 3) {
+		if c.err != nil {
+			t.Fatal(c.err)
+		}
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("server got %d message(s), want 3", len(messages))
+	}
+	for _, env := range messages {
+		if subject := want[env.To[0]]; !strings.Contains(string(env.Data), subject+"\r\n") {
+			t.Errorf("message to %s lacks %q:\n%s", env.To[0], subject, env.Data)
+		}
+	}
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnqueueBatchStopsAtMissingTemplate(t *testing.T) {
+	ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", "localhost:1"))
+
+	n, err := ml.EnqueueBatch(context.Background(), rmailer.Batch{
+		Templates:  rmailer.NewTemplateStore(fstest.MapFS{}),
+		Template:   "welcome",
+		Recipients: []rmailer.BatchRecipient{{To: mail.Address{Address: "a@toto.fr"}}},
+	})
+	if err == nil || n != 0 {
+		t.Fatalf("EnqueueBatch = %d, %v, want an error", n, err)
+	}
+}
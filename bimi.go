@@ -0,0 +1,22 @@
+package rmailer
+
+import (
+	"fmt"
+)
+
+// SetBIMISelector adds the BIMI-Selector header pointing receivers at the
+// BIMI record published under selector. BIMI logos are only displayed for
+// messages passing DMARC, so the From domain must be aligned with
+// signingDomain, the d= domain of the DKIM signature the message will carry.
+func (m *Message) SetBIMISelector(selector string, signingDomain string) error {
+	domain := addressDomain(m.From.Address)
+	if len(domain) == 0 {
+		return fmt.Errorf("rmailer: BIMI requires a From address")
+	}
+
+	if !aligned(domain, signingDomain, false) {
+		return fmt.Errorf("rmailer: BIMI requires the From domain %s to be aligned with the signing domain %s", domain, signingDomain)
+	}
+
+	return m.SetHeader("BIMI-Selector", fmt.Sprintf("v=BIMI1; s=%s;", selector))
+}
@@ -0,0 +1,227 @@
+package rmailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bounce is the status of one recipient reported by a delivery status
+// notification (RFC 3464).
+type Bounce struct {
+	Recipient string
+	// Action is failed, delayed, delivered, relayed or expanded.
+	Action string
+	// Status is the enhanced status code, e.g. 5.1.1.
+	Status string
+	// Diagnostic is the remote server reply, when reported.
+	Diagnostic string
+}
+
+// Hard reports a permanent failure.
+func (b Bounce) Hard() bool {
+	return strings.EqualFold(b.Action, "failed") && strings.HasPrefix(b.Status, "5")
+}
+
+var errNotDSN = errors.New("rmailer: message is not a delivery status notification")
+
+// ParseDSN extracts the per-recipient statuses of the delivery status
+// notification read from r.
+func ParseDSN(r io.Reader) ([]Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := findDeliveryStatus(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, errNotDSN
+	}
+
+	return parseDeliveryStatus(status)
+}
+
+// findDeliveryStatus walks the MIME tree down to the message/delivery-status
+// part and returns its decoded content, nil when there is none.
+func findDeliveryStatus(header textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+
+	switch {
+	case mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status":
+		return io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			status, err := findDeliveryStatus(p.Header, p)
+			if status != nil || err != nil {
+				return status, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case string(EncodingBase64):
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case string(EncodingQuotedPrintable):
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// parseDeliveryStatus parses the per-message fields followed by the
+// per-recipient field groups.
+func parseDeliveryStatus(status []byte) ([]Bounce, error) {
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(normalizeCRLF(status))))
+
+	if _, err := tr.ReadMIMEHeader(); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("rmailer: malformed delivery status: %w", err)
+	}
+
+	var bounces []Bounce
+
+	for {
+		fields, err := tr.ReadMIMEHeader()
+		if len(fields) > 0 {
+			recipient := fields.Get("Final-Recipient")
+			if len(recipient) == 0 {
+				recipient = fields.Get("Original-Recipient")
+			}
+			if _, address, ok := strings.Cut(recipient, ";"); ok {
+				recipient = address
+			}
+
+			bounces = append(bounces, Bounce{
+				Recipient:  strings.Trim(strings.TrimSpace(recipient), "<>"),
+				Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				Status:     strings.TrimSpace(strings.SplitN(fields.Get("Status"), " ", 2)[0]),
+				Diagnostic: diagnostic(fields.Get("Diagnostic-Code")),
+			})
+		}
+
+		if err == io.EOF {
+			return bounces, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rmailer: malformed delivery status: %w", err)
+		}
+	}
+}
+
+// diagnostic strips the type of a Diagnostic-Code field, e.g. "smtp; 550 ...".
+func diagnostic(value string) string {
+	if _, text, ok := strings.Cut(value, ";"); ok {
+		return strings.TrimSpace(text)
+	}
+
+	return strings.TrimSpace(value)
+}
+
+// BounceProcessor records the hard bounces reported by delivery status
+// notifications in a SuppressionStore.
+type BounceProcessor struct {
+	Store SuppressionStore
+	// Events, when set, receives an EventBounced per recipient reported.
+	Events *EventBus
+}
+
+func NewBounceProcessor(store SuppressionStore) *BounceProcessor {
+	return &BounceProcessor{Store: store}
+}
+
+// Process parses the notification read from r and suppresses its hard
+// bounced recipients. All the parsed statuses are returned.
+func (p *BounceProcessor) Process(r io.Reader) ([]Bounce, error) {
+	bounces, err := ParseDSN(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range bounces {
+		p.Events.Publish(Event{Type: EventBounced, Recipient: b.Recipient, Bounce: &b})
+
+		if b.Hard() && len(b.Recipient) > 0 {
+			if err := p.Store.Suppress(b.Recipient, SuppressedBounce); err != nil {
+				return bounces, err
+			}
+		}
+	}
+
+	return bounces, nil
+}
+
+// ProcessMaildir processes the messages delivered to the new directory of
+// the Maildir at dir and moves them to cur, flagged as seen. Messages which
+// cannot be parsed as notifications are moved as well and skipped. A message
+// whose bounces could not be stored is left in new for the next run.
+func (p *BounceProcessor) ProcessMaildir(dir string) ([]Bounce, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Bounce
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, "new", entry.Name())
+
+		bounces, err := p.processFile(path)
+		if err != nil && bounces != nil {
+			return all, fmt.Errorf("rmailer: processing %s: %w", path, err)
+		}
+		if err != nil {
+			logf("Skipping %s: %s", path, err)
+		}
+		all = append(all, bounces...)
+
+		if err = os.Rename(path, filepath.Join(dir, "cur", entry.Name()+":2,S")); err != nil {
+			return all, err
+		}
+	}
+
+	return all, nil
+}
+
+func (p *BounceProcessor) processFile(path string) ([]Bounce, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return p.Process(file)
+}
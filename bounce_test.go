@@ -0,0 +1,255 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// postfixDSN is a notification as sent by Postfix, its status part quoted-
+// printable encoded.
+const postfixDSN = "From: MAILER-DAEMON@relay.fr\r\n" +
+	"To: me@toto.fr\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"B\"\r\n" +
+	"\r\n" +
+	"--B\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--B\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; relay.fr\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; Gone@toto.fr\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <gone@toto.fr>: Recipient address rejec=\r\n" +
+	"ted\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; <busy@toto.fr>\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2 (mailbox full)\r\n" +
+	"\r\n" +
+	"Original-Recipient: rfc822; alias@toto.fr\r\n" +
+	"Action: failed\r\n" +
+	"Status: 4.4.7\r\n" +
+	"--B--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	bounces, err := rmailer.ParseDSN(strings.NewReader(postfixDSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []rmailer.Bounce{
+		{Recipient: "Gone@toto.fr", Action: "failed", Status: "5.1.1", Diagnostic: "550 5.1.1 <gone@toto.fr>: Recipient address rejected"},
+		{Recipient: "busy@toto.fr", Action: "delayed", Status: "4.2.2"},
+		{Recipient: "alias@toto.fr", Action: "failed", Status: "4.4.7"},
+	}
+	if !reflect.DeepEqual(bounces, want) {
+		t.Errorf("ParseDSN = %+v\nwant %+v", bounces, want)
+	}
+	for i, hard := range []bool{true, false, false} {
+		if bounces[i].Hard() != hard {
+			t.Errorf("%s: Hard = %t", bounces[i].Recipient, !hard)
+		}
+	}
+
+	if _, err := rmailer.ParseDSN(bytes.NewReader(newTestMessage("a@toto.fr").ToBytes())); err == nil {
+		t.Error("plain message parsed as a notification")
+	}
+}
+
+func TestNewDSNParsesBack(t *testing.T) {
+	original := newTestMessage("gone@toto.fr").ToBytes()
+	report := rmailer.DeliveryReport{
+		ReportingMTA: "mx.toto.fr",
+		Recipients: []rmailer.Bounce{
+			{Recipient: "gone@toto.fr", Action: "failed", Status: "5.1.1", Diagnostic: "550 5.1.1 no such user"},
+			{Recipient: "busy@toto.fr", Action: "delayed"},
+		},
+		Original: original,
+	}
+
+	m, err := rmailer.NewDSN(mail.Address{Name: "Mail Delivery System", Address: "mailer-daemon@toto.fr"}, "me@toto.fr", report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.EnvelopeFrom != rmailer.NullReversePath || m.GetHeader("Auto-Submitted") != "auto-replied" || !strings.Contains(m.Subject, "Failure") {
+		t.Errorf("EnvelopeFrom = %q, Auto-Submitted = %q, Subject = %q", m.EnvelopeFrom, m.GetHeader("Auto-Submitted"), m.Subject)
+	}
+
+	raw := m.ToBytes()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the original header only is returned
+	if got := mimeStructure(t, msg.Header, msg.Body); got != "report(text/plain,message/delivery-status,text/rfc822-headers)" {
+		t.Errorf("structure = %s", got)
+	}
+	if bytes.Contains(raw, []byte("Hello world")) {
+		t.Error("the original content is returned")
+	}
+
+	bounces, err := rmailer.ParseDSN(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rmailer.Bounce{
+		{Recipient: "gone@toto.fr", Action: "failed", Status: "5.1.1", Diagnostic: "550 5.1.1 no such user"},
+		{Recipient: "busy@toto.fr", Action: "delayed", Status: "4.0.0"},
+	}
+	if !reflect.DeepEqual(bounces, want) {
+		t.Errorf("ParseDSN = %+v\nwant %+v", bounces, want)
+	}
+
+	if _, err := rmailer.NewDSN(mail.Address{Address: "mailer-daemon@toto.fr"}, "me@toto.fr", rmailer.DeliveryReport{}); err == nil {
+		t.Error("notification without recipients created")
+	}
+}
+
+func TestBounceProcessorSuppressesHardBounces(t *testing.T) {
+	store := rmailer.NewMemorySuppressions()
+	p := rmailer.NewBounceProcessor(store)
+	p.Events = rmailer.NewEventBus()
+	events, cancel := p.Events.Subscribe(8)
+	defer cancel()
+
+	bounces, err := p.Process(strings.NewReader(postfixDSN))
+	if err != nil || len(bounces) != 3 {
+		t.Fatalf("Process = %+v, %v", bounces, err)
+	}
+
+	for address, want := range map[string]rmailer.SuppressionReason{
+		"gone@toto.fr": rmailer.SuppressedBounce, "busy@toto.fr": "", "alias@toto.fr": "",
+	} {
+		if reason, _ := store.Suppressed(address); reason != want {
+			t.Errorf("%s suppressed for %q, want %q", address, reason, want)
+		}
+	}
+
+	for _, b := range bounces {
+		e := <-events
+		if e.Type != rmailer.EventBounced || e.Recipient != b.Recipient || e.Bounce == nil || *e.Bounce != b {
+			t.Errorf("event = %+v, want the bounce of %s", e, b.Recipient)
+		}
+	}
+}
+
+func TestBounceProcessorProcessesMaildir(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string][]byte{
+		"1.dsn":  []byte(postfixDSN),
+		"2.junk": newTestMessage("a@toto.fr").ToBytes(),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "new", name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := rmailer.NewMemorySuppressions()
+	bounces, err := rmailer.NewBounceProcessor(store).ProcessMaildir(dir)
+	if err != nil || len(bounces) != 3 {
+		t.Fatalf("ProcessMaildir = %+v, %v", bounces, err)
+	}
+	if reason, _ := store.Suppressed("gone@toto.fr"); reason != rmailer.SuppressedBounce {
+		t.Errorf("gone@toto.fr suppressed for %q", reason)
+	}
+
+	for sub, want := range map[string][]string{"new": nil, "cur": {"1.dsn:2,S", "2.junk:2,S"}} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s holds %v, want %v", sub, names, want)
+		}
+	}
+}
+
+func TestFileSuppressionsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressions")
+
+	s, err := rmailer.NewFileSuppressions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, reason := range map[string]rmailer.SuppressionReason{
+		"Gone@toto.fr ": rmailer.SuppressedBounce,
+		"spam@toto.fr":  rmailer.SuppressedComplaint,
+		"back@toto.fr":  rmailer.SuppressedUnsubscribe,
+	} {
+		if err := s.Suppress(address, reason); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Unsuppress("BACK@toto.fr"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := rmailer.NewFileSuppressions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, want := range map[string]rmailer.SuppressionReason{
+		"gone@toto.fr": rmailer.SuppressedBounce, "spam@toto.fr": rmailer.SuppressedComplaint, "back@toto.fr": "",
+	} {
+		if reason, _ := reopened.Suppressed(address); reason != want {
+			t.Errorf("%s suppressed for %q after reopening, want %q", address, reason, want)
+		}
+	}
+}
+
+func TestSenderSkipsSuppressedRecipients(t *testing.T) {
+	srv := newTestServer(t)
+	store := rmailer.NewMemorySuppressions()
+	store.Suppress("gone@toto.fr", rmailer.SuppressedBounce)
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Suppressions = store
+
+	result, err := sender.SendWithResult(newTestMessage("a@toto.fr", "Gone@toto.fr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || !reflect.DeepEqual(msgs[0].To, []string{"a@toto.fr"}) {
+		t.Errorf("sent %+v, want to a@toto.fr only", msgs)
+	}
+
+	statuses := make(map[string]rmailer.RecipientStatus)
+	for _, status := range result.Recipients {
+		statuses[status.Address] = status
+	}
+	if status := statuses["Gone@toto.fr"]; status.Suppressed != rmailer.SuppressedBounce || status.Temporary() {
+		t.Errorf("status of the suppressed recipient = %+v", status)
+	}
+
+	srv.Reset()
+	if _, err := sender.SendWithResult(newTestMessage("gone@toto.fr")); err == nil {
+		t.Error("message sent with every recipient suppressed")
+	}
+	if n := len(srv.Messages()); n != 0 {
+		t.Errorf("%d message(s) sent to suppressed recipients", n)
+	}
+}
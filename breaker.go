@@ -0,0 +1,118 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen matches the *CircuitOpenError returned without connecting
+// while the circuit breaker of the relay is open.
+var ErrCircuitOpen = errors.New("rmailer: circuit breaker open")
+
+// CircuitOpenError is returned without connecting while the circuit of Host
+// is open. The send should be attempted again at Until, once the cooldown is
+// over; the Mailer queue defers it until then.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("rmailer: circuit breaker of %s open until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// CircuitBreaker tracks consecutive connection failures per relay host. After
+// Threshold failures the host is considered down and sends fail fast with
+// a *CircuitOpenError; once Cooldown has elapsed a single probe connection is let
+// through, closing the circuit on success. A CircuitBreaker may be shared by
+// several Senders.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	// Clock times the cooldown, SystemClock when nil.
+	Clock Clock
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		hosts:     make(map[string]*circuit),
+	}
+}
+
+// Open reports whether the circuit of host is currently open.
+func (b *CircuitBreaker) Open(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.hosts[host]
+	return c != nil && c.failures >= b.Threshold
+}
+
+// allow reports whether a connection to host may be attempted, marking it as
+// the probe when the circuit is half-open.
+func (b *CircuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.hosts[host]
+	if c == nil || c.failures < b.Threshold {
+		return nil
+	}
+
+	now := clockOf(b.Clock).Now()
+	if until := c.openedAt.Add(b.Cooldown); now.Before(until) {
+		return &CircuitOpenError{Host: host, Until: until}
+	}
+	if c.probing {
+		// the probe reopens the circuit for a cooldown if it fails
+		return &CircuitOpenError{Host: host, Until: now.Add(b.Cooldown)}
+	}
+
+	c.probing = true
+	return nil
+}
+
+// record updates the circuit of host with the outcome of a connection.
+func (b *CircuitBreaker) record(host string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hosts == nil {
+		b.hosts = make(map[string]*circuit)
+	}
+
+	c := b.hosts[host]
+	if c == nil {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+
+	c.probing = false
+
+	if err == nil {
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= b.Threshold {
+		c.openedAt = clockOf(b.Clock).Now()
+	}
+}
@@ -0,0 +1,138 @@
+package rmailer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// refusedAddr returns a local address nothing listens on.
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	return addr
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", refusedAddr(t))
+	sender.Breaker = rmailer.NewCircuitBreaker(2, time.Minute)
+	sender.Breaker.Clock = clock
+
+	for range 2 {
+		if err := sender.Send(newTestMessage("a@toto.fr")); err == nil || errors.Is(err, rmailer.ErrCircuitOpen) {
+			t.Fatalf("Send = %v, want a connection error", err)
+		}
+	}
+
+	var circuitErr *rmailer.CircuitOpenError
+	err := sender.Send(newTestMessage("a@toto.fr"))
+	if !errors.As(err, &circuitErr) || !errors.Is(err, rmailer.ErrCircuitOpen) {
+		t.Fatalf("Send = %v, want a *CircuitOpenError", err)
+	}
+	if want := clock.Now().Add(time.Minute); !circuitErr.Until.Equal(want) {
+		t.Errorf("Until = %s, want %s", circuitErr.Until, want)
+	}
+
+	// the probe let through after the cooldown fails and reopens the circuit
+	clock.Advance(time.Minute)
+	if err := sender.Send(newTestMessage("a@toto.fr")); errors.Is(err, rmailer.ErrCircuitOpen) {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if !sender.Breaker.Open(sender.Host) {
+		t.Error("circuit closed by a failed probe")
+	}
+}
+
+func TestQueueDefersWhileCircuitOpen(t *testing.T) {
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", refusedAddr(t))
+	sender.Clock = clock
+	sender.Breaker = rmailer.NewCircuitBreaker(1, time.Hour)
+	sender.Breaker.Clock = clock
+
+	// the smarthost is down
+	if err := sender.Send(newTestMessage("a@toto.fr")); err == nil {
+		t.Fatal("Send to a closed port succeeded")
+	}
+
+	// the cooldown is waited out by the queue, not by the Sender retries
+	sender.Retry = &rmailer.RetryPolicy{Attempts: 3, Delay: time.Second}
+
+	ml := rmailer.NewMailer(sender)
+	ml.Retry = fastRetry(1)
+	var err error
+	if ml.DeadLetters, err = rmailer.NewDirDeadLetters(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	done := newCompletions(ml)
+
+	if err := ml.Enqueue(newTestMessage("b@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return ml.QueueStats().Deferred == 1 })
+
+	if letters, err := ml.DeadLetters.List(); err != nil || len(letters) != 0 {
+		t.Fatalf("%d dead letter(s), %v, want the message requeued", len(letters), err)
+	}
+	if n := done.count(); n != 0 {
+		t.Fatalf("%d completion(s) while the circuit is open", n)
+	}
+
+	var shutdownErr *rmailer.ShutdownError
+	if err := ml.Shutdown(context.Background()); !errors.As(err, &shutdownErr) || len(shutdownErr.Pending) != 1 {
+		t.Fatalf("Shutdown = %v, want the deferred message withdrawn", err)
+	}
+}
+
+func TestSenderRetryWaitsOutCooldownOnItsClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", refusedAddr(t))
+	sender.Clock = clock
+	sender.Breaker = rmailer.NewCircuitBreaker(1, time.Hour)
+	sender.Breaker.Clock = clock
+	sender.Send(newTestMessage("a@toto.fr"))
+
+	sender.Retry = &rmailer.RetryPolicy{Attempts: 2, Backoff: rmailer.DefaultBackoff()}
+	sent := make(chan error, 1)
+	go func() { sent <- sender.Send(newTestMessage("a@toto.fr")) }()
+
+	var at time.Time
+	waitFor(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+
+		if len(clock.timers) != 1 {
+			return false
+		}
+		at = clock.timers[0].at
+		return true
+	})
+	if want := clock.Now().Add(time.Hour); !at.Equal(want) {
+		t.Fatalf("retry timer at %s, want the end of the cooldown %s", at, want)
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case err := <-sent:
+		if err == nil || errors.Is(err, rmailer.ErrCircuitOpen) {
+			t.Fatalf("Send = %v, want the probe to fail connecting", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send still waiting after the cooldown")
+	}
+}
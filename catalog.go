@@ -0,0 +1,26 @@
+package rmailer
+
+import (
+	"fmt"
+)
+
+// Catalog translates message keys for a locale, args being substituted in
+// the translation.
+type Catalog interface {
+	Translate(locale string, key string, args ...any) string
+}
+
+// MapCatalog is a Catalog of fmt formats indexed by locale then key. Missing
+// translations fall back to the base language, then to the "" locale, then
+// to the key itself.
+type MapCatalog map[string]map[string]string
+
+func (c MapCatalog) Translate(locale string, key string, args ...any) string {
+	for _, l := range localeFallbacks(locale) {
+		if format, ok := c[l][key]; ok {
+			return fmt.Sprintf(format, args...)
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,136 @@
+package rmailer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// lookupCharset returns the encoding registered under the MIME charset name
+// together with its canonical name.
+func lookupCharset(name string) (encoding.Encoding, string, error) {
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if enc == nil {
+		return nil, "", fmt.Errorf("rmailer: charset %s is not supported", name)
+	}
+
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return enc, canonical, nil
+}
+
+// transcoded returns a copy of m with the subject and bodies transcoded from
+// UTF-8 to m.TargetCharset. Characters the charset cannot represent become
+// numeric character references in HTML and question marks in text.
+func (m *Message) transcoded() (*Message, error) {
+	enc, charset, err := lookupCharset(m.TargetCharset)
+	if err != nil {
+		return nil, err
+	}
+
+	t := *m
+	t.TextCharset = charset
+	t.HtmlCharset = charset
+	t.subjectCharset = charset
+
+	if t.Subject, err = enc.NewEncoder().String(replaceUnsupported(enc, m.Subject)); err != nil {
+		return nil, err
+	}
+
+	if t.BodyText, err = enc.NewEncoder().String(replaceUnsupported(enc, m.BodyText)); err != nil {
+		return nil, err
+	}
+
+	if t.BodyHtml, err = encoding.HTMLEscapeUnsupported(enc.NewEncoder()).String(m.BodyHtml); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// replaceUnsupported replaces the runes of s which enc cannot represent by
+// "?", so that s can be encoded in one pass by stateful encoders.
+func replaceUnsupported(enc encoding.Encoding, s string) string {
+	e := enc.NewEncoder()
+	supported := make(map[rune]bool)
+
+	return strings.Map(func(r rune) rune {
+		ok, known := supported[r]
+		if !known {
+			_, err := e.String(string(r))
+			ok = err == nil
+			supported[r] = ok
+		}
+
+		if !ok {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// maxEncodedWord is the length limit of an encoded-word (RFC 2047 section 2).
+const maxEncodedWord = 75
+
+// encodeWords returns s, encoded in charset, as B encoded-words of at most
+// 75 chars when it needs encoding. mime.BEncoding splits the UTF-8 text
+// only, so words in other charsets are split here, between characters and
+// each one complete for the stateful charsets like ISO-2022-JP.
+func encodeWords(charset string, s string) string {
+	encoded := mime.BEncoding.Encode(charset, s)
+	if encoded == s || strings.EqualFold(charset, "UTF-8") {
+		return encoded
+	}
+
+	enc, _, err := lookupCharset(charset)
+	if err != nil {
+		return encoded
+	}
+
+	text, err := enc.NewDecoder().String(s)
+	if err != nil {
+		return encoded
+	}
+
+	word := func(raw string) string {
+		return "=?" + charset + "?B?" + base64.StdEncoding.EncodeToString([]byte(raw)) + "?="
+	}
+	maxRaw := (maxEncodedWord - len(word(""))) / 4 * 3
+
+	var words []string
+	var chars, raw string
+
+	for _, r := range text {
+		next, err := enc.NewEncoder().String(chars + string(r))
+		if err != nil {
+			return encoded
+		}
+
+		if len(next) > maxRaw && len(chars) > 0 {
+			words = append(words, word(raw))
+			if next, err = enc.NewEncoder().String(string(r)); err != nil {
+				return encoded
+			}
+			chars = ""
+		}
+
+		chars += string(r)
+		raw = next
+	}
+
+	if len(chars) > 0 {
+		words = append(words, word(raw))
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,40 @@
+package rmailer
+
+import "time"
+
+// Clock tells the time to the Date header, retries and schedules, so that
+// tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the Clock used when none is configured.
+var SystemClock Clock = systemClock{}
+
+func clockOf(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+
+	return c
+}
+
+// senderClock returns the Clock of s, SystemClock when s is nil.
+func senderClock(s *Sender) Clock {
+	if s == nil {
+		return SystemClock
+	}
+
+	return clockOf(s.Clock)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+const doctorUsage = `usage: rmailer doctor [flags]
+
+Checks the SPF, DKIM and DMARC records of the From domain, the connection,
+encryption and authentication to the relay, and the reverse DNS of the
+sending IP, and prints a report. The exit status is 1 when a check fails.
+
+The relay password is read from RMAILER_PASSWORD.
+
+Flags:
+`
+
+func doctorCommand(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	from := fs.String("from", "", "From address or domain to check")
+	host := fs.String("host", "", "relay host:port to check")
+	user := fs.String("user", "", "relay user name")
+	selectors := fs.String("dkim-selectors", "", "comma-separated DKIM selectors to check")
+	ip := fs.String("ip", "", "public IP of the outgoing mail, when the relay connection is NATed")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed for the checks")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), doctorUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(*from) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	domain := *from
+	if at := strings.LastIndex(domain, "@"); at >= 0 {
+		domain = domain[at+1:]
+	}
+
+	d := &rmailer.Doctor{Domain: domain}
+
+	if len(*selectors) > 0 {
+		d.DKIMSelectors = strings.Split(*selectors, ",")
+	}
+
+	if len(*ip) > 0 {
+		if d.SourceIP = net.ParseIP(*ip); d.SourceIP == nil {
+			return fmt.Errorf("doctor: invalid IP %q", *ip)
+		}
+	}
+
+	if len(*host) > 0 {
+		d.Sender = rmailer.NewSender(*user, os.Getenv("RMAILER_PASSWORD"), *host)
+		d.Sender.Timeouts = &rmailer.Timeouts{Greeting: *timeout, Hello: *timeout, Auth: *timeout}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	diag := d.Run(ctx)
+	if _, err := diag.WriteTo(os.Stdout); err != nil {
+		return err
+	}
+
+	if !diag.OK() {
+		return errors.New("doctor: some checks failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+// Command rmailer administers the mail spooled by rmailer Mailers and
+// diagnoses their deliverability.
+//
+// Usage:
+//
+//	rmailer queue [flags] list
+//	rmailer queue [flags] flush
+//	rmailer queue [flags] retry <id>
+//	rmailer queue [flags] rm <id>
+//	rmailer doctor [flags]
+//
+// Run "rmailer <command> -h" for the flags.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "queue":
+		err = queueCommand(os.Args[2:])
+	case "doctor":
+		err = doctorCommand(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "rmailer: unknown command %q\n", os.Args[1])
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rmailer:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  rmailer queue [flags] list|flush|retry <id>|rm <id>
+  rmailer doctor [flags]`)
+	os.Exit(2)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+const queueUsage = `usage: rmailer queue [flags] <command>
+
+Commands:
+  list        list the queued messages and the dead letters
+  flush       send every queued message and dead letter now
+  retry <id>  send the message or dead letter id now
+  rm <id>     delete the message or dead letter id
+
+Messages are sent through a plain Sender: the identities, signatures and
+other completions of the Mailer which queued them are not applied. A message
+refused by some of its recipients stays in the spool for them. Stop the
+service owning the journal first, which would otherwise send the messages
+again on its next start.
+
+The relay password is read from RMAILER_PASSWORD, and the journal key, if
+the journal is encrypted, from RMAILER_JOURNAL_KEY in hex.
+
+Flags:
+`
+
+// spool is the persistent state of a Mailer: its Journal of queued messages
+// and its dead letters.
+type spool struct {
+	journal *rmailer.Journal
+	dead    *rmailer.DirDeadLetters
+}
+
+// spoolEntry is a message of the spool.
+type spoolEntry struct {
+	id      string
+	dead    bool
+	queued  time.Time
+	message *rmailer.Message
+	err     string
+}
+
+func queueCommand(args []string) error {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	journalPath := fs.String("journal", "", "path of the Mailer journal")
+	deadDir := fs.String("dead", "", "directory of the dead letters")
+	host := fs.String("host", "", "relay host:port to send through, for flush and retry")
+	user := fs.String("user", "", "relay user name")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), queueUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(*journalPath) == 0 && len(*deadDir) == 0 {
+		return errors.New("queue: -journal or -dead is required")
+	}
+
+	s, err := openSpool(*journalPath, *deadDir)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	sender := func() (*rmailer.Sender, error) {
+		if len(*host) == 0 {
+			return nil, errors.New("queue: -host is required to send")
+		}
+		return rmailer.NewSender(*user, os.Getenv("RMAILER_PASSWORD"), *host), nil
+	}
+
+	cmd := fs.Arg(0)
+	switch {
+	case cmd == "list" && fs.NArg() == 1:
+		return s.list()
+	case cmd == "flush" && fs.NArg() == 1:
+		sender, err := sender()
+		if err != nil {
+			return err
+		}
+		return s.flush(sender)
+	case cmd == "retry" && fs.NArg() == 2:
+		sender, err := sender()
+		if err != nil {
+			return err
+		}
+		return s.retry(sender, fs.Arg(1))
+	case cmd == "rm" && fs.NArg() == 2:
+		return s.remove(fs.Arg(1))
+	}
+
+	fs.Usage()
+	os.Exit(2)
+	return nil
+}
+
+func openSpool(journalPath, deadDir string) (*spool, error) {
+	s := &spool{}
+
+	if len(journalPath) > 0 {
+		var opts []rmailer.JournalOption
+		if key := os.Getenv("RMAILER_JOURNAL_KEY"); len(key) > 0 {
+			b, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("queue: invalid RMAILER_JOURNAL_KEY: %w", err)
+			}
+			opts = append(opts, rmailer.WithJournalKey(b))
+		}
+
+		var err error
+		if s.journal, err = rmailer.NewJournal(journalPath, opts...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(deadDir) > 0 {
+		s.dead = &rmailer.DirDeadLetters{Dir: deadDir}
+	}
+
+	return s, nil
+}
+
+func (s *spool) close() {
+	if s.journal != nil {
+		s.journal.Close()
+	}
+}
+
+// entries returns the queued messages, oldest first, then the dead letters.
+func (s *spool) entries() ([]spoolEntry, error) {
+	var entries []spoolEntry
+
+	if s.journal != nil {
+		for _, entry := range s.journal.Pending() {
+			entries = append(entries, spoolEntry{id: entry.ID, queued: entry.Queued, message: entry.Message})
+		}
+	}
+
+	if s.dead != nil {
+		letters, err := s.dead.List()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		for _, letter := range letters {
+			entries = append(entries, spoolEntry{id: letter.ID, dead: true, queued: letter.Queued, message: letter.Message, err: letter.Error})
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *spool) find(id string) (spoolEntry, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return spoolEntry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.id == id {
+			return entry, nil
+		}
+	}
+
+	return spoolEntry{}, fmt.Errorf("queue: no message %s", id)
+}
+
+func (s *spool) list() error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tQUEUED\tFROM\tTO\tSUBJECT\tERROR")
+
+	for _, entry := range entries {
+		state := "queued"
+		if entry.dead {
+			state = "dead"
+		}
+
+		m := entry.message
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.id, state, entry.queued.Format(time.RFC3339),
+			m.From.Address, strings.Join(recipients(m), ","), m.Subject, entry.err)
+	}
+
+	return w.Flush()
+}
+
+func (s *spool) flush(sender *rmailer.Sender) error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if err := s.send(sender, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", entry.id, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("queue: %d of %d message(s) failed", failed, len(entries))
+	}
+
+	return nil
+}
+
+func (s *spool) retry(sender *rmailer.Sender, id string) error {
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	return s.send(sender, entry)
+}
+
+// send sends entry and removes it from the spool once every recipient
+// accepted it. When only some did, the entry is kept for the others.
+func (s *spool) send(sender *rmailer.Sender, entry spoolEntry) error {
+	if len(entry.message.Identity) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: identity %q is not applied\n", entry.id, entry.message.Identity)
+	}
+
+	result, err := sender.SendWithResult(entry.message)
+
+	var failed []rmailer.RecipientStatus
+	if result != nil {
+		for _, status := range result.Recipients {
+			fmt.Printf("%s: %s %d %s\n", entry.id, status.Address, status.Code, status.Message)
+			if !status.Accepted() && len(status.Suppressed) == 0 {
+				failed = append(failed, status)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		if err := s.narrow(entry, failed); err != nil {
+			return err
+		}
+		return fmt.Errorf("queue: %d recipient(s) refused the message", len(failed))
+	}
+
+	return s.delete(entry)
+}
+
+// narrow keeps entry in the spool for its failed recipients only. A queued
+// message is journaled again under a new ID.
+func (s *spool) narrow(entry spoolEntry, failed []rmailer.RecipientStatus) error {
+	m := *entry.message
+	m.EnvelopeTo = nil
+	for _, status := range failed {
+		m.EnvelopeTo = append(m.EnvelopeTo, status.Address)
+	}
+
+	if entry.dead {
+		letter, err := s.dead.Get(entry.id)
+		if err != nil {
+			return err
+		}
+		letter.Message = &m
+		letter.Failed = time.Now()
+		letter.Recipients = failed
+		letter.Error = ""
+		return s.dead.Put(letter)
+	}
+
+	id, err := s.journal.Append(&m)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: kept as %s for %s\n", entry.id, id, strings.Join(m.EnvelopeTo, ","))
+
+	return s.journal.Ack(entry.id)
+}
+
+func (s *spool) remove(id string) error {
+	entry, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	return s.delete(entry)
+}
+
+func (s *spool) delete(entry spoolEntry) error {
+	if entry.dead {
+		return s.dead.Delete(entry.id)
+	}
+
+	return s.journal.Ack(entry.id)
+}
+
+func recipients(m *rmailer.Message) []string {
+	if len(m.EnvelopeTo) > 0 {
+		return m.EnvelopeTo
+	}
+
+	var rcpts []string
+	for _, list := range [][]mail.Address{m.To, m.CC, m.BCC} {
+		for _, r := range list {
+			rcpts = append(rcpts, r.Address)
+		}
+	}
+
+	return rcpts
+}
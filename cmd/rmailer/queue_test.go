@@ -0,0 +1,157 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+	"github.com/RaoH37/rmailer/rmailertest"
+)
+
+func newTestServer(t *testing.T) *rmailertest.Server {
+	t.Helper()
+
+	srv, err := rmailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+func newTestMessage(rcpts ...string) *rmailer.Message {
+	m := rmailer.NewMessage("Hello", "Hello world", "")
+	m.SetFromFromString("me@toto.fr")
+	m.SetToFromStrings(rcpts)
+	return m
+}
+
+// newTestSpool returns the paths of a journal holding a message to queued
+// and of a dead letter directory holding one to dead, whose ID is returned.
+func newTestSpool(t *testing.T, queued, dead []string) (string, string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	journalPath, deadDir := filepath.Join(dir, "journal"), filepath.Join(dir, "dead")
+
+	j, err := rmailer.NewJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Append(newTestMessage(queued...)); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	letters, err := rmailer.NewDirDeadLetters(deadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter := &rmailer.DeadLetter{ID: "letter", Message: newTestMessage(dead...), Queued: time.Now(), Failed: time.Now(), Error: "timeout"}
+	if err := letters.Put(letter); err != nil {
+		t.Fatal(err)
+	}
+
+	return journalPath, deadDir, letter.ID
+}
+
+func spoolEntries(t *testing.T, journalPath, deadDir string) []spoolEntry {
+	t.Helper()
+
+	s, err := openSpool(journalPath, deadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	entries, err := s.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestQueueFlushRemovesDeliveredMessages(t *testing.T) {
+	srv := newTestServer(t)
+	journalPath, deadDir, _ := newTestSpool(t, []string{"a@toto.fr"}, []string{"b@toto.fr"})
+
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "-host", srv.Addr, "-user", "me@toto.fr", "flush"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(srv.Messages()); n != 2 {
+		t.Errorf("%d message(s) sent, want 2", n)
+	}
+	if entries := spoolEntries(t, journalPath, deadDir); len(entries) != 0 {
+		t.Errorf("spool holds %+v after a flush", entries)
+	}
+}
+
+func TestQueueFlushKeepsRefusedRecipients(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("b@toto.fr", "550 5.1.1 no such user")
+	srv.RejectRecipient("d@toto.fr", "450 4.2.0 mailbox busy")
+
+	journalPath, deadDir, _ := newTestSpool(t, []string{"a@toto.fr", "b@toto.fr"}, []string{"c@toto.fr", "d@toto.fr"})
+
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "-host", srv.Addr, "-user", "me@toto.fr", "flush"}); err == nil {
+		t.Error("flush succeeded with refused recipients")
+	}
+
+	var sent []string
+	for _, envelope := range srv.Messages() {
+		sent = append(sent, envelope.To...)
+	}
+	if want := []string{"a@toto.fr", "c@toto.fr"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent to %v, want %v", sent, want)
+	}
+
+	entries := spoolEntries(t, journalPath, deadDir)
+	if len(entries) != 2 {
+		t.Fatalf("spool holds %+v, want the 2 messages", entries)
+	}
+	for i, want := range []string{"b@toto.fr", "d@toto.fr"} {
+		if rcpts := entries[i].message.EnvelopeTo; !reflect.DeepEqual(rcpts, []string{want}) {
+			t.Errorf("entry %s kept for %v, want %s", entries[i].id, rcpts, want)
+		}
+	}
+	if !entries[1].dead || entries[1].id != "letter" || len(entries[1].err) > 0 {
+		t.Errorf("dead letter = %+v, want the letter kept", entries[1])
+	}
+
+	// retrying delivers to the refused recipients only
+	srv.Reset()
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "-host", srv.Addr, "-user", "me@toto.fr", "retry", entries[0].id}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := srv.Messages(); len(msgs) != 1 || !reflect.DeepEqual(msgs[0].To, []string{"b@toto.fr"}) {
+		t.Errorf("retry sent %+v, want to b@toto.fr", msgs)
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	journalPath, deadDir, id := newTestSpool(t, []string{"a@toto.fr"}, []string{"b@toto.fr"})
+
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "rm", id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "rm", id}); err == nil {
+		t.Error("dead letter removed twice")
+	}
+
+	entries := spoolEntries(t, journalPath, deadDir)
+	if len(entries) != 1 || entries[0].dead || entries[0].message.To[0].Address != "a@toto.fr" {
+		t.Errorf("spool holds %+v, want the queued message only", entries)
+	}
+}
+
+func TestQueueSendRequiresHost(t *testing.T) {
+	journalPath, deadDir, _ := newTestSpool(t, []string{"a@toto.fr"}, nil)
+
+	if err := queueCommand([]string{"-journal", journalPath, "-dead", deadDir, "flush"}); err == nil {
+		t.Error("flush without -host succeeded")
+	}
+}
@@ -0,0 +1,62 @@
+package rmailer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// MessageCodec serializes messages, e.g. for the entries of a Journal.
+type MessageCodec interface {
+	// Name identifies the codec in the records it wrote.
+	Name() string
+	Marshal(m *Message) ([]byte, error)
+	Unmarshal(b []byte) (*Message, error)
+}
+
+// JSONCodec encodes messages as JSON, attachments being base64 strings.
+// Journal entries in JSON are written inline, readable by external tools.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(m *Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (JSONCodec) Unmarshal(b []byte) (*Message, error) {
+	m := &Message{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// GobCodec encodes messages with encoding/gob, attachments being kept as raw
+// bytes, which suits large attachments better than JSON.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(m *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(b []byte) (*Message, error) {
+	m := &Message{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
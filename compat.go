@@ -0,0 +1,50 @@
+package rmailer
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+)
+
+// ParseMessage parses a rendered RFC 5322 message into a Message, see
+// FromMailMessage. Rendering the result again breaks its DKIM signatures,
+// which VerifyDKIM checks on the raw message.
+func ParseMessage(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromMailMessage(msg)
+}
+
+// FromGomail converts a message built with gopkg.in/gomail.v2 (or any other
+// io.WriterTo rendering a message) to a Message, so that existing code can
+// move to rmailer transports without rewriting how messages are built.
+// gomail does not render Bcc, which must be set again on the result.
+func FromGomail(msg io.WriterTo) (*Message, error) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(buf)
+}
+
+// BytesMessage is implemented by *email.Email of
+// github.com/jordan-wright/email.
+type BytesMessage interface {
+	Bytes() ([]byte, error)
+}
+
+// FromJordanWrightEmail converts a github.com/jordan-wright/email message to
+// a Message. Its Bcc recipients are not rendered and must be set again on
+// the result.
+func FromJordanWrightEmail(e BytesMessage) (*Message, error) {
+	raw, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMessage(bytes.NewReader(raw))
+}
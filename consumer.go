@@ -0,0 +1,157 @@
+package rmailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Transport sends messages. Sender and Mailer are transports.
+type Transport interface {
+	SendWithResult(m *Message) (*SendResult, error)
+}
+
+// Delivery is a message received from a broker, e.g. an AMQP delivery or a
+// NATS JetStream message.
+type Delivery interface {
+	Body() []byte
+	// Ack settles the delivery as done.
+	Ack() error
+	// Nack settles the delivery as failed, to be delivered again when
+	// requeue is set, else dropped or dead-lettered by the broker.
+	Nack(requeue bool) error
+}
+
+// DeliverySource receives the deliveries of a broker queue or subject.
+type DeliverySource interface {
+	// Next blocks until a delivery arrives or ctx is done.
+	Next(ctx context.Context) (Delivery, error)
+}
+
+// Consumer sends the messages read from a broker through a Transport and
+// settles each delivery after the result of its send: acked once sent, or
+// once any recipient accepted it, requeued after a temporary failure and
+// nacked without requeue after a permanent failure or when the payload
+// cannot be decoded.
+type Consumer struct {
+	Source    DeliverySource
+	Transport Transport
+	// Codec decodes the payloads, JSONCodec when nil.
+	Codec MessageCodec
+	// Workers is the number of messages sent concurrently, 1 when zero.
+	Workers int
+	// Completed, when set, is called after each message is sent.
+	Completed func(m *Message, result *SendResult, err error)
+}
+
+func NewConsumer(source DeliverySource, transport Transport) *Consumer {
+	return &Consumer{Source: source, Transport: transport}
+}
+
+// Run consumes the deliveries until ctx is done or the source fails, and
+// returns once the messages in flight are settled.
+func (c *Consumer) Run(ctx context.Context) error {
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	slots := make(chan struct{}, workers)
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		d, err := c.Source.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			c.handle(d)
+		}()
+	}
+}
+
+func (c *Consumer) handle(d Delivery) {
+	codec := c.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	m, err := codec.Unmarshal(d.Body())
+	if err != nil {
+		logf("Consumer: cannot decode message: %s", err)
+		c.settle(d, d.Nack(false))
+		return
+	}
+
+	result, err := c.Transport.SendWithResult(m)
+	if c.Completed != nil {
+		c.Completed(m, result, err)
+	}
+
+	switch {
+	case err == nil || delivered(result):
+		c.settle(d, d.Ack())
+	case requeueable(result, err):
+		c.settle(d, d.Nack(true))
+	default:
+		c.settle(d, d.Nack(false))
+	}
+}
+
+func (c *Consumer) settle(d Delivery, err error) {
+	if err != nil {
+		logf("Consumer: cannot settle delivery: %s", err)
+	}
+}
+
+// delivered reports whether any recipient accepted the message, in which case
+// delivering it again would duplicate it.
+func delivered(result *SendResult) bool {
+	if result == nil {
+		return false
+	}
+
+	for _, status := range result.Recipients {
+		if status.Accepted() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requeueable reports whether a failed send may succeed later.
+func requeueable(result *SendResult, err error) bool {
+	var warmUpErr *WarmUpError
+	if errors.Is(err, ErrMailerClosed) || errors.As(err, &warmUpErr) {
+		return true
+	}
+
+	if result == nil {
+		return isTemporary(err)
+	}
+
+	for _, status := range result.Recipients {
+		if status.Temporary() {
+			return true
+		}
+	}
+
+	return false
+}
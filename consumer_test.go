@@ -0,0 +1,180 @@
+package rmailer_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// testDelivery records how it was settled: "ack", "requeue" or "drop".
+type testDelivery struct {
+	body []byte
+
+	mu      sync.Mutex
+	settled []string
+}
+
+func (d *testDelivery) Body() []byte { return d.body }
+
+func (d *testDelivery) Ack() error {
+	d.settle("ack")
+	return nil
+}
+
+func (d *testDelivery) Nack(requeue bool) error {
+	if requeue {
+		d.settle("requeue")
+	} else {
+		d.settle("drop")
+	}
+	return nil
+}
+
+func (d *testDelivery) settle(how string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.settled = append(d.settled, how)
+}
+
+func (d *testDelivery) settlement() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string(nil), d.settled...)
+}
+
+// testSource hands out its deliveries, then fails with err, or blocks until
+// the context is done when err is nil.
+type testSource struct {
+	deliveries chan rmailer.Delivery
+	err        error
+}
+
+func newTestSource(err error, deliveries ...rmailer.Delivery) *testSource {
+	s := &testSource{deliveries: make(chan rmailer.Delivery, len(deliveries)), err: err}
+	for _, d := range deliveries {
+		s.deliveries <- d
+	}
+	return s
+}
+
+func (s *testSource) Next(ctx context.Context) (rmailer.Delivery, error) {
+	select {
+	case d := <-s.deliveries:
+		return d, nil
+	default:
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// transportFunc adapts a function to a Transport.
+type transportFunc func(m *rmailer.Message) (*rmailer.SendResult, error)
+
+func (f transportFunc) SendWithResult(m *rmailer.Message) (*rmailer.SendResult, error) {
+	return f(m)
+}
+
+func TestConsumerSettlesDeliveries(t *testing.T) {
+	accepted := rmailer.RecipientStatus{Address: "a@toto.fr", Code: 250}
+	busy := rmailer.RecipientStatus{Address: "b@toto.fr", Code: 451, Message: "try again later"}
+	unknown := rmailer.RecipientStatus{Address: "c@toto.fr", Code: 550, Message: "no such user"}
+
+	outcomes := map[string]struct {
+		result *rmailer.SendResult
+		err    error
+	}{
+		"sent":      {&rmailer.SendResult{Recipients: []rmailer.RecipientStatus{accepted}}, nil},
+		"partial":   {&rmailer.SendResult{Recipients: []rmailer.RecipientStatus{accepted, busy}}, errors.New("DATA failed")},
+		"temporary": {&rmailer.SendResult{Recipients: []rmailer.RecipientStatus{busy, unknown}}, errors.New("no recipient accepted")},
+		"permanent": {&rmailer.SendResult{Recipients: []rmailer.RecipientStatus{unknown}}, errors.New("no recipient accepted")},
+		"closed":    {nil, rmailer.ErrMailerClosed},
+		"warm-up":   {nil, &rmailer.WarmUpError{}},
+		"invalid":   {nil, errors.New("malformed message")},
+	}
+	want := map[string]string{
+		"sent": "ack", "partial": "ack", "temporary": "requeue", "permanent": "drop",
+		"closed": "requeue", "warm-up": "requeue", "invalid": "drop", "undecodable": "drop",
+	}
+
+	deliveries := map[string]*testDelivery{"undecodable": {body: []byte("{not json")}}
+	var all []rmailer.Delivery
+	for subject := range want {
+		d := deliveries[subject]
+		if d == nil {
+			body, err := rmailer.JSONCodec{}.Marshal(rmailer.NewMessage(subject, "Hello", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d = &testDelivery{body: body}
+			deliveries[subject] = d
+		}
+		all = append(all, d)
+	}
+
+	c := rmailer.NewConsumer(newTestSource(nil, all...), transportFunc(func(m *rmailer.Message) (*rmailer.SendResult, error) {
+		outcome := outcomes[m.Subject]
+		return outcome.result, outcome.err
+	}))
+	c.Workers = 3
+
+	var completed sync.WaitGroup
+	completed.Add(len(outcomes))
+	c.Completed = func(m *rmailer.Message, result *rmailer.SendResult, err error) { completed.Done() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool {
+		for _, d := range deliveries {
+			if len(d.settlement()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	completed.Wait()
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+
+	for subject, d := range deliveries {
+		if got := d.settlement(); len(got) != 1 || got[0] != want[subject] {
+			t.Errorf("%s settled %v, want %s", subject, got, want[subject])
+		}
+	}
+}
+
+func TestConsumerStopsOnSourceFailure(t *testing.T) {
+	failure := errors.New("connection to the broker lost")
+
+	body, err := rmailer.JSONCodec{}.Marshal(rmailer.NewMessage("Hello", "Hello", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDelivery{body: body}
+
+	c := rmailer.NewConsumer(newTestSource(failure, d), transportFunc(func(m *rmailer.Message) (*rmailer.SendResult, error) {
+		return &rmailer.SendResult{Recipients: []rmailer.RecipientStatus{{Address: "a@toto.fr", Code: 250}}}, nil
+	}))
+
+	if err := c.Run(context.Background()); !errors.Is(err, failure) {
+		t.Errorf("Run = %v, want the source failure", err)
+	}
+	// the message in flight is settled before Run returns
+	if got := d.settlement(); len(got) != 1 || got[0] != "ack" {
+		t.Errorf("delivery settled %v, want ack", got)
+	}
+}
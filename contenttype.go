@@ -0,0 +1,86 @@
+package rmailer
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ContentTypes detects the content types of attachments. The signatures
+// registered are tried first, then the extensions, then the standard
+// detection of net/http, the type of the extension being used when it only
+// finds text/plain, as for most binary formats it does not know.
+type ContentTypes struct {
+	mu         sync.RWMutex
+	extensions map[string]string
+	signatures []contentSignature
+}
+
+type contentSignature struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+func NewContentTypes() *ContentTypes {
+	return &ContentTypes{}
+}
+
+// DefaultContentTypes is the registry used when rendering attachments.
+var DefaultContentTypes = NewContentTypes()
+
+// RegisterExtension maps the file extension ext, e.g. ".dwg", to
+// contentType, overriding the standard detection for the files named so.
+func (r *ContentTypes) RegisterExtension(ext string, contentType string) {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.extensions == nil {
+		r.extensions = make(map[string]string)
+	}
+	r.extensions[strings.ToLower(ext)] = contentType
+}
+
+// RegisterSignature maps the contents holding magic at offset, e.g. "PAR1"
+// at 0 for Parquet files, to contentType. Signatures are tried in the order
+// of registration.
+func (r *ContentTypes) RegisterSignature(offset int, magic []byte, contentType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signatures = append(r.signatures, contentSignature{offset: offset, magic: append([]byte{}, magic...), contentType: contentType})
+}
+
+// Detect returns the content type of the file name holding content, empty
+// when unknown.
+func (r *ContentTypes) Detect(name string, content []byte) string {
+	r.mu.RLock()
+	for _, s := range r.signatures {
+		if len(content) >= s.offset+len(s.magic) && bytes.Equal(content[s.offset:s.offset+len(s.magic)], s.magic) {
+			r.mu.RUnlock()
+			return s.contentType
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	contentType, ok := r.extensions[ext]
+	r.mu.RUnlock()
+
+	if ok {
+		return contentType
+	}
+
+	contentType = http.DetectContentType(content)
+	if strings.HasPrefix(contentType, ContentTypeTextPlain) {
+		contentType = mime.TypeByExtension(ext)
+	}
+
+	return contentType
+}
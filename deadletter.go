@@ -0,0 +1,367 @@
+package rmailer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned for the IDs a DeadLetterStore does not
+// hold.
+var ErrDeadLetterNotFound = errors.New("rmailer: dead letter not found")
+
+// DeadLetter is a queued message which failed for good, with the history of
+// its attempts.
+type DeadLetter struct {
+	ID string `json:"id"`
+	// Message is the message as queued, its EnvelopeTo listing the
+	// recipients which failed when the relay was reached.
+	Message *Message  `json:"message"`
+	Queued  time.Time `json:"queued"`
+	Failed  time.Time `json:"failed"`
+	// Recipients holds the final status of the recipients which failed.
+	Recipients []RecipientStatus `json:"recipients,omitempty"`
+	// Error is the error of the last attempt, if any.
+	Error string `json:"error,omitempty"`
+	// History records each attempt of the message.
+	History []AuditRecord `json:"history"`
+}
+
+// DeadLetterStore keeps the dead letters of a Mailer until they are
+// inspected, re-driven or deleted.
+type DeadLetterStore interface {
+	Put(letter *DeadLetter) error
+	// List returns the dead letters, oldest failure first.
+	List() ([]*DeadLetter, error)
+	Get(id string) (*DeadLetter, error)
+	Delete(id string) error
+}
+
+// MemoryDeadLetters is a DeadLetterStore kept in memory.
+type MemoryDeadLetters struct {
+	mu      sync.Mutex
+	letters map[string]*DeadLetter
+}
+
+func NewMemoryDeadLetters() *MemoryDeadLetters {
+	return &MemoryDeadLetters{letters: make(map[string]*DeadLetter)}
+}
+
+func (s *MemoryDeadLetters) Put(letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.letters == nil {
+		s.letters = make(map[string]*DeadLetter)
+	}
+	s.letters[letter.ID] = letter
+
+	return nil
+}
+
+func (s *MemoryDeadLetters) List() ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]*DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sortDeadLetters(letters)
+
+	return letters, nil
+}
+
+func (s *MemoryDeadLetters) Get(id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	return letter, nil
+}
+
+func (s *MemoryDeadLetters) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.letters[id]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	delete(s.letters, id)
+
+	return nil
+}
+
+// DirDeadLetters is a DeadLetterStore keeping each dead letter as a JSON file
+// of a directory, readable by external tools.
+type DirDeadLetters struct {
+	Dir string
+}
+
+// NewDirDeadLetters returns a store of the directory dir, creating it when it
+// does not exist.
+func NewDirDeadLetters(dir string) (*DirDeadLetters, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &DirDeadLetters{Dir: dir}, nil
+}
+
+func (s *DirDeadLetters) path(id string) (string, error) {
+	if len(id) == 0 || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", ErrDeadLetterNotFound
+	}
+
+	return filepath.Join(s.Dir, id+".json"), nil
+}
+
+func (s *DirDeadLetters) Put(letter *DeadLetter) error {
+	path, err := s.path(letter.ID)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".deadletter-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DirDeadLetters) List() ([]*DeadLetter, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var letters []*DeadLetter
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || strings.HasPrefix(id, ".") {
+			continue
+		}
+
+		letter, err := s.Get(id)
+		if err != nil {
+			if errors.Is(err, ErrDeadLetterNotFound) {
+				continue // deleted meanwhile
+			}
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	sortDeadLetters(letters)
+
+	return letters, nil
+}
+
+func (s *DirDeadLetters) Get(id string) (*DeadLetter, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(b, letter); err != nil {
+		return nil, err
+	}
+
+	return letter, nil
+}
+
+func (s *DirDeadLetters) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrDeadLetterNotFound
+	}
+
+	return err
+}
+
+func sortDeadLetters(letters []*DeadLetter) {
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].Failed.Equal(letters[j].Failed) {
+			return letters[i].Failed.Before(letters[j].Failed)
+		}
+		return letters[i].ID < letters[j].ID
+	})
+}
+
+// deadLetter returns the dead letter of item after its last attempt, nil when
+// no recipient failed, suppressed ones aside.
+func (ml *Mailer) deadLetter(item *queuedMessage, result *SendResult, err error) *DeadLetter {
+	if errors.Is(err, ErrDuplicate) {
+		return nil
+	}
+
+	rcpts := item.m.envelopeRecipients()
+	if result != nil {
+		rcpts = nil
+		for _, status := range result.Recipients {
+			rcpts = append(rcpts, status.Address)
+		}
+	}
+
+	var failed []RecipientStatus
+	for _, status := range attemptStatuses(rcpts, result, err) {
+		if !status.Accepted() && len(status.Suppressed) == 0 {
+			failed = append(failed, status)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	m := item.m.clone()
+	if result != nil {
+		m.EnvelopeTo = nil
+		for _, status := range failed {
+			m.EnvelopeTo = append(m.EnvelopeTo, status.Address)
+		}
+	}
+
+	letter := &DeadLetter{
+		ID:         newJournalID(),
+		Message:    m,
+		Queued:     item.queued,
+		Failed:     senderClock(ml.senderOf(item)).Now(),
+		Recipients: failed,
+		History:    item.history,
+	}
+	if err != nil {
+		letter.Error = err.Error()
+	}
+
+	return letter
+}
+
+// RedriveOption modifies the dead letters re-driven by Mailer.Redrive.
+type RedriveOption func(r *redrive)
+
+type redrive struct {
+	from   string
+	to     []string
+	sender *Sender
+}
+
+// RedriveFrom sends the re-driven messages with from as MAIL FROM address.
+func RedriveFrom(from string) RedriveOption {
+	return func(r *redrive) {
+		r.from = from
+	}
+}
+
+// RedriveTo sends the re-driven messages to rcpts instead of the recipients
+// which failed.
+func RedriveTo(rcpts ...string) RedriveOption {
+	return func(r *redrive) {
+		r.to = rcpts
+	}
+}
+
+// RedriveVia sends the re-driven messages through sender, e.g. a Sender of
+// another relay host, instead of the Mailer's Sender. Messages recovered from
+// the Journal after a crash are sent through the Mailer's Sender.
+func RedriveVia(sender *Sender) RedriveOption {
+	return func(r *redrive) {
+		r.sender = sender
+	}
+}
+
+// Redrive queues again the dead letters selected by filter, all of them when
+// it is nil, and deletes them from DeadLetters. It returns the number of
+// messages queued, regardless of QueueSize. Their outcome is reported like
+// that of Enqueue, and those failing again become new dead letters.
+func (ml *Mailer) Redrive(filter func(letter *DeadLetter) bool, opts ...RedriveOption) (int, error) {
+	if ml.DeadLetters == nil {
+		return 0, errors.New("rmailer: Mailer has no DeadLetters to redrive")
+	}
+
+	var r redrive
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	letters, err := ml.DeadLetters.List()
+	if err != nil {
+		return 0, err
+	}
+
+	q := &ml.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+
+	for _, letter := range letters {
+		if filter != nil && !filter(letter) {
+			continue
+		}
+
+		if q.closed {
+			return n, ErrMailerClosed
+		}
+
+		m := letter.Message.clone()
+		if len(r.from) > 0 {
+			m.EnvelopeFrom = r.from
+		}
+		if len(r.to) > 0 {
+			m.EnvelopeTo = r.to
+		}
+
+		item := &queuedMessage{m: m, sender: r.sender}
+		item.queued = senderClock(ml.senderOf(item)).Now()
+		if err := ml.admit(item); err != nil {
+			return n, err
+		}
+		n++
+
+		if err := ml.DeadLetters.Delete(letter.ID); err != nil && !errors.Is(err, ErrDeadLetterNotFound) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,205 @@
+package rmailer_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestQueueDeadLettersFailedRecipients(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("gone@toto.fr", "550 5.1.1 no such user")
+	srv.RejectRecipient("busy@toto.fr", "451 4.2.0 mailbox busy")
+
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Clock = clock
+
+	ml := rmailer.NewMailer(sender)
+	ml.Retry = &rmailer.Backoff{Attempts: 2, Default: rmailer.BackoffClass{Name: "test", Delay: time.Minute}}
+	ml.DeadLetters = rmailer.NewMemoryDeadLetters()
+	done := newCompletions(ml)
+
+	if err := ml.Enqueue(newTestMessage("a@toto.fr", "gone@toto.fr", "busy@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+
+	// deferred for busy@, not dead-lettered before its retry
+	waitFor(t, func() bool { return ml.QueueStats().Deferred == 1 })
+	if letters, _ := ml.DeadLetters.List(); len(letters) != 0 {
+		t.Fatalf("%d dead letter(s) while the retry is pending", len(letters))
+	}
+
+	clock.Advance(time.Minute)
+	done.wait(t, 1)
+
+	letters, err := ml.DeadLetters.List()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("%d dead letter(s), %v, want 1", len(letters), err)
+	}
+	letter := letters[0]
+
+	// the retry went to the recipients which had not accepted the message
+	if got := letter.Message.EnvelopeTo; !slices.Equal(got, []string{"gone@toto.fr", "busy@toto.fr"}) {
+		t.Errorf("dead letter for %v, want gone@ and busy@", got)
+	}
+	codes := map[string]int{}
+	for _, status := range letter.Recipients {
+		codes[status.Address] = status.Code
+	}
+	if codes["gone@toto.fr"] != 550 || codes["busy@toto.fr"] != 451 || len(codes) != 2 {
+		t.Errorf("Recipients = %+v", letter.Recipients)
+	}
+	if len(letter.History) != 2 || !letter.Failed.Equal(clock.Now()) {
+		t.Errorf("History = %+v, failed %s", letter.History, letter.Failed)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedriveSelectedLetters(t *testing.T) {
+	srv := newTestServer(t)
+
+	ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+	ml.DeadLetters = rmailer.NewMemoryDeadLetters()
+	done := newCompletions(ml)
+
+	for _, letter := range []*rmailer.DeadLetter{
+		{ID: "bounced", Message: newTestMessage("gone@toto.fr"), Error: "550 5.1.1 no such user"},
+		{ID: "timeout", Message: newTestMessage("slow@toto.fr"), Error: "i/o timeout"},
+	} {
+		if err := ml.DeadLetters.Put(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := ml.Redrive(func(letter *rmailer.DeadLetter) bool { return letter.ID == "timeout" },
+		rmailer.RedriveFrom("bounces@toto.fr"), rmailer.RedriveTo("fixed@toto.fr"))
+	if err != nil || n != 1 {
+		t.Fatalf("Redrive = %d, %v, want 1", n, err)
+	}
+	if c := done.wait(t, 1)[0]; c.err != nil {
+		t.Fatalf("re-driven send failed: %v", c.err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 || messages[0].From != "bounces@toto.fr" || !slices.Equal(messages[0].To, []string{"fixed@toto.fr"}) {
+		t.Errorf("server got %+v, want from bounces@ to fixed@", messages)
+	}
+	if _, err := ml.DeadLetters.Get("timeout"); !errors.Is(err, rmailer.ErrDeadLetterNotFound) {
+		t.Errorf("re-driven letter still stored: %v", err)
+	}
+	if _, err := ml.DeadLetters.Get("bounced"); err != nil {
+		t.Errorf("letter not selected is gone: %v", err)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ml.Redrive(nil); !errors.Is(err, rmailer.ErrMailerClosed) {
+		t.Errorf("Redrive after Shutdown = %v, want ErrMailerClosed", err)
+	}
+}
+
+func TestDirDeadLetters(t *testing.T) {
+	store, err := rmailer.NewDirDeadLetters(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"late", "early"} {
+		letter := &rmailer.DeadLetter{ID: id, Message: newTestMessage("a@toto.fr"), Failed: failed.Add(time.Duration(1-i) * time.Hour)}
+		if err := store.Put(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	letters, err := store.List()
+	if err != nil || len(letters) != 2 || letters[0].ID != "early" || letters[1].ID != "late" {
+		t.Fatalf("List = %+v, %v, want early then late", letters, err)
+	}
+	if letters[0].Message.To[0].Address != "a@toto.fr" {
+		t.Errorf("message read back = %+v", letters[0].Message)
+	}
+
+	if err := store.Delete("early"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"early", "../late", ".hidden", ""} {
+		if _, err := store.Get(id); !errors.Is(err, rmailer.ErrDeadLetterNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrDeadLetterNotFound", id, err)
+		}
+	}
+}
+
+func TestRedriveViaUsesItsSenderClock(t *testing.T) {
+	srv := newTestServer(t)
+	srv.FailNext("RCPT", "451 4.3.0 try again later")
+
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	relay := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	relay.Clock = clock
+
+	// a Mailer sending through per-item senders only
+	ml := rmailer.NewMailer(nil)
+	ml.Retry = &rmailer.Backoff{Attempts: 2, Default: rmailer.BackoffClass{Name: "test", Delay: time.Minute}}
+	ml.DeadLetters = rmailer.NewMemoryDeadLetters()
+	done := newCompletions(ml)
+
+	letter := &rmailer.DeadLetter{ID: "letter-1", Message: newTestMessage("a@toto.fr", "b@toto.fr")}
+	letter.Message.EnvelopeTo = []string{"b@toto.fr"}
+	if err := ml.DeadLetters.Put(letter); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := ml.Redrive(nil, rmailer.RedriveVia(relay)); err != nil || n != 1 {
+		t.Fatalf("Redrive = %d, %v, want 1", n, err)
+	}
+	waitFor(t, func() bool { return ml.QueueStats().Deferred == 1 })
+
+	// the retry waits on the clock of the relay
+	clock.Advance(time.Minute)
+	if c := done.wait(t, 1)[0]; c.err != nil {
+		t.Fatalf("re-driven send failed: %v", c.err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 || !slices.Equal(messages[0].To, []string{"b@toto.fr"}) {
+		t.Fatalf("server got %v, want the message for b@toto.fr only", messages)
+	}
+	if letters, _ := ml.DeadLetters.List(); len(letters) != 0 {
+		t.Errorf("%d dead letter(s) left after the redrive", len(letters))
+	}
+
+	// failing again, the message is a new dead letter timed by the relay
+	srv.RejectRecipient("b@toto.fr", "550 5.1.1 no such user")
+	if err := ml.DeadLetters.Put(letter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ml.Redrive(nil, rmailer.RedriveVia(relay)); err != nil {
+		t.Fatal(err)
+	}
+	done.wait(t, 1)
+
+	letters, err := ml.DeadLetters.List()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("%d dead letter(s), %v, want 1", len(letters), err)
+	}
+	if !letters[0].Failed.Equal(clock.Now()) || !letters[0].Queued.Equal(clock.Now()) {
+		t.Errorf("dead letter queued %s, failed %s, want %s", letters[0].Queued, letters[0].Failed, clock.Now())
+	}
+	if len(letters[0].Recipients) != 1 || letters[0].Recipients[0].Code != 550 {
+		t.Errorf("Recipients = %+v, want b@toto.fr refused", letters[0].Recipients)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
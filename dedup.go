@@ -0,0 +1,493 @@
+package rmailer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDuplicate is reported to Mailer.Completed for a queued message which
+// the Dedup store has seen sent to all its recipients already.
+var ErrDuplicate = errors.New("rmailer: message already sent")
+
+// DefaultDedupTTL is how long sent messages are remembered when
+// Mailer.DedupTTL is zero.
+const DefaultDedupTTL = 24 * time.Hour
+
+// DedupStore remembers the keys of the messages sent, one per message and
+// recipient, so that the messages replayed from a Journal after a crash are
+// not sent twice to the same recipient.
+type DedupStore interface {
+	// Seen reports whether key was marked and has not expired.
+	Seen(key string) (bool, error)
+	// Mark records key for ttl.
+	Mark(key string, ttl time.Duration) error
+}
+
+// dedupKey returns the IdempotencyKey of m, or a hash of its content: the
+// addresses, subject, date, bodies, attachments, parts, headers and
+// metadata. The rendering settings are left out, and nil and empty values
+// hash alike, so that a message reloaded from the Journal with any codec
+// keeps its key.
+func dedupKey(m *Message) string {
+	if len(m.IdempotencyKey) > 0 {
+		return m.IdempotencyKey
+	}
+
+	h := contentHash{Hash: sha256.New()}
+
+	h.string(m.EnvelopeFrom)
+	for _, list := range [][]mail.Address{{m.From}, m.To, m.CC, m.BCC} {
+		h.int(len(list))
+		for _, addr := range list {
+			h.string(addr.Name)
+			h.string(addr.Address)
+		}
+	}
+	h.string(m.Subject)
+	var date int64
+	if !m.Date.IsZero() {
+		date = m.Date.UnixNano()
+	}
+	h.int64(date)
+	h.string(m.BodyText)
+	h.string(m.BodyHtml)
+
+	h.int(len(m.Attachments))
+	for _, a := range m.Attachments {
+		h.string(a.Name)
+		h.string(string(a.Content))
+		h.string(a.ContentID)
+		h.string(strconv.FormatBool(a.Inline))
+		h.string(string(a.Encoding))
+		h.string(strconv.FormatBool(a.PreEncoded))
+		h.string(a.Path)
+	}
+
+	h.int(len(m.Parts))
+	for _, p := range m.Parts {
+		h.part(p)
+	}
+
+	h.int(len(m.Headers))
+	for _, header := range m.Headers {
+		h.string(header.Name)
+		h.string(header.Value)
+		h.int(int(header.Position))
+	}
+
+	h.strings(m.Metadata)
+	h.string(m.Identity)
+	h.string(strconv.FormatBool(m.Bulk))
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// contentHash hashes the values of a message, each prefixed with its length
+// so that they cannot run into each other.
+type contentHash struct {
+	hash.Hash
+}
+
+func (h contentHash) int(n int) {
+	h.int64(int64(n))
+}
+
+func (h contentHash) int64(n int64) {
+	h.Write(binary.AppendVarint(nil, n))
+}
+
+func (h contentHash) string(s string) {
+	h.int(len(s))
+	io.WriteString(h, s)
+}
+
+// strings hashes the entries of m ordered by key.
+func (h contentHash) strings(m map[string]string) {
+	h.int(len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		h.string(k)
+		h.string(m[k])
+	}
+}
+
+func (h contentHash) part(p *Part) {
+	h.int(len(p.Header))
+	for _, name := range slices.Sorted(maps.Keys(p.Header)) {
+		h.string(name)
+		h.int(len(p.Header[name]))
+		for _, value := range p.Header[name] {
+			h.string(value)
+		}
+	}
+	h.string(string(p.Content))
+
+	h.int(len(p.Parts))
+	for _, child := range p.Parts {
+		h.part(child)
+	}
+}
+
+// dedupRecipientKey returns the key marking the message of key sent to rcpt.
+func dedupRecipientKey(key string, rcpt string) string {
+	return key + ":" + strings.ToLower(rcpt)
+}
+
+// MemoryDedup is an in-memory DedupStore, which does not survive restarts
+// and suits tests or a Journal-less Mailer only, see FileDedup.
+type MemoryDedup struct {
+	// Clock expires the keys, SystemClock when nil.
+	Clock Clock
+
+	mu   sync.Mutex
+	keys map[string]time.Time
+	// swept is the number of keys left by the last sweep of the expired
+	// ones, the next being due once the map has doubled.
+	swept int
+}
+
+func NewMemoryDedup() *MemoryDedup {
+	return &MemoryDedup{keys: make(map[string]time.Time)}
+}
+
+func (d *MemoryDedup) Seen(key string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expiry, ok := d.keys[key]
+	if !ok {
+		return false, nil
+	}
+
+	if !clockOf(d.Clock).Now().Before(expiry) {
+		delete(d.keys, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (d *MemoryDedup) Mark(key string, ttl time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.keys == nil {
+		d.keys = make(map[string]time.Time)
+	}
+
+	now := clockOf(d.Clock).Now()
+	d.keys[key] = now.Add(ttl)
+
+	// the keys not looked up again are swept once the map has doubled, so
+	// that Mark runs in amortized constant time
+	if len(d.keys) >= max(1024, 2*d.swept) {
+		for k, expiry := range d.keys {
+			if !now.Before(expiry) {
+				delete(d.keys, k)
+			}
+		}
+		d.swept = len(d.keys)
+	}
+
+	return nil
+}
+
+// FileDedup is a DedupStore kept in a file, which survives restarts and
+// suits a Mailer with a Journal on a single host. Each key marked is
+// appended to the file and synced before the message is acknowledged, and
+// the expired keys are dropped when the file is compacted.
+type FileDedup struct {
+	// Clock expires the keys, SystemClock when nil.
+	Clock Clock
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	keys    map[string]time.Time
+	records int
+}
+
+// dedupRecord is a line of the file of a FileDedup.
+type dedupRecord struct {
+	Key    string    `json:"key"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// NewFileDedup opens the store at path, which is created when it does not
+// exist, and loads the keys it holds, compacting it.
+func NewFileDedup(path string) (*FileDedup, error) {
+	d := &FileDedup{path: path, keys: make(map[string]time.Time)}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	if err := d.Compact(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *FileDedup) load() error {
+	file, err := os.Open(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("rmailer: reading %s: %w", d.path, err)
+		}
+
+		var record dedupRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// the last record may be cut short by a crash
+			logf("SMTP dedup %s: skipping unreadable record: %s", d.path, err)
+			continue
+		}
+
+		if record.Expiry.After(d.keys[record.Key]) {
+			d.keys[record.Key] = record.Expiry
+		}
+	}
+}
+
+func (d *FileDedup) Seen(key string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expiry, ok := d.keys[key]
+	if !ok {
+		return false, nil
+	}
+
+	if !clockOf(d.Clock).Now().Before(expiry) {
+		delete(d.keys, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (d *FileDedup) Mark(key string, ttl time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record := dedupRecord{Key: key, Expiry: clockOf(d.Clock).Now().Add(ttl)}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = d.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err = d.file.Sync(); err != nil {
+		return err
+	}
+
+	d.keys[key] = record.Expiry
+	d.records++
+
+	// compacted once the file mostly holds expired or replaced keys
+	if d.records >= 1024 && d.records > 2*len(d.keys) {
+		return d.compact()
+	}
+
+	return nil
+}
+
+// Compact rewrites the file with the keys which have not expired.
+func (d *FileDedup) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.compact()
+}
+
+func (d *FileDedup) compact() error {
+	now := clockOf(d.Clock).Now()
+	for key, expiry := range d.keys {
+		if !now.Before(expiry) {
+			delete(d.keys, key)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+
+	for key, expiry := range d.keys {
+		if err := enc.Encode(dedupRecord{Key: key, Expiry: expiry}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), d.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = file
+	d.records = len(d.keys)
+	return nil
+}
+
+func (d *FileDedup) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.file.Close()
+}
+
+// RedisDedup is a DedupStore kept in Redis, the keys expiring on the server.
+// Each call opens a connection of its own.
+type RedisDedup struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Password string
+	DB       int
+	// Prefix is prepended to the keys, "rmailer:dedup:" when empty.
+	Prefix  string
+	Timeout time.Duration
+}
+
+func NewRedisDedup(addr string) *RedisDedup {
+	return &RedisDedup{Addr: addr, Timeout: 5 * time.Second}
+}
+
+func (d *RedisDedup) Seen(key string) (bool, error) {
+	reply, err := d.do("EXISTS", d.key(key))
+	if err != nil {
+		return false, err
+	}
+
+	return reply == ":1", nil
+}
+
+func (d *RedisDedup) Mark(key string, ttl time.Duration) error {
+	_, err := d.do("SET", d.key(key), "1", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (d *RedisDedup) key(key string) string {
+	prefix := d.Prefix
+	if len(prefix) == 0 {
+		prefix = "rmailer:dedup:"
+	}
+
+	return prefix + key
+}
+
+// do runs a command, after AUTH and SELECT as configured, and returns its
+// reply line.
+func (d *RedisDedup) do(args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", d.Addr, d.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	r := bufio.NewReader(conn)
+
+	var commands [][]string
+	if len(d.Password) > 0 {
+		commands = append(commands, []string{"AUTH", d.Password})
+	}
+	if d.DB != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(d.DB)})
+	}
+	commands = append(commands, args)
+
+	var reply string
+	for _, command := range commands {
+		if reply, err = redisCommand(conn, r, command); err != nil {
+			return "", err
+		}
+	}
+
+	return reply, nil
+}
+
+// redisCommand sends a RESP command and reads a simple reply: a status, an
+// integer or a bulk string header.
+func redisCommand(conn net.Conn, r *bufio.Reader, args []string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("rmailer: redis %s: %s", args[0], line[1:])
+	}
+
+	return line, nil
+}
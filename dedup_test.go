@@ -0,0 +1,213 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestFileDedupSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+
+	d, err := rmailer.NewFileDedup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, ttl := range map[string]time.Duration{"kept": time.Hour, "expired": 0} {
+		if err := d.Mark(key, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = rmailer.NewFileDedup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for key, want := range map[string]bool{"kept": true, "expired": false, "unknown": false} {
+		if seen, err := d.Seen(key); err != nil || seen != want {
+			t.Errorf("Seen(%q) = %t, %v, want %t", key, seen, err, want)
+		}
+	}
+
+	// reopening compacted the expired key away
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 1 {
+		t.Errorf("file holds %d record(s) after compaction, want 1", n)
+	}
+}
+
+func TestRecoverSkipsRecipientsSentBeforeCrash(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("b@toto.fr", "451 4.3.0 try again later")
+
+	dir := t.TempDir()
+	open := func() *rmailer.Mailer {
+		ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+
+		var err error
+		if ml.Journal, err = rmailer.NewJournal(filepath.Join(dir, "journal")); err != nil {
+			t.Fatal(err)
+		}
+		if ml.Dedup, err = rmailer.NewFileDedup(filepath.Join(dir, "dedup")); err != nil {
+			t.Fatal(err)
+		}
+		return ml
+	}
+
+	ml := open()
+	done := newCompletions(ml)
+
+	m := newTestMessage("a@toto.fr", "b@toto.fr")
+	m.IdempotencyKey = "order-42"
+	if err := ml.Enqueue(m); err != nil {
+		t.Fatal(err)
+	}
+	done.wait(t, 1)
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process crashes after the send, before its acknowledgement
+	if _, err := ml.Journal.Append(m); err != nil {
+		t.Fatal(err)
+	}
+	ml.Journal.Close()
+	ml.Dedup.(*rmailer.FileDedup).Close()
+	srv.Reset()
+
+	ml = open()
+	done = newCompletions(ml)
+
+	if n, err := ml.Recover(); err != nil || n != 1 {
+		t.Fatalf("Recover = %d, %v, want 1 entry", n, err)
+	}
+	if c := done.wait(t, 1)[0]; c.err != nil {
+		t.Fatalf("recovered send failed: %v", c.err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 || !slices.Equal(messages[0].To, []string{"b@toto.fr"}) {
+		t.Fatalf("server got %v, want the message for b@toto.fr only", messages)
+	}
+	if n := len(ml.Journal.Pending()); n != 0 {
+		t.Errorf("%d journal entries left, want 0", n)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverKeepsDedupKeyWithEveryCodec(t *testing.T) {
+	for name, codec := range map[string]rmailer.MessageCodec{
+		"json":  rmailer.JSONCodec{},
+		"gob":   rmailer.GobCodec{},
+		"proto": rmailer.ProtoCodec{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t)
+			dedup := rmailer.NewMemoryDedup()
+			path := filepath.Join(t.TempDir(), "journal")
+
+			open := func() *rmailer.Mailer {
+				ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+				ml.Dedup = dedup
+
+				var err error
+				if ml.Journal, err = rmailer.NewJournal(path, rmailer.WithJournalCodec(codec)); err != nil {
+					t.Fatal(err)
+				}
+				return ml
+			}
+
+			// no IdempotencyKey: the content is hashed, settings and empty
+			// values which the codecs do not all keep included
+			m := newTestMessage("a@toto.fr")
+			m.CC = []mail.Address{}
+			m.Attachments = []rmailer.Attachment{}
+			m.Metadata = map[string]string{}
+			m.AttachmentPolicy = rmailer.NewAttachmentPolicy()
+			m.EncodeConcurrency = 2
+
+			ml := open()
+			done := newCompletions(ml)
+			if err := ml.Enqueue(m); err != nil {
+				t.Fatal(err)
+			}
+			if c := done.wait(t, 1)[0]; c.err != nil {
+				t.Fatal(c.err)
+			}
+			if err := ml.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// the process crashes after the send, before its acknowledgement
+			if _, err := ml.Journal.Append(m); err != nil {
+				t.Fatal(err)
+			}
+			ml.Journal.Close()
+
+			ml = open()
+			defer ml.Journal.Close()
+			done = newCompletions(ml)
+
+			if _, err := ml.Recover(); err != nil {
+				t.Fatal(err)
+			}
+			if c := done.wait(t, 1)[0]; !errors.Is(c.err, rmailer.ErrDuplicate) {
+				t.Fatalf("recovered send = %v, want ErrDuplicate", c.err)
+			}
+			if n := len(srv.Messages()); n != 1 {
+				t.Fatalf("server got %d message(s), want 1", n)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupExpires(t *testing.T) {
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	d := rmailer.NewMemoryDedup()
+	d.Clock = clock
+
+	// enough keys to trigger sweeps, which must not drop the live ones
+	for i := range 5000 {
+		ttl := time.Minute
+		if i%2 == 0 {
+			ttl = time.Hour
+		}
+		if err := d.Mark(fmt.Sprint(i), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2500 {
+			clock.Advance(2 * time.Minute)
+		}
+	}
+
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "4999": true, "4998": true} {
+		if seen, _ := d.Seen(key); seen != want {
+			t.Errorf("Seen(%s) = %t, want %t", key, seen, want)
+		}
+	}
+
+	clock.Advance(time.Hour)
+	if seen, _ := d.Seen("0"); seen {
+		t.Error("key seen after its TTL")
+	}
+}
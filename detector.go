@@ -0,0 +1,236 @@
+package rmailer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ListSource provides a list of entries, such as disposable domains, one
+// per line in the files and URLs it reads.
+type ListSource interface {
+	List() ([]string, error)
+}
+
+// ListFunc adapts a function to a ListSource.
+type ListFunc func() ([]string, error)
+
+func (f ListFunc) List() ([]string, error) {
+	return f()
+}
+
+// StaticList is a fixed list.
+type StaticList []string
+
+func (l StaticList) List() ([]string, error) {
+	return l, nil
+}
+
+// FileList reads the list from the file Path, one entry per line. Empty
+// lines and lines starting with # are skipped.
+type FileList struct {
+	Path string
+}
+
+func (l FileList) List() ([]string, error) {
+	file, err := os.Open(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readList(file)
+}
+
+// URLList downloads the list from URL, in the format of FileList, e.g. the
+// disposable-email-domains project's list.
+type URLList struct {
+	URL    string
+	Client *http.Client
+}
+
+func (l *URLList) List() ([]string, error) {
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rmailer: %s returned %s", l.URL, resp.Status)
+	}
+
+	return readList(resp.Body)
+}
+
+func readList(r io.Reader) ([]string, error) {
+	var entries []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	return entries, scanner.Err()
+}
+
+// DefaultDisposableDomains are a few well known disposable mail domains, used
+// by an AddressDetector until Refresh loads its Disposable source.
+var DefaultDisposableDomains = StaticList{
+	"10minutemail.com", "dispostable.com", "getnada.com", "guerrillamail.com",
+	"mailinator.com", "maildrop.cc", "sharklasers.com", "temp-mail.org",
+	"tempmail.com", "throwawaymail.com", "trashmail.com", "yopmail.com",
+}
+
+// DefaultRoles are the local parts of common role addresses, which reach a
+// team or a system rather than a person.
+var DefaultRoles = StaticList{
+	"abuse", "admin", "administrator", "billing", "contact", "help",
+	"hostmaster", "info", "mailer-daemon", "marketing", "no-reply", "noc",
+	"noreply", "office", "postmaster", "root", "sales", "security",
+	"support", "team", "webmaster", "www",
+}
+
+// AddressCheck is the classification of an address by an AddressDetector.
+type AddressCheck struct {
+	// Disposable reports an address of a throwaway mail service.
+	Disposable bool
+	// Role reports an address of a function, e.g. info@ or admin@.
+	Role bool
+}
+
+// AddressDetector flags disposable and role addresses, so that signup flows
+// can refuse or treat them apart before sending anything. Its lists are
+// loaded from Disposable and Roles by Refresh, which can be called again to
+// update them.
+type AddressDetector struct {
+	// Disposable lists the disposable domains, their subdomains included,
+	// DefaultDisposableDomains when nil.
+	Disposable ListSource
+	// Roles lists the role local parts, DefaultRoles when nil.
+	Roles ListSource
+
+	mu         sync.RWMutex
+	disposable map[string]bool
+	roles      map[string]bool
+}
+
+// NewAddressDetector returns a detector loading its disposable domains from
+// disposable. DefaultDisposableDomains and DefaultRoles are used until
+// Refresh loads the sources.
+func NewAddressDetector(disposable ListSource) *AddressDetector {
+	d := &AddressDetector{Disposable: disposable}
+	d.disposable = listSet(DefaultDisposableDomains)
+	d.roles = listSet(DefaultRoles)
+
+	return d
+}
+
+func listSet(entries []string) map[string]bool {
+	set := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		set[strings.ToLower(strings.TrimSuffix(entry, "."))] = true
+	}
+
+	return set
+}
+
+// Refresh loads the lists again. The lists in use are kept when a source
+// fails.
+func (d *AddressDetector) Refresh() error {
+	var disposable, roles map[string]bool
+
+	if d.Disposable != nil {
+		entries, err := d.Disposable.List()
+		if err != nil {
+			return fmt.Errorf("rmailer: loading disposable domains: %w", err)
+		}
+		disposable = listSet(entries)
+	}
+
+	if d.Roles != nil {
+		entries, err := d.Roles.List()
+		if err != nil {
+			return fmt.Errorf("rmailer: loading roles: %w", err)
+		}
+		roles = listSet(entries)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if disposable != nil {
+		d.disposable = disposable
+	}
+	if roles != nil {
+		d.roles = roles
+	}
+
+	return nil
+}
+
+// Check classifies address.
+func (d *AddressDetector) Check(address string) AddressCheck {
+	return AddressCheck{Disposable: d.IsDisposable(address), Role: d.IsRole(address)}
+}
+
+// IsDisposable reports whether the domain of address, or a parent domain of
+// it, is disposable.
+func (d *AddressDetector) IsDisposable(address string) bool {
+	domain := strings.ToLower(strings.TrimSuffix(addressDomain(address), "."))
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	disposable := d.disposable
+	if disposable == nil {
+		disposable = listSet(DefaultDisposableDomains)
+	}
+
+	for len(domain) > 0 {
+		if disposable[domain] {
+			return true
+		}
+
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+
+	return false
+}
+
+// IsRole reports whether the local part of address, without its +tag, is a
+// role.
+func (d *AddressDetector) IsRole(address string) bool {
+	local := address
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		local = address[:at]
+	}
+	local, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(local)), "+")
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	roles := d.roles
+	if roles == nil {
+		roles = listSet(DefaultRoles)
+	}
+
+	return roles[local]
+}
@@ -0,0 +1,168 @@
+package rmailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultFallbackDelay is the connection attempt delay recommended by RFC
+// 8305 section 5.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// dial connects to the relay, resolving Host with the Sender's Resolver when
+// set and racing its addresses Happy Eyeballs style.
+func (s *Sender) dial() (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if s.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: s.LocalAddr}
+	}
+
+	host, port, err := net.SplitHostPort(s.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil || (s.Resolver == nil && !s.PreferIPv4) {
+		// the standard dialer already falls back between address families
+		return dialer.Dial("tcp", s.Host)
+	}
+
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := resolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	if s.LocalAddr != nil {
+		// only the family of the local address is reachable
+		addrs = sameFamily(addrs, s.LocalAddr)
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("rmailer: %s has no address reachable from %s", host, s.LocalAddr)
+		}
+	}
+
+	delay := s.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+
+	return raceDial(dialer, sortAddrs(addrs, s.PreferIPv4), port, delay)
+}
+
+// sortAddrs interleaves the IPv6 and IPv4 addresses (RFC 8305 section 4),
+// starting with the family of the first answer, or with IPv4 when preferIPv4
+// is set.
+func sortAddrs(addrs []string, preferIPv4 bool) []string {
+	var v4, v6 []string
+
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	first, second := v6, v4
+	if preferIPv4 || (len(addrs) > 0 && net.ParseIP(addrs[0]).To4() != nil) {
+		first, second = v4, v6
+	}
+
+	sorted := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+
+	return sorted
+}
+
+func sameFamily(addrs []string, local net.IP) []string {
+	var same []string
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip != nil && (ip.To4() != nil) == (local.To4() != nil) {
+			same = append(same, addr)
+		}
+	}
+
+	return same
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// raceDial starts a connection attempt on each address in turn, the next one
+// starting when the previous fails or after delay, and returns the first
+// established connection.
+func raceDial(dialer *net.Dialer, addrs []string, port string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	start := func(addr string) {
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	var errs []error
+
+	start(addrs[0])
+	next, pending := 1, 1
+
+	for {
+		var timer <-chan time.Time
+		if next < len(addrs) {
+			timer = time.After(delay)
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the losers as they come in
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				pending++
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-timer:
+			start(addrs[next])
+			next++
+			pending++
+		}
+	}
+}
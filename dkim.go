@@ -0,0 +1,205 @@
+package rmailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// headerField is a raw header field as found in a message, continuation lines
+// and trailing CRLF included.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// splitMessage splits a rendered message into its header fields and body.
+func splitMessage(raw []byte) ([]headerField, []byte, error) {
+	var fields []headerField
+
+	for len(raw) > 0 {
+		end := bytes.Index(raw, []byte("\r\n"))
+		if end < 0 {
+			return nil, nil, errors.New("rmailer: message header is not CRLF terminated")
+		}
+
+		if end == 0 {
+			return fields, raw[2:], nil
+		}
+
+		line := string(raw[:end+2])
+		raw = raw[end+2:]
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) == 0 {
+				return nil, nil, errors.New("rmailer: message starts with a continuation line")
+			}
+			fields[len(fields)-1].raw += line
+			continue
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, nil, fmt.Errorf("rmailer: malformed header line %q", strings.TrimSpace(line))
+		}
+
+		fields = append(fields, headerField{name: strings.TrimSpace(line[:colon]), raw: line})
+	}
+
+	return fields, nil, nil
+}
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm of
+// RFC 6376 section 3.4.2.
+func relaxedHeader(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimSpace(raw[:colon]))
+
+	value := strings.NewReplacer("\r\n", "").Replace(raw[colon+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes a body with the "relaxed" algorithm of RFC 6376
+// section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	buf := bytes.NewBuffer(nil)
+	empty := 0
+
+	for i, line := range lines {
+		if i == len(lines)-1 && len(line) == 0 {
+			break
+		}
+
+		line = strings.TrimRightFunc(line, isWSP)
+		if len(line) == 0 {
+			empty++
+			continue
+		}
+
+		for ; empty > 0; empty-- {
+			buf.WriteString("\r\n")
+		}
+
+		// reduce runs of whitespace to a single space, byte by byte as 8bit
+		// bodies need not be valid UTF-8
+		var previousWSP bool
+		for i := 0; i < len(line); i++ {
+			if c := line[i]; c == ' ' || c == '\t' {
+				if !previousWSP {
+					buf.WriteByte(' ')
+				}
+				previousWSP = true
+				continue
+			}
+
+			previousWSP = false
+			buf.WriteByte(line[i])
+		}
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// bodyHash returns the base64 SHA-256 of the relaxed body.
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(relaxedBody(body))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selectHeaders picks the fields named by names, each occurrence of a name
+// selecting the next instance from the bottom of the header (RFC 6376
+// section 5.4.2). Names without a remaining instance are skipped.
+func selectHeaders(fields []headerField, names []string) []headerField {
+	used := make(map[int]bool)
+	var selected []headerField
+
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// presentHeaders filters names down to the headers present in fields, one
+// entry per occurrence.
+func presentHeaders(fields []headerField, names []string) []string {
+	var present []string
+
+	for _, name := range names {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, name) {
+				present = append(present, strings.ToLower(name))
+			}
+		}
+	}
+
+	return present
+}
+
+// signatureAlgorithm returns the a= tag value matching signer.
+func signatureAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("rmailer: unsupported signing key %T", signer.Public())
+	}
+}
+
+// sign signs the SHA-256 digest of data and returns the base64 signature.
+func sign(signer crypto.Signer, data []byte) (string, error) {
+	digest := sha256.Sum256(data)
+
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		// ed25519-sha256 signs the digest itself (RFC 8463)
+		opts = crypto.Hash(0)
+	}
+
+	sig, err := signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// parseTags parses a tag=value list as used by DKIM and ARC headers.
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, tag := range strings.Split(value, ";") {
+		name, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+
+		v = strings.Join(strings.Fields(v), "")
+		tags[strings.TrimSpace(name)] = v
+	}
+
+	return tags
+}
@@ -0,0 +1,105 @@
+package rmailer_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// signDKIM returns the message of header and body signed with key, header
+// being canonicalized as simple and the body hashed as canonical, the
+// relaxed canonicalization of body computed by hand.
+func signDKIM(t *testing.T, key ed25519.PrivateKey, header string, body string, canonical string) []byte {
+	t.Helper()
+
+	bh := sha256.Sum256([]byte(canonical))
+	field := "DKIM-Signature: v=1; a=ed25519-sha256; c=simple/relaxed; d=toto.fr; s=sel;\r\n" +
+		" h=from:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+
+	digest := sha256.Sum256([]byte(header + field))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest[:]))
+
+	return []byte(field + signature + "\r\n" + header + "\r\n" + body)
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := &fakeDNS{txt: map[string][]string{
+		"sel._domainkey.toto.fr": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)},
+	}}
+
+	header := "From: me@toto.fr\r\nSubject: Hello\r\n"
+
+	for _, c := range []struct {
+		name      string
+		body      string
+		canonical string
+		tamper    func(raw string) string
+		err       string
+	}{
+		{name: "valid", body: "Hello  world \r\n\r\n", canonical: "Hello world\r\n"},
+		// an 8bit Latin-1 body is hashed byte for byte
+		{name: "latin-1", body: "Caf\xe9 \t cr\xe8me\r\n", canonical: "Caf\xe9 cr\xe8me\r\n"},
+		{
+			name: "body changed", body: "Hello world\r\n", canonical: "Hello world\r\n",
+			tamper: func(raw string) string { return strings.Replace(raw, "world", "there", 1) },
+			err:    "body hash mismatch",
+		},
+		{
+			name: "subject changed", body: "Hello world\r\n", canonical: "Hello world\r\n",
+			tamper: func(raw string) string { return strings.Replace(raw, "Subject: Hello", "Subject: Win", 1) },
+			err:    "signature mismatch",
+		},
+		{
+			name: "unsigned header added", body: "Hello world\r\n", canonical: "Hello world\r\n",
+			tamper: func(raw string) string { return strings.Replace(raw, "\r\n\r\n", "\r\nX-Spam: no\r\n\r\n", 1) },
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			raw := string(signDKIM(t, private, header, c.body, c.canonical))
+			if c.tamper != nil {
+				raw = c.tamper(raw)
+			}
+
+			verifications, err := rmailer.VerifyDKIM(context.Background(), dns, []byte(raw))
+			if err != nil || len(verifications) != 1 {
+				t.Fatalf("VerifyDKIM = %d verification(s), %v", len(verifications), err)
+			}
+
+			v := verifications[0]
+			if v.Domain != "toto.fr" || !v.Signed("Subject") || v.Signed("X-Spam") {
+				t.Errorf("verification = %+v", v)
+			}
+
+			switch {
+			case len(c.err) == 0 && !v.Valid():
+				t.Errorf("signature not valid: %v", v.Err)
+			case len(c.err) > 0 && (v.Valid() || !strings.Contains(v.Err.Error(), c.err)):
+				t.Errorf("Err = %v, want %q", v.Err, c.err)
+			}
+		})
+	}
+}
+
+func TestVerifyDKIMRevokedKey(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := &fakeDNS{txt: map[string][]string{"sel._domainkey.toto.fr": {"v=DKIM1; k=ed25519; p="}}}
+
+	raw := signDKIM(t, private, "From: me@toto.fr\r\nSubject: Hello\r\n", "Hello\r\n", "Hello\r\n")
+
+	verifications, err := rmailer.VerifyDKIM(context.Background(), dns, raw)
+	if err != nil || len(verifications) != 1 || verifications[0].Valid() {
+		t.Fatalf("VerifyDKIM = %+v, %v, want an invalid signature", verifications, err)
+	}
+}
@@ -0,0 +1,278 @@
+package rmailer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMVerification is the outcome of the verification of one DKIM-Signature
+// of a message.
+type DKIMVerification struct {
+	Domain    string
+	Selector  string
+	Algorithm string
+	// Headers are the headers signed, lower case, in the order of the h=
+	// tag. Headers of the message missing from it can be changed or added
+	// without breaking the signature.
+	Headers []string
+	// PartialBody reports a signature limited by l= to the beginning of the
+	// body, which allows content to be appended.
+	PartialBody bool
+	// Err is nil when the signature is valid.
+	Err error
+}
+
+// Valid reports whether the signature verified.
+func (v *DKIMVerification) Valid() bool {
+	return v.Err == nil
+}
+
+// Signed reports whether the header name is covered by the signature.
+func (v *DKIMVerification) Signed(name string) bool {
+	for _, h := range v.Headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyDKIM verifies the DKIM signatures (RFC 6376) of the rendered message
+// raw, as read from an .eml file or received for relaying, in the order of
+// its DKIM-Signature headers. The keys are looked up with resolver,
+// net.DefaultResolver when nil. An error is returned only when raw cannot be
+// parsed; a message without signature yields none.
+func VerifyDKIM(ctx context.Context, resolver DNSResolver, raw []byte) ([]DKIMVerification, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	raw = toCRLF(raw)
+
+	fields, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifications []DKIMVerification
+
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+
+		v := DKIMVerification{}
+		v.Err = verifySignature(ctx, resolver, &v, f, fields, body)
+		verifications = append(verifications, v)
+	}
+
+	return verifications, nil
+}
+
+// toCRLF converts bare LF line endings, frequent in .eml files, to CRLF.
+func toCRLF(raw []byte) []byte {
+	if !bytes.Contains(raw, []byte("\n")) || bytes.Count(raw, []byte("\r\n")) == bytes.Count(raw, []byte("\n")) {
+		return raw
+	}
+
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
+
+func verifySignature(ctx context.Context, resolver DNSResolver, v *DKIMVerification, sig headerField, fields []headerField, body []byte) error {
+	_, value, _ := strings.Cut(sig.raw, ":")
+	tags := parseTags(value)
+
+	v.Domain, v.Selector, v.Algorithm = strings.ToLower(tags["d"]), tags["s"], tags["a"]
+
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			v.Headers = append(v.Headers, strings.ToLower(name))
+		}
+	}
+
+	if tags["v"] != "1" {
+		return errors.New("rmailer: DKIM signature version is not 1")
+	}
+	if len(v.Domain) == 0 || len(v.Selector) == 0 || len(tags["b"]) == 0 || len(tags["bh"]) == 0 {
+		return errors.New("rmailer: DKIM signature lacks a required tag")
+	}
+	if !v.Signed("From") {
+		return errors.New("rmailer: DKIM signature does not cover From")
+	}
+	if identity := strings.ToLower(tags["i"]); len(identity) > 0 {
+		if domain := addressDomain(identity); domain != v.Domain && !strings.HasSuffix(domain, "."+v.Domain) {
+			return fmt.Errorf("rmailer: DKIM identity %s is outside %s", identity, v.Domain)
+		}
+	}
+	if expires, err := strconv.ParseInt(tags["x"], 10, 64); err == nil && time.Now().Unix() > expires {
+		return errors.New("rmailer: DKIM signature expired")
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if len(headerCanon) == 0 {
+		headerCanon = "simple"
+	}
+	if len(bodyCanon) == 0 {
+		bodyCanon = "simple"
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return fmt.Errorf("rmailer: unknown DKIM canonicalization %s", tags["c"])
+	}
+
+	// body hash
+	canonical := simpleBody(body)
+	if bodyCanon == "relaxed" {
+		canonical = relaxedBody(body)
+	}
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 || length > int64(len(canonical)) {
+			return fmt.Errorf("rmailer: invalid DKIM body length %s", l)
+		}
+		v.PartialBody = length < int64(len(canonical))
+		canonical = canonical[:length]
+	}
+
+	if v.Algorithm != "rsa-sha256" && v.Algorithm != "ed25519-sha256" {
+		return fmt.Errorf("rmailer: unsupported DKIM algorithm %s", v.Algorithm)
+	}
+
+	sum := sha256.Sum256(canonical)
+	if base64.StdEncoding.EncodeToString(sum[:]) != tags["bh"] {
+		return errors.New("rmailer: DKIM body hash mismatch, the body was changed")
+	}
+
+	// header hash, the signature field itself last without its b= value
+	canonHeader := func(raw string) string {
+		if headerCanon == "relaxed" {
+			return relaxedHeader(raw)
+		}
+		return raw
+	}
+
+	data := bytes.NewBuffer(nil)
+	for _, f := range selectHeaders(fields, v.Headers) {
+		data.WriteString(canonHeader(f.raw))
+	}
+	data.WriteString(strings.TrimSuffix(canonHeader(withoutSignature(sig.raw)), "\r\n"))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.New("rmailer: invalid DKIM signature encoding")
+	}
+
+	key, err := lookupDKIMKey(ctx, resolver, v.Selector, v.Domain)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data.Bytes())
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if v.Algorithm != "rsa-sha256" {
+			return errors.New("rmailer: DKIM key does not match the algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("rmailer: DKIM signature mismatch, signed headers were changed")
+		}
+	case ed25519.PublicKey:
+		if v.Algorithm != "ed25519-sha256" {
+			return errors.New("rmailer: DKIM key does not match the algorithm")
+		}
+		if !ed25519.Verify(key, digest[:], signature) {
+			return errors.New("rmailer: DKIM signature mismatch, signed headers were changed")
+		}
+	}
+
+	return nil
+}
+
+// simpleBody canonicalizes a body with the "simple" algorithm of RFC 6376
+// section 3.4.3: trailing empty lines are removed, and a final CRLF added.
+func simpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+
+	return append(body[:len(body):len(body)], "\r\n"...)
+}
+
+// withoutSignature empties the b= tag value of a raw DKIM-Signature field.
+func withoutSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	tags := strings.Split(raw[colon+1:], ";")
+
+	for i, tag := range tags {
+		name, _, ok := strings.Cut(tag, "=")
+		if ok && strings.TrimSpace(name) == "b" {
+			tags[i] = name + "="
+			if strings.HasSuffix(tag, "\r\n") {
+				tags[i] += "\r\n"
+			}
+		}
+	}
+
+	return raw[:colon+1] + strings.Join(tags, ";")
+}
+
+// lookupDKIMKey returns the public key published under selector for domain.
+func lookupDKIMKey(ctx context.Context, resolver DNSResolver, selector string, domain string) (crypto.PublicKey, error) {
+	host := selector + "._domainkey." + domain
+
+	txts, err := resolver.LookupTXT(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: DKIM key lookup of %s failed: %w", host, err)
+	}
+
+	tags := parseTags(strings.Join(txts, ""))
+	p, ok := tags["p"]
+
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("rmailer: no DKIM key at %s", host)
+	case len(p) == 0:
+		return nil, fmt.Errorf("rmailer: DKIM key at %s is revoked", host)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: invalid DKIM key at %s", host)
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			if key, err = x509.ParsePKCS1PublicKey(b); err != nil {
+				return nil, fmt.Errorf("rmailer: invalid DKIM key at %s", host)
+			}
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("rmailer: invalid DKIM key at %s", host)
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("rmailer: invalid DKIM key at %s", host)
+		}
+		return ed25519.PublicKey(b), nil
+	default:
+		return nil, fmt.Errorf("rmailer: unsupported DKIM key type %s at %s", tags["k"], host)
+	}
+}
@@ -0,0 +1,327 @@
+package rmailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+)
+
+// DNSResolver looks up the records checked by Doctor. *net.Resolver
+// implements it.
+type DNSResolver interface {
+	Resolver
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// CheckStatus is the outcome of a Check.
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+	// CheckSkip reports a check which could not be made, e.g. for lack of a
+	// DKIM selector.
+	CheckSkip CheckStatus = "skip"
+)
+
+// Check is the outcome of one diagnostic.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// Diagnosis is the report of Doctor.Run.
+type Diagnosis struct {
+	Checks []Check
+}
+
+// OK reports whether no check failed.
+func (d *Diagnosis) OK() bool {
+	for _, check := range d.Checks {
+		if check.Status == CheckFail {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WriteTo writes the report as a table, one check per line.
+func (d *Diagnosis) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	tw := tabwriter.NewWriter(cw, 0, 8, 2, ' ', 0)
+
+	for _, check := range d.Checks {
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\n", check.Status, check.Name, check.Detail)
+	}
+
+	err := tw.Flush()
+	return cw.n, err
+}
+
+func (d *Diagnosis) add(name string, status CheckStatus, format string, args ...any) {
+	d.Checks = append(d.Checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Doctor diagnoses the deliverability of the mail of Domain sent through
+// Sender: its SPF, DKIM and DMARC records, the connection, encryption and
+// authentication to the relay, and the reverse DNS of the sending IP.
+type Doctor struct {
+	Sender *Sender
+	// Domain is the From domain.
+	Domain string
+	// DKIMSelectors are the DKIM keys to check.
+	DKIMSelectors []string
+	// SourceIP is the public IP of the outgoing mail, Sender.LocalAddr or
+	// the local address of the relay connection when nil.
+	SourceIP net.IP
+	// Resolver looks up the records, net.DefaultResolver when nil.
+	Resolver DNSResolver
+}
+
+// Run makes every check, the relay ones only when Sender is set.
+func (d *Doctor) Run(ctx context.Context) *Diagnosis {
+	diag := &Diagnosis{}
+	domain := strings.ToLower(strings.TrimSuffix(d.Domain, "."))
+
+	d.checkSPF(ctx, diag, domain)
+	d.checkDKIM(ctx, diag, domain)
+	d.checkDMARC(ctx, diag, domain)
+
+	source := d.SourceIP
+	if d.Sender != nil {
+		local := d.checkRelay(diag)
+		if source == nil {
+			source = d.Sender.LocalAddr
+		}
+		if source == nil {
+			source = local
+		}
+	}
+	d.checkPTR(ctx, diag, source)
+	d.checkSPFSource(ctx, diag, domain, source)
+
+	return diag
+}
+
+func (d *Doctor) resolver() DNSResolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return d.Resolver
+}
+
+// lookupRecords returns the TXT records of name which match.
+func (d *Doctor) lookupRecords(ctx context.Context, name string, match func(txt string) bool) ([]string, error) {
+	txts, err := d.resolver().LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if match(txt) {
+			records = append(records, txt)
+		}
+	}
+
+	return records, nil
+}
+
+func isSPFRecord(txt string) bool {
+	version, _, _ := strings.Cut(txt, " ")
+	return strings.EqualFold(version, "v=spf1")
+}
+
+func isDMARCRecord(txt string) bool {
+	version, _, _ := strings.Cut(txt, ";")
+	return strings.EqualFold(strings.TrimSpace(version), "v=DMARC1")
+}
+
+func (d *Doctor) checkSPF(ctx context.Context, diag *Diagnosis, domain string) {
+	records, err := d.lookupRecords(ctx, domain, isSPFRecord)
+
+	switch {
+	case err != nil:
+		diag.add("SPF", CheckFail, "lookup of %s failed: %s", domain, err)
+	case len(records) == 0:
+		diag.add("SPF", CheckFail, "no SPF record for %s", domain)
+	case len(records) > 1:
+		diag.add("SPF", CheckFail, "%d SPF records for %s, receivers treat it as an error", len(records), domain)
+	case strings.HasSuffix(strings.ToLower(records[0]), " +all") || strings.HasSuffix(strings.ToLower(records[0]), " all"):
+		diag.add("SPF", CheckWarn, "%s permits any host", records[0])
+	default:
+		diag.add("SPF", CheckOK, "%s", records[0])
+	}
+}
+
+// checkSPFSource evaluates the SPF record of domain against the sending IP.
+func (d *Doctor) checkSPFSource(ctx context.Context, diag *Diagnosis, domain string, ip net.IP) {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		diag.add("SPF IP", CheckSkip, "public sending IP unknown")
+		return
+	}
+
+	result, err := CheckSPF(ctx, d.resolver(), ip, domain, "")
+
+	switch result {
+	case SPFPass:
+		diag.add("SPF IP", CheckOK, "%s is permitted", ip)
+	case SPFFail, SPFSoftFail:
+		diag.add("SPF IP", CheckFail, "%s is not permitted (%s)", ip, result)
+	case SPFTempError, SPFPermError:
+		diag.add("SPF IP", CheckFail, "%s", err)
+	default:
+		diag.add("SPF IP", CheckWarn, "%s is %s", ip, result)
+	}
+}
+
+func (d *Doctor) checkDKIM(ctx context.Context, diag *Diagnosis, domain string) {
+	if len(d.DKIMSelectors) == 0 {
+		diag.add("DKIM", CheckSkip, "no selector to check")
+		return
+	}
+
+	for _, selector := range d.DKIMSelectors {
+		name := "DKIM " + selector
+		host := selector + "._domainkey." + domain
+
+		txts, err := d.lookupRecords(ctx, host, func(string) bool { return true })
+		if err != nil {
+			diag.add(name, CheckFail, "lookup of %s failed: %s", host, err)
+			continue
+		}
+
+		tags := parseTags(strings.Join(txts, ""))
+		key, ok := tags["p"]
+
+		switch {
+		case !ok:
+			diag.add(name, CheckFail, "no DKIM key at %s", host)
+		case len(key) == 0:
+			diag.add(name, CheckFail, "key at %s is revoked", host)
+		case tags["t"] == "y":
+			diag.add(name, CheckWarn, "key at %s is in test mode", host)
+		default:
+			algorithm := tags["k"]
+			if len(algorithm) == 0 {
+				algorithm = "rsa"
+			}
+			diag.add(name, CheckOK, "%s key at %s", algorithm, host)
+		}
+	}
+}
+
+func (d *Doctor) checkDMARC(ctx context.Context, diag *Diagnosis, domain string) {
+	host := "_dmarc." + domain
+	records, err := d.lookupRecords(ctx, host, isDMARCRecord)
+
+	if err == nil && len(records) == 0 {
+		if org := organizationalDomain(domain); org != domain {
+			host = "_dmarc." + org
+			records, err = d.lookupRecords(ctx, host, isDMARCRecord)
+		}
+	}
+
+	switch {
+	case err != nil:
+		diag.add("DMARC", CheckFail, "lookup of %s failed: %s", host, err)
+	case len(records) == 0:
+		diag.add("DMARC", CheckFail, "no DMARC record for %s", domain)
+	case len(records) > 1:
+		diag.add("DMARC", CheckFail, "%d DMARC records at %s", len(records), host)
+	default:
+		policy := parseTags(records[0])["p"]
+		switch policy {
+		case "reject", "quarantine":
+			diag.add("DMARC", CheckOK, "policy %s at %s", policy, host)
+		case "none":
+			diag.add("DMARC", CheckWarn, "policy none at %s, failures are only reported", host)
+		default:
+			diag.add("DMARC", CheckFail, "invalid policy %q at %s", policy, host)
+		}
+	}
+}
+
+// checkRelay opens a session with the relay and returns the local IP of the
+// connection.
+func (d *Doctor) checkRelay(diag *Diagnosis) net.IP {
+	s := d.Sender
+
+	c, err := s.client()
+	if err != nil {
+		diag.add("Relay", CheckFail, "%s: %s", s.Host, err)
+		return nil
+	}
+	defer c.Close()
+
+	diag.add("Relay", CheckOK, "connected to %s", s.Host)
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		diag.add("TLS", CheckOK, "%s", tls.VersionName(tlsConn.ConnectionState().Version))
+	} else if tlsOK, _ := c.Extension("STARTTLS"); tlsOK {
+		diag.add("TLS", CheckWarn, "session not encrypted, the relay offers STARTTLS")
+	} else {
+		diag.add("TLS", CheckWarn, "session not encrypted, the relay offers no STARTTLS")
+	}
+
+	if s.IsAuthenticated() {
+		diag.add("AUTH", CheckOK, "accepted")
+	} else {
+		diag.add("AUTH", CheckSkip, "no credentials")
+	}
+
+	c.quit()
+
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
+
+func (d *Doctor) checkPTR(ctx context.Context, diag *Diagnosis, ip net.IP) {
+	switch {
+	case ip == nil:
+		diag.add("PTR", CheckSkip, "sending IP unknown")
+		return
+	case ip.IsLoopback() || ip.IsPrivate():
+		diag.add("PTR", CheckSkip, "%s is not public, set the public sending IP", ip)
+		return
+	}
+
+	names, err := d.resolver().LookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		diag.add("PTR", CheckFail, "no PTR record for %s", ip)
+		return
+	}
+
+	for _, name := range names {
+		addrs, err := d.resolver().LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				diag.add("PTR", CheckOK, "%s is %s", ip, name)
+				return
+			}
+		}
+	}
+
+	diag.add("PTR", CheckWarn, "%s is %s, which does not resolve back to it", ip, names[0])
+}
@@ -0,0 +1,153 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// NullReversePath, set as Message.EnvelopeFrom, sends the message with an
+// empty MAIL FROM, as required for delivery status notifications.
+const NullReversePath = "<>"
+
+// DeliveryReport describes a delivery status notification (RFC 3464).
+type DeliveryReport struct {
+	// ReportingMTA is the host name of the MTA issuing the report.
+	ReportingMTA string
+	// ArrivalDate is when the original message was received, if known.
+	ArrivalDate time.Time
+	// Explanation is the human readable part, a default one being written
+	// when empty.
+	Explanation string
+	// Recipients holds the status of each reported recipient.
+	Recipients []Bounce
+	// Original is the original message, of which only the header is
+	// returned unless ReturnContent is set.
+	Original      []byte
+	ReturnContent bool
+}
+
+// NewDSN returns the notification of report, sent from from to the
+// original envelope sender to, with a null reverse path.
+func NewDSN(from mail.Address, to string, report DeliveryReport) (*Message, error) {
+	if len(report.Recipients) == 0 {
+		return nil, fmt.Errorf("rmailer: delivery report without recipients")
+	}
+
+	failed := false
+	for _, r := range report.Recipients {
+		failed = failed || strings.EqualFold(r.Action, "failed")
+	}
+
+	subject := "Delivery Status Notification (Delay)"
+	if failed {
+		subject = "Delivery Status Notification (Failure)"
+	}
+
+	m := NewMessage(subject, "", "")
+	m.From = from
+	m.To = []mail.Address{{Address: to}}
+	m.EnvelopeFrom = NullReversePath
+	m.SetHeader("Auto-Submitted", "auto-replied")
+
+	explanation := report.Explanation
+	if len(explanation) == 0 {
+		explanation = defaultExplanation(report.Recipients, failed)
+	}
+
+	parts := []*Part{
+		newTextPart(explanation, ContentTypeTextPlain, "", ""),
+		deliveryStatusPart(report),
+	}
+
+	if len(report.Original) > 0 {
+		parts = append(parts, originalPart(report.Original, report.ReturnContent))
+	}
+
+	m.AddPart(NewMultipart("multipart/report; report-type=delivery-status", parts...))
+
+	return m, nil
+}
+
+func defaultExplanation(recipients []Bounce, failed bool) string {
+	buf := bytes.NewBuffer(nil)
+
+	if failed {
+		buf.WriteString("Your message could not be delivered to the following recipients:\n\n")
+	} else {
+		buf.WriteString("Delivery of your message to the following recipients is delayed:\n\n")
+	}
+
+	for _, r := range recipients {
+		buf.WriteString("  " + r.Recipient)
+		if len(r.Diagnostic) > 0 {
+			buf.WriteString(": " + r.Diagnostic)
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.String()
+}
+
+// deliveryStatusPart renders the per-message and per-recipient fields, as
+// message/global-delivery-status (RFC 6533) when they are not ASCII.
+func deliveryStatusPart(report DeliveryReport) *Part {
+	buf := bytes.NewBuffer(nil)
+
+	fmt.Fprintf(buf, "Reporting-MTA: dns; %s\r\n", report.ReportingMTA)
+	if !report.ArrivalDate.IsZero() {
+		fmt.Fprintf(buf, "Arrival-Date: %s\r\n", report.ArrivalDate.Format(time.RFC1123Z))
+	}
+
+	for _, r := range report.Recipients {
+		status := r.Status
+		if len(status) == 0 {
+			status = "5.0.0"
+			if !strings.EqualFold(r.Action, "failed") {
+				status = "4.0.0"
+			}
+		}
+
+		buf.WriteString(BackLine)
+		fmt.Fprintf(buf, "Final-Recipient: rfc822; %s\r\n", r.Recipient)
+		fmt.Fprintf(buf, "Action: %s\r\n", strings.ToLower(r.Action))
+		fmt.Fprintf(buf, "Status: %s\r\n", status)
+		if len(r.Diagnostic) > 0 {
+			fmt.Fprintf(buf, "Diagnostic-Code: smtp; %s\r\n", r.Diagnostic)
+		}
+	}
+
+	contentType, encoding := "message/delivery-status", Encoding7Bit
+	if !isASCII(buf.String()) {
+		contentType, encoding = "message/global-delivery-status", Encoding8Bit
+	}
+
+	p := NewPart(contentType, buf.Bytes())
+	p.Header.Set("Content-Transfer-Encoding", string(encoding))
+	return p
+}
+
+// originalPart returns the original message, or its header only, which
+// must not be transfer encoded.
+func originalPart(original []byte, content bool) *Part {
+	original = normalizeCRLF(original)
+
+	contentType := "message/rfc822"
+	if !content {
+		contentType = "text/rfc822-headers"
+		if end := bytes.Index(original, []byte("\r\n\r\n")); end >= 0 {
+			original = original[:end+2]
+		}
+	}
+
+	encoding := Encoding7Bit
+	if !isASCII(string(original)) {
+		encoding = Encoding8Bit
+	}
+
+	p := NewPart(contentType, original)
+	p.Header.Set("Content-Transfer-Encoding", string(encoding))
+	return p
+}
@@ -0,0 +1,115 @@
+package rmailer
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// imgSrcPattern matches the src attribute of img elements.
+var imgSrcPattern = regexp.MustCompile(`(?is)(<img\b[^>]*?\bsrc\s*=\s*)("[^"]*"|'[^']*')`)
+
+// EmbedLocalImages embeds the images of the HTML body referenced by
+// relative path, resolved against dir, and rewrites their src to the
+// matching cid: URL. Each file is embedded once. Remote, data: and cid:
+// sources are left alone. Absolute paths, file:// URLs and paths escaping
+// dir are refused, so that HTML from users cannot mail arbitrary local
+// files, unless EmbedAnyFile is given.
+func (m *Message) EmbedLocalImages(dir string, opts ...EmbedOption) error {
+	var o embedOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	embedded := make(map[string]string)
+	attachments := len(m.Attachments)
+	var err error
+
+	body := imgSrcPattern.ReplaceAllStringFunc(m.BodyHtml, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		groups := imgSrcPattern.FindStringSubmatch(match)
+		quoted := groups[2]
+		src := html.UnescapeString(quoted[1 : len(quoted)-1])
+
+		path, local, confined := localImagePath(src, dir)
+		if !local {
+			return match
+		}
+		if !confined && !o.anyFile {
+			err = fmt.Errorf("rmailer: image %s is outside %s", src, dir)
+			return match
+		}
+
+		id, ok := embedded[path]
+		if !ok {
+			id, err = m.EmbedFile(path)
+			if err != nil {
+				err = fmt.Errorf("rmailer: embedding %s: %w", src, err)
+				return match
+			}
+			embedded[path] = id
+		}
+
+		return groups[1] + `"cid:` + id + `"`
+	})
+
+	if err != nil {
+		// leave the message as it was
+		m.Attachments = m.Attachments[:attachments]
+		return err
+	}
+
+	m.BodyHtml = body
+	return nil
+}
+
+// EmbedOption modifies the behavior of Message.EmbedLocalImages.
+type EmbedOption func(o *embedOptions)
+
+type embedOptions struct {
+	anyFile bool
+}
+
+// EmbedAnyFile lets EmbedLocalImages embed absolute paths, file:// URLs and
+// paths outside its directory, for HTML which is trusted.
+func EmbedAnyFile() EmbedOption {
+	return func(o *embedOptions) {
+		o.anyFile = true
+	}
+}
+
+// localImagePath returns the file referenced by src, if it is a local one,
+// and whether it is a relative path confined to dir.
+func localImagePath(src string, dir string) (string, bool, bool) {
+	src = strings.TrimSpace(src)
+	if len(src) == 0 || strings.HasPrefix(src, "#") {
+		return "", false, false
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false, false
+	}
+
+	switch {
+	case strings.EqualFold(u.Scheme, "file"):
+		return filepath.FromSlash(u.Path), len(u.Path) > 0, false
+	case len(u.Scheme) > 0 || len(u.Host) > 0:
+		// remote, data: or cid: URL, or protocol-relative //host/path
+		return "", false, false
+	}
+
+	path := filepath.FromSlash(u.Path)
+	if filepath.IsAbs(path) {
+		return path, true, false
+	}
+
+	// IsLocal rejects the paths escaping dir once cleaned, e.g. ../x
+	return filepath.Join(dir, path), true, filepath.IsLocal(path)
+}
@@ -0,0 +1,279 @@
+package rmailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"sync"
+)
+
+// TransferEncoding is a Content-Transfer-Encoding value.
+type TransferEncoding string
+
+const (
+	EncodingBase64          TransferEncoding = "base64"
+	EncodingQuotedPrintable TransferEncoding = "quoted-printable"
+	Encoding7Bit            TransferEncoding = "7bit"
+	Encoding8Bit            TransferEncoding = "8bit"
+)
+
+// maxLineLength is the line length recommended by RFC 5322, above which
+// bodies are not sent as 7bit.
+const maxLineLength = 78
+
+// chooseEncoding picks 7bit for ASCII text with short lines, quoted-printable
+// for mostly ASCII text and base64 for everything else.
+func chooseEncoding(content []byte) TransferEncoding {
+	var special, lineLength int
+	var longLines bool
+
+	for _, b := range content {
+		switch {
+		case b == '\n':
+			lineLength = 0
+			continue
+		case b == '\r':
+			continue
+		case b >= 0x80, b < 0x20 && b != '\t':
+			special++
+		}
+
+		lineLength++
+		if lineLength > maxLineLength {
+			longLines = true
+		}
+	}
+
+	switch {
+	case special == 0 && !longLines:
+		return Encoding7Bit
+	case special*6 < len(content):
+		// quoted-printable triples special bytes, it stays smaller than
+		// base64 while they are less than about a sixth of the content
+		return EncodingQuotedPrintable
+	default:
+		return EncodingBase64
+	}
+}
+
+// maxWireLineLength is the hard limit of RFC 5321 on line length, CRLF
+// excluded.
+const maxWireLineLength = 998
+
+// wireSafeEncoding returns encoding, unless it would put content on the wire
+// with lines over 998 octets or, for 7bit, with 8-bit data, in which case
+// quoted-printable is used instead.
+func wireSafeEncoding(content []byte, encoding TransferEncoding) TransferEncoding {
+	if encoding != Encoding7Bit && encoding != Encoding8Bit {
+		return encoding
+	}
+
+	var lineLength int
+
+	for _, b := range content {
+		switch {
+		case b == '\n':
+			lineLength = 0
+			continue
+		case b == '\r':
+			continue
+		case b >= 0x80 && encoding == Encoding7Bit:
+			return EncodingQuotedPrintable
+		}
+
+		lineLength++
+		if lineLength > maxWireLineLength {
+			return EncodingQuotedPrintable
+		}
+	}
+
+	return encoding
+}
+
+// normalizeCRLF converts bare LF and bare CR line endings to CRLF.
+func normalizeCRLF(content []byte) []byte {
+	if !bytes.ContainsAny(content, "\r\n") {
+		return content
+	}
+
+	out := make([]byte, 0, len(content)+len(content)/32)
+
+	for i := 0; i < len(content); i++ {
+		switch b := content[i]; b {
+		case '\r':
+			out = append(out, '\r', '\n')
+			if i+1 < len(content) && content[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Base64Wrapping configures the lines of base64 encoded content.
+type Base64Wrapping struct {
+	// LineLength is the length of the lines, CRLF excluded, 76 (the limit of
+	// RFC 2045) when zero. It is rounded down to a multiple of 4.
+	LineLength int
+	// LF ends the lines with LF instead of CRLF, for pipelines converting
+	// line endings themselves.
+	LF bool
+}
+
+// defaultBase64LineLength is the line length limit of RFC 2045.
+const defaultBase64LineLength = 76
+
+// base64FlushSize is the output buffered by base64Writer between writes.
+const base64FlushSize = 32 << 10
+
+// lineLength returns the effective line length, a multiple of 4.
+func (bw Base64Wrapping) lineLength() int {
+	n := bw.LineLength
+	if n <= 0 {
+		n = defaultBase64LineLength
+	}
+
+	return max(4, min(n, maxWireLineLength)/4*4)
+}
+
+func (bw Base64Wrapping) eol() string {
+	if bw.LF {
+		return "\n"
+	}
+
+	return BackLine
+}
+
+// encode writes content to w in the given transfer encoding. 7bit, 8bit and
+// the empty encoding write content unchanged.
+func encode(w io.Writer, content []byte, encoding TransferEncoding, wrapping Base64Wrapping) error {
+	return encodeReader(w, bytes.NewReader(content), encoding, wrapping)
+}
+
+// encodeReader encodes r to w as it is read, like encode.
+func encodeReader(w io.Writer, r io.Reader, encoding TransferEncoding, wrapping Base64Wrapping) error {
+	var ew io.WriteCloser
+
+	switch encoding {
+	case EncodingBase64:
+		ew = newBase64Writer(w, wrapping)
+	case EncodingQuotedPrintable:
+		ew = quotedprintable.NewWriter(w)
+	default:
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	if _, err := io.Copy(ew, r); err != nil {
+		ew.Close()
+		return err
+	}
+
+	return ew.Close()
+}
+
+// base64Writer encodes what is written to it in base64 lines. Close writes
+// the last line and must be called.
+type base64Writer struct {
+	w   io.Writer
+	in  int // input bytes per line
+	eol string
+	err error
+
+	pending []byte // input of the line being filled
+	out     []byte // encoded lines not written yet
+}
+
+var base64Buffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, base64FlushSize+maxWireLineLength+2)
+		return &b
+	},
+}
+
+func newBase64Writer(w io.Writer, wrapping Base64Wrapping) *base64Writer {
+	length := wrapping.lineLength()
+	out := base64Buffers.Get().(*[]byte)
+
+	return &base64Writer{
+		w:       w,
+		in:      length / 4 * 3,
+		eol:     wrapping.eol(),
+		pending: make([]byte, 0, length/4*3),
+		out:     (*out)[:0],
+	}
+}
+
+func (bw *base64Writer) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+
+	n := len(p)
+
+	if len(bw.pending) > 0 {
+		k := min(bw.in-len(bw.pending), len(p))
+		bw.pending = append(bw.pending, p[:k]...)
+		p = p[k:]
+
+		if len(bw.pending) < bw.in {
+			return n, nil
+		}
+
+		bw.line(bw.pending)
+		bw.pending = bw.pending[:0]
+	}
+
+	for ; len(p) >= bw.in && bw.err == nil; p = p[bw.in:] {
+		bw.line(p[:bw.in])
+	}
+
+	if bw.err != nil {
+		return 0, bw.err
+	}
+
+	bw.pending = append(bw.pending, p...)
+	return n, nil
+}
+
+// line encodes a line of input, writing the output once bw.out is full.
+func (bw *base64Writer) line(src []byte) {
+	bw.out = base64.StdEncoding.AppendEncode(bw.out, src)
+	bw.out = append(bw.out, bw.eol...)
+
+	if len(bw.out) >= base64FlushSize {
+		bw.flush()
+	}
+}
+
+func (bw *base64Writer) flush() {
+	if bw.err == nil && len(bw.out) > 0 {
+		_, bw.err = bw.w.Write(bw.out)
+	}
+	bw.out = bw.out[:0]
+}
+
+// Close writes the last line and returns the buffer to the pool.
+func (bw *base64Writer) Close() error {
+	if bw.out == nil {
+		return bw.err
+	}
+
+	if len(bw.pending) > 0 {
+		bw.line(bw.pending)
+		bw.pending = bw.pending[:0]
+	}
+	bw.flush()
+
+	out := bw.out[:0]
+	base64Buffers.Put(&out)
+	bw.out = nil
+
+	return bw.err
+}
@@ -0,0 +1,180 @@
+package rmailer
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the stage of the life of a message an Event reports.
+type EventType string
+
+const (
+	// EventQueued is published when Mailer.Enqueue accepts a message.
+	EventQueued EventType = "queued"
+	// EventAttempting is published before each attempt of a Sender.
+	EventAttempting EventType = "attempting"
+	// EventDelivered is published for each recipient which accepted the
+	// message.
+	EventDelivered EventType = "delivered"
+	// EventDeferred is published for each recipient which failed
+	// temporarily and is attempted again, by the Sender or the queue of a
+	// Mailer.
+	EventDeferred EventType = "deferred"
+	// EventFailed is published for each recipient which did not accept the
+	// message once the attempts are over.
+	EventFailed EventType = "failed"
+	// EventBounced is published by BounceProcessor for each recipient
+	// reported by a delivery status notification.
+	EventBounced EventType = "bounced"
+)
+
+// Event reports a step of the sending of a message.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// MessageID is the Message-ID of the message, without angle brackets,
+	// empty before it is sent or for bounces.
+	MessageID string
+	// Recipient is the recipient the event is about, empty for events about
+	// the whole message.
+	Recipient string
+	// Attempt counts the attempts of the message, from 1.
+	Attempt int
+	// Status is the recipient status of delivery events.
+	Status *RecipientStatus
+	// Bounce is the report of bounce events.
+	Bounce *Bounce
+	// Metadata is the Message.Metadata of the message, to correlate the
+	// events with the caller's entities.
+	Metadata map[string]string
+}
+
+// EventBus delivers the events published by Mailer, Sender and
+// BounceProcessor to subscribers, e.g. to update dashboards or drive sagas
+// without polling. A nil *EventBus publishes nothing.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// with room for buffer events, and a function ending the subscription and
+// closing the channel. Events are dropped for a subscriber whose buffer is
+// full, so that a slow subscriber never stalls the sends.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+// Publish sends e to the subscribers, dating it when its Time is zero.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishAttempt publishes a delivery event per recipient of an attempt,
+// those in retry being deferred and the other failures final.
+func (b *EventBus) publishAttempt(attempt int, statuses []RecipientStatus, retry []string, messageID string, metadata map[string]string) {
+	if b == nil {
+		return
+	}
+
+	deferred := make(map[string]bool, len(retry))
+	for _, rcpt := range retry {
+		deferred[rcpt] = true
+	}
+
+	for _, status := range statuses {
+		typ := EventFailed
+		switch {
+		case status.Accepted():
+			typ = EventDelivered
+		case deferred[status.Address]:
+			typ = EventDeferred
+		}
+
+		b.Publish(Event{
+			Type:      typ,
+			MessageID: messageID,
+			Recipient: status.Address,
+			Attempt:   attempt,
+			Status:    &status,
+			Metadata:  metadata,
+		})
+	}
+}
+
+// filterRecipients returns the statuses of statuses whose recipient is in
+// rcpts when keep is set, or is not otherwise.
+func filterRecipients(statuses []RecipientStatus, rcpts []string, keep bool) []RecipientStatus {
+	in := make(map[string]bool, len(rcpts))
+	for _, rcpt := range rcpts {
+		in[rcpt] = true
+	}
+
+	var filtered []RecipientStatus
+	for _, status := range statuses {
+		if in[status.Address] == keep {
+			filtered = append(filtered, status)
+		}
+	}
+
+	return filtered
+}
+
+// attemptStatuses returns the statuses of the recipients of an attempt,
+// derived from err when the attempt got no result.
+func attemptStatuses(rcpts []string, result *SendResult, err error) []RecipientStatus {
+	if result != nil {
+		return result.Recipients
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	code, msg := replyCode(err)
+	statuses := make([]RecipientStatus, len(rcpts))
+	for i, rcpt := range rcpts {
+		statuses[i] = RecipientStatus{Address: rcpt, Code: code, Message: msg}
+	}
+
+	return statuses
+}
@@ -0,0 +1,24 @@
+package rmailer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetFeedbackID adds the Feedback-ID header read by Gmail Postmaster Tools,
+// formatted as campaign:customer:mailType:senderID. senderID is required,
+// the other identifiers may be empty.
+func (m *Message) SetFeedbackID(campaign, customer, mailType, senderID string) error {
+	if len(senderID) == 0 {
+		return fmt.Errorf("rmailer: Feedback-ID requires a sender ID")
+	}
+
+	ids := []string{campaign, customer, mailType, senderID}
+	for _, id := range ids {
+		if strings.ContainsAny(id, ":\r\n") {
+			return fmt.Errorf("rmailer: Feedback-ID identifier %q contains a colon or a line break", id)
+		}
+	}
+
+	return m.SetHeader("Feedback-ID", strings.Join(ids, ":"))
+}
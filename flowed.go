@@ -0,0 +1,102 @@
+package rmailer
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// flowText wraps text as format=flowed; delsp=yes (RFC 3676): paragraphs
+// are cut into lines of at most 78 chars, each soft break being marked by a
+// trailing space which receivers delete when reflowing.
+func flowText(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	out := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		if line == "-- " {
+			// the signature delimiter keeps its trailing space
+			out = append(out, line)
+			continue
+		}
+
+		depth, rest := quoteDepth(line)
+		rest = strings.TrimRight(rest, " ")
+
+		prefix := strings.Repeat(">", depth)
+		if depth > 0 {
+			prefix += " "
+		}
+
+		// room for the prefix, a stuffed space and the soft break space
+		width := maxLineLength - utf8.RuneCountInString(prefix) - 2
+
+		for {
+			if utf8.RuneCountInString(rest) <= width {
+				out = append(out, prefix+spaceStuff(rest, depth))
+				break
+			}
+
+			cut := flowCut(rest, width)
+			out = append(out, prefix+spaceStuff(rest[:cut], depth)+" ")
+			rest = rest[cut:]
+		}
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// quoteDepth counts the quote marks starting line, written either ">>" or
+// "> >", and returns the rest of the line.
+func quoteDepth(line string) (int, string) {
+	depth := 0
+
+	for {
+		trimmed := line
+		if depth > 0 {
+			trimmed = strings.TrimPrefix(line, " ")
+		}
+
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+
+		line = trimmed[1:]
+		depth++
+	}
+
+	if depth > 0 {
+		line = strings.TrimPrefix(line, " ")
+	}
+
+	return depth, line
+}
+
+// spaceStuff protects unquoted lines which would otherwise be taken for
+// quoted, stuffed or mbox "From " lines.
+func spaceStuff(line string, depth int) string {
+	if depth == 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, ">") || strings.HasPrefix(line, "From ")) {
+		return " " + line
+	}
+
+	return line
+}
+
+// flowCut returns the byte offset at which to cut s so that the first line
+// holds at most width runes, after the last space when there is one.
+func flowCut(s string, width int) int {
+	limit, runes := len(s), 0
+	for i := range s {
+		if runes == width {
+			limit = i
+			break
+		}
+		runes++
+	}
+
+	if i := strings.LastIndexByte(s[:limit], ' '); i > 0 {
+		return i + 1
+	}
+
+	// a word longer than the line, delsp=yes lets it be split anywhere
+	return limit
+}
@@ -0,0 +1,68 @@
+package rmailer
+
+import (
+	"errors"
+	"net/smtp"
+)
+
+// GSSAPIContext is the client side of a GSS-API security context, typically
+// backed by the host's Kerberos credential cache.
+type GSSAPIContext interface {
+	// Step consumes the server token (nil on the first call) and returns the
+	// next client token, reporting whether the context is established.
+	Step(input []byte) (output []byte, established bool, err error)
+	Unwrap(input []byte) ([]byte, error)
+	Wrap(input []byte) ([]byte, error)
+}
+
+type gssapiAuth struct {
+	ctx         GSSAPIContext
+	authzid     string
+	established bool
+}
+
+// GSSAPIAuth returns an smtp.Auth running the SASL GSSAPI exchange (RFC 4752)
+// over ctx, to be set as Sender.Auth. No security layer is negotiated.
+func GSSAPIAuth(ctx GSSAPIContext, authzid string) smtp.Auth {
+	return &gssapiAuth{ctx: ctx, authzid: authzid}
+}
+
+func (a *gssapiAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	out, established, err := a.ctx.Step(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	a.established = established
+
+	return "GSSAPI", out, nil
+}
+
+func (a *gssapiAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	if !a.established {
+		out, established, err := a.ctx.Step(fromServer)
+		if err != nil {
+			return nil, err
+		}
+		a.established = established
+
+		return out, nil
+	}
+
+	if len(fromServer) == 0 {
+		return []byte{}, nil
+	}
+
+	layers, err := a.ctx.Unwrap(fromServer)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) != 4 || layers[0]&1 == 0 {
+		return nil, errors.New("gssapi: server does not offer the no-security layer")
+	}
+
+	return a.ctx.Wrap(append([]byte{1, 0, 0, 0}, a.authzid...))
+}
@@ -0,0 +1,249 @@
+package rmailer
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// HeaderPosition places a custom header relative to the standard ones
+// (From, To, Cc, Subject, MIME-Version).
+type HeaderPosition int
+
+const (
+	HeaderAfterStandard HeaderPosition = iota
+	HeaderBeforeStandard
+)
+
+// Header is a custom header field. Custom headers are written in insertion
+// order, which DKIM signatures and some filters depend on.
+type Header struct {
+	Name     string
+	Value    string
+	Position HeaderPosition
+}
+
+// AddHeader appends a custom header after the standard ones. Rendering fails
+// when name is not a valid field name or is one of the headers written from
+// the Message fields (From, To, Cc, Bcc, Subject) or its content
+// (MIME-Version, Content-Type, Content-Transfer-Encoding).
+func (m *Message) AddHeader(name string, value string) {
+	m.Headers = append(m.Headers, Header{Name: name, Value: value})
+}
+
+// AddHeaderBefore appends a custom header written before the standard ones,
+// e.g. for trace fields.
+func (m *Message) AddHeaderBefore(name string, value string) {
+	m.Headers = append(m.Headers, Header{Name: name, Value: value, Position: HeaderBeforeStandard})
+}
+
+// GetHeader returns the value of the first header called name, which may be a
+// standard header (From, To, Cc, Bcc, Subject) or a custom one.
+func (m *Message) GetHeader(name string) string {
+	switch {
+	case strings.EqualFold(name, "From"):
+		if len(m.From.Address) == 0 {
+			return ""
+		}
+		return m.From.String()
+	case strings.EqualFold(name, "To"):
+		return getRecipientsStr(m.To)
+	case strings.EqualFold(name, "Cc"):
+		return getRecipientsStr(m.CC)
+	case strings.EqualFold(name, "Bcc"):
+		return getRecipientsStr(m.BCC)
+	case strings.EqualFold(name, "Subject"):
+		return m.Subject
+	}
+
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+
+	return ""
+}
+
+// SetHeader replaces the value of the header called name. Standard headers
+// update the corresponding Message field, custom ones keep the position of
+// their first occurrence, other occurrences being removed, or are added when
+// missing. The MIME headers are derived from the content and cannot be set.
+func (m *Message) SetHeader(name string, value string) error {
+	var err error
+
+	switch {
+	case !validHeaderName(name):
+		return fmt.Errorf("rmailer: invalid header name %q", name)
+	case strings.EqualFold(name, "From"):
+		var from *mail.Address
+		if from, err = mail.ParseAddress(value); err == nil {
+			m.From = *from
+		}
+		return err
+	case strings.EqualFold(name, "To"):
+		m.To, err = parseAddressList(value)
+		return err
+	case strings.EqualFold(name, "Cc"):
+		m.CC, err = parseAddressList(value)
+		return err
+	case strings.EqualFold(name, "Bcc"):
+		m.BCC, err = parseAddressList(value)
+		return err
+	case strings.EqualFold(name, "Subject"):
+		m.Subject = value
+		return nil
+	case isMIMEHeader(name):
+		return fmt.Errorf("rmailer: header %s is derived from the content", name)
+	}
+
+	replaced := false
+	headers := m.Headers[:0]
+
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			if replaced {
+				continue
+			}
+			h.Value = value
+			replaced = true
+		}
+		headers = append(headers, h)
+	}
+	m.Headers = headers
+
+	if !replaced {
+		m.AddHeader(name, value)
+	}
+
+	return nil
+}
+
+// DelHeader removes the headers called name, clearing the corresponding
+// field for standard headers.
+func (m *Message) DelHeader(name string) {
+	switch {
+	case strings.EqualFold(name, "From"):
+		m.From = mail.Address{}
+	case strings.EqualFold(name, "To"):
+		m.To = nil
+	case strings.EqualFold(name, "Cc"):
+		m.CC = nil
+	case strings.EqualFold(name, "Bcc"):
+		m.BCC = nil
+	case strings.EqualFold(name, "Subject"):
+		m.Subject = ""
+	}
+
+	headers := m.Headers[:0]
+
+	for _, h := range m.Headers {
+		if !strings.EqualFold(h.Name, name) {
+			headers = append(headers, h)
+		}
+	}
+	m.Headers = headers
+}
+
+// hasHeader reports whether a custom header called name is set.
+func (m *Message) hasHeader(name string) bool {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseAddressList(value string) ([]mail.Address, error) {
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil, nil
+	}
+
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]mail.Address, len(list))
+	for i, a := range list {
+		addresses[i] = *a
+	}
+
+	return addresses, nil
+}
+
+// isStandardHeader reports whether name is written from the Message fields.
+func isStandardHeader(name string) bool {
+	for _, standard := range []string{"From", "To", "Cc", "Bcc", "Subject"} {
+		if strings.EqualFold(name, standard) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isMIMEHeader(name string) bool {
+	return strings.EqualFold(name, "MIME-Version") ||
+		strings.EqualFold(name, "Content-Type") ||
+		strings.EqualFold(name, "Content-Transfer-Encoding")
+}
+
+// addressHeaders are the fields holding addresses, whose non-ASCII local
+// parts are sent as is (RFC 6532) rather than as encoded-words.
+var addressHeaders = map[string]bool{
+	"reply-to": true, "sender": true, "return-path": true,
+	"resent-from": true, "resent-sender": true, "resent-to": true,
+	"resent-cc": true, "resent-bcc": true, "disposition-notification-to": true,
+}
+
+// validHeaderName reports whether name is a field name of RFC 5322 section
+// 3.6.8: printable US-ASCII but the colon.
+func validHeaderName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeHeaders writes the custom headers at position. Invalid names and those
+// of the standard and MIME headers are refused, and line breaks in values replaced by spaces to prevent header
+// injection. Non-ASCII values are written as encoded-words (RFC 2047).
+func (m *Message) writeHeaders(w io.Writer, position HeaderPosition) error {
+	for _, h := range m.Headers {
+		if h.Position != position {
+			continue
+		}
+
+		if !validHeaderName(h.Name) {
+			return fmt.Errorf("rmailer: invalid header name %q", h.Name)
+		}
+		if isStandardHeader(h.Name) || isMIMEHeader(h.Name) {
+			return fmt.Errorf("rmailer: header %s is written from the message and cannot be added", h.Name)
+		}
+
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(h.Value)
+
+		line := h.Name + ": " + value + "\r\n"
+		if !isASCII(value) && !addressHeaders[strings.ToLower(h.Name)] {
+			line = foldHeader(h.Name, mime.BEncoding.Encode("UTF-8", value))
+		}
+
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
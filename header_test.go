@@ -0,0 +1,48 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAddHeaderRefusesStandardNames(t *testing.T) {
+	for _, name := range []string{"From", "to", "Cc", "BCC", "Subject", "MIME-Version", "content-type", "Content-Transfer-Encoding", "Bad Name", "X:Colon"} {
+		for _, before := range []bool{false, true} {
+			m := newTestMessage("a@toto.fr")
+			if before {
+				m.AddHeaderBefore(name, "value")
+			} else {
+				m.AddHeader(name, "value")
+			}
+
+			if _, err := m.WriteTo(io.Discard); err == nil {
+				t.Errorf("message rendered with the custom header %q (before = %t)", name, before)
+			}
+		}
+	}
+}
+
+func TestAddHeaderWritesCustomHeaders(t *testing.T) {
+	m := newTestMessage("a@toto.fr")
+	m.AddHeaderBefore("Received", "from relay")
+	m.AddHeader("X-Campaign", "spring\r\nBcc: victim@toto.fr")
+	m.AddHeader("Reply-To", "support@toto.fr")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	header, _, _ := strings.Cut(buf.String(), "\r\n\r\n")
+
+	if !strings.HasPrefix(header, "Received: from relay\r\n") {
+		t.Errorf("header does not start with the Received field:\n%s", header)
+	}
+	if !strings.Contains(header, "\r\nX-Campaign: spring  Bcc: victim@toto.fr\r\nReply-To: support@toto.fr") {
+		t.Errorf("custom headers missing or out of order:\n%s", header)
+	}
+	if i, j := strings.Index(header, "MIME-Version"), strings.Index(header, "X-Campaign"); i > j {
+		t.Errorf("custom header written before the standard ones:\n%s", header)
+	}
+}
@@ -0,0 +1,49 @@
+package rmailer
+
+import "net/mail"
+
+// Identity holds the defaults of one sending brand or persona, registered on
+// a Mailer and selected per message with Message.Identity.
+type Identity struct {
+	// From, including its display name, is used when the message has none.
+	From mail.Address
+	// EnvelopeFrom is used when the message does not set its own, e.g. to
+	// route bounces to a per-brand domain.
+	EnvelopeFrom string
+	// ReplyTo sets the Reply-To header unless the message has one.
+	ReplyTo []mail.Address
+	// Headers are added to the message unless it already has a header of the
+	// same name.
+	Headers []Header
+	// Signature is appended to the bodies, overriding Mailer.Signature.
+	Signature *Signature
+}
+
+// WithIdentity selects the identity registered on the Mailer as name.
+func WithIdentity(name string) MessageOption {
+	return func(m *Message) {
+		m.Identity = name
+	}
+}
+
+func (id Identity) apply(m *Message) {
+	if len(m.From.Address) == 0 {
+		m.From = id.From
+	} else if len(m.From.Name) == 0 && m.From.Address == id.From.Address {
+		m.From.Name = id.From.Name
+	}
+
+	if len(m.EnvelopeFrom) == 0 {
+		m.EnvelopeFrom = id.EnvelopeFrom
+	}
+
+	if len(id.ReplyTo) > 0 && len(m.GetHeader("Reply-To")) == 0 {
+		m.AddHeader("Reply-To", getRecipientsStr(id.ReplyTo))
+	}
+
+	for _, h := range id.Headers {
+		if len(m.GetHeader(h.Name)) == 0 {
+			m.Headers = append(m.Headers, h)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrNonASCIILocalPart is returned when an address has a non-ASCII local part
+// and the server does not support SMTPUTF8, so it cannot be delivered.
+var ErrNonASCIILocalPart = errors.New("non-ASCII local part requires SMTPUTF8")
+
+// ToASCIIDomain converts an internationalized domain name to its ASCII
+// (A-label) form, e.g. "bücher.de" to "xn--bcher-kva.de".
+func ToASCIIDomain(domain string) (string, error) {
+	return idna.Lookup.ToASCII(domain)
+}
+
+// ToUnicodeDomain converts a domain name with A-labels back to Unicode.
+func ToUnicodeDomain(domain string) (string, error) {
+	return idna.Lookup.ToUnicode(domain)
+}
+
+// asciiAddress converts the domain of addr to its A-label form, failing when
+// the local part itself is not ASCII.
+func asciiAddress(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || isASCII(addr) {
+		return addr, nil
+	}
+
+	local, domain := addr[:at], addr[at+1:]
+	if !isASCII(local) {
+		return "", fmt.Errorf("rmailer: %s: %w", addr, ErrNonASCIILocalPart)
+	}
+
+	domain, err := ToASCIIDomain(domain)
+	if err != nil {
+		return "", fmt.Errorf("rmailer: %s: %w", addr, err)
+	}
+
+	return local + "@" + domain, nil
+}
+
+// asciiEnvelope applies asciiAddress to the envelope sender and recipients,
+// for servers which do not advertise SMTPUTF8.
+func asciiEnvelope(from string, rcpts []string) (string, []string, error) {
+	from, err := asciiAddress(from)
+	if err != nil {
+		return "", nil, err
+	}
+
+	converted := make([]string, len(rcpts))
+
+	for i, rcpt := range rcpts {
+		if converted[i], err = asciiAddress(rcpt); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return from, converted, nil
+}
+
+// headerAddress returns a with its domain in A-label form, so headers stay
+// ASCII unless the local part itself is not.
+func headerAddress(a mail.Address) mail.Address {
+	at := strings.LastIndex(a.Address, "@")
+	if at < 0 || isASCII(a.Address[at+1:]) {
+		return a
+	}
+
+	if domain, err := ToASCIIDomain(a.Address[at+1:]); err == nil {
+		a.Address = a.Address[:at+1] + domain
+	}
+
+	return a
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// AsMailMessage returns the rendered message parsed as a net/mail message.
+func (m *Message) AsMailMessage() (*mail.Message, error) {
+	raw, err := m.render()
+	if err != nil {
+		return nil, err
+	}
+
+	return mail.ReadMessage(bytes.NewReader(raw))
+}
+
+// headerDecoder decodes RFC 2047 encoded words in any supported charset.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, _, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// FromMailMessage converts a net/mail message, e.g. fetched over IMAP, to a
+// Message. The bodies are decoded to UTF-8, the other parts becoming
+// attachments, and the headers which are not standard nor MIME ones are kept
+// as custom headers, ordered by name.
+func FromMailMessage(msg *mail.Message) (*Message, error) {
+	m := &Message{}
+	parser := &mail.AddressParser{WordDecoder: headerDecoder}
+
+	for name, values := range msg.Header {
+		if len(values) == 0 {
+			continue
+		}
+
+		var err error
+
+		switch textproto.CanonicalMIMEHeaderKey(name) {
+		case "From":
+			var from *mail.Address
+			if from, err = parser.Parse(values[0]); err == nil {
+				m.From = *from
+			}
+		case "To":
+			m.To, err = parseMailAddresses(parser, values)
+		case "Cc":
+			m.CC, err = parseMailAddresses(parser, values)
+		case "Bcc":
+			m.BCC, err = parseMailAddresses(parser, values)
+		case "Subject":
+			m.Subject, err = headerDecoder.DecodeHeader(values[0])
+		case "Date":
+			m.Date, err = mail.ParseDate(values[0])
+		case "Mime-Version":
+		default:
+			if isMIMEHeader(name) {
+				continue
+			}
+			for _, v := range values {
+				m.AddHeader(name, v)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("rmailer: parsing %s: %w", name, err)
+		}
+	}
+
+	sort.SliceStable(m.Headers, func(i, j int) bool {
+		return m.Headers[i].Name < m.Headers[j].Name
+	})
+
+	if err := m.addMIMEPart(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func parseMailAddresses(parser *mail.AddressParser, values []string) ([]mail.Address, error) {
+	var addresses []mail.Address
+
+	for _, v := range values {
+		if len(strings.TrimSpace(v)) == 0 {
+			continue
+		}
+
+		list, err := parser.ParseList(v)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range list {
+			addresses = append(addresses, *a)
+		}
+	}
+
+	return addresses, nil
+}
+
+// addMIMEPart adds the part to the bodies or the attachments of m, walking
+// down multiparts.
+func (m *Message) addMIMEPart(header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "text/plain; charset=us-ascii"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("rmailer: parsing Content-Type: %w", err)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err = m.addMIMEPart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+	if disposition != "attachment" && (mediaType == ContentTypeTextPlain || mediaType == ContentTypeTextHtml) {
+		text, err := decodeCharset(content, params["charset"])
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case mediaType == ContentTypeTextPlain && len(m.BodyText) == 0:
+			m.BodyText = text
+			return nil
+		case mediaType == ContentTypeTextHtml && len(m.BodyHtml) == 0:
+			m.BodyHtml = text
+			return nil
+		}
+	}
+
+	name := dispositionParams["filename"]
+	if len(name) == 0 {
+		name = params["name"]
+	}
+	if decoded, err := headerDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	if len(name) == 0 && mediaType == "message/rfc822" {
+		name = "message.eml"
+	}
+
+	m.Attachments = append(m.Attachments, Attachment{
+		Name:      name,
+		Content:   content,
+		ContentID: strings.Trim(strings.TrimSpace(header.Get("Content-ID")), "<>"),
+		Inline:    disposition == "inline",
+	})
+
+	return nil
+}
+
+// decodeCharset converts content from charset to UTF-8.
+func decodeCharset(content []byte, charset string) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "us-ascii":
+		return string(content), nil
+	}
+
+	enc, _, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
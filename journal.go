@@ -0,0 +1,394 @@
+package rmailer
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JournalSync tells when a Journal flushes its file to disk.
+type JournalSync int
+
+const (
+	// SyncEntries syncs each new entry but not the acknowledgements, a lost
+	// acknowledgement only making the message be sent again.
+	SyncEntries JournalSync = iota
+	// SyncAll syncs entries and acknowledgements.
+	SyncAll
+	// SyncNone leaves flushing to the operating system.
+	SyncNone
+)
+
+// JournalEntry is a message accepted by Enqueue and not acknowledged yet.
+type JournalEntry struct {
+	ID      string
+	Queued  time.Time
+	Message *Message
+}
+
+// journalRecord is the header line of a record. The message is either
+// inline, in JSON and in clear, or follows the line as Size bytes of payload
+// encoded with Codec, and encrypted when Encrypted is set.
+type journalRecord struct {
+	ID        string    `json:"id"`
+	Queued    time.Time `json:"queued,omitempty"`
+	Message   *Message  `json:"message,omitempty"`
+	Codec     string    `json:"codec,omitempty"`
+	Size      int       `json:"size,omitempty"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Ack       bool      `json:"ack,omitempty"`
+}
+
+// JournalOption configures a Journal when it is opened.
+type JournalOption func(j *Journal) error
+
+// WithJournalCodec writes the messages with codec instead of JSON. The
+// records written with JSON, GobCodec, ProtoCodec or codec are all read.
+func WithJournalCodec(codec MessageCodec) JournalOption {
+	return func(j *Journal) error {
+		j.codec = codec
+		j.codecs[codec.Name()] = codec
+		return nil
+	}
+}
+
+// WithJournalKey encrypts the messages written to the journal with AES-GCM
+// under key, of 16, 24 or 32 bytes, as queued mail often holds personal
+// data. The IDs and dates of the entries are left in clear. Entries written
+// in clear before the key was set are still read.
+func WithJournalKey(key []byte) JournalOption {
+	return func(j *Journal) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("rmailer: journal key: %w", err)
+		}
+
+		j.aead, err = cipher.NewGCM(block)
+		return err
+	}
+}
+
+// Journal is a write-ahead log of the messages queued on a Mailer, appended
+// to before a message is queued and acknowledged once it has been sent, so
+// that the messages of a crashed process are recovered on the next start.
+// The file holds one JSON header line per record, followed by the message
+// when it is not inline.
+type Journal struct {
+	Sync JournalSync
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	pending map[string]*JournalEntry
+	aead    cipher.AEAD
+	codec   MessageCodec
+	codecs  map[string]MessageCodec
+}
+
+// NewJournal opens the journal at path, which is created when it does not
+// exist, and loads the entries it holds which were not acknowledged.
+func NewJournal(path string, opts ...JournalOption) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		pending: make(map[string]*JournalEntry),
+		codec:   JSONCodec{},
+		codecs:  map[string]MessageCodec{"json": JSONCodec{}, "gob": GobCodec{}, "proto": ProtoCodec{}},
+	}
+
+	for _, opt := range opts {
+		if err := opt(j); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("rmailer: reading %s: %w", j.path, err)
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// the last record may be cut short by a crash
+			logf("SMTP journal %s: skipping unreadable record: %s", j.path, err)
+			continue
+		}
+
+		var payload []byte
+		if record.Size > 0 {
+			payload = make([]byte, record.Size+1)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				logf("SMTP journal %s: skipping truncated record %s", j.path, record.ID)
+				return nil
+			}
+			payload = payload[:record.Size]
+		}
+
+		if record.Ack {
+			delete(j.pending, record.ID)
+			continue
+		}
+
+		m, err := j.open(record, payload)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			j.pending[record.ID] = &JournalEntry{ID: record.ID, Queued: record.Queued, Message: m}
+		}
+	}
+}
+
+// Append records m and returns the ID of its entry.
+func (j *Journal) Append(m *Message) (string, error) {
+	entry := &JournalEntry{ID: newJournalID(), Queued: time.Now(), Message: m}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	record, payload, err := j.seal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	if err = j.write(record, payload, j.Sync != SyncNone); err != nil {
+		return "", err
+	}
+
+	j.pending[entry.ID] = entry
+	return entry.ID, nil
+}
+
+// Ack records that the message of entry id has been handled.
+func (j *Journal) Ack(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalRecord{ID: id, Ack: true}, nil, j.Sync == SyncAll); err != nil {
+		return err
+	}
+
+	delete(j.pending, id)
+	return nil
+}
+
+// Pending returns the entries not acknowledged, oldest first.
+func (j *Journal) Pending() []*JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.sortedPending()
+}
+
+func (j *Journal) sortedPending() []*JournalEntry {
+	entries := make([]*JournalEntry, 0, len(j.pending))
+	for _, entry := range j.pending {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Queued.Before(entries[b].Queued)
+	})
+
+	return entries
+}
+
+// Compact rewrites the file with the pending entries only.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+
+	for _, entry := range j.sortedPending() {
+		record, payload, err := j.seal(entry)
+		if err == nil {
+			err = writeJournalRecord(w, record, payload)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	j.file.Close()
+	j.file = file
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+func (j *Journal) write(record journalRecord, payload []byte, sync bool) error {
+	if err := writeJournalRecord(j.file, record, payload); err != nil {
+		return err
+	}
+
+	if sync {
+		return j.file.Sync()
+	}
+
+	return nil
+}
+
+// writeJournalRecord writes the header line of record and its payload in a
+// single write.
+func writeJournalRecord(w io.Writer, record journalRecord, payload []byte) error {
+	record.Size = len(payload)
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+	if len(payload) > 0 {
+		b = append(append(b, payload...), '\n')
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// seal returns the record of entry and its payload, the message being
+// inline only in JSON without a key.
+func (j *Journal) seal(entry *JournalEntry) (journalRecord, []byte, error) {
+	record := journalRecord{ID: entry.ID, Queued: entry.Queued}
+
+	_, inline := j.codec.(JSONCodec)
+	if inline && j.aead == nil {
+		record.Message = entry.Message
+		return record, nil, nil
+	}
+
+	payload, err := j.codec.Marshal(entry.Message)
+	if err != nil {
+		return record, nil, err
+	}
+	record.Codec = j.codec.Name()
+
+	if j.aead != nil {
+		nonce := make([]byte, j.aead.NonceSize())
+		if _, err = rand.Read(nonce); err != nil {
+			return record, nil, err
+		}
+
+		// the ID is authenticated so that sealed messages cannot be swapped
+		payload = j.aead.Seal(nonce, nonce, payload, []byte(entry.ID))
+		record.Encrypted = true
+	}
+
+	return record, payload, nil
+}
+
+// open returns the message of an entry record, nil for a record without one.
+func (j *Journal) open(record journalRecord, payload []byte) (*Message, error) {
+	if record.Message != nil || len(payload) == 0 {
+		return record.Message, nil
+	}
+
+	if record.Encrypted {
+		if j.aead == nil {
+			return nil, fmt.Errorf("rmailer: journal %s holds encrypted entries, see WithJournalKey", j.path)
+		}
+
+		size := j.aead.NonceSize()
+		if len(payload) < size {
+			return nil, fmt.Errorf("rmailer: journal entry %s is truncated", record.ID)
+		}
+
+		var err error
+		payload, err = j.aead.Open(nil, payload[:size], payload[size:], []byte(record.ID))
+		if err != nil {
+			return nil, fmt.Errorf("rmailer: decrypting journal entry %s: %w", record.ID, err)
+		}
+	}
+
+	codec, ok := j.codecs[record.Codec]
+	if !ok {
+		return nil, fmt.Errorf("rmailer: journal entry %s has unknown codec %q, see WithJournalCodec", record.ID, record.Codec)
+	}
+
+	m, err := codec.Unmarshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: decoding journal entry %s: %w", record.ID, err)
+	}
+
+	return m, nil
+}
+
+func newJournalID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
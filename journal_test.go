@@ -0,0 +1,171 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestJournalReloadsPendingEntries(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	for name, opts := range map[string][]rmailer.JournalOption{
+		"json":      nil,
+		"gob":       {rmailer.WithJournalCodec(rmailer.GobCodec{})},
+		"encrypted": {rmailer.WithJournalKey(key)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal")
+
+			j, err := rmailer.NewJournal(path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent, err := j.Append(newTestMessage("sent@toto.fr"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending, err := j.Append(newTestMessage("pending@toto.fr"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := j.Ack(sent); err != nil {
+				t.Fatal(err)
+			}
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted := !bytes.Contains(b, []byte("pending@toto.fr")); encrypted != (name == "encrypted") {
+				t.Errorf("recipient in clear = %t", !encrypted)
+			}
+
+			j, err = rmailer.NewJournal(path, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+
+			entries := j.Pending()
+			if len(entries) != 1 || entries[0].ID != pending || entries[0].Message.To[0].Address != "pending@toto.fr" {
+				t.Fatalf("Pending = %+v, want the entry %s", entries, pending)
+			}
+		})
+	}
+}
+
+func TestJournalSkipsTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := rmailer.NewJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := j.Append(newTestMessage("a@toto.fr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Append(newTestMessage("b@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// the process crashed while writing the second record
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b[:len(b)-20], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = rmailer.NewJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if entries := j.Pending(); len(entries) != 1 || entries[0].ID != id {
+		t.Fatalf("Pending = %+v, want the entry %s only", entries, id)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := rmailer.NewJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var ids []string
+	for _, rcpt := range []string{"a@toto.fr", "b@toto.fr", "c@toto.fr"} {
+		id, err := j.Append(newTestMessage(rcpt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:2] {
+		if err := j.Ack(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// still appendable after the file was replaced
+	last, err := j.Append(newTestMessage("d@toto.fr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 2 {
+		t.Errorf("compacted file holds %d line(s), want 2", n)
+	}
+
+	reopened, err := rmailer.NewJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	entries := reopened.Pending()
+	if len(entries) != 2 || entries[0].ID != ids[2] || entries[1].ID != last {
+		t.Fatalf("Pending = %+v, want %s and %s", entries, ids[2], last)
+	}
+}
+
+func TestJournalNeedsKeyForEncryptedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := rmailer.NewJournal(path, rmailer.WithJournalKey(bytes.Repeat([]byte{7}, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Append(newTestMessage("a@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if _, err := rmailer.NewJournal(path); err == nil {
+		t.Error("encrypted journal opened without its key")
+	}
+	if _, err := rmailer.NewJournal(path, rmailer.WithJournalKey(bytes.Repeat([]byte{8}, 16))); err == nil {
+		t.Error("encrypted journal opened with another key")
+	}
+}
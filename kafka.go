@@ -0,0 +1,140 @@
+package rmailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// KafkaProducer writes a record to a Kafka topic. It is implemented over the
+// Kafka client of the caller's choice, e.g. a kafka-go Writer.
+type KafkaProducer interface {
+	Produce(ctx context.Context, topic string, key []byte, value []byte) error
+}
+
+// KafkaProducerFunc adapts a function to a KafkaProducer.
+type KafkaProducerFunc func(ctx context.Context, topic string, key []byte, value []byte) error
+
+func (f KafkaProducerFunc) Produce(ctx context.Context, topic string, key []byte, value []byte) error {
+	return f(ctx, topic, key, value)
+}
+
+// OutcomeRecord is the JSON value of the records published by KafkaPublisher,
+// one per recipient outcome.
+type OutcomeRecord struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	MessageID string    `json:"message_id,omitempty"`
+	Recipient string    `json:"recipient"`
+	Attempt   int       `json:"attempt,omitempty"`
+	// Code and Message are the last reply of the relay for the recipient.
+	Code       int               `json:"code,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Suppressed SuppressionReason `json:"suppressed,omitempty"`
+	// BounceAction and BounceStatus are set for bounces.
+	BounceAction string            `json:"bounce_action,omitempty"`
+	BounceStatus string            `json:"bounce_status,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// KafkaPublisher publishes the delivery outcomes of an EventBus to a Kafka
+// topic, keyed by Message-ID so that the records of a message stay ordered.
+type KafkaPublisher struct {
+	Producer KafkaProducer
+	Topic    string
+	// Timeout bounds each Produce call when positive.
+	Timeout time.Duration
+}
+
+// NewKafkaPublisher returns a KafkaPublisher producing the outcome records to
+// topic through producer, without a timeout.
+func NewKafkaPublisher(producer KafkaProducer, topic string) *KafkaPublisher {
+	return &KafkaPublisher{Producer: producer, Topic: topic}
+}
+
+// Run publishes the delivered, deferred, failed and bounced events of bus
+// until ctx is done, with room for buffer events between the bus and the
+// producer. Records failing to be produced are logged and dropped. An error
+// is returned at once when bus or the Producer is nil.
+func (p *KafkaPublisher) Run(ctx context.Context, bus *EventBus, buffer int) error {
+	if bus == nil {
+		return errors.New("rmailer: KafkaPublisher needs an EventBus to run")
+	}
+	if p.Producer == nil {
+		return errors.New("rmailer: KafkaPublisher has no Producer")
+	}
+
+	events, cancel := bus.Subscribe(buffer)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-events:
+			if err := p.Publish(ctx, e); err != nil {
+				logf("Kafka publish failed: %s", err)
+			}
+		}
+	}
+}
+
+// Publish produces the record of e, ignoring the events which are not
+// delivery outcomes.
+func (p *KafkaPublisher) Publish(ctx context.Context, e Event) error {
+	record, ok := outcomeRecord(e)
+	if !ok {
+		return nil
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	key := record.MessageID
+	if len(key) == 0 {
+		key = record.Recipient
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	return p.Producer.Produce(ctx, p.Topic, []byte(key), value)
+}
+
+func outcomeRecord(e Event) (OutcomeRecord, bool) {
+	switch e.Type {
+	case EventDelivered, EventDeferred, EventFailed, EventBounced:
+	default:
+		return OutcomeRecord{}, false
+	}
+
+	record := OutcomeRecord{
+		Type:      e.Type,
+		Time:      e.Time,
+		MessageID: e.MessageID,
+		Recipient: e.Recipient,
+		Attempt:   e.Attempt,
+		Metadata:  e.Metadata,
+	}
+
+	if e.Status != nil {
+		record.Code, record.Message = e.Status.Code, e.Status.Message
+		record.Suppressed = e.Status.Suppressed
+	}
+
+	if e.Bounce != nil {
+		record.BounceAction, record.BounceStatus = e.Bounce.Action, e.Bounce.Status
+		record.Message = e.Bounce.Diagnostic
+		if len(record.Recipient) == 0 {
+			record.Recipient = e.Bounce.Recipient
+		}
+	}
+
+	return record, true
+}
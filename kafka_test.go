@@ -0,0 +1,111 @@
+package rmailer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// kafkaRecords collects the records produced to it.
+type kafkaRecords struct {
+	mu      sync.Mutex
+	keys    []string
+	records []rmailer.OutcomeRecord
+}
+
+func (k *kafkaRecords) Produce(ctx context.Context, topic string, key []byte, value []byte) error {
+	if topic != "outcomes" {
+		return errors.New("unknown topic " + topic)
+	}
+
+	var record rmailer.OutcomeRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = append(k.keys, string(key))
+	k.records = append(k.records, record)
+	return nil
+}
+
+func (k *kafkaRecords) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.records)
+}
+
+func TestKafkaPublisherPublishesOutcomes(t *testing.T) {
+	producer := &kafkaRecords{}
+	p := rmailer.NewKafkaPublisher(producer, "outcomes")
+
+	at := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	for _, e := range []rmailer.Event{
+		{Type: rmailer.EventQueued, Time: at},
+		{Type: rmailer.EventAttempting, Time: at, Attempt: 1},
+		{
+			Type: rmailer.EventDeferred, Time: at, MessageID: "1@toto.fr", Recipient: "a@toto.fr", Attempt: 1,
+			Status:   &rmailer.RecipientStatus{Address: "a@toto.fr", Code: 451, Message: "try again later"},
+			Metadata: map[string]string{"order": "42"},
+		},
+		{Type: rmailer.EventBounced, Time: at, Recipient: "b@toto.fr"},
+	} {
+		if err := p.Publish(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(producer.records) != 2 {
+		t.Fatalf("%d record(s) produced, want the 2 outcomes", len(producer.records))
+	}
+
+	want := rmailer.OutcomeRecord{
+		Type: rmailer.EventDeferred, Time: at, MessageID: "1@toto.fr", Recipient: "a@toto.fr", Attempt: 1,
+		Code: 451, Message: "try again later", Metadata: map[string]string{"order": "42"},
+	}
+	if got := producer.records[0]; got.Type != want.Type || !got.Time.Equal(want.Time) || got.Code != want.Code || got.Metadata["order"] != "42" {
+		t.Errorf("record = %+v, want %+v", got, want)
+	}
+	// keyed by Message-ID, by recipient without one
+	if producer.keys[0] != "1@toto.fr" || producer.keys[1] != "b@toto.fr" {
+		t.Errorf("keys = %v", producer.keys)
+	}
+}
+
+func TestKafkaPublisherRun(t *testing.T) {
+	producer := &kafkaRecords{}
+	p := rmailer.NewKafkaPublisher(producer, "outcomes")
+	bus := rmailer.NewEventBus()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx, bus, 16) }()
+
+	// the subscription starts with Run
+	waitFor(t, func() bool {
+		bus.Publish(rmailer.Event{Type: rmailer.EventDelivered, Recipient: "a@toto.fr"})
+		return producer.count() > 0
+	})
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+}
+
+func TestKafkaPublisherRunNeedsBusAndProducer(t *testing.T) {
+	if err := rmailer.NewKafkaPublisher(&kafkaRecords{}, "outcomes").Run(context.Background(), nil, 16); err == nil {
+		t.Error("Run without an EventBus succeeded")
+	}
+	if err := rmailer.NewKafkaPublisher(nil, "outcomes").Run(context.Background(), rmailer.NewEventBus(), 16); err == nil {
+		t.Error("Run without a Producer succeeded")
+	}
+}
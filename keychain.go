@@ -0,0 +1,23 @@
+package rmailer
+
+import "errors"
+
+// ErrKeychainUnsupported is returned by KeychainSecrets on systems without a
+// supported keyring.
+var ErrKeychainUnsupported = errors.New("rmailer: no OS keychain on this system")
+
+// KeychainSecrets is a SecretProvider reading secrets from the keyring of the
+// operating system: the macOS Keychain, the Secret Service (GNOME Keyring,
+// KWallet) through secret-tool, or the Windows Credential Manager. A secret
+// name is the account under Service, stored the way go-keyring does, e.g.
+//
+//	security add-generic-password -s rmailer -a relay -w
+//	secret-tool store --label=rmailer service rmailer username relay
+//	cmdkey /generic:rmailer:relay /user:relay /pass
+type KeychainSecrets struct {
+	Service string
+}
+
+func (s KeychainSecrets) Secret(name string) (string, error) {
+	return keychainSecret(s.Service, name)
+}
@@ -0,0 +1,16 @@
+package rmailer
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func keychainSecret(service string, account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("rmailer: reading %s/%s from the keychain: %w", service, account, err)
+	}
+
+	return strings.TrimRight(string(out), "\n"), nil
+}
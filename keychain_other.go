@@ -0,0 +1,7 @@
+//go:build !darwin && !windows && !linux && !freebsd && !openbsd && !netbsd
+
+package rmailer
+
+func keychainSecret(service string, account string) (string, error) {
+	return "", ErrKeychainUnsupported
+}
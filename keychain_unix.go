@@ -0,0 +1,28 @@
+//go:build linux || freebsd || openbsd || netbsd
+
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+func keychainSecret(service string, account string) (string, error) {
+	path, err := exec.LookPath("secret-tool")
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", ErrKeychainUnsupported
+	}
+
+	out, err := exec.Command(path, "lookup", "service", service, "username", account).Output()
+	if err != nil {
+		return "", fmt.Errorf("rmailer: reading %s/%s from the secret service: %w", service, account, err)
+	}
+
+	// secret-tool prints the secret as stored, without a trailing newline
+	if len(out) == 0 {
+		return "", fmt.Errorf("rmailer: no secret %s/%s in the secret service", service, account)
+	}
+
+	return string(out), nil
+}
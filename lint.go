@@ -0,0 +1,187 @@
+package rmailer
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxInlineImageSize is the size above which embedded images are reported
+// by Lint, as they slow down rendering and weigh in spam scores.
+const maxInlineImageSize = 100 << 10
+
+// maxMessageSize is the rendered size above which Lint warns, as many
+// receivers refuse messages over 10MB.
+const maxMessageSize = 10 << 20
+
+const (
+	LintHtmlOnly           = "html-only"
+	LintEmptySubject       = "empty-subject"
+	LintAllCapsSubject     = "all-caps-subject"
+	LintShoutingSubject    = "shouting-subject"
+	LintLargeInlineImage   = "large-inline-image"
+	LintMissingUnsubscribe = "missing-list-unsubscribe"
+	LintMissingFrom        = "missing-from"
+	LintLargeMessage       = "large-message"
+	LintUnalignedEnvelope  = "unaligned-envelope-from"
+	LintUnalignedDKIM      = "unaligned-dkim"
+)
+
+// LintWarning is a deliverability issue found by Lint.
+type LintWarning struct {
+	Code    string
+	Message string
+}
+
+func (w LintWarning) String() string {
+	return w.Code + ": " + w.Message
+}
+
+// Lint returns the deliverability issues of the message as it is. Run it on
+// the result of Mailer.Prepare to account for what the Mailer adds.
+func (m *Message) Lint() []LintWarning {
+	var warnings []LintWarning
+	warn := func(code string, format string, args ...any) {
+		warnings = append(warnings, LintWarning{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(m.From.Address) == 0 {
+		warn(LintMissingFrom, "the message has no From address")
+	}
+
+	if len(m.BodyHtml) > 0 && len(strings.TrimSpace(m.BodyText)) == 0 {
+		warn(LintHtmlOnly, "the message has no plain text alternative to its HTML body")
+	}
+
+	subject := strings.TrimSpace(m.Subject)
+	switch {
+	case len(subject) == 0:
+		warn(LintEmptySubject, "the subject is empty")
+	case allCaps(subject):
+		warn(LintAllCapsSubject, "the subject is written in capitals")
+	}
+
+	if strings.Contains(subject, "!!") || strings.Contains(subject, "$$") {
+		warn(LintShoutingSubject, "the subject repeats punctuation")
+	}
+
+	for _, a := range m.Attachments {
+		if size := a.size(); len(a.ContentID) > 0 && size > maxInlineImageSize {
+			warn(LintLargeInlineImage, "inline image %s is %d KiB", a.Name, size>>10)
+		}
+	}
+
+	if m.Bulk && !m.hasHeader("List-Unsubscribe") {
+		warn(LintMissingUnsubscribe, "the bulk message has no List-Unsubscribe header")
+	}
+
+	if size := len(m.ToBytes()); size > maxMessageSize {
+		warn(LintLargeMessage, "the message is %d MiB once rendered", size>>20)
+	}
+
+	envelopeFrom := m.EnvelopeFrom
+	if envelopeFrom == NullReversePath {
+		envelopeFrom = ""
+	}
+	warnings = append(warnings, m.LintAlignment(envelopeFrom, m.signingDomains()...)...)
+
+	return warnings
+}
+
+// LintAlignment returns the DMARC alignment issues of the From domain with
+// envelopeFrom and the d= domains of the DKIM signatures the message will
+// carry, for the identifiers added on the way by the Sender or the relay.
+// DMARC passes when one identifier is aligned, in relaxed mode, and
+// verified, so nothing is reported when one of them is. Empty identifiers
+// are not checked.
+func (m *Message) LintAlignment(envelopeFrom string, signingDomains ...string) []LintWarning {
+	domain := addressDomain(m.fromAddress())
+	if len(domain) == 0 {
+		return nil
+	}
+
+	var warnings []LintWarning
+	alignedWith := false
+
+	if envelopeDomain := addressDomain(envelopeFrom); len(envelopeDomain) > 0 {
+		if aligned(domain, envelopeDomain, false) {
+			alignedWith = true
+		} else {
+			warnings = append(warnings, LintWarning{Code: LintUnalignedEnvelope,
+				Message: fmt.Sprintf("the envelope sender domain %s is not aligned with the From domain %s, SPF cannot pass DMARC", envelopeDomain, domain)})
+		}
+	}
+
+	var unaligned []string
+	for _, signingDomain := range signingDomains {
+		if len(signingDomain) == 0 {
+			continue
+		}
+		if aligned(domain, signingDomain, false) {
+			alignedWith = true
+		} else {
+			unaligned = append(unaligned, signingDomain)
+		}
+	}
+
+	if len(unaligned) > 0 {
+		warnings = append(warnings, LintWarning{Code: LintUnalignedDKIM,
+			Message: fmt.Sprintf("the DKIM domain %s is not aligned with the From domain %s, DKIM cannot pass DMARC", strings.Join(unaligned, ", "), domain)})
+	}
+
+	if alignedWith {
+		return nil
+	}
+
+	return warnings
+}
+
+// fromAddress returns the From address, parsed from the From header when
+// the message has one instead.
+func (m *Message) fromAddress() string {
+	if len(m.From.Address) > 0 {
+		return m.From.Address
+	}
+
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, "From") {
+			if addrs, err := parseAddressList(h.Value); err == nil && len(addrs) > 0 {
+				return addrs[0].Address
+			}
+		}
+	}
+
+	return ""
+}
+
+// signingDomains returns the d= domains of the DKIM-Signature headers of the
+// message.
+func (m *Message) signingDomains() []string {
+	var domains []string
+
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, "DKIM-Signature") {
+			if d := parseTags(h.Value)["d"]; len(d) > 0 {
+				domains = append(domains, d)
+			}
+		}
+	}
+
+	return domains
+}
+
+// allCaps reports whether s has at least a few letters, all upper case.
+func allCaps(s string) bool {
+	letters := 0
+
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsUpper(r) {
+			letters++
+		}
+	}
+
+	return letters >= 4
+}
@@ -0,0 +1,243 @@
+package rmailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends messages through Sender, completing them with the Identity
+// they select.
+type Mailer struct {
+	Sender *Sender
+	// DefaultIdentity is used by messages which do not select one, if set.
+	DefaultIdentity string
+	// Signature is appended to the bodies of messages whose identity has no
+	// signature of its own.
+	Signature *Signature
+	// DisableSignatures leaves the bodies untouched.
+	DisableSignatures bool
+	// Unsubscribe adds the unsubscribe headers and footers to bulk
+	// messages, which are refused when it is nil.
+	Unsubscribe *Unsubscribe
+	// AttachmentFilters inspect or transform the attachments of each
+	// message sent, in order.
+	AttachmentFilters []AttachmentFilter
+	// WarmUp, when set, caps the daily volume and refuses the excess with a
+	// *WarmUpError. The messages queued by Enqueue are deferred until the
+	// next day instead, regardless of Retry.
+	WarmUp *WarmUp
+	// Throttle, when set, delays sends to respect per-domain rate limits.
+	// The messages queued by Enqueue over a limit are deferred with a
+	// *ThrottleError rather than waiting in a worker, regardless of Retry.
+	Throttle *DomainThrottle
+	// SpamCheck, when set, scores each message before sending and refuses
+	// the ones it blocks with a *SpamError.
+	SpamCheck *SpamAssassin
+	// HtmlProcessors rewrite the HTML body of each message sent, in order,
+	// after the signature and unsubscribe footer are appended.
+	HtmlProcessors []HtmlProcessor
+	// Workers is the number of messages queued by Enqueue which are sent
+	// concurrently, 1 when zero.
+	Workers int
+	// QueueSize caps the number of messages waiting for a worker, unlimited
+	// when zero.
+	QueueSize int
+	// Completed, when set, is called with the outcome of each message queued
+	// by Enqueue. Failures are logged otherwise.
+	Completed func(m *Message, result *SendResult, err error)
+	// Journal, when set, records the messages queued by Enqueue until they
+	// are sent, see Recover.
+	Journal *Journal
+	// Dedup, when set, skips the recipients a queued message was already
+	// sent to, as when replayed from the Journal after a crash, reporting
+	// ErrDuplicate to Completed when none is left. With a Journal, it must
+	// survive restarts as FileDedup and RedisDedup do.
+	Dedup DedupStore
+	// DedupTTL is how long sent messages are remembered, DefaultDedupTTL
+	// when zero.
+	DedupTTL time.Duration
+	// Retry, when set, queues the messages queued by Enqueue again for the
+	// recipients which failed temporarily, after the delay of the class of
+	// the failure, until Retry.Attempts attempts were made. Completed is
+	// called once with the outcome for all the recipients.
+	Retry *Backoff
+	// DeadLetters, when set, keeps the messages queued by Enqueue which
+	// failed for some recipient once the retries are over, with the history
+	// of their attempts.
+	DeadLetters DeadLetterStore
+
+	mu         sync.RWMutex
+	identities map[string]Identity
+	queue      queue
+}
+
+func NewMailer(sender *Sender) *Mailer {
+	return &Mailer{
+		Sender:     sender,
+		identities: make(map[string]Identity),
+	}
+}
+
+// RegisterIdentity registers id under name, replacing any identity already
+// registered with that name.
+func (ml *Mailer) RegisterIdentity(name string, id Identity) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.identities == nil {
+		ml.identities = make(map[string]Identity)
+	}
+	ml.identities[name] = id
+}
+
+// Identity returns the identity registered under name.
+func (ml *Mailer) Identity(name string) (Identity, bool) {
+	ml.mu.RLock()
+	defer ml.mu.RUnlock()
+
+	id, ok := ml.identities[name]
+	return id, ok
+}
+
+func (ml *Mailer) Send(m *Message) error {
+	_, err := ml.SendWithResult(m)
+	return err
+}
+
+// SendWithResult completes a copy of m with its identity and sends it, see
+// Sender.SendWithResult. m itself is left untouched.
+func (ml *Mailer) SendWithResult(m *Message) (*SendResult, error) {
+	result, err := ml.sendVia(ml.Sender, m, false)
+	return result, redactErr(err)
+}
+
+// sendVia completes a copy of m and sends it through sender, queued telling
+// whether it comes from the queue, see Sender.sendWithResult.
+func (ml *Mailer) sendVia(sender *Sender, m *Message, queued bool) (*SendResult, error) {
+	prepared, err := ml.Prepare(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if ml.SpamCheck != nil {
+		// checked as sent, with its Date and Message-ID
+		if prepared, err = sender.stamped(prepared); err != nil {
+			return nil, err
+		}
+
+		raw, err := prepared.render()
+		if err != nil {
+			return nil, err
+		}
+
+		report, err := ml.SpamCheck.Check(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if ml.SpamCheck.blocks(report) {
+			return nil, &SpamError{Report: report}
+		}
+	}
+
+	// throttled before the warm-up, which would count a deferred message
+	if ml.Throttle != nil {
+		domains := recipientDomains(prepared)
+		if queued {
+			if err := ml.Throttle.reserveAll(domains); err != nil {
+				return nil, err
+			}
+		} else {
+			for _, domain := range domains {
+				if err := ml.Throttle.Wait(context.Background(), domain); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if ml.WarmUp != nil {
+		if err := ml.WarmUp.Reserve(len(prepared.envelopeRecipients())); err != nil {
+			return nil, err
+		}
+	}
+
+	return sender.sendWithResult(prepared, queued)
+}
+
+// Prepare returns a copy of m completed with the identity it selects, or
+// DefaultIdentity, as it would be sent.
+func (ml *Mailer) Prepare(m *Message) (*Message, error) {
+	name := m.Identity
+	if len(name) == 0 {
+		name = ml.DefaultIdentity
+	}
+
+	prepared := *m
+	prepared.Headers = append([]Header(nil), m.Headers...)
+
+	signature := ml.Signature
+
+	if len(name) > 0 {
+		id, ok := ml.Identity(name)
+		if !ok {
+			return nil, fmt.Errorf("rmailer: unknown identity %q", name)
+		}
+
+		id.apply(&prepared)
+
+		if id.Signature != nil {
+			signature = id.Signature
+		}
+	}
+
+	if signature != nil && !ml.DisableSignatures {
+		signature.appendTo(&prepared)
+	}
+
+	if prepared.Bulk {
+		if ml.Unsubscribe == nil {
+			return nil, errors.New("rmailer: bulk messages need Mailer.Unsubscribe")
+		}
+
+		if err := ml.Unsubscribe.apply(&prepared); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := filterAttachments(&prepared, ml.AttachmentFilters); err != nil {
+		return nil, err
+	}
+
+	if len(prepared.BodyHtml) > 0 {
+		for _, p := range ml.HtmlProcessors {
+			body, err := p.ProcessHtml(&prepared, prepared.BodyHtml)
+			if err != nil {
+				return nil, err
+			}
+			prepared.BodyHtml = body
+		}
+	}
+
+	return &prepared, nil
+}
+
+// recipientDomains returns the distinct domains of the envelope recipients.
+func recipientDomains(m *Message) []string {
+	seen := make(map[string]bool)
+	var domains []string
+
+	for _, rcpt := range m.envelopeRecipients() {
+		domain := strings.ToLower(addressDomain(rcpt))
+		if len(domain) > 0 && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
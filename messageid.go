@@ -0,0 +1,53 @@
+package rmailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// MessageIDGenerator generates the Message-ID of messages sent without one,
+// returned without angle brackets.
+type MessageIDGenerator interface {
+	MessageID(m *Message) (string, error)
+}
+
+// MessageIDFunc adapts a function to the MessageIDGenerator interface.
+type MessageIDFunc func(m *Message) (string, error)
+
+func (f MessageIDFunc) MessageID(m *Message) (string, error) {
+	return f(m)
+}
+
+// RandomMessageIDs generates random identifiers at Domain, or at the domain
+// of the From address when Domain is empty.
+type RandomMessageIDs struct {
+	Domain string
+}
+
+func (g RandomMessageIDs) MessageID(m *Message) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	domain := g.Domain
+	if len(domain) == 0 {
+		domain = addressDomain(m.From.Address)
+	}
+	if len(domain) == 0 {
+		domain = "localhost"
+	}
+
+	if ascii, err := ToASCIIDomain(domain); err == nil {
+		domain = ascii
+	}
+
+	return hex.EncodeToString(b) + "@" + domain, nil
+}
+
+// messageID returns the Message-ID header value of m, without angle
+// brackets.
+func (m *Message) messageID() string {
+	return strings.Trim(strings.TrimSpace(m.GetHeader("Message-ID")), "<>")
+}
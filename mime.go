@@ -0,0 +1,323 @@
+package rmailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Part is a node of the MIME tree rendered by Message.ToBytes. A Part with
+// children is rendered as the multipart type named by its Content-Type, the
+// boundary parameter being added when missing. A leaf Part's Content is
+// written verbatim, so it must already be encoded as its headers declare.
+type Part struct {
+	Header  textproto.MIMEHeader
+	Content []byte
+	Parts   []*Part
+
+	// encoding is applied to Content when writing, for parts built from
+	// the Message fields
+	encoding TransferEncoding
+	// path names the file streamed in place of Content
+	path string
+}
+
+// NewPart returns a leaf part with the given Content-Type.
+func NewPart(contentType string, content []byte) *Part {
+	p := &Part{Header: make(textproto.MIMEHeader), Content: content}
+	p.Header.Set("Content-Type", contentType)
+	return p
+}
+
+// NewMultipart returns a multipart part, contentType being a full media type
+// such as "multipart/report; report-type=delivery-status".
+func NewMultipart(contentType string, parts ...*Part) *Part {
+	p := &Part{Header: make(textproto.MIMEHeader), Parts: append([]*Part{}, parts...)}
+	p.Header.Set("Content-Type", contentType)
+	return p
+}
+
+// AddPart appends a custom part after the bodies and attachments. A message
+// made of a single custom part uses it as its root.
+func (m *Message) AddPart(p *Part) {
+	m.Parts = append(m.Parts, p)
+}
+
+func newMultipart(subtype string, params map[string]string, children ...*Part) *Part {
+	return NewMultipart(mime.FormatMediaType(subtype, params), children...)
+}
+
+func newTextPart(content string, contentType string, charset string, encoding TransferEncoding) *Part {
+	b := normalizeCRLF([]byte(content))
+
+	if len(encoding) == 0 {
+		encoding = chooseEncoding(b)
+	} else {
+		encoding = wireSafeEncoding(b, encoding)
+	}
+
+	p := &Part{Header: make(textproto.MIMEHeader), Content: b, encoding: encoding}
+	if len(charset) == 0 {
+		charset = "utf-8"
+	}
+	p.Header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": charset}))
+
+	p.Header.Set("Content-Transfer-Encoding", string(encoding))
+	return p
+}
+
+// newAttachmentPart returns the part of a, labelled contentType.
+func newAttachmentPart(a Attachment, contentType string) *Part {
+	encoding := a.Encoding
+	if len(encoding) == 0 {
+		encoding = EncodingBase64
+	}
+
+	p := &Part{Header: make(textproto.MIMEHeader), Content: a.Content}
+	if a.streamed() {
+		p.path = a.Path
+	}
+
+	switch {
+	case a.PreEncoded:
+		p.encoding = ""
+	case a.streamed():
+		p.encoding = encoding
+	default:
+		encoding = wireSafeEncoding(a.Content, encoding)
+		p.encoding = encoding
+	}
+
+	p.Header.Set("Content-Type", contentType)
+	p.Header.Set("Content-Transfer-Encoding", string(encoding))
+
+	if len(a.ContentID) > 0 {
+		p.Header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+
+	disposition := "attachment"
+	if a.Inline {
+		disposition = "inline"
+	}
+	p.Header.Set("Content-Disposition", fmt.Sprintf("%s; filename=\"=?UTF-8?B?%s?=\"", disposition, base64.StdEncoding.EncodeToString([]byte(a.Name))))
+
+	return p
+}
+
+// mimeTree arranges the bodies and attachments as
+// mixed > alternative > related, omitting the levels that are not needed.
+func (m *Message) mimeTree() *Part {
+	var related, mixed []*Part
+
+	for _, a := range m.Attachments {
+		if len(a.ContentID) > 0 && len(m.BodyHtml) > 0 {
+			related = append(related, newAttachmentPart(a, m.contentType(a.Name, a.head())))
+		} else {
+			mixed = append(mixed, newAttachmentPart(a, m.contentType(a.Name, a.head())))
+		}
+	}
+
+	var text, html, body *Part
+
+	if len(m.BodyText) > 0 {
+		text = newTextPart(m.BodyText, ContentTypeTextPlain, m.TextCharset, m.TextEncoding)
+
+		if m.TextFlowed {
+			_, params, _ := mime.ParseMediaType(text.Header.Get("Content-Type"))
+			params["format"] = "flowed"
+			params["delsp"] = "yes"
+			text.Header.Set("Content-Type", mime.FormatMediaType(ContentTypeTextPlain, params))
+		}
+	}
+
+	if len(m.BodyHtml) > 0 {
+		html = newTextPart(m.BodyHtml, ContentTypeTextHtml, m.HtmlCharset, m.HtmlEncoding)
+
+		if len(related) > 0 {
+			html = newMultipart(ContentTypeMultipartRelated, map[string]string{"type": ContentTypeTextHtml}, append([]*Part{html}, related...)...)
+		}
+	}
+
+	switch {
+	case text != nil && html != nil:
+		body = newMultipart(ContentTypeMultipartAlternative, nil, text, html)
+	case html != nil:
+		body = html
+	case text != nil:
+		body = text
+	}
+
+	if body == nil && len(mixed) == 0 && len(m.Parts) == 1 {
+		return m.Parts[0]
+	}
+
+	mixed = append(mixed, m.Parts...)
+
+	if len(mixed) == 0 {
+		if body == nil {
+			body = newTextPart("", ContentTypeTextPlain, "", "")
+		}
+		return body
+	}
+
+	if body != nil {
+		mixed = append([]*Part{body}, mixed...)
+	}
+
+	return newMultipart(ContentTypeMultipartMixed, nil, mixed...)
+}
+
+func (p *Part) writeHeader(w io.Writer) error {
+	if err := p.setBoundary(); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(p.Header))
+	for k := range p.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range p.Header[k] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, BackLine)
+	return err
+}
+
+// writeBody writes the body of p, encoding up to concurrency of its leaf
+// children at once when above 1.
+func (p *Part) writeBody(w io.Writer, wrapping Base64Wrapping, concurrency int) error {
+	if p.Parts == nil && len(p.path) > 0 {
+		file, err := os.Open(p.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return encodeReader(w, file, p.encoding, wrapping)
+	}
+
+	if p.Parts == nil {
+		return encode(w, p.Content, p.encoding, wrapping)
+	}
+
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		return err
+	}
+
+	encoded, err := p.encodeChildren(wrapping, concurrency)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range p.Parts {
+		if err := c.setBoundary(); err != nil {
+			return err
+		}
+
+		pw, err := mw.CreatePart(c.Header)
+		if err != nil {
+			return err
+		}
+
+		if encoded[i] != nil {
+			_, err = pw.Write(encoded[i])
+		} else {
+			err = c.writeBody(pw, wrapping, concurrency)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// encodeChildren encodes the leaf children of p needing a transfer
+// encoding, concurrency at a time, and returns their bodies by index. Nothing
+// is encoded ahead when concurrency is at most 1 or fewer than two children
+// qualify, or with a single CPU. Streamed children are left out, so that
+// they are not held in memory.
+func (p *Part) encodeChildren(wrapping Base64Wrapping, concurrency int) ([][]byte, error) {
+	encoded := make([][]byte, len(p.Parts))
+
+	// more goroutines than CPUs only add copies
+	if concurrency = min(concurrency, runtime.GOMAXPROCS(0)); concurrency <= 1 {
+		return encoded, nil
+	}
+
+	var leaves []int
+	for i, c := range p.Parts {
+		if c.Parts == nil && len(c.path) == 0 && (c.encoding == EncodingBase64 || c.encoding == EncodingQuotedPrintable) {
+			leaves = append(leaves, i)
+		}
+	}
+
+	if len(leaves) < 2 {
+		return encoded, nil
+	}
+
+	errs := make([]error, len(p.Parts))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, i := range leaves {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int, c *Part) {
+			defer func() { <-slots; wg.Done() }()
+
+			buf := bytes.NewBuffer(make([]byte, 0, c.contentSize(wrapping)))
+			if errs[i] = encode(buf, c.Content, c.encoding, wrapping); errs[i] == nil {
+				encoded[i] = buf.Bytes()
+			}
+		}(i, p.Parts[i])
+	}
+
+	wg.Wait()
+
+	return encoded, errors.Join(errs...)
+}
+
+// setBoundary adds a random boundary parameter to multipart parts which do
+// not define one.
+func (p *Part) setBoundary() error {
+	if p.Parts == nil {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	if len(params["boundary"]) > 0 {
+		return nil
+	}
+
+	params["boundary"] = multipart.NewWriter(io.Discard).Boundary()
+	p.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	return nil
+}
@@ -0,0 +1,135 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// mimeStructure returns the tree of the part of header and body, e.g.
+// "mixed(text/plain,application/pdf)", checking that the related parts
+// reference their root type and that each embedded image has a Content-ID.
+func mimeStructure(t *testing.T, header map[string][]string, body io.Reader) string {
+	t.Helper()
+
+	get := func(key string) string {
+		if values := header[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", get("Content-Type"), err)
+	}
+
+	subtype, ok := strings.CutPrefix(mediaType, "multipart/")
+	if !ok {
+		if strings.HasPrefix(mediaType, "image/") && get("Content-Id") == "" {
+			t.Errorf("%s part without a Content-ID", mediaType)
+		}
+		return mediaType
+	}
+
+	if subtype == "related" && params["type"] != "text/html" {
+		t.Errorf("related part of type %q, want text/html", params["type"])
+	}
+
+	var children []string
+	r := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, mimeStructure(t, p.Header, p))
+	}
+
+	return subtype + "(" + strings.Join(children, ",") + ")"
+}
+
+func TestMimeTreeNesting(t *testing.T) {
+	for _, c := range []struct{ text, html, inline, attachment bool }{
+		{}, {text: true}, {html: true}, {text: true, html: true},
+		{inline: true}, {text: true, inline: true}, {html: true, inline: true}, {text: true, html: true, inline: true},
+		{attachment: true}, {text: true, attachment: true}, {html: true, attachment: true}, {text: true, html: true, attachment: true},
+		{inline: true, attachment: true}, {text: true, inline: true, attachment: true},
+		{html: true, inline: true, attachment: true}, {text: true, html: true, inline: true, attachment: true},
+	} {
+		name := fmt.Sprintf("text=%t,html=%t,inline=%t,attachment=%t", c.text, c.html, c.inline, c.attachment)
+		t.Run(name, func(t *testing.T) {
+			m := rmailer.NewMessage("Hello", "", "")
+			m.SetFromFromString("me@toto.fr")
+			m.SetToFromStrings([]string{"a@toto.fr"})
+
+			if c.text {
+				m.BodyText = "Hello world"
+			}
+			if c.inline {
+				id := m.EmbedBytes("logo.png", []byte("\x89PNG\r\n\x1a\n"))
+				if c.html {
+					m.BodyHtml = `<p>Hello <img src="cid:` + id + `"></p>`
+				}
+			} else if c.html {
+				m.BodyHtml = "<p>Hello world</p>"
+			}
+			if c.attachment {
+				m.AttachBytes("invoice.pdf", []byte("%PDF-1.4"))
+			}
+
+			// mixed > alternative > related, the levels not needed omitted
+			html := "text/html"
+			if c.inline {
+				html = "related(text/html,image/png)"
+			}
+
+			var body string
+			switch {
+			case c.text && c.html:
+				body = "alternative(text/plain," + html + ")"
+			case c.html:
+				body = html
+			case c.text:
+				body = "text/plain"
+			}
+
+			var mixed []string
+			if c.inline && !c.html {
+				mixed = append(mixed, "image/png")
+			}
+			if c.attachment {
+				mixed = append(mixed, "application/pdf")
+			}
+
+			want := body
+			switch {
+			case len(mixed) > 0 && len(body) > 0:
+				want = "mixed(" + body + "," + strings.Join(mixed, ",") + ")"
+			case len(mixed) > 0:
+				want = "mixed(" + strings.Join(mixed, ",") + ")"
+			case len(body) == 0:
+				want = "text/plain"
+			}
+
+			msg, err := mail.ReadMessage(bytes.NewReader(m.ToBytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := mimeStructure(t, msg.Header, msg.Body); got != want {
+				t.Errorf("structure = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package rmailer
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+var messagePool = sync.Pool{
+	New: func() any {
+		return &Message{}
+	},
+}
+
+// AcquireMessage returns an empty Message from a pool, for services
+// building many short-lived messages. The slices of a recycled message keep
+// their capacity. Return it with ReleaseMessage once sent.
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage resets m and returns it to the pool. m must no longer be
+// used, which excludes releasing a message queued with Mailer.Enqueue before
+// its Completed callback.
+func ReleaseMessage(m *Message) {
+	if m == nil {
+		return
+	}
+
+	m.Reset()
+	messagePool.Put(m)
+}
+
+// Reset empties m, keeping the capacity of its slices. Its Metadata is
+// dropped rather than cleared, as it may be held by a SendResult, and
+// SetMetadata allocates a new map when needed.
+func (m *Message) Reset() {
+	clear(m.EnvelopeTo)
+	clear(m.To)
+	clear(m.CC)
+	clear(m.BCC)
+	clear(m.Attachments)
+	clear(m.Parts)
+	clear(m.Headers)
+
+	*m = Message{
+		EnvelopeTo:  m.EnvelopeTo[:0],
+		To:          m.To[:0],
+		CC:          m.CC[:0],
+		BCC:         m.BCC[:0],
+		Attachments: m.Attachments[:0],
+		Parts:       m.Parts[:0],
+		Headers:     m.Headers[:0],
+	}
+}
+
+// clone returns a copy of m sharing none of its slices and maps, for the
+// copies outliving a send, such as retries and dead letters, which must not
+// see a pooled message being reset.
+func (m *Message) clone() *Message {
+	c := *m
+	c.EnvelopeTo = slices.Clone(m.EnvelopeTo)
+	c.To = slices.Clone(m.To)
+	c.CC = slices.Clone(m.CC)
+	c.BCC = slices.Clone(m.BCC)
+	c.Attachments = slices.Clone(m.Attachments)
+	c.Parts = slices.Clone(m.Parts)
+	c.Headers = slices.Clone(m.Headers)
+	c.Metadata = maps.Clone(m.Metadata)
+	c.ContentTypes = maps.Clone(m.ContentTypes)
+
+	return &c
+}
@@ -0,0 +1,107 @@
+package rmailer_test
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// fullMessage returns a message with every field set.
+func fullMessage(t *testing.T) *rmailer.Message {
+	t.Helper()
+
+	m := &rmailer.Message{
+		EnvelopeFrom:       "bounce@toto.fr",
+		EnvelopeTo:         []string{"a@toto.fr"},
+		From:               mail.Address{Address: "me@toto.fr"},
+		To:                 []mail.Address{{Address: "a@toto.fr"}},
+		CC:                 []mail.Address{{Address: "b@toto.fr"}},
+		BCC:                []mail.Address{{Address: "c@toto.fr"}},
+		Subject:            "Hello",
+		Date:               time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+		BodyText:           "Hello",
+		BodyHtml:           "<p>Hello</p>",
+		TextEncoding:       rmailer.EncodingQuotedPrintable,
+		HtmlEncoding:       rmailer.EncodingBase64,
+		TextCharset:        "utf-8",
+		HtmlCharset:        "utf-8",
+		TextFlowed:         true,
+		TargetCharset:      "iso-8859-1",
+		Attachments:        []rmailer.Attachment{{Name: "a.txt", Content: []byte("a")}},
+		AttachmentPolicy:   rmailer.NewAttachmentPolicy(),
+		Parts:              []*rmailer.Part{rmailer.NewPart("text/plain", []byte("part"))},
+		Headers:            []rmailer.Header{{Name: "X-Campaign", Value: "spring"}},
+		Metadata:           map[string]string{"order": "42"},
+		Strict:             true,
+		Identity:           "support",
+		Bulk:               true,
+		IdempotencyKey:     "order-42",
+		ContentTypes:       map[string]string{".log": "text/plain"},
+		DefaultContentType: "text/plain",
+		Base64Wrapping:     rmailer.Base64Wrapping{LineLength: 64},
+		EncodeConcurrency:  2,
+	}
+
+	// a field added to Message must be covered here
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.IsExported() && v.Field(i).IsZero() {
+			t.Fatalf("fullMessage leaves %s unset", field.Name)
+		}
+	}
+
+	return m
+}
+
+func TestResetZeroesMessage(t *testing.T) {
+	m := fullMessage(t)
+	to, attachments, metadata := m.To, m.Attachments, m.Metadata
+
+	m.Reset()
+
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if value.Kind() == reflect.Slice {
+			if value.Len() > 0 || value.Cap() == 0 {
+				t.Errorf("%s has length %d and capacity %d, want 0 and the previous", field.Name, value.Len(), value.Cap())
+			}
+			continue
+		}
+		if !value.IsZero() {
+			t.Errorf("%s = %v after Reset, want zero", field.Name, value)
+		}
+	}
+
+	// the backing arrays kept do not retain the previous content
+	if to[0] != (mail.Address{}) || attachments[0].Content != nil {
+		t.Errorf("backing arrays still hold %v and %v", to[0], attachments[0])
+	}
+	// a SendResult may still hold the previous metadata
+	if metadata["order"] != "42" {
+		t.Errorf("previous metadata = %v, want it untouched", metadata)
+	}
+
+	m.SetMetadata("order", "43")
+	if metadata["order"] != "42" || m.Metadata["order"] != "43" {
+		t.Errorf("Metadata = %v, previous = %v", m.Metadata, metadata)
+	}
+}
+
+func TestReleasedMessageComesBackEmpty(t *testing.T) {
+	for range 10 {
+		m := rmailer.AcquireMessage()
+		if m.Subject != "" || len(m.To) > 0 || m.Metadata != nil || m.Strict {
+			t.Fatalf("acquired message %+v, want an empty one", m)
+		}
+
+		m.Subject = "Hello"
+		m.SetToFromStrings([]string{"a@toto.fr"})
+		m.SetMetadata("order", "42")
+		m.Strict = true
+		rmailer.ReleaseMessage(m)
+	}
+}
@@ -0,0 +1,97 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Preview writes the message as it will be sent to dir for review:
+// headers.txt with the rendered header and the attachment list, body.txt,
+// body.html with its cid: references pointing to the extracted inline
+// images, and those images.
+func (m *Message) Preview(dir string) error {
+	raw, err := m.render()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	header, _, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	summary := bytes.NewBuffer(nil)
+	summary.Write(header)
+	summary.WriteString("\r\n")
+
+	html := m.BodyHtml
+	used := make(map[string]bool)
+
+	if len(m.Attachments) > 0 {
+		summary.WriteString("\r\nAttachments:\r\n")
+	}
+
+	for _, a := range m.Attachments {
+		disposition := "attachment"
+		if a.Inline {
+			disposition = "inline"
+		}
+		fmt.Fprintf(summary, "  %s (%s, %s, %d bytes)\r\n", a.Name, m.contentType(a.Name, a.head()), disposition, a.size())
+
+		if len(a.ContentID) == 0 || a.PreEncoded {
+			continue
+		}
+
+		content := a.Content
+		if a.streamed() {
+			if content, err = os.ReadFile(a.Path); err != nil {
+				return err
+			}
+		}
+
+		name := previewFileName(a.Name, used)
+		if err = os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			return err
+		}
+		html = strings.ReplaceAll(html, "cid:"+a.ContentID, name)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "headers.txt"), summary.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	if len(m.BodyText) > 0 {
+		if err = os.WriteFile(filepath.Join(dir, "body.txt"), []byte(m.BodyText), 0o644); err != nil {
+			return err
+		}
+	}
+
+	if len(m.BodyHtml) > 0 {
+		if err = os.WriteFile(filepath.Join(dir, "body.html"), []byte(html), 0o644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// previewFileName returns a file name for an extracted image which cannot
+// escape the preview directory nor overwrite another file.
+func previewFileName(name string, used map[string]bool) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." || strings.HasPrefix(name, "body.") || name == "headers.txt" {
+		name = "image" + filepath.Ext(name)
+	}
+
+	candidate := name
+	ext := filepath.Ext(name)
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[candidate] = true
+
+	return candidate
+}
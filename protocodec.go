@@ -0,0 +1,510 @@
+package rmailer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"time"
+)
+
+// protoChunkSize is the largest chunk of attachment or part content written
+// in one field.
+const protoChunkSize = 64 << 10
+
+var errProtoTruncated = errors.New("rmailer: truncated protobuf message")
+
+// ProtoCodec encodes messages in the protobuf format of proto/message.proto,
+// the canonical wire format shared with other services. Unknown fields are
+// skipped when decoding.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Name() string {
+	return "proto"
+}
+
+func (ProtoCodec) Marshal(m *Message) ([]byte, error) {
+	var b protoBuffer
+
+	b.string(1, m.EnvelopeFrom)
+	for _, rcpt := range m.EnvelopeTo {
+		b.bytes(25, []byte(rcpt))
+	}
+	if len(m.From.Name) > 0 || len(m.From.Address) > 0 {
+		b.message(2, protoAddress(m.From))
+	}
+	for _, r := range m.To {
+		b.message(3, protoAddress(r))
+	}
+	for _, r := range m.CC {
+		b.message(4, protoAddress(r))
+	}
+	for _, r := range m.BCC {
+		b.message(5, protoAddress(r))
+	}
+	b.string(6, m.Subject)
+	if !m.Date.IsZero() {
+		_, offset := m.Date.Zone()
+		b.varint(7, uint64(m.Date.UnixNano()))
+		b.varint(24, uint64(int64(offset)))
+	}
+	b.string(8, m.BodyText)
+	b.string(9, m.BodyHtml)
+	b.string(10, string(m.TextEncoding))
+	b.string(11, string(m.HtmlEncoding))
+	b.string(12, m.TextCharset)
+	b.string(13, m.HtmlCharset)
+	b.bool(14, m.TextFlowed)
+	b.string(15, m.TargetCharset)
+
+	for _, a := range m.Attachments {
+		var ab protoBuffer
+		ab.string(1, a.Name)
+		ab.chunks(2, a.Content)
+		ab.string(3, a.ContentID)
+		ab.bool(4, a.Inline)
+		ab.string(5, string(a.Encoding))
+		ab.bool(6, a.PreEncoded)
+		ab.string(7, a.Path)
+		b.message(16, ab)
+	}
+
+	for _, p := range m.Parts {
+		b.message(17, protoPart(p))
+	}
+
+	for _, h := range m.Headers {
+		var hb protoBuffer
+		hb.string(1, h.Name)
+		hb.string(2, h.Value)
+		hb.varint(3, uint64(h.Position))
+		b.message(18, hb)
+	}
+
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var eb protoBuffer
+		eb.string(1, k)
+		eb.string(2, m.Metadata[k])
+		b.message(19, eb)
+	}
+
+	b.bool(20, m.Strict)
+	b.string(21, m.Identity)
+	b.bool(22, m.Bulk)
+	b.string(23, m.IdempotencyKey)
+
+	exts := make([]string, 0, len(m.ContentTypes))
+	for ext := range m.ContentTypes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		var eb protoBuffer
+		eb.string(1, ext)
+		eb.string(2, m.ContentTypes[ext])
+		b.message(26, eb)
+	}
+	b.string(27, m.DefaultContentType)
+	b.varint(28, uint64(m.Base64Wrapping.LineLength))
+	b.bool(29, m.Base64Wrapping.LF)
+	b.varint(30, uint64(m.EncodeConcurrency))
+
+	if p := m.AttachmentPolicy; p != nil {
+		var pb protoBuffer
+		for i, list := range [][]string{p.DeniedExtensions, p.DeniedTypes, p.AllowedExtensions, p.AllowedTypes} {
+			for _, v := range list {
+				pb.bytes(i+1, []byte(v))
+			}
+		}
+		b.message(31, pb)
+	}
+
+	return b, nil
+}
+
+func (ProtoCodec) Unmarshal(data []byte) (*Message, error) {
+	m := &Message{}
+	var dateNano, dateOffset int64
+	hasDate := false
+
+	err := protoFields(data, func(field int, v uint64, b []byte) error {
+		var err error
+
+		switch field {
+		case 1:
+			m.EnvelopeFrom = string(b)
+		case 25:
+			m.EnvelopeTo = append(m.EnvelopeTo, string(b))
+		case 2:
+			m.From, err = unmarshalProtoAddress(b)
+		case 3, 4, 5:
+			var addr mail.Address
+			if addr, err = unmarshalProtoAddress(b); err != nil {
+				return err
+			}
+			switch field {
+			case 3:
+				m.To = append(m.To, addr)
+			case 4:
+				m.CC = append(m.CC, addr)
+			default:
+				m.BCC = append(m.BCC, addr)
+			}
+		case 6:
+			m.Subject = string(b)
+		case 7:
+			dateNano, hasDate = int64(v), true
+		case 24:
+			dateOffset = int64(v)
+		case 8:
+			m.BodyText = string(b)
+		case 9:
+			m.BodyHtml = string(b)
+		case 10:
+			m.TextEncoding = TransferEncoding(b)
+		case 11:
+			m.HtmlEncoding = TransferEncoding(b)
+		case 12:
+			m.TextCharset = string(b)
+		case 13:
+			m.HtmlCharset = string(b)
+		case 14:
+			m.TextFlowed = v != 0
+		case 15:
+			m.TargetCharset = string(b)
+		case 16:
+			var a Attachment
+			if a, err = unmarshalProtoAttachment(b); err == nil {
+				m.Attachments = append(m.Attachments, a)
+			}
+		case 17:
+			var p *Part
+			if p, err = unmarshalProtoPart(b); err == nil {
+				m.Parts = append(m.Parts, p)
+			}
+		case 18:
+			var h Header
+			if h, err = unmarshalProtoHeader(b); err == nil {
+				m.Headers = append(m.Headers, h)
+			}
+		case 19:
+			var k, val string
+			err = protoFields(b, func(field int, _ uint64, b []byte) error {
+				switch field {
+				case 1:
+					k = string(b)
+				case 2:
+					val = string(b)
+				}
+				return nil
+			})
+			if err == nil {
+				m.SetMetadata(k, val)
+			}
+		case 20:
+			m.Strict = v != 0
+		case 21:
+			m.Identity = string(b)
+		case 22:
+			m.Bulk = v != 0
+		case 23:
+			m.IdempotencyKey = string(b)
+		case 26:
+			var ext, contentType string
+			err = protoFields(b, func(field int, _ uint64, b []byte) error {
+				switch field {
+				case 1:
+					ext = string(b)
+				case 2:
+					contentType = string(b)
+				}
+				return nil
+			})
+			if err == nil {
+				if m.ContentTypes == nil {
+					m.ContentTypes = make(map[string]string)
+				}
+				m.ContentTypes[ext] = contentType
+			}
+		case 27:
+			m.DefaultContentType = string(b)
+		case 28:
+			m.Base64Wrapping.LineLength = int(int64(v))
+		case 29:
+			m.Base64Wrapping.LF = v != 0
+		case 30:
+			m.EncodeConcurrency = int(int64(v))
+		case 31:
+			m.AttachmentPolicy, err = unmarshalProtoAttachmentPolicy(b)
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hasDate {
+		m.Date = time.Unix(0, dateNano).In(time.FixedZone("", int(dateOffset)))
+	}
+
+	return m, nil
+}
+
+func protoAddress(addr mail.Address) protoBuffer {
+	var b protoBuffer
+	b.string(1, addr.Name)
+	b.string(2, addr.Address)
+	return b
+}
+
+func protoPart(p *Part) protoBuffer {
+	var b protoBuffer
+
+	names := make([]string, 0, len(p.Header))
+	for name := range p.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var fb protoBuffer
+		fb.string(1, name)
+		for _, value := range p.Header[name] {
+			fb.bytes(2, []byte(value))
+		}
+		b.message(1, fb)
+	}
+
+	b.chunks(2, p.Content)
+
+	for _, child := range p.Parts {
+		b.message(3, protoPart(child))
+	}
+
+	return b
+}
+
+func unmarshalProtoAddress(data []byte) (mail.Address, error) {
+	var addr mail.Address
+
+	err := protoFields(data, func(field int, _ uint64, b []byte) error {
+		switch field {
+		case 1:
+			addr.Name = string(b)
+		case 2:
+			addr.Address = string(b)
+		}
+		return nil
+	})
+
+	return addr, err
+}
+
+func unmarshalProtoAttachment(data []byte) (Attachment, error) {
+	var a Attachment
+
+	err := protoFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			a.Name = string(b)
+		case 2:
+			a.Content = append(a.Content, b...)
+		case 3:
+			a.ContentID = string(b)
+		case 4:
+			a.Inline = v != 0
+		case 5:
+			a.Encoding = TransferEncoding(b)
+		case 6:
+			a.PreEncoded = v != 0
+		case 7:
+			a.Path = string(b)
+		}
+		return nil
+	})
+
+	return a, err
+}
+
+func unmarshalProtoAttachmentPolicy(data []byte) (*AttachmentPolicy, error) {
+	p := &AttachmentPolicy{}
+
+	err := protoFields(data, func(field int, _ uint64, b []byte) error {
+		switch field {
+		case 1:
+			p.DeniedExtensions = append(p.DeniedExtensions, string(b))
+		case 2:
+			p.DeniedTypes = append(p.DeniedTypes, string(b))
+		case 3:
+			p.AllowedExtensions = append(p.AllowedExtensions, string(b))
+		case 4:
+			p.AllowedTypes = append(p.AllowedTypes, string(b))
+		}
+		return nil
+	})
+
+	return p, err
+}
+
+func unmarshalProtoHeader(data []byte) (Header, error) {
+	var h Header
+
+	err := protoFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			h.Name = string(b)
+		case 2:
+			h.Value = string(b)
+		case 3:
+			h.Position = HeaderPosition(v)
+		}
+		return nil
+	})
+
+	return h, err
+}
+
+func unmarshalProtoPart(data []byte) (*Part, error) {
+	p := &Part{Header: make(textproto.MIMEHeader)}
+
+	err := protoFields(data, func(field int, _ uint64, b []byte) error {
+		switch field {
+		case 1:
+			var name string
+			var values []string
+			err := protoFields(b, func(field int, _ uint64, b []byte) error {
+				switch field {
+				case 1:
+					name = string(b)
+				case 2:
+					values = append(values, string(b))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			p.Header[name] = values
+		case 2:
+			p.Content = append(p.Content, b...)
+		case 3:
+			child, err := unmarshalProtoPart(b)
+			if err != nil {
+				return err
+			}
+			p.Parts = append(p.Parts, child)
+		}
+		return nil
+	})
+
+	return p, err
+}
+
+// protoBuffer appends protobuf fields, leaving out the zero values as proto3
+// does.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field int, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field)<<3|uint64(wireType))
+}
+
+func (b *protoBuffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	b.tag(field, 0)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) bool(field int, v bool) {
+	if v {
+		b.varint(field, 1)
+	}
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if len(v) > 0 {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// chunks writes v as a repeated bytes field of chunks of protoChunkSize.
+func (b *protoBuffer) chunks(field int, v []byte) {
+	for len(v) > 0 {
+		n := min(len(v), protoChunkSize)
+		b.bytes(field, v[:n])
+		v = v[n:]
+	}
+}
+
+func (b *protoBuffer) message(field int, v protoBuffer) {
+	b.bytes(field, v)
+}
+
+// protoFields calls fn with each field of data, v holding varints and b the
+// length-delimited values. Fixed-size fields are skipped.
+func protoFields(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+
+		field, wireType := int(key>>3), int(key&7)
+
+		var v uint64
+		var b []byte
+
+		switch wireType {
+		case 0:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			data = data[8:]
+			continue
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errProtoTruncated
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("rmailer: unsupported protobuf wire type %d", wireType)
+		}
+
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
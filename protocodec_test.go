@@ -0,0 +1,167 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// protoGolden is a message encoded after proto/message.proto, field by field.
+var protoGolden = []byte("" +
+	"\x0a\x03a@b" + // envelope_from = 1
+	"\xca\x01\x03x@y" + // envelope_to = 25
+	"\x1a\x05\x12\x03c@d" + // to = 3 { address = 2 }
+	"\x32\x02Hi" + // subject = 6
+	"\x82\x01\x07\x0a\x01f\x12\x02ab" + // attachments = 16 { name = 1, content = 2 }
+	"\xa0\x01\x01" + // strict = 20
+	"\xfa\x01\x06\x0a\x04.exe") // attachment_policy = 31 { denied_extensions = 1 }
+
+func protoGoldenMessage() *rmailer.Message {
+	return &rmailer.Message{
+		EnvelopeFrom:     "a@b",
+		EnvelopeTo:       []string{"x@y"},
+		To:               []mail.Address{{Address: "c@d"}},
+		Subject:          "Hi",
+		Attachments:      []rmailer.Attachment{{Name: "f", Content: []byte("ab")}},
+		Strict:           true,
+		AttachmentPolicy: &rmailer.AttachmentPolicy{DeniedExtensions: []string{".exe"}},
+	}
+}
+
+func TestProtoCodecGolden(t *testing.T) {
+	b, err := rmailer.ProtoCodec{}.Marshal(protoGoldenMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, protoGolden) {
+		t.Errorf("Marshal = %q, want %q", b, protoGolden)
+	}
+
+	m, err := rmailer.ProtoCodec{}.Unmarshal(protoGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := protoGoldenMessage(); !reflect.DeepEqual(m, want) {
+		t.Errorf("Unmarshal = %+v, want %+v", m, want)
+	}
+}
+
+func TestProtoCodecRoundTrip(t *testing.T) {
+	date := time.Date(2026, 3, 2, 10, 30, 0, 123, time.FixedZone("CET", 3600))
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10<<10) // several chunks
+
+	related := rmailer.NewMultipart("multipart/related", rmailer.NewPart("text/html", []byte("<p>hi</p>")))
+	related.Header.Add("X-Trace", "a")
+	related.Header.Add("X-Trace", "b")
+
+	m := &rmailer.Message{
+		EnvelopeFrom:  "bounce@toto.fr",
+		EnvelopeTo:    []string{"a@toto.fr", "b@toto.fr"},
+		From:          mail.Address{Name: "Toto", Address: "me@toto.fr"},
+		To:            []mail.Address{{Name: "Zoé", Address: "a@toto.fr"}},
+		CC:            []mail.Address{{Address: "b@toto.fr"}},
+		BCC:           []mail.Address{{Address: "c@toto.fr"}},
+		Subject:       "Café",
+		Date:          date,
+		BodyText:      "Hello",
+		BodyHtml:      "<p>Hello</p>",
+		TextEncoding:  rmailer.TransferEncoding("quoted-printable"),
+		HtmlEncoding:  rmailer.TransferEncoding("base64"),
+		TextCharset:   "iso-8859-1",
+		HtmlCharset:   "utf-8",
+		TextFlowed:    true,
+		TargetCharset: "iso-8859-1",
+		Attachments: []rmailer.Attachment{
+			{Name: "large.bin", Content: large, Encoding: rmailer.TransferEncoding("base64")},
+			{Name: "logo.png", Content: []byte("png"), ContentID: "logo@toto.fr", Inline: true, PreEncoded: true},
+			{Name: "report.pdf", Path: "/var/reports/report.pdf"},
+		},
+		Parts:              []*rmailer.Part{related},
+		Headers:            []rmailer.Header{{Name: "X-Campaign", Value: "spring"}, {Name: "X-First", Value: "1", Position: 1}},
+		Metadata:           map[string]string{"order": "42", "tenant": "acme"},
+		Strict:             true,
+		Identity:           "support",
+		Bulk:               true,
+		IdempotencyKey:     "order-42",
+		ContentTypes:       map[string]string{".log": "text/plain"},
+		DefaultContentType: "application/x-unknown",
+		Base64Wrapping:     rmailer.Base64Wrapping{LineLength: 64, LF: true},
+		EncodeConcurrency:  4,
+		AttachmentPolicy:   rmailer.NewAttachmentPolicy(),
+	}
+
+	b, err := rmailer.ProtoCodec{}.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rmailer.ProtoCodec{}.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the zone keeps its offset, not its name
+	if _, offset := got.Date.Zone(); !got.Date.Equal(date) || offset != 3600 {
+		t.Errorf("Date = %s, want %s", got.Date, date)
+	}
+	got.Date = date
+
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("round trip = %+v\nwant %+v", got, m)
+	}
+}
+
+func TestProtoCodecSkipsUnknownFields(t *testing.T) {
+	data := append(bytes.Clone(protoGolden), ""+
+		"\x98\x06\x05"+ // field 99, varint
+		"\xa1\x06\x01\x02\x03\x04\x05\x06\x07\x08"+ // field 100, fixed64
+		"\xaa\x06\x02zz"+ // field 101, length-delimited
+		"\xb5\x06\x01\x02\x03\x04"...) // field 102, fixed32
+
+	m, err := rmailer.ProtoCodec{}.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := protoGoldenMessage(); !reflect.DeepEqual(m, want) {
+		t.Errorf("Unmarshal = %+v, want %+v", m, want)
+	}
+}
+
+func TestProtoCodecRejectsMalformedInput(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"tag only":         protoGolden[:1],
+		"cut in a value":   protoGolden[:len(protoGolden)-1],
+		"cut in a tag":     []byte("\xca"),
+		"cut in a varint":  []byte("\xa0\x01\x80"),
+		"cut in a fixed64": []byte("\xa1\x06\x01\x02"),
+		"cut in a fixed32": []byte("\xb5\x06\x01"),
+		"length overflow":  []byte("\x0a\xff\xff\xff\xff\xff\xff\xff\xff\x7f"),
+		"cut in a nested":  []byte("\x1a\x02\x12\x03"),
+		"group wire type":  []byte("\x0b"),
+	} {
+		if m, err := (rmailer.ProtoCodec{}).Unmarshal(data); err == nil {
+			t.Errorf("%s: Unmarshal = %+v, want an error", name, m)
+		}
+	}
+}
+
+func TestProtoCodecPartHeaders(t *testing.T) {
+	p := rmailer.NewPart("text/plain", []byte("hi"))
+	p.Header = textproto.MIMEHeader{"Content-Type": {"text/plain"}, "X-A": {"1", "2"}}
+
+	b, err := rmailer.ProtoCodec{}.Marshal(&rmailer.Message{Parts: []*rmailer.Part{p}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := rmailer.ProtoCodec{}.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 1 || !reflect.DeepEqual(m.Parts[0].Header, p.Header) {
+		t.Errorf("part header = %v, want %v", m.Parts[0].Header, p.Header)
+	}
+}
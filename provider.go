@@ -0,0 +1,35 @@
+package rmailer
+
+// MessageOption configures a Message, see Message.Apply.
+type MessageOption func(m *Message)
+
+// Apply applies the options to m.
+func (m *Message) Apply(opts ...MessageOption) {
+	for _, opt := range opts {
+		opt(m)
+	}
+}
+
+// WithSESConfigurationSet selects the Amazon SES configuration set used for
+// event publishing when relaying through the SES SMTP interface.
+func WithSESConfigurationSet(name string) MessageOption {
+	return func(m *Message) {
+		m.SetHeader("X-SES-CONFIGURATION-SET", name)
+	}
+}
+
+// WithMailgunTag tags the message in Mailgun analytics. It may be applied
+// several times.
+func WithMailgunTag(tag string) MessageOption {
+	return func(m *Message) {
+		m.AddHeader("X-Mailgun-Tag", tag)
+	}
+}
+
+// WithPostmarkStream sends the message through the given Postmark message
+// stream.
+func WithPostmarkStream(id string) MessageOption {
+	return func(m *Message) {
+		m.SetHeader("X-PM-Message-Stream", id)
+	}
+}
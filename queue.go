@@ -0,0 +1,646 @@
+package rmailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+// ErrMailerClosed is returned by Enqueue once Shutdown has been called.
+var ErrMailerClosed = errors.New("rmailer: mailer is shut down")
+
+// ErrQueueFull is returned by Enqueue when QueueSize messages are queued.
+var ErrQueueFull = errors.New("rmailer: queue is full")
+
+// QueueStats describes the state of the queue of a Mailer.
+type QueueStats struct {
+	// Depth is the number of messages waiting for a worker.
+	Depth int
+	// InFlight is the number of messages being sent.
+	InFlight int
+	// Deferred is the number of messages waiting for a retry.
+	Deferred int
+	// OldestAge is how long the oldest waiting message has been queued.
+	OldestAge time.Duration
+}
+
+// ShutdownError reports the messages left when Shutdown gave up waiting.
+type ShutdownError struct {
+	// Pending holds the queued messages which were never attempted, and
+	// those waiting for a retry or failing temporarily during the shutdown,
+	// their EnvelopeTo listing the recipients left.
+	Pending []*Message
+	// InFlight is the number of sends still running, whose outcome is
+	// reported to Completed when they end. Those failing temporarily are
+	// left in the Journal.
+	InFlight int
+	Err      error
+}
+
+func (e *ShutdownError) Error() string {
+	msg := fmt.Sprintf("rmailer: shutdown left %d pending and %d in-flight message(s)", len(e.Pending), e.InFlight)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+type queuedMessage struct {
+	m      *Message
+	queued time.Time
+	// journalID is the ID of the Journal entry of m, if any.
+	journalID string
+	// attempts counts the attempts made, and settled holds the statuses of
+	// the recipients they settled, when the message is retried.
+	attempts int
+	settled  []RecipientStatus
+	history  []AuditRecord
+	// sender, when set, sends m instead of the Mailer's Sender.
+	sender *Sender
+	// key is the Dedup key of m as queued, kept by its retries.
+	key string
+	// withdrawn is set when m failed temporarily after Shutdown returned,
+	// and is left in the Journal rather than retried.
+	withdrawn bool
+}
+
+func (ml *Mailer) senderOf(item *queuedMessage) *Sender {
+	if item.sender != nil {
+		return item.sender
+	}
+
+	return ml.Sender
+}
+
+// queue holds the messages sent in the background by the workers of a Mailer.
+type queue struct {
+	mu       sync.Mutex
+	items    []*queuedMessage
+	started  bool
+	closed   bool
+	inFlight int
+	// deferred holds the messages waiting for a retry, released from their
+	// timers unless stop is closed first.
+	deferred map[*queuedMessage]struct{}
+	stop     chan struct{}
+	wake     chan struct{}
+	// space is closed when a message leaves the queue, waking the producers
+	// blocked in EnqueueWait.
+	space chan struct{}
+	// reported is set once Shutdown returned the messages left.
+	reported bool
+	wg       sync.WaitGroup
+}
+
+// Enqueue queues m to be sent in the background by the Mailer workers, which
+// are started on the first call. The outcome is reported to Completed. m must
+// not be modified afterwards. ErrQueueFull is returned when the queue holds
+// QueueSize messages already.
+func (ml *Mailer) Enqueue(m *Message) error {
+	return ml.enqueue(nil, m)
+}
+
+// EnqueueWait is like Enqueue but waits for room in the queue, until ctx is
+// done.
+func (ml *Mailer) EnqueueWait(ctx context.Context, m *Message) error {
+	return ml.enqueue(ctx, m)
+}
+
+// enqueue waits for room unless ctx is nil.
+func (ml *Mailer) enqueue(ctx context.Context, m *Message) error {
+	q := &ml.queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return ErrMailerClosed
+		}
+
+		if ml.QueueSize <= 0 || len(q.items) < ml.QueueSize {
+			break
+		}
+
+		if ctx == nil {
+			return ErrQueueFull
+		}
+
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+
+		q.mu.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			q.mu.Lock()
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+
+	return ml.admit(&queuedMessage{m: m, queued: senderClock(ml.Sender).Now()})
+}
+
+// admit records item in the Journal, if any, and queues it, q.mu being held.
+func (ml *Mailer) admit(item *queuedMessage) error {
+	if ml.Journal != nil {
+		id, err := ml.Journal.Append(item.m)
+		if err != nil {
+			return err
+		}
+		item.journalID = id
+	}
+
+	ml.push(item)
+
+	if sender := ml.senderOf(item); sender != nil {
+		sender.Events.Publish(Event{Type: EventQueued, Metadata: maps.Clone(item.m.Metadata)})
+	}
+
+	return nil
+}
+
+// Recover queues the messages of the Journal which were not acknowledged,
+// e.g. on startup after a crash, and returns their number. They are queued
+// regardless of QueueSize.
+func (ml *Mailer) Recover() (int, error) {
+	if ml.Journal == nil {
+		return 0, errors.New("rmailer: Mailer has no Journal to recover from")
+	}
+
+	q := &ml.queue
+	entries := ml.Journal.Pending()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrMailerClosed
+	}
+
+	for _, entry := range entries {
+		ml.push(&queuedMessage{m: entry.Message, queued: entry.Queued, journalID: entry.ID})
+	}
+
+	return len(entries), nil
+}
+
+// push queues item, starting the workers if needed, q.mu being held.
+func (ml *Mailer) push(item *queuedMessage) {
+	q := &ml.queue
+
+	if !q.started {
+		q.started = true
+		q.wake = make(chan struct{}, 1)
+		q.stop = make(chan struct{})
+
+		for range max(1, ml.Workers) {
+			q.wg.Add(1)
+			go ml.work()
+		}
+	}
+
+	q.items = append(q.items, item)
+	q.signal()
+}
+
+// Shutdown stops accepting messages and waits for the queued and in-flight
+// ones to be sent. When ctx is done first, the queued messages are withdrawn
+// and returned in a *ShutdownError. The messages waiting for a retry are not
+// waited for: they are withdrawn and returned as well, like the in-flight
+// ones failing temporarily, which are not retried. With a Journal, the
+// withdrawn messages stay in it to be recovered on the next start.
+func (ml *Mailer) Shutdown(ctx context.Context) error {
+	q := &ml.queue
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		if q.started {
+			close(q.wake)
+			close(q.stop)
+		}
+		q.freed()
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.reported = true
+	if err == nil && len(q.deferred) == 0 {
+		return nil
+	}
+
+	shutdownErr := &ShutdownError{InFlight: q.inFlight, Err: err}
+	for _, item := range q.items {
+		shutdownErr.Pending = append(shutdownErr.Pending, item.m)
+	}
+	for item := range q.deferred {
+		shutdownErr.Pending = append(shutdownErr.Pending, item.m)
+	}
+	q.items, q.deferred = nil, nil
+	q.freed()
+
+	return shutdownErr
+}
+
+func (ml *Mailer) work() {
+	q := &ml.queue
+	defer q.wg.Done()
+
+	for {
+		item, ok := q.next()
+		if !ok {
+			return
+		}
+
+		rcpts, result, err := ml.sendQueued(item)
+		item.record(ml.senderOf(item), rcpts, result, err)
+		retried := ml.retry(item, rcpts, result, err)
+
+		q.mu.Lock()
+		q.inFlight--
+		q.mu.Unlock()
+
+		if retried {
+			continue
+		}
+
+		failed := EventFailed
+		if item.withdrawn {
+			failed = EventDeferred
+		}
+		ml.publishPending(item, failed, retryRecipients(rcpts, result, err), result, err)
+
+		result, err = item.outcome(rcpts, result, err)
+
+		if ml.DeadLetters != nil && !item.withdrawn {
+			if letter := ml.deadLetter(item, result, err); letter != nil {
+				if err := ml.DeadLetters.Put(letter); err != nil {
+					logf("SMTP dead letter failed: %s", err)
+				}
+			}
+		}
+
+		if ml.Completed != nil {
+			ml.Completed(item.m, result, err)
+		} else if err != nil {
+			logf("SMTP queued send failed: %s", err)
+		}
+
+		if len(item.journalID) > 0 && !item.withdrawn {
+			if err := ml.Journal.Ack(item.journalID); err != nil {
+				logf("SMTP journal acknowledgement failed: %s", err)
+			}
+		}
+	}
+}
+
+// retry defers item for the recipients among rcpts which failed temporarily,
+// or withdraws it when the Mailer is shut down, reporting whether it did.
+func (ml *Mailer) retry(item *queuedMessage, rcpts []string, result *SendResult, err error) bool {
+	// warm-up, throttle and circuit breaker deferrals are not failed
+	// attempts, and wait until the time they give
+	until, deferral := deferredUntil(err)
+
+	if !deferral && (ml.Retry == nil || item.attempts >= ml.Retry.attempts()) || errors.Is(err, ErrDuplicate) {
+		return false
+	}
+
+	pending := retryRecipients(rcpts, result, err)
+	if len(pending) == 0 {
+		return false
+	}
+
+	m := item.m.clone()
+	m.EnvelopeTo = pending
+	if result != nil && len(result.MessageID) > 0 && !m.hasHeader("Message-ID") {
+		// retries keep the Message-ID of the first attempt
+		m.Headers = append([]Header{{Name: "Message-ID", Value: "<" + result.MessageID + ">"}}, m.Headers...)
+	}
+
+	next := &queuedMessage{
+		m:         m,
+		queued:    item.queued,
+		journalID: item.journalID,
+		attempts:  item.attempts,
+		settled:   item.settled,
+		history:   item.history,
+		sender:    item.sender,
+		key:       item.key,
+	}
+	if deferral {
+		next.attempts--
+	}
+
+	if result != nil {
+		retried := make(map[string]bool, len(pending))
+		for _, rcpt := range pending {
+			retried[rcpt] = true
+		}
+
+		for _, status := range result.Recipients {
+			if !retried[status.Address] {
+				next.settled = append(next.settled, status)
+			}
+		}
+	}
+
+	var delay time.Duration
+	var class *BackoffClass
+	if deferral {
+		delay = max(0, until.Sub(senderClock(ml.senderOf(item)).Now()))
+		class = deferralClass(err)
+	} else {
+		delay, class = ml.Retry.Delay(item.attempts, result, err)
+	}
+
+	q := &ml.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		// withdrawn, its Journal entry being left to Recover
+		if q.reported {
+			item.withdrawn = true
+			return false
+		}
+
+		if q.deferred == nil {
+			q.deferred = make(map[*queuedMessage]struct{})
+		}
+		q.deferred[next] = struct{}{}
+
+		logf("SMTP queued send withdrawn by shutdown for %d recipient(s)", len(pending))
+		ml.publishPending(item, EventDeferred, pending, result, err)
+		return true
+	}
+
+	if q.deferred == nil {
+		q.deferred = make(map[*queuedMessage]struct{})
+	}
+	q.deferred[next] = struct{}{}
+
+	logf("SMTP queued send deferred by %s (%s) for %d recipient(s)", delay, class.Name, len(pending))
+	ml.publishPending(item, EventDeferred, pending, result, err)
+
+	after, stop := senderClock(ml.senderOf(item)).After(delay), q.stop
+	go func() {
+		select {
+		case <-after:
+		case <-stop:
+			return
+		}
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if _, ok := q.deferred[next]; ok && !q.closed {
+			delete(q.deferred, next)
+			ml.push(next)
+		}
+	}()
+
+	return true
+}
+
+// deferredUntil returns when a message refused by a WarmUp, a
+// DomainThrottle or an open CircuitBreaker may be sent.
+func deferredUntil(err error) (time.Time, bool) {
+	var warmUpErr *WarmUpError
+	if errors.As(err, &warmUpErr) {
+		return warmUpErr.Until, true
+	}
+
+	var throttleErr *ThrottleError
+	if errors.As(err, &throttleErr) {
+		return throttleErr.Until, true
+	}
+
+	var circuitErr *CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		return circuitErr.Until, true
+	}
+
+	return time.Time{}, false
+}
+
+// publishPending publishes an event of type typ, EventDeferred or
+// EventFailed, for the recipients of pending which failed temporarily on the
+// last attempt of item, the Sender leaving them to the queue.
+func (ml *Mailer) publishPending(item *queuedMessage, typ EventType, pending []string, result *SendResult, err error) {
+	sender := ml.senderOf(item)
+	if sender == nil || sender.Events == nil || len(pending) == 0 {
+		return
+	}
+
+	messageID := item.m.messageID()
+	if result != nil && len(result.MessageID) > 0 {
+		messageID = result.MessageID
+	}
+
+	statuses := filterRecipients(attemptStatuses(pending, result, err), pending, true)
+
+	var retry []string
+	if typ == EventDeferred {
+		retry = pending
+	}
+
+	sender.Events.publishAttempt(item.attempts, statuses, retry, messageID, maps.Clone(item.m.Metadata))
+}
+
+// record counts an attempt of item to rcpts and adds it to its history.
+func (item *queuedMessage) record(s *Sender, rcpts []string, result *SendResult, err error) {
+	item.attempts++
+
+	record := AuditRecord{
+		Time:    clockOf(s.Clock).Now(),
+		Host:    s.Host,
+		Attempt: item.attempts,
+		From:    s.envelopeFrom(item.m),
+		To:      rcpts,
+	}
+
+	if result != nil {
+		record.MessageID, record.Recipients = result.MessageID, result.Recipients
+		record.Response, record.QueueID = result.Response, result.QueueID
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	item.history = append(item.history, record)
+}
+
+// outcome merges the statuses settled by the previous attempts of item into
+// the result of its last attempt to rcpts.
+func (item *queuedMessage) outcome(rcpts []string, result *SendResult, err error) (*SendResult, error) {
+	if len(item.settled) == 0 {
+		return result, err
+	}
+
+	merged := &SendResult{MessageID: item.m.messageID(), Metadata: maps.Clone(item.m.Metadata)}
+	if result != nil {
+		*merged = *result
+	}
+	merged.Recipients = append(append([]RecipientStatus(nil), item.settled...), attemptStatuses(rcpts, result, err)...)
+
+	for _, status := range merged.Recipients {
+		if status.Accepted() {
+			return merged, nil
+		}
+	}
+
+	return merged, err
+}
+
+// sendQueued sends item to the recipients the Dedup store has not seen it
+// sent to already, and returns them. ErrDuplicate is returned when there are
+// none left. As the store is keyed per recipient, a message partially
+// delivered can be retried or re-driven for the others.
+func (ml *Mailer) sendQueued(item *queuedMessage) ([]string, *SendResult, error) {
+	rcpts := item.m.envelopeRecipients()
+	if ml.Dedup == nil {
+		result, err := ml.sendQueuedVia(item, item.m)
+		return rcpts, result, err
+	}
+
+	if len(item.key) == 0 {
+		item.key = dedupKey(item.m)
+	}
+
+	var unseen []string
+	for _, rcpt := range rcpts {
+		seen, err := ml.Dedup.Seen(dedupRecipientKey(item.key, rcpt))
+		if err != nil {
+			return rcpts, nil, err
+		}
+		if !seen {
+			unseen = append(unseen, rcpt)
+		}
+	}
+
+	if len(unseen) == 0 {
+		return rcpts, nil, ErrDuplicate
+	}
+
+	m := item.m
+	if len(unseen) < len(rcpts) {
+		narrowed := *m
+		narrowed.EnvelopeTo = unseen
+		m = &narrowed
+	}
+
+	result, err := ml.sendQueuedVia(item, m)
+	if result != nil {
+		ttl := ml.DedupTTL
+		if ttl <= 0 {
+			ttl = DefaultDedupTTL
+		}
+
+		for _, status := range result.Recipients {
+			if !status.Accepted() {
+				continue
+			}
+			if markErr := ml.Dedup.Mark(dedupRecipientKey(item.key, status.Address), ttl); markErr != nil {
+				logf("SMTP dedup mark failed: %s", markErr)
+			}
+		}
+	}
+
+	return unseen, result, err
+}
+
+func (ml *Mailer) sendQueuedVia(item *queuedMessage, m *Message) (*SendResult, error) {
+	result, err := ml.sendVia(ml.senderOf(item), m, true)
+	return result, redactErr(err)
+}
+
+// next waits for a queued message, reporting false once the queue is closed
+// and empty.
+func (q *queue) next() (*queuedMessage, bool) {
+	for {
+		q.mu.Lock()
+
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			q.inFlight++
+			if len(q.items) > 0 {
+				q.signal()
+			}
+			q.freed()
+			q.mu.Unlock()
+			return item, true
+		}
+
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+
+		<-q.wake
+	}
+}
+
+// QueueStats returns the current state of the queue.
+func (ml *Mailer) QueueStats() QueueStats {
+	q := &ml.queue
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueueStats{Depth: len(q.items), InFlight: q.inFlight, Deferred: len(q.deferred)}
+	if len(q.items) > 0 {
+		stats.OldestAge = time.Since(q.items[0].queued)
+	}
+
+	return stats
+}
+
+// freed wakes up the producers waiting for room, q.mu being held.
+func (q *queue) freed() {
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+}
+
+// signal wakes up an idle worker, q.mu being held.
+func (q *queue) signal() {
+	if q.closed {
+		return
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,378 @@
+package rmailer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+	"github.com/RaoH37/rmailer/rmailertest"
+)
+
+func newTestServer(t *testing.T) *rmailertest.Server {
+	t.Helper()
+
+	srv, err := rmailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+func newTestMessage(rcpts ...string) *rmailer.Message {
+	m := rmailer.NewMessage("Hello", "Hello world", "")
+	m.SetFromFromString("me@toto.fr")
+	m.SetToFromStrings(rcpts)
+	return m
+}
+
+// fastRetry retries every failure after a millisecond.
+func fastRetry(attempts int) *rmailer.Backoff {
+	return &rmailer.Backoff{Attempts: attempts, Default: rmailer.BackoffClass{Name: "test", Delay: time.Millisecond}}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+	}
+}
+
+type completion struct {
+	m      *rmailer.Message
+	result *rmailer.SendResult
+	err    error
+}
+
+// completions records the outcomes reported to Mailer.Completed.
+type completions struct {
+	mu   sync.Mutex
+	done []completion
+	ch   chan struct{}
+}
+
+func newCompletions(ml *rmailer.Mailer) *completions {
+	c := &completions{ch: make(chan struct{}, 100)}
+	ml.Completed = func(m *rmailer.Message, result *rmailer.SendResult, err error) {
+		c.mu.Lock()
+		c.done = append(c.done, completion{m, result, err})
+		c.mu.Unlock()
+		c.ch <- struct{}{}
+	}
+
+	return c
+}
+
+func (c *completions) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.done)
+}
+
+// wait waits for n more completions and returns all of them.
+func (c *completions) wait(t *testing.T, n int) []completion {
+	t.Helper()
+
+	for range n {
+		select {
+		case <-c.ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d completion(s)", n)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]completion(nil), c.done...)
+}
+
+func TestQueueDedupRetriesPartialDelivery(t *testing.T) {
+	srv := newTestServer(t)
+	srv.FailNext("RCPT", "451 4.3.0 try again later")
+
+	ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+	ml.Retry = fastRetry(3)
+	ml.Dedup = rmailer.NewMemoryDedup()
+	done := newCompletions(ml)
+
+	m := newTestMessage("a@toto.fr", "b@toto.fr")
+	m.IdempotencyKey = "order-42"
+	if err := ml.Enqueue(m); err != nil {
+		t.Fatal(err)
+	}
+
+	c := done.wait(t, 1)[0]
+	if c.err != nil {
+		t.Fatalf("retried send failed: %v", c.err)
+	}
+	for _, status := range c.result.Recipients {
+		if !status.Accepted() {
+			t.Errorf("%s not delivered: %d %s", status.Address, status.Code, status.Message)
+		}
+	}
+
+	// a@ deferred on the first attempt, then delivered by the retry
+	delivered := map[string]int{}
+	for _, env := range srv.Messages() {
+		for _, rcpt := range env.To {
+			delivered[rcpt]++
+		}
+	}
+	if delivered["a@toto.fr"] != 1 || delivered["b@toto.fr"] != 1 {
+		t.Fatalf("deliveries = %v, want each recipient once", delivered)
+	}
+
+	// a replay of the same message is a duplicate for both recipients
+	if err := ml.Enqueue(newTestMessage("a@toto.fr", "b@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	replayed := newTestMessage("a@toto.fr", "b@toto.fr")
+	replayed.IdempotencyKey = "order-42"
+	if err := ml.Enqueue(replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	var duplicates int
+	for _, c := range done.wait(t, 2)[1:] {
+		if errors.Is(c.err, rmailer.ErrDuplicate) {
+			duplicates++
+		}
+	}
+	if duplicates != 1 {
+		t.Fatalf("got %d duplicate(s), want 1", duplicates)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownWithdrawsTemporaryFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := rmailer.NewJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	sender := rmailer.NewSender("me@toto.fr", "", "relay.invalid:25")
+	sender.Conn = func() (net.Conn, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+
+	ml := rmailer.NewMailer(sender)
+	ml.Retry = fastRetry(3)
+	ml.Journal = journal
+	done := newCompletions(ml)
+
+	if err := ml.Enqueue(newTestMessage("a@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shutdown := make(chan error)
+	go func() { shutdown <- ml.Shutdown(context.Background()) }()
+	waitFor(t, func() bool { return ml.Enqueue(newTestMessage("b@toto.fr")) == rmailer.ErrMailerClosed })
+	close(release)
+
+	// probes queued before the shutdown are pending too
+	var shutdownErr *rmailer.ShutdownError
+	if err := <-shutdown; !errors.As(err, &shutdownErr) {
+		t.Fatalf("Shutdown() = %v, want a *ShutdownError", err)
+	}
+	withdrawn := false
+	for _, m := range shutdownErr.Pending {
+		withdrawn = withdrawn || m.To[0].Address == "a@toto.fr"
+	}
+	if !withdrawn {
+		t.Fatalf("the in-flight message is not pending")
+	}
+	if n := done.count(); n != 0 {
+		t.Fatalf("Completed called for a withdrawn message")
+	}
+
+	journal.Close()
+	if journal, err = rmailer.NewJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if n := len(journal.Pending()); n != len(shutdownErr.Pending) {
+		t.Fatalf("journal holds %d entries, want the withdrawn message", n)
+	}
+}
+
+func TestQueueRetryEvents(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("a@toto.fr", "451 4.3.0 try again later")
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Events = rmailer.NewEventBus()
+	events, cancel := sender.Events.Subscribe(100)
+	defer cancel()
+
+	ml := rmailer.NewMailer(sender)
+	ml.Retry = fastRetry(2)
+	done := newCompletions(ml)
+
+	if err := ml.Enqueue(newTestMessage("a@toto.fr", "b@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	done.wait(t, 1)
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	var got []string
+	for e := range events {
+		if len(e.Recipient) > 0 {
+			got = append(got, string(e.Type)+" "+e.Recipient)
+		}
+	}
+
+	// a@ is deferred by the queue, then fails once its retries are over
+	want := []string{"delivered b@toto.fr", "deferred a@toto.fr", "failed a@toto.fr"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+// testClock is a Clock whose time only moves with Advance.
+type testClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []testTimer
+}
+
+type testTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, testTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// waiting returns the number of timers not fired yet.
+func (c *testClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = timers
+}
+
+func TestQueueDefersWarmUpExcess(t *testing.T) {
+	srv := newTestServer(t)
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Clock = clock
+
+	ml := rmailer.NewMailer(sender)
+	ml.WarmUp = &rmailer.WarmUp{Start: clock.Now(), Curve: []int{1}, Clock: clock}
+	done := newCompletions(ml)
+
+	for _, rcpt := range []string{"a@toto.fr", "b@toto.fr"} {
+		if err := ml.Enqueue(newTestMessage(rcpt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c := done.wait(t, 1)[0]; c.err != nil || c.m.To[0].Address != "a@toto.fr" {
+		t.Fatalf("first completion = %s, %v", c.m.To[0].Address, c.err)
+	}
+	waitFor(t, func() bool { return ml.QueueStats().Deferred == 1 })
+
+	clock.Advance(24 * time.Hour)
+	if c := done.wait(t, 1)[1]; c.err != nil || c.m.To[0].Address != "b@toto.fr" {
+		t.Fatalf("deferred message not sent the next day: %v", c.err)
+	}
+	if n := len(srv.Messages()); n != 2 {
+		t.Fatalf("server got %d message(s), want 2", n)
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownWithdrawsThrottledMessages(t *testing.T) {
+	srv := newTestServer(t)
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Clock = clock
+
+	ml := rmailer.NewMailer(sender)
+	ml.Throttle = rmailer.NewDomainThrottle(map[string]rmailer.DomainLimit{"toto.fr": {Count: 1, Per: time.Minute}})
+	ml.Throttle.Clock = clock
+	done := newCompletions(ml)
+
+	for _, rcpt := range []string{"a@toto.fr", "b@toto.fr"} {
+		if err := ml.Enqueue(newTestMessage(rcpt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done.wait(t, 1)
+	waitFor(t, func() bool { return ml.QueueStats().Deferred == 1 })
+
+	// the throttled message holds no worker, so Shutdown does not wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var shutdownErr *rmailer.ShutdownError
+	if err := ml.Shutdown(ctx); !errors.As(err, &shutdownErr) || shutdownErr.Err != nil {
+		t.Fatalf("Shutdown = %v, want the throttled message withdrawn", err)
+	}
+	if len(shutdownErr.Pending) != 1 || shutdownErr.Pending[0].To[0].Address != "b@toto.fr" || shutdownErr.InFlight != 0 {
+		t.Fatalf("Pending = %d message(s), InFlight = %d", len(shutdownErr.Pending), shutdownErr.InFlight)
+	}
+	if n := done.count(); n != 1 {
+		t.Fatalf("%d completion(s), want 1", n)
+	}
+}
@@ -0,0 +1,70 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var redacting atomic.Bool
+
+// SetRedaction turns the masking of personal data on or off in the log
+// output of the package and in the errors returned by Sender and Mailer:
+// the local parts of addresses are masked as in "j***@example.com", and so
+// are subjects quoted in server replies. Errors keep wrapping the original
+// ones, which errors.As still finds.
+func SetRedaction(enabled bool) {
+	redacting.Store(enabled)
+}
+
+var (
+	addressPattern = regexp.MustCompile(`([A-Za-z0-9._%+\-=#!$&'*/?^{|}~]+)@([A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*)`)
+	subjectPattern = regexp.MustCompile(`(?i)(subject:[ \t]*)[^\r\n]+`)
+)
+
+// Redact returns s with the local parts of the addresses and the subjects it
+// contains masked.
+func Redact(s string) string {
+	s = addressPattern.ReplaceAllStringFunc(s, func(addr string) string {
+		local, domain, _ := strings.Cut(addr, "@")
+		return local[:1] + "***@" + domain
+	})
+
+	return subjectPattern.ReplaceAllString(s, "${1}***")
+}
+
+// logf logs a message, redacted when SetRedaction is on.
+func logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if redacting.Load() {
+		msg = Redact(msg)
+	}
+
+	log.Println(msg)
+}
+
+// redactedError masks the message of the error it wraps.
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return Redact(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactErr wraps err to mask its message when SetRedaction is on.
+func redactErr(err error) error {
+	var redacted *redactedError
+	if err == nil || !redacting.Load() || errors.As(err, &redacted) {
+		return err
+	}
+
+	return &redactedError{err: err}
+}
@@ -0,0 +1,118 @@
+package rmailer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves relay hosts and mail exchangers. *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// CachingResolver caches the answers of Resolver (net.DefaultResolver when
+// nil). The standard resolver does not expose record TTLs, so answers are
+// kept for TTL, and failed lookups for NegativeTTL.
+type CachingResolver struct {
+	Resolver    Resolver
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]cachedHosts
+	mxs   map[string]cachedMXs
+}
+
+type cachedHosts struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+type cachedMXs struct {
+	mxs     []*net.MX
+	err     error
+	expires time.Time
+}
+
+func NewCachingResolver(resolver Resolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		Resolver:    resolver,
+		TTL:         ttl,
+		NegativeTTL: ttl / 10,
+	}
+}
+
+func (r *CachingResolver) resolver() Resolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+
+	return r.Resolver
+}
+
+func (r *CachingResolver) ttl(err error) time.Duration {
+	if err != nil {
+		return r.NegativeTTL
+	}
+
+	return r.TTL
+}
+
+func (r *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	key := strings.ToLower(host)
+
+	r.mu.Lock()
+	cached, ok := r.hosts[key]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, cached.err
+	}
+
+	addrs, err := r.resolver().LookupHost(ctx, host)
+	if ctx.Err() != nil {
+		// do not cache the cancellation of this caller
+		return addrs, err
+	}
+
+	r.mu.Lock()
+	if r.hosts == nil {
+		r.hosts = make(map[string]cachedHosts)
+	}
+	r.hosts[key] = cachedHosts{addrs: addrs, err: err, expires: time.Now().Add(r.ttl(err))}
+	r.mu.Unlock()
+
+	return addrs, err
+}
+
+func (r *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key := strings.ToLower(name)
+
+	r.mu.Lock()
+	cached, ok := r.mxs[key]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.mxs, cached.err
+	}
+
+	mxs, err := r.resolver().LookupMX(ctx, name)
+	if ctx.Err() != nil {
+		return mxs, err
+	}
+
+	r.mu.Lock()
+	if r.mxs == nil {
+		r.mxs = make(map[string]cachedMXs)
+	}
+	r.mxs[key] = cachedMXs{mxs: mxs, err: err, expires: time.Now().Add(r.ttl(err))}
+	r.mu.Unlock()
+
+	return mxs, err
+}
@@ -0,0 +1,167 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoRecipient = errors.New("rmailer: no recipient accepted the message")
+
+// RetryPolicy configures how SendWithResult retries deferred recipients.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, the first one included.
+	Attempts int
+	// Delay is the wait before the first retry, doubled after each retry.
+	Delay time.Duration
+	// Backoff, when set, chooses the wait of each retry after the class of
+	// the failure instead, Attempts still bounding the attempts.
+	Backoff *Backoff
+}
+
+// RecipientStatus is the outcome of the delivery to one envelope recipient.
+type RecipientStatus struct {
+	Address string `json:"address"`
+	// Code is the SMTP reply code, 0 when the relay could not be reached.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	// Suppressed is set when the recipient was skipped because of the
+	// Sender's SuppressionStore.
+	Suppressed SuppressionReason `json:"suppressed,omitempty"`
+}
+
+func (r RecipientStatus) Accepted() bool {
+	return r.Code/100 == 2
+}
+
+// Temporary reports whether the failure may succeed later (4xx reply or
+// network error).
+func (r RecipientStatus) Temporary() bool {
+	if len(r.Suppressed) > 0 {
+		return false
+	}
+
+	return r.Code/100 == 4 || r.Code == 0
+}
+
+// SendResult describes how the relay accepted a message.
+type SendResult struct {
+	// Response is the text of the final response to DATA, e.g.
+	// "2.0.0 Ok: queued as 4F2B31C0A2".
+	Response string
+	// QueueID is the relay's queue identifier parsed from Response, empty
+	// when the response format is not recognized.
+	QueueID string
+	// MessageID is the Message-ID of the message sent, without angle
+	// brackets.
+	MessageID string
+	// Recipients holds the final status of each envelope recipient.
+	Recipients []RecipientStatus
+	// Metadata is the Message.Metadata of the message sent.
+	Metadata map[string]string
+}
+
+// SizeError reports a message larger than the SIZE limit advertised by the
+// relay (RFC 1870).
+type SizeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("rmailer: message of %d bytes exceeds the relay limit of %d bytes", e.Size, e.Limit)
+}
+
+// sizeLimit returns the SIZE limit advertised by the relay, 0 when none.
+func sizeLimit(c *smtp.Client) int64 {
+	ok, param := c.Extension("SIZE")
+	if !ok {
+		return 0
+	}
+
+	limit, err := strconv.ParseInt(strings.TrimSpace(param), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return limit
+}
+
+// replyCode returns the SMTP code and text of err, code 0 for errors which do
+// not come from a server reply.
+func replyCode(err error) (int, string) {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code, tpErr.Msg
+	}
+
+	return 0, err.Error()
+}
+
+// isTemporary reports whether err is a 4xx reply, a network error or a
+// warm-up deferral.
+func isTemporary(err error) bool {
+	if _, ok := deferredUntil(err); ok {
+		return true
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code/100 == 4
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryRecipients returns the recipients among rcpts to attempt again after
+// an attempt ended with result and err.
+func retryRecipients(rcpts []string, result *SendResult, err error) []string {
+	if result == nil {
+		if err != nil && isTemporary(err) {
+			return rcpts
+		}
+		return nil
+	}
+
+	var retry []string
+
+	for _, status := range result.Recipients {
+		// statuses without reply code come from err, e.g. an SPF refusal
+		// which is not temporary
+		if !status.Accepted() && status.Temporary() && (status.Code != 0 || err == nil || isTemporary(err)) {
+			retry = append(retry, status.Address)
+		}
+	}
+
+	return retry
+}
+
+var queueIDPatterns = []*regexp.Regexp{
+	// Postfix, Exim
+	regexp.MustCompile(`(?i)queued as\s+([^\s;,]+)`),
+	regexp.MustCompile(`(?i)\bid=([^\s;,]+)`),
+	// Exchange
+	regexp.MustCompile(`(?i)\[InternalId=(\d+)`),
+	// Gmail
+	regexp.MustCompile(`(?i)\bOK\s+\d+\s+(\S+)\s+-\s+gsmtp`),
+	// Sendmail
+	regexp.MustCompile(`(?i)^\d\.\d\.\d\s+(\S+)\s+Message accepted`),
+}
+
+// parseQueueID extracts the queue identifier from a DATA response.
+func parseQueueID(response string) string {
+	for _, re := range queueIDPatterns {
+		if m := re.FindStringSubmatch(response); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
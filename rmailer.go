@@ -2,314 +2,312 @@ package rmailer
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
-	"mime"
-	"mime/multipart"
-	"net"
-	"net/http"
 	"net/mail"
-	"net/smtp"
-	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
 	ContentTypeMultipartMixed          = "multipart/mixed"
 	ContentTypeMultipartAlternative    = "multipart/alternative"
+	ContentTypeMultipartRelated        = "multipart/related"
 	ContentTypeTextHtml                = "text/html"
 	ContentTypeTextPlain               = "text/plain"
+	ContentTypeOctetStream             = "application/octet-stream"
 	ContentTypeLine                    = "Content-Type: %s\n"
 	ContentTypeLineBoundary            = "Content-Type: %s; boundary=%s\n\n--%s\n"
 	ContentTransfertEncodingBase64Line = "Content-Transfer-Encoding: base64\n"
-	MimeVersionLine                    = "MIME-Version: 1.0\n"
+	MimeVersionLine                    = "MIME-Version: 1.0\r\n"
 	BoundaryLine                       = "\n\n--%s\n"
+	ContentIDLine                      = "Content-ID: <%s>\r\n"
 	ContentDispositionAttachmentLine   = "Content-Disposition: attachment; filename=\"=?UTF-8?B?%s?=\"\r\n\r\n"
+	ContentDispositionInlineLine       = "Content-Disposition: inline; filename=\"=?UTF-8?B?%s?=\"\r\n\r\n"
 	BackLine                           = "\r\n"
 )
 
-type Sender struct {
-	UserName string
-	Password string
-	Host     string
+type Message struct {
+	// EnvelopeFrom overrides the Sender's MAIL FROM address for this message.
+	EnvelopeFrom string
+	// EnvelopeTo, when set, are the RCPT TO addresses instead of those of
+	// To, CC and BCC, e.g. to send again to some recipients only.
+	EnvelopeTo []string
+	From       mail.Address
+	To         []mail.Address
+	CC         []mail.Address
+	BCC        []mail.Address
+	Subject    string
+	// Date is rendered in the Date header, the time of sending when zero.
+	Date     time.Time
+	BodyText string
+	BodyHtml string
+	// TextEncoding and HtmlEncoding set the Content-Transfer-Encoding of
+	// the bodies, which is chosen from their content when empty.
+	TextEncoding TransferEncoding
+	HtmlEncoding TransferEncoding
+	// TextCharset and HtmlCharset label the bodies, which must already be
+	// encoded in that charset. They default to utf-8.
+	TextCharset string
+	HtmlCharset string
+	// TextFlowed wraps the text body at 78 chars and labels it
+	// format=flowed, so that clients reflow long paragraphs.
+	TextFlowed bool
+	// TargetCharset, when set, transcodes the UTF-8 subject and bodies to
+	// that charset (e.g. ISO-8859-1 or Shift_JIS) when rendering.
+	TargetCharset string
+	Attachments   []Attachment
+	// AttachmentPolicy, when set, is checked by Attach, AttachFile,
+	// AttachFileInline and EmbedFile.
+	AttachmentPolicy *AttachmentPolicy
+	Parts            []*Part
+	Headers          []Header
+	// Metadata is never rendered in the message. It is carried along with
+	// the message so callers can correlate sends with their own entities.
+	Metadata map[string]string
+	// Strict makes rendering fail with a *ComplianceError on any deviation
+	// from RFC 5322, see CheckRFC5322. ToBytes then returns nil.
+	Strict bool
+	// Identity selects the identity registered on the Mailer sending the
+	// message, see Mailer.RegisterIdentity.
+	Identity string
+	// Bulk flags marketing or other bulk mail, which a Mailer completes with
+	// unsubscribe links.
+	Bulk bool
+	// IdempotencyKey identifies the message to the Mailer's Dedup store,
+	// which hashes its content when empty, so that identical messages are
+	// sent once. It is never rendered.
+	IdempotencyKey string
+	// ContentTypes maps attachment file extensions in lower case, e.g.
+	// ".log", to the content type to label them with instead of the
+	// detected one.
+	ContentTypes map[string]string
+	// DefaultContentType labels the attachments whose type is unknown,
+	// application/octet-stream when empty.
+	DefaultContentType string
+	// Base64Wrapping sets the lines of the base64 encoded parts.
+	Base64Wrapping Base64Wrapping
+	// EncodeConcurrency, above 1, encodes up to that many attachments at
+	// once when rendering, each being held in memory until written.
+	// Attachments streamed from a Path are still encoded as they are
+	// written.
+	EncodeConcurrency int
+
+	subjectCharset string
 }
 
-func NewSender(username string, password string, host string) *Sender {
-	return &Sender{
-		UserName: username,
-		Password: password,
-		Host:     host,
-	}
+func (m *Message) SetFromFromString(s string) {
+	m.From = mail.Address{Address: s}
 }
 
-func (s *Sender) IsAuthenticated() bool {
-	return len(s.Password) > 0
-}
+func (m *Message) SetToFromStrings(ss []string) {
+	m.To = make([]mail.Address, len(ss))
 
-func (s *Sender) Send(m *Message) error {
-	if s.IsAuthenticated() {
-		return s.AuthenticatedSend(m)
-	} else {
-		return s.AnonymousSend(m)
+	for i, r := range ss {
+		m.To[i] = mail.Address{Address: r}
 	}
 }
 
-func (s *Sender) AnonymousSend(m *Message) error {
-	log.Println(fmt.Sprintf("SMTP connection to %s with username %s", s.Host, s.UserName))
-
-	c, err := smtp.Dial(s.Host)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+func (m *Message) SetCcFromStrings(ss []string) {
+	m.CC = make([]mail.Address, len(ss))
 
-	if err = c.Mail(s.UserName); err != nil {
-		return err
+	for i, r := range ss {
+		m.CC[i] = mail.Address{Address: r}
 	}
-	defer c.Close()
-
-	recipients(c, m)
+}
 
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+func (m *Message) SetBccFromStrings(ss []string) {
+	m.BCC = make([]mail.Address, len(ss))
 
-	_, err = w.Write(m.ToBytes())
-	if err != nil {
-		return err
+	for i, r := range ss {
+		m.BCC[i] = mail.Address{Address: r}
 	}
-	defer c.Close()
+}
 
-	err = w.Close()
-	if err != nil {
-		return err
+func (m *Message) SetMetadata(key string, value string) {
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]string)
 	}
-	defer c.Close()
 
-	return c.Quit()
+	m.Metadata[key] = value
 }
 
-func (s *Sender) AuthenticatedSend(m *Message) error {
-	log.Println(fmt.Sprintf("SMTP AUTH connection to %s", s.Host))
-
-	host, _, _ := net.SplitHostPort(s.Host)
-
-	auth := smtp.PlainAuth("", s.UserName, s.Password, host)
-
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         host,
+func (m *Message) envelopeRecipients() []string {
+	if len(m.EnvelopeTo) > 0 {
+		return m.EnvelopeTo
 	}
 
-	conn, err := tls.Dial("tcp", s.Host, tlsconfig)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+	var rcpts []string
 
-	c, err := smtp.NewClient(conn, host)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	// Auth
-	if err = c.Auth(auth); err != nil {
-		return err
+	for _, r := range m.To {
+		rcpts = append(rcpts, r.Address)
 	}
-	defer c.Close()
 
-	if err = c.Mail(s.UserName); err != nil {
-		return err
+	for _, r := range m.CC {
+		rcpts = append(rcpts, r.Address)
 	}
-	defer c.Close()
 
-	recipients(c, m)
-
-	// Data
-	w, err := c.Data()
-	if err != nil {
-		return err
+	for _, r := range m.BCC {
+		rcpts = append(rcpts, r.Address)
 	}
-	defer c.Close()
 
-	_, err = w.Write(m.ToBytes())
-	if err != nil {
-		return err
-	}
-	defer c.Close()
+	return rcpts
+}
 
-	err = w.Close()
-	if err != nil {
-		return err
+func NewMessage(subject, text string, html string) *Message {
+	return &Message{
+		Subject:  subject,
+		BodyText: text,
+		BodyHtml: html,
 	}
-	defer c.Close()
+}
 
-	return c.Quit()
+func (m *Message) ToBytes() []byte {
+	b, _ := m.render()
+	return b
 }
 
-func recipients(c *smtp.Client, m *Message) {
-	for _, r := range m.To {
-		if err := c.Rcpt(r.Address); err != nil {
-			log.Println(err)
-		}
+// render returns the rendered message, or the error ToBytes discards.
+func (m *Message) render() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := m.writeTo(buf); err != nil {
+		return nil, err
 	}
 
-	for _, r := range m.CC {
-		if err := c.Rcpt(r.Address); err != nil {
-			log.Println(err)
+	if m.Strict {
+		if err := CheckRFC5322(buf.Bytes()); err != nil {
+			return nil, err
 		}
 	}
 
-	for _, r := range m.BCC {
-		if err := c.Rcpt(r.Address); err != nil {
-			log.Println(err)
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the rendered message to w as it is encoded. In Strict mode
+// the message is rendered in memory first, so that nothing is written when it
+// fails the compliance check.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if m.Strict {
+		b, err := m.render()
+		if err != nil {
+			return 0, err
 		}
+
+		n, err := w.Write(b)
+		return int64(n), err
 	}
-}
 
-type Message struct {
-	From        mail.Address
-	To          []mail.Address
-	CC          []mail.Address
-	BCC         []mail.Address
-	Subject     string
-	BodyText    string
-	BodyHtml    string
-	Attachments map[string][]byte
+	cw := &countingWriter{w: w}
+	err := m.writeTo(cw)
+	return cw.n, err
 }
 
-func (m *Message) SetFromFromString(s string) {
-	m.From = mail.Address{Address: s}
-}
+// Reader returns the rendered message as a reader, encoding it lazily as it
+// is read. Rendering errors are returned by Read. The reader must be read to
+// EOF, or the encoding goroutine is left blocked.
+func (m *Message) Reader() io.Reader {
+	pr, pw := io.Pipe()
 
-func (m *Message) SetToFromStrings(ss []string) {
-	m.To = make([]mail.Address, len(ss))
+	go func() {
+		_, err := m.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
 
-	for i, r := range ss {
-		m.To[i] = mail.Address{Address: r}
-	}
+	return pr
 }
 
-func (m *Message) SetCcFromStrings(ss []string) {
-	m.CC = make([]mail.Address, len(ss))
-
-	for i, r := range ss {
-		m.CC[i] = mail.Address{Address: r}
-	}
+type countingWriter struct {
+	w io.Writer
+	n int64
 }
 
-func (m *Message) SetBccFromStrings(ss []string) {
-	m.BCC = make([]mail.Address, len(ss))
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
 
-	for i, r := range ss {
-		m.BCC[i] = mail.Address{Address: r}
+func (m *Message) writeTo(w io.Writer) error {
+	m, head, root, err := m.layout()
+	if err != nil {
+		return err
 	}
-}
 
-func NewMessage(subject, text string, html string) *Message {
-	return &Message{
-		Subject:     subject,
-		BodyText:    text,
-		BodyHtml:    html,
-		Attachments: make(map[string][]byte),
+	if buf, ok := w.(*bytes.Buffer); ok {
+		// allocate the rendered message at once rather than growing it
+		buf.Grow(len(head) + int(root.headerSize()+root.encodedSize(m.Base64Wrapping)))
 	}
-}
 
-func (m *Message) AttachFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
+	if _, err := w.Write(head); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	b, err := io.ReadAll(file)
-	if err != nil {
+	if err := root.writeHeader(w); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, fileName := filepath.Split(path)
-	m.Attachments[fileName] = b
-	return nil
+	return root.writeBody(w, m.Base64Wrapping, m.EncodeConcurrency)
 }
 
-func (m *Message) ToBytes() []byte {
-	var coder = base64.StdEncoding
-
-	mb := &MessageBuilder{Message: m, Coder: coder}
-	withAttachments := len(m.Attachments) > 0
-	bothBody := len(m.BodyHtml) > 0 && len(m.BodyText) > 0
-
-	buf := bytes.NewBuffer(nil)
-	buf.WriteString(mb.FromLine())
-	buf.WriteString(mb.ToLine())
-
-	if len(m.CC) > 0 {
-		buf.WriteString(mb.CcLine())
+// SizeHint returns the size of the rendered message, computed without
+// encoding it, e.g. to size a buffer or check it against the SIZE limit of
+// a relay. It is exact but for quoted-printable parts, which are estimated,
+// and 0 when the message cannot be rendered.
+func (m *Message) SizeHint() int64 {
+	m, head, root, err := m.layout()
+	if err != nil {
+		return 0
 	}
 
-	buf.WriteString(mb.SubjectLine())
-
-	buf.WriteString(MimeVersionLine)
-
-	writer := multipart.NewWriter(buf)
-	boundaryMixed := writer.Boundary()
-	boundaryAlternative := writer.Boundary()
+	return int64(len(head)) + root.headerSize() + root.encodedSize(m.Base64Wrapping)
+}
 
-	if withAttachments {
-		buf.WriteString(fmt.Sprintf(ContentTypeLineBoundary, ContentTypeMultipartMixed, boundaryMixed, boundaryMixed))
+// layout returns the message as it is rendered, its text flowed and
+// transcoded, with its header and MIME tree.
+func (m *Message) layout() (*Message, []byte, *Part, error) {
+	if m.TextFlowed && len(m.BodyText) > 0 {
+		// wrapped before transcoding, so that lines are cut between runes
+		flowed := *m
+		flowed.BodyText = flowText(m.BodyText)
+		m = &flowed
 	}
 
-	if bothBody {
-		buf.WriteString(fmt.Sprintf(ContentTypeLineBoundary, ContentTypeMultipartAlternative, boundaryAlternative, boundaryAlternative))
+	if len(m.TargetCharset) > 0 {
+		t, err := m.transcoded()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		m = t
 	}
 
-	if len(m.BodyHtml) > 0 {
-		buf.WriteString(mb.BodyHtmlLine())
+	mb := &MessageBuilder{Message: m, Coder: base64.StdEncoding}
 
-		if len(m.BodyText) > 0 {
-			buf.WriteString(fmt.Sprintf(BoundaryLine, boundaryAlternative))
-		}
+	buf := bytes.NewBuffer(nil)
+	if err := m.writeHeaders(buf, HeaderBeforeStandard); err != nil {
+		return nil, nil, nil, err
 	}
 
-	if len(m.BodyText) > 0 {
-		buf.WriteString(mb.BodyTextLine())
+	if !m.hasHeader("Date") {
+		buf.WriteString(mb.DateLine())
 	}
 
-	if withAttachments {
-		for k, v := range m.Attachments {
-			buf.WriteString(fmt.Sprintf(BoundaryLine, boundaryMixed))
-
-			buf.WriteString(fmt.Sprintf(ContentTypeLine, getContentType(k, v)))
-			buf.WriteString(ContentTransfertEncodingBase64Line)
-			buf.WriteString(fmt.Sprintf(ContentDispositionAttachmentLine, coder.EncodeToString([]byte(k))))
-
-			b := make([]byte, base64.StdEncoding.EncodedLen(len(v)))
-			base64.StdEncoding.Encode(b, v)
+	buf.WriteString(mb.FromLine())
+	buf.WriteString(mb.ToLine())
 
-			// write base64 content in lines of up to 76 chars
-			for i, l := 0, len(b); i < l; i++ {
-				buf.WriteByte(b[i])
-				if (i+1)%76 == 0 {
-					buf.WriteString(BackLine)
-				}
-			}
+	if len(m.CC) > 0 {
+		buf.WriteString(mb.CcLine())
+	}
 
-			buf.WriteString(fmt.Sprintf(BoundaryLine, boundaryMixed))
-		}
+	buf.WriteString(mb.SubjectLine())
 
-		buf.WriteString("--")
+	buf.WriteString(MimeVersionLine)
+	if err := m.writeHeaders(buf, HeaderAfterStandard); err != nil {
+		return nil, nil, nil, err
 	}
 
-	return buf.Bytes()
+	return m, buf.Bytes(), m.mimeTree(), nil
 }
 
 type MessageBuilder struct {
@@ -317,8 +315,18 @@ type MessageBuilder struct {
 	Coder   *base64.Encoding
 }
 
+func (mb *MessageBuilder) DateLine() string {
+	date := mb.Message.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	return fmt.Sprintf("Date: %s\r\n", date.Format(time.RFC1123Z))
+}
+
 func (mb *MessageBuilder) FromLine() string {
-	return fmt.Sprintf("From: %s\r\n", mb.Message.From.String())
+	from := headerAddress(mb.Message.From)
+	return fmt.Sprintf("From: %s\r\n", from.String())
 }
 
 func (mb *MessageBuilder) ToLine() string {
@@ -330,8 +338,13 @@ func (mb *MessageBuilder) CcLine() string {
 }
 
 func (mb *MessageBuilder) SubjectLine() string {
-	var subjectUtf8 = mb.Coder.EncodeToString([]byte(mb.Message.Subject))
-	return fmt.Sprintf("Subject: =?UTF-8?B?%s?=\r\n", subjectUtf8)
+	charset := mb.Message.subjectCharset
+	if len(charset) == 0 {
+		charset = "UTF-8"
+	}
+
+	// encoded words are kept under 75 chars and folded onto continuation lines
+	return foldHeader("Subject", encodeWords(charset, mb.Message.Subject))
 }
 
 func (mb *MessageBuilder) BodyLine(content string, contentType string) string {
@@ -346,20 +359,66 @@ func (mb *MessageBuilder) BodyTextLine() string {
 	return mb.BodyLine(mb.Message.BodyText, ContentTypeTextPlain)
 }
 
+// foldHeader formats a header field, folding value at spaces so that lines
+// stay within 78 chars where possible.
+func foldHeader(name string, value string) string {
+	buf := bytes.NewBufferString(name + ":")
+	lineLength := buf.Len()
+
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxLineLength {
+			buf.WriteString("\r\n")
+			lineLength = 0
+		}
+
+		buf.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+
+	buf.WriteString("\r\n")
+	return buf.String()
+}
+
+// appendHtml inserts block at the end of the HTML body, before </body> when
+// present.
+func appendHtml(body string, block string) string {
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+		return body[:i] + block + body[i:]
+	}
+
+	return body + block
+}
+
 func getContentType(name string, content []byte) string {
-	contentType := http.DetectContentType(content)
-	if strings.HasPrefix(contentType, ContentTypeTextPlain) {
-		ext := filepath.Ext(name)
-		contentType = mime.TypeByExtension(ext)
+	return DefaultContentTypes.Detect(name, content)
+}
+
+// contentType returns the type of the attachment name holding content, as
+// overridden by ContentTypes, never empty.
+func (m *Message) contentType(name string, content []byte) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, key := range []string{ext, strings.TrimPrefix(ext, ".")} {
+		if contentType := m.ContentTypes[key]; len(key) > 0 && len(contentType) > 0 {
+			return contentType
+		}
+	}
+
+	if contentType := getContentType(name, content); len(contentType) > 0 {
+		return contentType
+	}
+
+	if len(m.DefaultContentType) > 0 {
+		return m.DefaultContentType
 	}
 
-	return contentType
+	return ContentTypeOctetStream
 }
 
 func getRecipientsStr(recipients []mail.Address) string {
 	var recipientsStr []string
 
 	for _, r := range recipients {
+		r = headerAddress(r)
 		recipientsStr = append(recipientsStr, r.String())
 	}
 
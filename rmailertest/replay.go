@@ -0,0 +1,356 @@
+package rmailertest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A transcript holds one session per "--" separator line, followed by one
+// line per protocol line: "C " or "S " for the client or the server, then
+// the Go quoted line, CRLF included.
+const sessionSeparator = "--"
+
+// Recorder writes the transcripts of the SMTP sessions of the connections it
+// wraps. Its Wrap method is meant to be set as rmailer.Sender.WrapConn.
+// Transcripts include the AUTH exchange, so record with test credentials.
+type Recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Wrap starts the transcript of a new session carried by conn.
+func (r *Recorder) Wrap(conn net.Conn) net.Conn {
+	r.mu.Lock()
+	fmt.Fprintln(r.w, sessionSeparator)
+	r.mu.Unlock()
+
+	return &recordedConn{Conn: conn, recorder: r}
+}
+
+func (r *Recorder) record(direction byte, line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintf(r.w, "%c %s\n", direction, strconv.Quote(string(line)))
+}
+
+type recordedConn struct {
+	net.Conn
+	recorder *Recorder
+	read     []byte
+	written  []byte
+	// payload is the size of the BDAT chunk being written.
+	payload int
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read = c.flush('S', append(c.read, b[:n]...))
+	return n, err
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.written = c.flush('C', append(c.written, b...))
+	return c.Conn.Write(b)
+}
+
+// flush records the complete lines of buf and returns the rest. A BDAT
+// chunk is recorded once written whole, as it need not end with a line feed.
+func (c *recordedConn) flush(direction byte, buf []byte) []byte {
+	for {
+		if c.payload > 0 {
+			if len(buf) < c.payload {
+				return buf
+			}
+
+			chunk := buf[:c.payload]
+			for len(chunk) > 0 {
+				end := bytes.IndexByte(chunk, '\n') + 1
+				if end == 0 {
+					end = len(chunk)
+				}
+				c.recorder.record(direction, chunk[:end])
+				chunk = chunk[end:]
+			}
+
+			buf, c.payload = buf[c.payload:], 0
+			continue
+		}
+
+		end := bytes.IndexByte(buf, '\n')
+		if end < 0 {
+			return buf
+		}
+
+		line := buf[:end+1]
+		c.recorder.record(direction, line)
+		buf = buf[end+1:]
+
+		if direction == 'C' {
+			c.payload, _, _ = parseBDAT(string(line))
+		}
+	}
+}
+
+// parseBDAT parses a BDAT command line, returning the size of its chunk and
+// whether it is the last one.
+func parseBDAT(line string) (int, bool, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || !strings.EqualFold(fields[0], "BDAT") {
+		return 0, false, false
+	}
+
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+
+	last := len(fields) == 3
+	if last && !strings.EqualFold(fields[2], "LAST") {
+		return 0, false, false
+	}
+
+	return size, last, true
+}
+
+type transcriptLine struct {
+	client bool
+	text   string
+}
+
+// Replayer plays recorded sessions back in place of a server, failing when
+// the client deviates from the transcript. Message contents sent after DATA
+// or BDAT are not compared, as they hold random boundaries and dates, nor
+// the sizes of the BDAT chunks.
+type Replayer struct {
+	mu       sync.Mutex
+	sessions [][]transcriptLine
+	err      error
+}
+
+// NewReplayer reads a transcript written by a Recorder.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+
+		if line == sessionSeparator {
+			p.sessions = append(p.sessions, nil)
+			continue
+		}
+
+		if len(line) < 3 || (line[0] != 'C' && line[0] != 'S') || line[1] != ' ' || len(p.sessions) == 0 {
+			return nil, fmt.Errorf("rmailertest: malformed transcript line %d", n)
+		}
+
+		text, err := strconv.Unquote(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("rmailertest: malformed transcript line %d: %w", n, err)
+		}
+
+		last := len(p.sessions) - 1
+		p.sessions[last] = append(p.sessions[last], transcriptLine{client: line[0] == 'C', text: text})
+	}
+
+	return p, scanner.Err()
+}
+
+// Conn returns a connection replaying the next recorded session. It is meant
+// to be set as rmailer.Sender.Conn.
+func (p *Replayer) Conn() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.sessions) == 0 {
+		return nil, errors.New("rmailertest: no recorded session left")
+	}
+
+	session := p.sessions[0]
+	p.sessions = p.sessions[1:]
+
+	return &replayConn{replayer: p, lines: session}, nil
+}
+
+// Err returns the first deviation from the transcript, if any.
+func (p *Replayer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+// Done returns an error if some recorded sessions were not replayed, or if
+// the client deviated from the transcript.
+func (p *Replayer) Done() error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.sessions) > 0 {
+		return fmt.Errorf("rmailertest: %d recorded session(s) not replayed", len(p.sessions))
+	}
+
+	return nil
+}
+
+func (p *Replayer) fail(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+
+	return err
+}
+
+type replayConn struct {
+	replayer *Replayer
+	lines    []transcriptLine
+	pending  []byte
+	written  []byte
+	inData   bool
+	// payload is the size of the BDAT chunk left to skip.
+	payload int
+	closed  bool
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	for len(c.pending) == 0 {
+		if len(c.lines) == 0 {
+			return 0, io.EOF
+		}
+
+		if c.lines[0].client {
+			return 0, c.replayer.fail(fmt.Errorf("rmailertest: client waits for a reply, expected it to send %q", c.lines[0].text))
+		}
+
+		c.pending = append(c.pending, c.lines[0].text...)
+		c.lines = c.lines[1:]
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.written = append(c.written, b...)
+
+	for {
+		if c.payload > 0 {
+			n := min(c.payload, len(c.written))
+			c.written, c.payload = c.written[n:], c.payload-n
+			if c.payload > 0 {
+				return len(b), nil
+			}
+		}
+
+		end := bytes.IndexByte(c.written, '\n')
+		if end < 0 {
+			return len(b), nil
+		}
+
+		line := string(c.written[:end+1])
+		c.written = c.written[end+1:]
+
+		if err := c.expect(line); err != nil {
+			return 0, c.replayer.fail(err)
+		}
+	}
+}
+
+// expect matches a line sent by the client against the transcript.
+func (c *replayConn) expect(line string) error {
+	if c.inData {
+		// skip the recorded content up to its terminating dot
+		for len(c.lines) > 0 && c.lines[0].client && c.lines[0].text != ".\r\n" {
+			c.lines = c.lines[1:]
+		}
+
+		if line != ".\r\n" {
+			return nil
+		}
+		c.inData = false
+	}
+
+	if len(c.lines) == 0 || !c.lines[0].client {
+		return fmt.Errorf("rmailertest: unexpected command %q", strings.TrimSpace(line))
+	}
+
+	expected := c.lines[0].text
+	if size, last, ok := parseBDAT(line); ok {
+		return c.expectBDAT(size, last, expected)
+	}
+
+	if line != expected {
+		return fmt.Errorf("rmailertest: sent %q, recorded %q", strings.TrimSpace(line), strings.TrimSpace(expected))
+	}
+	c.lines = c.lines[1:]
+
+	if strings.EqualFold(strings.TrimSpace(line), "DATA") && len(c.lines) > 0 && strings.HasPrefix(c.lines[0].text, "354") {
+		c.inData = true
+	}
+
+	return nil
+}
+
+// expectBDAT matches a BDAT command against the recorded one, and skips
+// both chunks.
+func (c *replayConn) expectBDAT(size int, last bool, expected string) error {
+	recorded, recordedLast, ok := parseBDAT(expected)
+	if !ok || last != recordedLast {
+		return fmt.Errorf("rmailertest: sent BDAT %d (last %t), recorded %q", size, last, strings.TrimSpace(expected))
+	}
+	c.lines = c.lines[1:]
+	c.payload = size
+
+	for skipped := 0; skipped < recorded && len(c.lines) > 0 && c.lines[0].client; {
+		skipped += len(c.lines[0].text)
+		c.lines = c.lines[1:]
+	}
+
+	return nil
+}
+
+func (c *replayConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
@@ -0,0 +1,54 @@
+package rmailertest_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+	"github.com/RaoH37/rmailer/rmailertest"
+)
+
+func TestReplayBDAT(t *testing.T) {
+	srv, err := rmailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Extensions = []string{"CHUNKING"}
+
+	newMessage := func() *rmailer.Message {
+		m := rmailer.NewMessage("Replay", "line one\nline two\n"+strings.Repeat("x", 300), "")
+		m.SetFromFromString("me@toto.fr")
+		m.SetToFromStrings([]string{"you@toto.fr"})
+		return m
+	}
+
+	var transcript bytes.Buffer
+	rec := rmailertest.NewRecorder(&transcript)
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.ChunkSize = 100
+	sender.WrapConn = rec.Wrap
+	if err := sender.Send(newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(transcript.String(), "BDAT") {
+		t.Fatalf("transcript has no BDAT command:\n%s", transcript.String())
+	}
+
+	replayer, err := rmailertest.NewReplayer(&transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender = rmailer.NewSender("me@toto.fr", "", "replay")
+	sender.ChunkSize = 100
+	sender.Conn = replayer.Conn
+	if err := sender.Send(newMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayer.Done(); err != nil {
+		t.Fatal(err)
+	}
+}
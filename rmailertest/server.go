@@ -0,0 +1,519 @@
+// Package rmailertest provides an in-process SMTP server for testing code
+// sending mail with rmailer.
+package rmailertest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Envelope is a message accepted by the Server.
+type Envelope struct {
+	From string
+	To   []string
+	// Data is the raw message, dot-unstuffed and CRLF terminated.
+	Data []byte
+	// UserName is the authenticated user, if any.
+	UserName string
+	// TLS reports whether the session was encrypted.
+	TLS bool
+}
+
+// Server is an SMTP server recording the messages it accepts. Its
+// configuration fields must be set before Start.
+type Server struct {
+	// Addr is the address the server listens on, set by Start.
+	Addr string
+	// ImplicitTLS serves TLS from the first byte, as expected by an
+	// authenticated Sender.
+	ImplicitTLS bool
+	// StartTLS advertises the STARTTLS extension.
+	StartTLS bool
+	// TLSConfig defaults to a self-signed certificate for localhost.
+	TLSConfig *tls.Config
+	// Users, when set, enables AUTH PLAIN and LOGIN for these user names and
+	// passwords.
+	Users map[string]string
+	// Extensions are additional EHLO keywords, e.g. "SIZE 1000000",
+	// "SMTPUTF8" or "CHUNKING". BDAT is accepted whether advertised or not.
+	Extensions []string
+
+	ln       net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	messages []Envelope
+	failures map[string][]string
+	rejected map[string]string
+	conns    map[net.Conn]bool
+}
+
+// NewServer returns a plain text server listening on a random local port.
+func NewServer() (*Server, error) {
+	s := &Server{}
+	return s, s.Start()
+}
+
+// NewTLSServer returns an implicit TLS server accepting the given user.
+func NewTLSServer(username string, password string) (*Server, error) {
+	s := &Server{ImplicitTLS: true, Users: map[string]string{username: password}}
+	return s, s.Start()
+}
+
+// Start listens on a random port of the loopback interface.
+func (s *Server) Start() error {
+	if s.TLSConfig == nil && (s.ImplicitTLS || s.StartTLS) {
+		config, err := selfSignedConfig()
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = config
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	if s.ImplicitTLS {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+
+	s.ln = ln
+	s.Addr = ln.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return nil
+}
+
+// Close stops the server, ending the open sessions.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Messages returns the messages accepted so far.
+func (s *Server) Messages() []Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Envelope(nil), s.messages...)
+}
+
+// Reset forgets the accepted messages and the injected failures.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+	s.failures = nil
+	s.rejected = nil
+}
+
+// FailNext makes the next occurrence of command (e.g. "MAIL", "RCPT",
+// "DATA" for the reply after the content or to BDAT LAST, "AUTH") get
+// reply, such as "451 4.3.0 try again later". Calls queue up.
+func (s *Server) FailNext(command string, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures == nil {
+		s.failures = make(map[string][]string)
+	}
+	command = strings.ToUpper(command)
+	s.failures[command] = append(s.failures[command], reply)
+}
+
+// RejectRecipient answers reply to every RCPT for address.
+func (s *Server) RejectRecipient(address string, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejected == nil {
+		s.rejected = make(map[string]string)
+	}
+	s.rejected[strings.ToLower(address)] = reply
+}
+
+func (s *Server) failure(command string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replies := s.failures[command]
+	if len(replies) == 0 {
+		return "", false
+	}
+	s.failures[command] = replies[1:]
+
+	return replies[0], true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]bool)
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				conn.Close()
+
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+
+			sess := &session{server: s, conn: conn}
+			_, sess.tls = conn.(*tls.Conn)
+			sess.run()
+		}()
+	}
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+	tls    bool
+	user   string
+	from   string
+	to     []string
+	inMail bool
+	chunks []byte
+}
+
+func (c *session) reply(line string) error {
+	return c.text.PrintfLine("%s", line)
+}
+
+func (c *session) run() {
+	c.text = textproto.NewConn(c.conn)
+
+	if c.reply("220 localhost rmailertest ESMTP") != nil {
+		return
+	}
+
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		// DATA failures are answered after the content
+		if verb != "DATA" && verb != "BDAT" {
+			if reply, ok := c.server.failure(verb); ok {
+				if c.reply(reply) != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		if !c.command(verb, strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+// command handles one command and reports whether the session goes on.
+func (c *session) command(verb string, arg string) bool {
+	switch verb {
+	case "EHLO":
+		c.resetTransaction()
+		return c.ehlo()
+	case "HELO":
+		c.resetTransaction()
+		return c.reply("250 localhost") == nil
+	case "STARTTLS":
+		return c.startTLS()
+	case "AUTH":
+		return c.auth(arg)
+	case "MAIL":
+		return c.mail(arg)
+	case "RCPT":
+		return c.rcpt(arg)
+	case "DATA":
+		return c.data()
+	case "BDAT":
+		return c.bdat(arg)
+	case "RSET":
+		c.resetTransaction()
+		return c.reply("250 2.0.0 OK") == nil
+	case "NOOP":
+		return c.reply("250 2.0.0 OK") == nil
+	case "QUIT":
+		c.reply("221 2.0.0 Bye")
+		return false
+	default:
+		return c.reply("502 5.5.2 command not recognized") == nil
+	}
+}
+
+func (c *session) ehlo() bool {
+	lines := []string{"localhost"}
+	lines = append(lines, "8BITMIME", "ENHANCEDSTATUSCODES")
+
+	if c.server.StartTLS && !c.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if c.server.Users != nil {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	lines = append(lines, c.server.Extensions...)
+
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if c.reply("250"+sep+line) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *session) startTLS() bool {
+	if !c.server.StartTLS || c.tls {
+		return c.reply("502 5.5.1 STARTTLS not available") == nil
+	}
+
+	if c.reply("220 2.0.0 Ready to start TLS") != nil {
+		return false
+	}
+
+	conn := tls.Server(c.conn, c.server.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		return false
+	}
+
+	c.conn, c.tls = conn, true
+	c.text = textproto.NewConn(conn)
+	c.resetTransaction()
+	c.user = ""
+
+	return true
+}
+
+func (c *session) auth(arg string) bool {
+	if c.server.Users == nil {
+		return c.reply("502 5.5.1 AUTH not available") == nil
+	}
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+
+	var username, password string
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		response, ok := c.challenge(initial, "")
+		if !ok {
+			return false
+		}
+		parts := strings.Split(string(response), "\x00")
+		if len(parts) != 3 {
+			return c.reply("501 5.5.2 malformed PLAIN response") == nil
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		user, ok := c.challenge(initial, "Username:")
+		if !ok {
+			return false
+		}
+		pass, ok := c.challenge("", "Password:")
+		if !ok {
+			return false
+		}
+		username, password = string(user), string(pass)
+	default:
+		return c.reply("504 5.5.4 unrecognized authentication mechanism") == nil
+	}
+
+	if expected, ok := c.server.Users[username]; !ok || expected != password {
+		return c.reply("535 5.7.8 authentication credentials invalid") == nil
+	}
+
+	c.user = username
+	return c.reply("235 2.7.0 Authentication successful") == nil
+}
+
+// challenge returns the decoded initial response, or asks for one with
+// prompt.
+func (c *session) challenge(initial string, prompt string) ([]byte, bool) {
+	if len(initial) == 0 {
+		if c.reply("334 "+base64.StdEncoding.EncodeToString([]byte(prompt))) != nil {
+			return nil, false
+		}
+
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return nil, false
+		}
+		initial = line
+	}
+
+	b, err := base64.StdEncoding.DecodeString(initial)
+	if err != nil {
+		c.reply("501 5.5.2 invalid base64")
+		return nil, false
+	}
+
+	return b, true
+}
+
+func (c *session) mail(arg string) bool {
+	if c.inMail {
+		return c.reply("503 5.5.1 nested MAIL command") == nil
+	}
+
+	from, ok := pathArgument(arg, "FROM:")
+	if !ok {
+		return c.reply("501 5.5.4 syntax: MAIL FROM:<address>") == nil
+	}
+
+	c.from, c.to, c.inMail = from, nil, true
+	return c.reply("250 2.1.0 OK") == nil
+}
+
+func (c *session) rcpt(arg string) bool {
+	if !c.inMail {
+		return c.reply("503 5.5.1 need MAIL command") == nil
+	}
+
+	to, ok := pathArgument(arg, "TO:")
+	if !ok {
+		return c.reply("501 5.5.4 syntax: RCPT TO:<address>") == nil
+	}
+
+	c.server.mu.Lock()
+	reply, rejected := c.server.rejected[strings.ToLower(to)]
+	c.server.mu.Unlock()
+
+	if rejected {
+		return c.reply(reply) == nil
+	}
+
+	c.to = append(c.to, to)
+	return c.reply("250 2.1.5 OK") == nil
+}
+
+func (c *session) data() bool {
+	if len(c.to) == 0 {
+		return c.reply("503 5.5.1 need RCPT command") == nil
+	}
+
+	if c.reply("354 Start mail input; end with <CRLF>.<CRLF>") != nil {
+		return false
+	}
+
+	data, err := io.ReadAll(c.text.DotReader())
+	if err != nil {
+		return false
+	}
+
+	return c.deliver(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+}
+
+func (c *session) bdat(arg string) bool {
+	sizeArg, last := strings.CutSuffix(strings.ToUpper(arg), " LAST")
+	size, err := strconv.Atoi(strings.TrimSpace(sizeArg))
+	if err != nil || size < 0 {
+		return c.reply("501 5.5.4 syntax: BDAT size [LAST]") == nil
+	}
+
+	chunk := make([]byte, size)
+	if _, err = io.ReadFull(c.text.R, chunk); err != nil {
+		return false
+	}
+
+	if len(c.to) == 0 {
+		c.chunks = nil
+		return c.reply("503 5.5.1 need RCPT command") == nil
+	}
+
+	c.chunks = append(c.chunks, chunk...)
+	if !last {
+		return c.reply("250 2.0.0 "+strconv.Itoa(size)+" octets received") == nil
+	}
+
+	data := c.chunks
+	c.chunks = nil
+	return c.deliver(data)
+}
+
+// deliver records the message unless a failure was injected for DATA.
+func (c *session) deliver(data []byte) bool {
+	defer c.resetTransaction()
+
+	if reply, ok := c.server.failure("DATA"); ok {
+		return c.reply(reply) == nil
+	}
+
+	c.server.mu.Lock()
+	c.server.messages = append(c.server.messages, Envelope{
+		From:     c.from,
+		To:       c.to,
+		Data:     data,
+		UserName: c.user,
+		TLS:      c.tls,
+	})
+	id := len(c.server.messages)
+	c.server.mu.Unlock()
+
+	return c.reply("250 2.0.0 OK: queued as "+strconv.Itoa(id)) == nil
+}
+
+func (c *session) resetTransaction() {
+	c.from, c.to, c.inMail, c.chunks = "", nil, false, nil
+}
+
+// pathArgument extracts the address of "FROM:<address> PARAMS".
+func pathArgument(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+
+	end := strings.IndexByte(path, '>')
+	if end < 0 {
+		return "", false
+	}
+
+	return path[1:end], true
+}
@@ -0,0 +1,356 @@
+package rmailer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a recurring time of the week or of the month, parsed by
+// ParseSchedule.
+type Schedule struct {
+	// Location is the time zone the schedule is evaluated in.
+	Location *time.Location
+
+	spec     string
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// anyDay and anyWeekday are set when the corresponding cron field is
+	// "*": a day then matches on the other field only.
+	anyDay     bool
+	anyWeekday bool
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "sunday": 0, "sundays": 0,
+	"mon": 1, "monday": 1, "mondays": 1,
+	"tue": 2, "tuesday": 2, "tuesdays": 2,
+	"wed": 3, "wednesday": 3, "wednesdays": 3,
+	"thu": 4, "thursday": 4, "thursdays": 4,
+	"fri": 5, "friday": 5, "fridays": 5,
+	"sat": 6, "saturday": 6, "saturdays": 6,
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// ParseSchedule parses a schedule, either in words or as a cron expression,
+// followed by an optional IANA time zone, UTC by default:
+//
+//	every Monday 08:00 Europe/Paris
+//	every weekday at 7:30
+//	every day 18:00 America/New_York
+//	every mon,thu 09:15
+//	0 8 * * 1 Europe/Paris
+//	*/15 9-17 * * mon-fri
+//
+// In words, the days are day, weekday, weekend or a comma-separated list of
+// days of the week. Cron expressions have the five usual fields, minute,
+// hour, day of month, month and day of week, accepting lists, ranges, steps
+// and names.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	s := &Schedule{spec: spec, Location: time.UTC}
+
+	var err error
+	if len(fields) > 0 && strings.EqualFold(fields[0], "every") {
+		fields, err = s.parseWords(fields[1:])
+	} else {
+		fields, err = s.parseCron(fields)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: invalid schedule %q: %w", spec, err)
+	}
+
+	switch len(fields) {
+	case 0:
+	case 1:
+		if s.Location, err = time.LoadLocation(fields[0]); err != nil {
+			return nil, fmt.Errorf("rmailer: invalid schedule %q: %w", spec, err)
+		}
+	default:
+		return nil, fmt.Errorf("rmailer: invalid schedule %q: unexpected %q", spec, strings.Join(fields[1:], " "))
+	}
+
+	return s, nil
+}
+
+// parseWords parses "<days> [at] HH:MM" and returns the remaining fields.
+func (s *Schedule) parseWords(fields []string) ([]string, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing days")
+	}
+
+	s.days, s.months, s.anyDay = bitRange(1, 31), bitRange(1, 12), true
+
+	switch days := strings.ToLower(fields[0]); days {
+	case "day":
+		s.weekdays, s.anyWeekday = bitRange(0, 6), true
+	case "weekday":
+		s.weekdays = bitRange(1, 5)
+	case "weekend":
+		s.weekdays = 1<<0 | 1<<6
+	default:
+		for _, name := range strings.Split(days, ",") {
+			day, ok := weekdayNames[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", name)
+			}
+			s.weekdays |= 1 << day
+		}
+	}
+	fields = fields[1:]
+
+	if len(fields) > 0 && strings.EqualFold(fields[0], "at") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing time of day")
+	}
+
+	hour, minute, ok := strings.Cut(fields[0], ":")
+	h, hErr := strconv.Atoi(hour)
+	m, mErr := strconv.Atoi(minute)
+	if !ok || hErr != nil || mErr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return nil, fmt.Errorf("invalid time of day %q", fields[0])
+	}
+	s.hours, s.minutes = 1<<h, 1<<m
+
+	return fields[1:], nil
+}
+
+// parseCron parses the five fields of a cron expression and returns the
+// remaining fields.
+func (s *Schedule) parseCron(fields []string) ([]string, error) {
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("expected \"every ...\" or five cron fields")
+	}
+
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if s.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, err
+	}
+
+	// 7 is Sunday as well.
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays = s.weekdays&^(1<<7) | 1
+	}
+
+	s.anyDay, s.anyWeekday = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+
+	return fields[5:], nil
+}
+
+// parseCronField returns the bits of the values of field between min and
+// max.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	value := func(s string) (int, error) {
+		if v, ok := names[strings.ToLower(s)]; ok {
+			return v, nil
+		}
+
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("invalid value %q in %q", s, field)
+		}
+
+		return v, nil
+	}
+
+	for _, item := range strings.Split(field, ",") {
+		item, stepText, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %q", stepText, field)
+			}
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			first, last, isRange := strings.Cut(item, "-")
+
+			var err error
+			if lo, err = value(first); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+			if isRange {
+				if hi, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q in %q", item, field)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+func bitRange(lo, hi int) uint64 {
+	var bits uint64
+	for v := lo; v <= hi; v++ {
+		bits |= 1 << v
+	}
+
+	return bits
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time of the schedule after after, the zero time
+// when there is none within five years.
+func (s *Schedule) Next(after time.Time) time.Time {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	t := after.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+
+		var next time.Time
+		switch {
+		case s.months&(1<<int(month)) == 0:
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchDay(t):
+			next = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case s.hours&(1<<t.Hour()) == 0:
+			next = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, loc)
+		case s.minutes&(1<<t.Minute()) == 0:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// Daylight saving changes may normalize a wall time backwards.
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+
+	return time.Time{}
+}
+
+// matchDay follows cron: when both the day of month and the day of week are
+// restricted, either may match.
+func (s *Schedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<int(t.Weekday())) != 0
+
+	if !s.anyDay && !s.anyWeekday {
+		return day || weekday
+	}
+
+	return day && weekday
+}
+
+// ScheduledSend describes a message sent on a schedule by Mailer.Schedule.
+type ScheduledSend struct {
+	Schedule *Schedule
+	Template *Template
+	// Data returns the fresh template data of the send due at at.
+	Data func(ctx context.Context, at time.Time) (any, error)
+	// Prepare completes the rendered message before it is queued, at least
+	// with its recipients, e.g. from data.
+	Prepare func(m *Message, data any) error
+}
+
+// Schedule queues a message rendered from job.Template at each time of
+// job.Schedule, until ctx is done or the Mailer shuts down. The outcomes are
+// reported like those of Enqueue; occurrences which cannot be rendered are
+// logged and skipped, and occurrences missed while a previous one was being
+// rendered are not caught up.
+func (ml *Mailer) Schedule(ctx context.Context, job ScheduledSend) {
+	clock := senderClock(ml.Sender)
+
+	go func() {
+		for {
+			at := job.Schedule.Next(clock.Now())
+			if at.IsZero() {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(at.Sub(clock.Now())):
+			}
+
+			m, err := job.render(ctx, at)
+			if err != nil {
+				logf("Scheduled send %q failed: %s", job.Schedule, err)
+				continue
+			}
+
+			if err := ml.Enqueue(m); err != nil {
+				logf("Scheduled send %q failed: %s", job.Schedule, err)
+				if err == ErrMailerClosed {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (job ScheduledSend) render(ctx context.Context, at time.Time) (*Message, error) {
+	var data any
+	if job.Data != nil {
+		var err error
+		if data, err = job.Data(ctx, at); err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := job.Template.Render(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Prepare != nil {
+		if err := job.Prepare(m, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,160 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestScheduleNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, c := range []struct {
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			"every Monday 08:00 Europe/Paris", time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 9, 8, 0, 0, 0, paris),
+		},
+		{
+			"every weekday at 7:30", time.Date(2026, 3, 6, 8, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 9, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			"every weekend 10:00", time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC),
+		},
+		// a time of the schedule is not its own next one
+		{
+			"every day 18:00", time.Date(2026, 3, 2, 18, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 3, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			"*/15 9-17 * * mon-fri", time.Date(2026, 3, 2, 17, 50, 0, 0, time.UTC),
+			time.Date(2026, 3, 3, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			"*/15 9-17 * * mon-fri", time.Date(2026, 3, 2, 9, 7, 0, 0, time.UTC),
+			time.Date(2026, 3, 2, 9, 15, 0, 0, time.UTC),
+		},
+		// either the day of month or the day of week
+		{
+			"0 8 1 * mon", time.Date(2026, 3, 31, 10, 0, 0, 0, time.UTC),
+			time.Date(2026, 4, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			"0 9 * * 7", time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 8, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			"0 0 1 jan *", time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+			time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		// 02:30 does not exist on the day clocks go forward
+		{
+			"every day 02:30 Europe/Paris", time.Date(2026, 3, 28, 12, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 30, 2, 30, 0, 0, paris),
+		},
+		{"0 0 30 feb *", time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC), time.Time{}},
+	} {
+		s, err := rmailer.ParseSchedule(c.spec)
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		if got := s.Next(c.after); !got.Equal(c.want) {
+			t.Errorf("%s: Next(%s) = %s, want %s", c.spec, c.after, got, c.want)
+		}
+	}
+}
+
+func TestParseScheduleRejectsInvalidSpecs(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"every",
+		"every funday 08:00",
+		"every day",
+		"every day 25:00",
+		"every day 08:00 UTC again",
+		"every day 08:00 Mars/Olympus",
+		"0 8 * *",
+		"61 * * * *",
+		"0 8 * * 1-",
+		"0 17-9 * * *",
+		"*/0 * * * *",
+	} {
+		if _, err := rmailer.ParseSchedule(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
+
+func TestMailerScheduleQueuesEachOccurrence(t *testing.T) {
+	srv := newTestServer(t)
+	clock := &testClock{now: time.Date(2026, 3, 2, 7, 59, 30, 0, time.UTC)}
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.Clock = clock
+
+	ml := rmailer.NewMailer(sender)
+	done := newCompletions(ml)
+
+	schedule, err := rmailer.ParseSchedule("every day 08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := rmailer.NewTemplate(`Report of {{.Format "Jan 2"}}`, "Hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ml.Schedule(ctx, rmailer.ScheduledSend{
+		Schedule: schedule,
+		Template: template,
+		Data: func(ctx context.Context, at time.Time) (any, error) {
+			// the occurrence of March 3 is skipped
+			if at.Day() == 3 {
+				return nil, errors.New("report not ready")
+			}
+			return at, nil
+		},
+		Prepare: func(m *rmailer.Message, data any) error {
+			m.SetFromFromString("me@toto.fr")
+			m.SetToFromStrings([]string{"a@toto.fr"})
+			return nil
+		},
+	})
+
+	for _, advance := range []time.Duration{30 * time.Second, 24 * time.Hour, 24 * time.Hour} {
+		waitFor(t, func() bool { return clock.waiting() > 0 })
+		clock.Advance(advance)
+	}
+	done.wait(t, 2)
+
+	messages := srv.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("%d message(s) sent, want 2", len(messages))
+	}
+	for i, subject := range []string{"Report of Mar 2", "Report of Mar 4"} {
+		if !bytes.Contains(messages[i].Data, []byte("Subject: "+subject+"\r\n")) {
+			t.Errorf("message %d is not the %s: %s", i, subject, strings.SplitN(string(messages[i].Data), "\r\n\r\n", 2)[0])
+		}
+	}
+
+	if err := ml.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
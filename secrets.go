@@ -0,0 +1,141 @@
+package rmailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecretProvider fetches named secrets from a secret store such as Vault,
+// AWS Secrets Manager or files mounted by an agent.
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// SecretFunc adapts a function to a SecretProvider, e.g. around the AWS
+// Secrets Manager SDK.
+type SecretFunc func(name string) (string, error)
+
+func (f SecretFunc) Secret(name string) (string, error) {
+	return f(name)
+}
+
+// SecretCredentials is a CredentialsProvider reading the password, or the
+// OAuth 2.0 token, from a SecretProvider on each connection, so that a
+// rotated secret is used without restarting the process.
+type SecretCredentials struct {
+	Provider SecretProvider
+	// UserName defaults to the Sender's UserName.
+	UserName string
+	// Password and Token name the secrets holding them, one of them being
+	// set.
+	Password string
+	Token    string
+}
+
+func (c *SecretCredentials) Credentials() (*Credentials, error) {
+	creds := &Credentials{UserName: c.UserName}
+
+	var err error
+	if len(c.Token) > 0 {
+		creds.Token, err = c.Provider.Secret(c.Token)
+	} else {
+		creds.Password, err = c.Provider.Secret(c.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// FileSecrets reads each secret from the file of that name in Dir, as
+// mounted by Kubernetes or written by the Vault agent. The trailing newline
+// is dropped.
+type FileSecrets struct {
+	Dir string
+}
+
+func (s FileSecrets) Secret(name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// VaultSecrets reads secrets from a HashiCorp Vault KV version 2 engine,
+// secret names being of the form "path#field", e.g. "smtp/relay#password".
+type VaultSecrets struct {
+	// Addr is the base URL of the server, e.g. "https://vault:8200".
+	Addr string
+	// Token authenticates the requests.
+	Token string
+	// Mount is the path of the KV engine, "secret" when empty.
+	Mount  string
+	Client *http.Client
+}
+
+func NewVaultSecrets(addr string, token string) *VaultSecrets {
+	return &VaultSecrets{Addr: addr, Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *VaultSecrets) Secret(name string) (string, error) {
+	path, field, ok := strings.Cut(name, "#")
+	if !ok {
+		return "", fmt.Errorf("rmailer: vault secret %q has no #field", name)
+	}
+
+	mount := s.Mount
+	if len(mount) == 0 {
+		mount = "secret"
+	}
+
+	u, err := url.JoinPath(s.Addr, "v1", mount, "data", path)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("rmailer: vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("rmailer: decoding vault secret %s: %w", path, err)
+	}
+
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("rmailer: vault secret %s has no field %q", path, field)
+	}
+
+	return value, nil
+}
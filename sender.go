@@ -0,0 +1,863 @@
+package rmailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+type Sender struct {
+	UserName  string
+	Password  string
+	Host      string
+	LocalName string
+	// Auth overrides the default PLAIN mechanism, e.g. with an NTLM
+	// implementation of smtp.Auth for on-prem Exchange.
+	Auth smtp.Auth
+	// Credentials, when set, is queried on each connection instead of
+	// using the static Password.
+	Credentials CredentialsProvider
+	// RefreshCredentials, when set, is called when the relay rejects the
+	// credentials (535), and the connection is retried once with the
+	// credentials it returns, e.g. a freshly leased password.
+	RefreshCredentials func(err error) (*Credentials, error)
+	// Retry, when set, repeats failed sends for the recipients which were
+	// deferred with a 4xx reply or could not be reached.
+	Retry *RetryPolicy
+	// Breaker, when set, fails sends fast while Host is known to be down.
+	Breaker *CircuitBreaker
+	// Resolver, when set, resolves Host instead of the system resolver, e.g.
+	// a CachingResolver or a stub in tests.
+	Resolver Resolver
+	// PreferIPv4 tries the IPv4 addresses of Host before its IPv6 ones, for
+	// relays publishing broken AAAA records.
+	PreferIPv4 bool
+	// FallbackDelay is how long an attempt may hang before the next address
+	// is tried in parallel (RFC 8305), 300ms when zero.
+	FallbackDelay time.Duration
+	// LocalAddr, when set, is the source IP of outgoing connections.
+	LocalAddr net.IP
+	// SizeFallback, when set, is called once when the message exceeds the
+	// SIZE advertised by the relay, e.g. to replace attachments with
+	// download links. The returned message is sent instead.
+	SizeFallback func(m *Message, limit int64) (*Message, error)
+	// MaxRecipients, when positive, splits the envelope recipients into
+	// transactions of at most that many RCPT commands, as many relays cap
+	// them at 100.
+	MaxRecipients int
+	// Suppressions, when set, lists the addresses which are not sent to.
+	Suppressions SuppressionStore
+	// Conn, when set, provides the connection of each SMTP session instead
+	// of dialing Host, e.g. to replay a recorded session. It is used as is,
+	// any TLS being handled by the connection.
+	Conn func() (net.Conn, error)
+	// WrapConn, when set, wraps the connection of each SMTP session, TLS
+	// being already established, e.g. to record it.
+	WrapConn func(conn net.Conn) net.Conn
+	// Clock dates the messages and times the retries, SystemClock when nil.
+	Clock Clock
+	// MessageIDs generates the Message-ID of messages which have none,
+	// RandomMessageIDs at the From domain when nil.
+	MessageIDs MessageIDGenerator
+	// ChunkSize is the size of the BDAT chunks used instead of DATA when the
+	// relay supports CHUNKING (RFC 3030), 1 MiB when zero.
+	ChunkSize int
+	// DisableChunking always sends the message with DATA.
+	DisableChunking bool
+	// Timeouts, when set, bound the wait for each SMTP reply.
+	Timeouts *Timeouts
+	// Audit, when set, receives a record of each attempt.
+	Audit AuditSink
+	// Events, when set, receives the lifecycle events of the messages sent,
+	// and of those queued by a Mailer using this Sender.
+	Events *EventBus
+	// SPF, when set, checks that the sending IP is permitted by the SPF
+	// record of the envelope-from domain before each transaction.
+	SPF *SPFCheck
+	// ContentTypes and DefaultContentType complete those of the messages
+	// sent, which take precedence.
+	ContentTypes       map[string]string
+	DefaultContentType string
+	// MemoryBudget, when above 0, is the size above which messages are
+	// rendered to a temporary file in SpillDir (os.TempDir when empty),
+	// then streamed from it into DATA, rather than rendered in memory.
+	// Strict messages are checked as they are written to the file.
+	MemoryBudget int64
+	SpillDir     string
+}
+
+func NewSender(username string, password string, host string) *Sender {
+	return &Sender{
+		UserName: username,
+		Password: password,
+		Host:     host,
+	}
+}
+
+// SenderOption configures a Sender, see Sender.Apply.
+type SenderOption func(s *Sender)
+
+// Apply applies the options to s.
+func (s *Sender) Apply(opts ...SenderOption) {
+	for _, opt := range opts {
+		opt(s)
+	}
+}
+
+// WithLocalAddr binds outgoing connections to ip, so that multi-homed hosts
+// choose the address (and PTR record) relays see.
+func WithLocalAddr(ip net.IP) SenderOption {
+	return func(s *Sender) {
+		s.LocalAddr = ip
+	}
+}
+
+func (s *Sender) IsAuthenticated() bool {
+	return s.Auth != nil || s.Credentials != nil || len(s.Password) > 0
+}
+
+func (s *Sender) Send(m *Message) error {
+	_, err := s.SendWithResult(m)
+	return err
+}
+
+// SendWithResult sends m and reports how the relay accepted it. With a Retry
+// policy, attempts are repeated for the recipients which failed temporarily
+// only. An error is returned when no recipient accepted the message.
+func (s *Sender) SendWithResult(m *Message) (*SendResult, error) {
+	result, err := s.sendWithResult(m, false)
+	return result, redactErr(err)
+}
+
+// sendWithResult sends m. When queued, the recipients failing temporarily on
+// the last attempt are left for the queue to report, as it retries them.
+func (s *Sender) sendWithResult(m *Message, queued bool) (*SendResult, error) {
+	m, err := s.stamped(m)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.render(m)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { raw.close() }()
+
+	from := s.envelopeFrom(m)
+	rcpts := m.envelopeRecipients()
+
+	attempts, delay := 1, time.Duration(0)
+	if s.Retry != nil {
+		attempts, delay = max(1, s.Retry.Attempts), s.Retry.Delay
+	}
+
+	// copied, as results and events outlive a pooled message
+	metadata := maps.Clone(m.Metadata)
+
+	final := &SendResult{MessageID: m.messageID(), Metadata: metadata}
+	statuses := make(map[string]RecipientStatus)
+
+	pending, err := s.suppress(rcpts, statuses)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		pending, err = nil, errAllSuppressed
+	}
+
+	for _, rcpt := range rcpts {
+		if status, ok := statuses[rcpt]; ok {
+			s.Events.publishAttempt(0, []RecipientStatus{status}, nil, final.MessageID, metadata)
+		}
+	}
+
+	downgraded := false
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		s.Events.Publish(Event{Type: EventAttempting, MessageID: final.MessageID, Attempt: attempt, Metadata: metadata})
+
+		var result *SendResult
+		result, err = s.attempt(from, pending, raw)
+		s.audit(attempt, from, pending, final.MessageID, result, err)
+
+		var sizeErr *SizeError
+		if errors.As(err, &sizeErr) && s.SizeFallback != nil && !downgraded {
+			downgraded = true
+
+			var smaller *Message
+			if smaller, err = s.SizeFallback(m, sizeErr.Limit); err != nil {
+				break
+			}
+
+			logf("SMTP message of %d bytes over the relay limit of %d, sending fallback", sizeErr.Size, sizeErr.Limit)
+			raw.close()
+			if raw, err = s.render(smaller); err != nil {
+				break
+			}
+			result, err = s.attempt(from, pending, raw)
+			s.audit(attempt, from, pending, final.MessageID, result, err)
+		}
+
+		if result != nil {
+			if err == nil && len(final.Response) == 0 {
+				final.Response, final.QueueID = result.Response, result.QueueID
+			}
+			for _, status := range result.Recipients {
+				statuses[status.Address] = status
+			}
+		} else {
+			// the relay was not reached or dropped the connection
+			for _, status := range attemptStatuses(pending, nil, err) {
+				statuses[status.Address] = status
+			}
+		}
+
+		retry := retryRecipients(pending, result, err)
+		// the queue waits out the deferrals of queued sends, not a worker
+		_, deferral := deferredUntil(err)
+		if attempt >= attempts || queued && deferral {
+			statuses := attemptStatuses(pending, result, err)
+			if queued {
+				statuses = filterRecipients(statuses, retry, false)
+			}
+			s.Events.publishAttempt(attempt, statuses, nil, final.MessageID, metadata)
+			break
+		}
+
+		s.Events.publishAttempt(attempt, attemptStatuses(pending, result, err), retry, final.MessageID, metadata)
+		if pending = retry; len(pending) == 0 {
+			break
+		}
+
+		wait := delay
+		if until, ok := deferredUntil(err); ok {
+			wait = max(0, until.Sub(clockOf(s.Clock).Now()))
+		} else if s.Retry.Backoff != nil {
+			wait, _ = s.Retry.Backoff.Delay(attempt, result, err)
+		}
+
+		logf("SMTP retry in %s for %d recipient(s)", wait, len(pending))
+		<-clockOf(s.Clock).After(wait)
+		delay *= 2
+	}
+
+	if err != nil {
+		// recipients left without status by a failed size fallback
+		for _, status := range attemptStatuses(pending, nil, err) {
+			if _, ok := statuses[status.Address]; !ok {
+				statuses[status.Address] = status
+			}
+		}
+	}
+
+	delivered := false
+	for _, rcpt := range rcpts {
+		if status, ok := statuses[rcpt]; ok {
+			final.Recipients = append(final.Recipients, status)
+			delivered = delivered || status.Accepted()
+		}
+	}
+
+	if delivered {
+		return final, nil
+	}
+
+	return final, err
+}
+
+// suppress records the status of the suppressed recipients and returns the
+// others.
+func (s *Sender) suppress(rcpts []string, statuses map[string]RecipientStatus) ([]string, error) {
+	if s.Suppressions == nil {
+		return rcpts, nil
+	}
+
+	var allowed []string
+
+	for _, rcpt := range rcpts {
+		reason, err := s.Suppressions.Suppressed(rcpt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reason) > 0 {
+			statuses[rcpt] = RecipientStatus{Address: rcpt, Message: "suppressed: " + string(reason), Suppressed: reason}
+			continue
+		}
+
+		allowed = append(allowed, rcpt)
+	}
+
+	return allowed, nil
+}
+
+func (s *Sender) attempt(from string, rcpts []string, raw *renderedMessage) (*SendResult, error) {
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if limit := sizeLimit(c.Client); limit > 0 && raw.size > limit {
+		c.quit()
+		return nil, &SizeError{Size: raw.size, Limit: limit}
+	}
+
+	if err := s.checkSPF(c, from); err != nil {
+		c.quit()
+		return nil, err
+	}
+
+	chunks := chunkRecipients(rcpts, s.MaxRecipients)
+	if len(chunks) <= 1 {
+		return s.quitTransaction(c, from, rcpts, raw.reader())
+	}
+
+	merged := &SendResult{}
+	var lastErr error
+
+	for i, chunk := range chunks {
+		result, err := s.transaction(c, from, chunk, raw.reader())
+		if err != nil {
+			lastErr = err
+		}
+
+		if result == nil {
+			// the connection is unusable, report the remaining recipients
+			code, msg := replyCode(err)
+			for _, rest := range chunks[i:] {
+				for _, rcpt := range rest {
+					merged.Recipients = append(merged.Recipients, RecipientStatus{Address: rcpt, Code: code, Message: msg})
+				}
+			}
+			break
+		}
+
+		if err == nil && len(merged.Response) == 0 {
+			merged.Response, merged.QueueID = result.Response, result.QueueID
+		}
+		merged.Recipients = append(merged.Recipients, result.Recipients...)
+	}
+
+	if lastErr == nil {
+		lastErr = c.quit()
+	}
+
+	return merged, lastErr
+}
+
+// chunkRecipients splits rcpts into groups of at most size recipients, a
+// single group when size is not positive.
+func chunkRecipients(rcpts []string, size int) [][]string {
+	if size <= 0 || len(rcpts) <= size {
+		return [][]string{rcpts}
+	}
+
+	var chunks [][]string
+	for len(rcpts) > size {
+		chunks = append(chunks, rcpts[:size])
+		rcpts = rcpts[size:]
+	}
+
+	return append(chunks, rcpts)
+}
+
+func (s *Sender) AnonymousSend(m *Message) error {
+	c, err := s.guard(s.anonymousClient)
+	if err != nil {
+		return redactErr(err)
+	}
+	defer c.Close()
+
+	_, err = s.send(c, m)
+	return redactErr(err)
+}
+
+func (s *Sender) AuthenticatedSend(m *Message) error {
+	c, err := s.guard(s.authenticatedClient)
+	if err != nil {
+		return redactErr(err)
+	}
+	defer c.Close()
+
+	_, err = s.send(c, m)
+	return redactErr(err)
+}
+
+// SendRaw relays an already rendered RFC 5322 message read from r to rcpts.
+func (s *Sender) SendRaw(envelopeFrom string, rcpts []string, r io.Reader) error {
+	c, err := s.client()
+	if err != nil {
+		return redactErr(err)
+	}
+	defer c.Close()
+
+	_, err = s.quitTransaction(c, envelopeFrom, rcpts, r)
+	return redactErr(err)
+}
+
+// stamped returns m, or a copy completed with the Date and Message-ID it
+// lacks and the Sender's content types.
+func (s *Sender) stamped(m *Message) (*Message, error) {
+	hasID := m.hasHeader("Message-ID")
+	typed := len(s.ContentTypes) == 0 && (len(s.DefaultContentType) == 0 || len(m.DefaultContentType) > 0)
+	if !m.Date.IsZero() && hasID && typed {
+		return m, nil
+	}
+
+	stamped := *m
+	if !typed {
+		stamped.ContentTypes = make(map[string]string, len(s.ContentTypes)+len(m.ContentTypes))
+		for ext, contentType := range s.ContentTypes {
+			stamped.ContentTypes[ext] = contentType
+		}
+		for ext, contentType := range m.ContentTypes {
+			stamped.ContentTypes[ext] = contentType
+		}
+
+		if len(stamped.DefaultContentType) == 0 {
+			stamped.DefaultContentType = s.DefaultContentType
+		}
+	}
+
+	if stamped.Date.IsZero() {
+		stamped.Date = clockOf(s.Clock).Now()
+	}
+
+	if !hasID {
+		generator := s.MessageIDs
+		if generator == nil {
+			generator = RandomMessageIDs{}
+		}
+
+		id, err := generator.MessageID(m)
+		if err != nil {
+			return nil, err
+		}
+
+		stamped.Headers = append([]Header{{Name: "Message-ID", Value: "<" + id + ">"}}, m.Headers...)
+	}
+
+	return &stamped, nil
+}
+
+func (s *Sender) send(c *session, m *Message) (*SendResult, error) {
+	m, err := s.stamped(m)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.render(m)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.close()
+
+	from, rcpts := s.envelopeFrom(m), m.envelopeRecipients()
+	metadata := maps.Clone(m.Metadata)
+	s.Events.Publish(Event{Type: EventAttempting, MessageID: m.messageID(), Attempt: 1, Metadata: metadata})
+
+	result, err := s.quitTransaction(c, from, rcpts, raw.reader())
+	if result != nil {
+		result.MessageID, result.Metadata = m.messageID(), metadata
+	}
+	s.audit(1, from, rcpts, m.messageID(), result, err)
+	s.Events.publishAttempt(1, attemptStatuses(rcpts, result, err), nil, m.messageID(), metadata)
+
+	return result, err
+}
+
+func (s *Sender) client() (*session, error) {
+	if s.IsAuthenticated() {
+		return s.guard(s.authenticatedClient)
+	}
+
+	return s.guard(s.anonymousClient)
+}
+
+// guard runs connect through the circuit breaker, if any.
+func (s *Sender) guard(connect func() (*session, error)) (*session, error) {
+	if s.Breaker == nil {
+		return connect()
+	}
+
+	if err := s.Breaker.allow(s.Host); err != nil {
+		return nil, err
+	}
+
+	c, err := connect()
+
+	// a reply, even a rejection, shows the relay is up
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		s.Breaker.record(s.Host, nil)
+	} else {
+		s.Breaker.record(s.Host, err)
+	}
+
+	return c, err
+}
+
+func (s *Sender) anonymousClient() (*session, error) {
+	logf("SMTP connection to %s with username %s", s.Host, s.UserName)
+
+	host, _, _ := net.SplitHostPort(s.Host)
+
+	conn, _, err := s.connect(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.newClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.hello(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// connect opens the connection of an SMTP session, TLS secured with config
+// when not nil. hidden reports whether the connection is secured but is not
+// a *tls.Conn, being provided by Conn or wrapped by WrapConn.
+func (s *Sender) connect(config *tls.Config) (conn net.Conn, hidden bool, err error) {
+	if s.Conn != nil {
+		if conn, err = s.Conn(); err != nil {
+			return nil, false, err
+		}
+		hidden = config != nil
+	} else {
+		if conn, err = s.dial(); err != nil {
+			return nil, false, err
+		}
+
+		if config != nil {
+			if s.Timeouts != nil {
+				setDeadline(conn, s.Timeouts.Greeting)
+			}
+
+			tlsConn := tls.Client(conn, config)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, false, err
+			}
+			conn = tlsConn
+		}
+	}
+
+	if s.WrapConn != nil {
+		conn = s.WrapConn(conn)
+		hidden = config != nil
+	}
+
+	return conn, hidden, nil
+}
+
+// newClient reads the greeting of the server on conn.
+func (s *Sender) newClient(conn net.Conn, host string) (*session, error) {
+	if s.Timeouts != nil {
+		setDeadline(conn, s.Timeouts.Greeting)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s.newSession(c, conn), nil
+}
+
+// secureAuth tells the wrapped mechanism that the session is encrypted, for
+// connections net/smtp does not recognize as TLS.
+type secureAuth struct {
+	smtp.Auth
+}
+
+func (a secureAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+func (s *Sender) authenticatedClient() (*session, error) {
+	logf("SMTP AUTH connection to %s", s.Host)
+
+	host, _, _ := net.SplitHostPort(s.Host)
+
+	auth, err := s.auth(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.authenticate(host, auth)
+	if err == nil || s.RefreshCredentials == nil || !isCredentialError(err) {
+		return c, err
+	}
+
+	logf("SMTP AUTH rejected by %s, retrying with refreshed credentials", s.Host)
+
+	creds, err := s.RefreshCredentials(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.authenticate(host, s.credentialsAuth(creds, host))
+}
+
+// authenticate opens a TLS session authenticated with auth. net/smtp ends
+// the session when AUTH fails.
+func (s *Sender) authenticate(host string, auth smtp.Auth) (*session, error) {
+	tlsconfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         host,
+	}
+
+	conn, hidden, err := s.connect(tlsconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if hidden {
+		// net/smtp cannot see the TLS layer under the connection anymore
+		auth = secureAuth{auth}
+	}
+
+	c, err := s.newClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.hello(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Auth
+	if ok, _ := c.Extension("AUTH"); !ok {
+		c.Close()
+		return nil, fmt.Errorf("smtp: %s does not advertise AUTH", s.Host)
+	}
+
+	c.expect(c.timeouts.Auth)
+	if err = c.Auth(auth); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// hello greets the server as LocalName (or "localhost"). net/smtp sends EHLO
+// first and retries with HELO when it is rejected, in which case no
+// extensions are known and c.Extension reports false for all of them.
+func (s *Sender) hello(c *session) error {
+	name := s.LocalName
+	if len(name) == 0 {
+		name = "localhost"
+	}
+
+	c.expect(c.timeouts.Hello)
+	return c.Hello(name)
+}
+
+func (s *Sender) transaction(c *session, from string, rcpts []string, r io.Reader) (*SendResult, error) {
+	envelope := rcpts
+
+	// net/smtp adds the SMTPUTF8 parameter itself when it is supported
+	if ok, _ := c.Extension("SMTPUTF8"); !ok {
+		var err error
+		if from, envelope, err = asciiEnvelope(from, rcpts); err != nil {
+			return nil, err
+		}
+	}
+
+	c.expect(c.timeouts.Mail)
+	if err := c.Mail(from); err != nil {
+		return nil, err
+	}
+
+	result := &SendResult{}
+	accepted := 0
+
+	for i, rcpt := range envelope {
+		status := RecipientStatus{Address: rcpts[i], Code: 250}
+
+		c.expect(c.timeouts.Rcpt)
+		if err := c.Rcpt(rcpt); err != nil {
+			logf("%s", err)
+			status.Code, status.Message = replyCode(err)
+		} else {
+			accepted++
+		}
+
+		result.Recipients = append(result.Recipients, status)
+	}
+
+	if accepted == 0 {
+		c.expect(c.timeouts.Mail)
+		c.Reset()
+		return result, errNoRecipient
+	}
+
+	var response string
+	var err error
+	if ok, _ := c.Extension("CHUNKING"); ok && !s.DisableChunking {
+		response, err = bdat(c, r, s.ChunkSize)
+	} else {
+		response, err = data(c, r)
+	}
+	if err != nil {
+		// none of the recipients got the message
+		code, msg := replyCode(err)
+		for i, status := range result.Recipients {
+			if status.Accepted() {
+				result.Recipients[i].Code, result.Recipients[i].Message = code, msg
+			}
+		}
+
+		return result, err
+	}
+
+	result.Response = response
+	result.QueueID = parseQueueID(response)
+
+	return result, nil
+}
+
+// quitTransaction runs a single transaction and ends the session when it
+// succeeds.
+func (s *Sender) quitTransaction(c *session, from string, rcpts []string, r io.Reader) (*SendResult, error) {
+	result, err := s.transaction(c, from, rcpts, r)
+	if err != nil {
+		return result, err
+	}
+
+	return result, c.quit()
+}
+
+// data runs the DATA command and returns the text of the final response,
+// which net/smtp's Data does not expose. The writer dot-stuffs lines
+// starting with ".".
+func data(c *session, r io.Reader) (string, error) {
+	c.expect(c.timeouts.Data)
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+
+	w := c.Text.DotWriter()
+
+	if _, err = io.Copy(&progressWriter{w: w, c: c, d: c.timeouts.Data}, r); err != nil {
+		return "", err
+	}
+
+	c.expect(c.timeouts.Data)
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	_, msg, err := c.Text.ReadResponse(250)
+	return msg, err
+}
+
+const defaultChunkSize = 1 << 20
+
+// bdat sends the message in BDAT chunks of about size bytes and returns the
+// text of the response to the last one. Unlike DATA, the content is sent as
+// is, bare line feeds being only turned into CRLF.
+func bdat(c *session, r io.Reader, size int) (string, error) {
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+
+	buf := make([]byte, size)
+	var chunk []byte
+	prevCR := false
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return "", err
+		}
+
+		chunk, prevCR = appendCRLF(chunk[:0], buf[:n], prevCR)
+
+		msg, err := bdatChunk(c, chunk, last)
+		if err != nil || last {
+			return msg, err
+		}
+	}
+}
+
+func bdatChunk(c *session, chunk []byte, last bool) (string, error) {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+
+	c.expect(c.timeouts.Data)
+	id, err := c.Text.Cmd("%s", cmd)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = c.Text.W.Write(chunk); err != nil {
+		return "", err
+	}
+	if err = c.Text.W.Flush(); err != nil {
+		return "", err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, msg, err := c.Text.ReadResponse(250)
+	return msg, err
+}
+
+// appendCRLF appends src to dst with bare line feeds turned into CRLF,
+// prevCR telling whether the byte before src was a carriage return.
+func appendCRLF(dst []byte, src []byte, prevCR bool) ([]byte, bool) {
+	for _, b := range src {
+		if b == '\n' && !prevCR {
+			dst = append(dst, '\r')
+		}
+		dst = append(dst, b)
+		prevCR = b == '\r'
+	}
+
+	return dst, prevCR
+}
+
+// envelopeFrom returns the MAIL FROM address for m, which defaults to the
+// Sender's UserName.
+func (s *Sender) envelopeFrom(m *Message) string {
+	if m.EnvelopeFrom == NullReversePath {
+		return ""
+	}
+
+	if len(m.EnvelopeFrom) > 0 {
+		return m.EnvelopeFrom
+	}
+
+	return s.UserName
+}
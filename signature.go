@@ -0,0 +1,36 @@
+package rmailer
+
+import "strings"
+
+// Signature is a block appended to the bodies of outgoing messages.
+type Signature struct {
+	Text string
+	Html string
+}
+
+const (
+	// signatureDelimiter separates the text signature from the body (RFC
+	// 3676 section 4.3).
+	signatureDelimiter = "-- \n"
+	// signatureAttribute marks the element holding the HTML signature.
+	signatureAttribute = "data-rmailer-signature"
+)
+
+// appendTo appends the signature to the bodies of m which are not signed
+// yet, so that resending a message does not sign it twice.
+func (s *Signature) appendTo(m *Message) {
+	if len(s.Text) > 0 && len(m.BodyText) > 0 && !textSigned(m.BodyText) {
+		m.BodyText = strings.TrimRight(m.BodyText, "\r\n") + "\n\n" + signatureDelimiter + s.Text
+	}
+
+	if len(s.Html) > 0 && len(m.BodyHtml) > 0 && !strings.Contains(m.BodyHtml, signatureAttribute) {
+		block := "<div " + signatureAttribute + ">" + s.Html + "</div>"
+
+		m.BodyHtml = appendHtml(m.BodyHtml, block)
+	}
+}
+
+func textSigned(body string) bool {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	return strings.HasPrefix(body, signatureDelimiter) || strings.Contains(body, "\n"+signatureDelimiter)
+}
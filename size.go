@@ -0,0 +1,107 @@
+package rmailer
+
+import (
+	"encoding/base64"
+	"mime"
+	"os"
+)
+
+// boundaryLength is the length of the boundaries generated by
+// mime/multipart.
+const boundaryLength = 60
+
+// headerSize returns the length of the header written by writeHeader, the
+// boundary it adds included.
+func (p *Part) headerSize() int64 {
+	var size int64
+
+	for k, values := range p.Header {
+		for _, v := range values {
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+
+	if p.Parts != nil {
+		if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil && len(params["boundary"]) == 0 {
+			size += int64(len("; boundary=") + boundaryLength)
+		}
+	}
+
+	return size + int64(len(BackLine))
+}
+
+// encodedSize returns the length of the body written by writeBody.
+func (p *Part) encodedSize(wrapping Base64Wrapping) int64 {
+	if p.Parts == nil {
+		return p.contentSize(wrapping)
+	}
+
+	boundary := boundaryLength
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil && len(params["boundary"]) > 0 {
+		boundary = len(params["boundary"])
+	}
+
+	// "\r\n--boundary\r\n" before each part, the first one without the
+	// leading CRLF, and "\r\n--boundary--\r\n" after the last
+	size := int64(boundary+8) - 2
+	for _, c := range p.Parts {
+		size += int64(boundary+6) + c.headerSize() + c.encodedSize(wrapping)
+	}
+
+	return size
+}
+
+// contentSize returns the encoded length of a leaf part.
+func (p *Part) contentSize(wrapping Base64Wrapping) int64 {
+	n := int64(len(p.Content))
+	if len(p.path) > 0 {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return 0
+		}
+		n = info.Size()
+	}
+
+	switch p.encoding {
+	case EncodingBase64:
+		encoded := int64(base64.StdEncoding.EncodedLen(int(n)))
+		length := int64(wrapping.lineLength())
+		lines := (encoded + length - 1) / length
+		return encoded + lines*int64(len(wrapping.eol()))
+	case EncodingQuotedPrintable:
+		if len(p.path) > 0 {
+			return n + n/8
+		}
+		return quotedPrintableSize(p.Content)
+	default:
+		return n
+	}
+}
+
+// quotedPrintableSize estimates the quoted-printable length of content,
+// soft line breaks included.
+func quotedPrintableSize(content []byte) int64 {
+	var size, column int64
+
+	for i, b := range content {
+		if b == '\n' && i > 0 && content[i-1] == '\r' {
+			size++
+			column = 0
+			continue
+		}
+
+		width := int64(1)
+		if b == '=' || (b < ' ' && b != '\t' && b != '\r') || b > '~' {
+			width = 3
+		}
+
+		if column+width > 75 {
+			size += 3 // "=\r\n"
+			column = 0
+		}
+		size += width
+		column += width
+	}
+
+	return size
+}
@@ -0,0 +1,139 @@
+package rmailer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpamReport is the verdict of spamd on a message.
+type SpamReport struct {
+	Spam bool
+	// Score is the message score and Required the spamd threshold.
+	Score    float64
+	Required float64
+	// Rules are the names of the rules which matched.
+	Rules []string
+}
+
+// SpamError is returned when the spam check blocks a send.
+type SpamError struct {
+	Report *SpamReport
+}
+
+func (e *SpamError) Error() string {
+	return fmt.Sprintf("rmailer: message scored %.1f, rules %s", e.Report.Score, strings.Join(e.Report.Rules, ","))
+}
+
+// SpamAssassin submits messages to a spamd daemon with the SPAMC protocol.
+type SpamAssassin struct {
+	// Addr is the spamd address, e.g. "localhost:783".
+	Addr string
+	// User is the user whose preferences spamd applies, if any.
+	User string
+	// Threshold blocks the messages scoring at least that much, spamd's own
+	// verdict being used when zero.
+	Threshold float64
+	Timeout   time.Duration
+}
+
+func NewSpamAssassin(addr string, threshold float64) *SpamAssassin {
+	return &SpamAssassin{Addr: addr, Threshold: threshold, Timeout: 30 * time.Second}
+}
+
+// Check scores the rendered message raw.
+func (sa *SpamAssassin) Check(raw []byte) (*SpamReport, error) {
+	conn, err := net.DialTimeout("tcp", sa.Addr, sa.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if sa.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(sa.Timeout))
+	}
+
+	// SYMBOLS is CHECK with the matched rules in the body
+	request := fmt.Sprintf("SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(raw))
+	if len(sa.User) > 0 {
+		request += "User: " + sa.User + "\r\n"
+	}
+	request += "\r\n"
+
+	if _, err = io.WriteString(conn, request); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(raw); err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+func parseSpamdResponse(r *bufio.Reader) (*SpamReport, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: reading spamd response: %w", err)
+	}
+
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.Fields(status)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("rmailer: malformed spamd response %q", strings.TrimSpace(status))
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("rmailer: spamd error %s", strings.Join(fields[1:], " "))
+	}
+
+	report := &SpamReport{}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("rmailer: reading spamd response: %w", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(name, "Spam") {
+			continue
+		}
+
+		// Spam: True ; 15.3 / 5.0
+		verdict, scores, _ := strings.Cut(value, ";")
+		score, required, _ := strings.Cut(scores, "/")
+
+		report.Spam = strings.EqualFold(strings.TrimSpace(verdict), "True") || strings.EqualFold(strings.TrimSpace(verdict), "Yes")
+		report.Score, _ = strconv.ParseFloat(strings.TrimSpace(score), 64)
+		report.Required, _ = strconv.ParseFloat(strings.TrimSpace(required), 64)
+	}
+
+	body, _ := io.ReadAll(r)
+	for _, rule := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if rule = strings.TrimSpace(rule); len(rule) > 0 {
+			report.Rules = append(report.Rules, rule)
+		}
+	}
+
+	return report, nil
+}
+
+// blocks reports whether report must block the send.
+func (sa *SpamAssassin) blocks(report *SpamReport) bool {
+	if sa.Threshold > 0 {
+		return report.Score >= sa.Threshold
+	}
+
+	return report.Spam
+}
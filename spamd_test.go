@@ -0,0 +1,158 @@
+package rmailer_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// spamd is a fake spamd scoring 15.3 the messages containing "VIAGRA", 2.5
+// those containing "FREE", 0.1 the others, and failing on "BROKEN".
+type spamd struct {
+	Addr string
+
+	mu    sync.Mutex
+	users []string
+}
+
+func newSpamd(t *testing.T) *spamd {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &spamd{Addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *spamd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	if _, err := r.ReadLine(); err != nil {
+		return
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.users = append(s.users, header.Get("User"))
+	s.mu.Unlock()
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.R, body); err != nil {
+		return
+	}
+
+	if bytes.Contains(body, []byte("BROKEN")) {
+		fmt.Fprint(conn, "SPAMD/1.1 74 EX_TEMPFAIL\r\n")
+		return
+	}
+
+	verdict, score, rules := "False", 0.1, "NO_RELAYS"
+	switch {
+	case bytes.Contains(body, []byte("VIAGRA")):
+		verdict, score, rules = "True", 15.3, "DRUGS_ERECTILE,URIBL_BLACK"
+	case bytes.Contains(body, []byte("FREE")):
+		score, rules = 2.5, "FREE_OFFER"
+	}
+
+	fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s ; %.1f / 5.0\r\n\r\n%s", len(rules), verdict, score, rules)
+}
+
+func TestSpamAssassinCheck(t *testing.T) {
+	s := newSpamd(t)
+
+	sa := rmailer.NewSpamAssassin(s.Addr, 0)
+	sa.User = "newsletter"
+
+	report, err := sa.Check([]byte("Subject: VIAGRA\r\n\r\nBuy now\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &rmailer.SpamReport{Spam: true, Score: 15.3, Required: 5, Rules: []string{"DRUGS_ERECTILE", "URIBL_BLACK"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Check = %+v, want %+v", report, want)
+	}
+	s.mu.Lock()
+	if s.users[0] != "newsletter" {
+		t.Errorf("User = %q", s.users[0])
+	}
+	s.mu.Unlock()
+
+	if _, err := sa.Check([]byte("Subject: BROKEN\r\n\r\n")); err == nil {
+		t.Error("Check succeeded on a spamd error")
+	}
+
+	if _, err := rmailer.NewSpamAssassin(refusedAddr(t), 0).Check([]byte("Subject: Hi\r\n\r\n")); err == nil {
+		t.Error("Check succeeded without spamd")
+	}
+}
+
+func TestMailerSpamCheckBlocksSends(t *testing.T) {
+	srv := newTestServer(t)
+	s := newSpamd(t)
+
+	for _, c := range []struct {
+		subject   string
+		threshold float64
+		blocked   bool
+	}{
+		{"Hello", 0, false},
+		{"VIAGRA", 0, true},
+		// spamd's verdict, unless a threshold is set
+		{"FREE", 0, false},
+		{"FREE", 2, true},
+		{"VIAGRA", 20, false},
+	} {
+		srv.Reset()
+
+		ml := rmailer.NewMailer(rmailer.NewSender("me@toto.fr", "", srv.Addr))
+		ml.SpamCheck = rmailer.NewSpamAssassin(s.Addr, c.threshold)
+
+		m := newTestMessage("a@toto.fr")
+		m.Subject = c.subject
+
+		err := ml.Send(m)
+
+		var spamErr *rmailer.SpamError
+		switch {
+		case c.blocked && !errors.As(err, &spamErr):
+			t.Errorf("%s with threshold %.0f: Send = %v, want a *SpamError", c.subject, c.threshold, err)
+		case !c.blocked && err != nil:
+			t.Errorf("%s with threshold %.0f: %v", c.subject, c.threshold, err)
+		}
+		if sent := len(srv.Messages()) == 1; sent == c.blocked {
+			t.Errorf("%s with threshold %.0f: sent = %t", c.subject, c.threshold, sent)
+		}
+	}
+}
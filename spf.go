@@ -0,0 +1,561 @@
+package rmailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the result of an SPF evaluation (RFC 7208 section 2.6).
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfLookupLimit is the number of mechanisms and modifiers querying the DNS
+// an evaluation may use (RFC 7208 section 4.6.4).
+const spfLookupLimit = 10
+
+// CheckSPF evaluates whether ip may send mail for domain, whose sender
+// address is sender (postmaster@domain when empty). The error explains the
+// temperror and permerror results.
+func CheckSPF(ctx context.Context, resolver DNSResolver, ip net.IP, domain string, sender string) (SPFResult, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if len(sender) == 0 {
+		sender = "postmaster@" + domain
+	}
+
+	e := &spfEvaluation{ctx: ctx, resolver: resolver, ip: ip, sender: sender}
+	return e.check(domain)
+}
+
+type spfEvaluation struct {
+	ctx      context.Context
+	resolver DNSResolver
+	ip       net.IP
+	sender   string
+	lookups  int
+}
+
+// spfErr builds the error of a temperror or permerror.
+func spfErr(result SPFResult, format string, args ...any) (SPFResult, error) {
+	return result, fmt.Errorf("rmailer: SPF %s: %s", result, fmt.Sprintf(format, args...))
+}
+
+func (e *spfEvaluation) check(domain string) (SPFResult, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return SPFNone, nil
+		}
+		return spfErr(SPFTempError, "lookup of %s failed: %s", domain, err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if isSPFRecord(txt) {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return SPFNone, nil
+	case 1:
+	default:
+		return spfErr(SPFPermError, "%d records for %s", len(records), domain)
+	}
+
+	terms := strings.Fields(records[0])[1:]
+	redirect := ""
+
+	for _, term := range terms {
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue // exp and unknown modifiers are ignored
+		}
+
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+
+		match, res, err := e.mechanism(domain, term)
+		if err != nil {
+			return res, err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if len(redirect) > 0 {
+		target, err := e.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err
+		}
+
+		if err := e.count(); err != nil {
+			return SPFPermError, err
+		}
+
+		result, err := e.check(target)
+		if result == SPFNone {
+			return spfErr(SPFPermError, "redirect to %s has no record", target)
+		}
+		return result, err
+	}
+
+	return SPFNeutral, nil
+}
+
+func (e *spfEvaluation) count() error {
+	if e.lookups++; e.lookups > spfLookupLimit {
+		_, err := spfErr(SPFPermError, "more than %d DNS lookups", spfLookupLimit)
+		return err
+	}
+
+	return nil
+}
+
+// mechanism reports whether term matches the IP. A non-nil error ends the
+// evaluation with the returned result.
+func (e *spfEvaluation) mechanism(domain string, term string) (bool, SPFResult, error) {
+	name, arg, hasArg := strings.Cut(term, ":")
+	if !hasArg {
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, arg = name[:i], name[i:]
+		}
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, "", nil
+
+	case "ip4", "ip6":
+		ipNet, err := parseSPFNetwork(arg, name == "ip6")
+		if err != nil {
+			result, err := spfErr(SPFPermError, "invalid %s", term)
+			return false, result, err
+		}
+		return ipNet.Contains(e.ip), "", nil
+
+	case "include":
+		target, err := e.expand(arg, domain)
+		if err == nil {
+			err = e.count()
+		}
+		if err != nil {
+			return false, SPFPermError, err
+		}
+
+		result, err := e.check(target)
+		switch result {
+		case SPFPass:
+			return true, "", nil
+		case SPFTempError, SPFPermError:
+			return false, result, err
+		case SPFNone:
+			result, err := spfErr(SPFPermError, "include of %s has no record", target)
+			return false, result, err
+		}
+		return false, "", nil
+
+	case "a", "mx":
+		host, cidr4, cidr6 := arg, 32, 128
+		if i := strings.Index(host, "/"); i >= 0 {
+			var err error
+			if cidr4, cidr6, err = parseSPFCIDRs(host[i:]); err != nil {
+				result, err := spfErr(SPFPermError, "invalid %s", term)
+				return false, result, err
+			}
+			host = host[:i]
+		}
+
+		target := domain
+		if len(host) > 0 {
+			var err error
+			if target, err = e.expand(host, domain); err != nil {
+				return false, SPFPermError, err
+			}
+		}
+
+		if err := e.count(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := e.resolver.LookupMX(e.ctx, target)
+			if err != nil && !isNotFound(err) {
+				result, err := spfErr(SPFTempError, "lookup of %s failed: %s", target, err)
+				return false, result, err
+			}
+
+			hosts = hosts[:0]
+			for i, mx := range mxs {
+				if i == spfLookupLimit {
+					result, err := spfErr(SPFPermError, "more than %d MX for %s", spfLookupLimit, target)
+					return false, result, err
+				}
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := e.resolver.LookupHost(e.ctx, host)
+			if err != nil && !isNotFound(err) {
+				result, err := spfErr(SPFTempError, "lookup of %s failed: %s", host, err)
+				return false, result, err
+			}
+
+			for _, addr := range addrs {
+				if spfAddrMatch(net.ParseIP(addr), e.ip, cidr4, cidr6) {
+					return true, "", nil
+				}
+			}
+		}
+		return false, "", nil
+
+	case "ptr":
+		target := domain
+		if len(arg) > 0 {
+			var err error
+			if target, err = e.expand(arg, domain); err != nil {
+				return false, SPFPermError, err
+			}
+		}
+
+		if err := e.count(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		names, _ := e.resolver.LookupAddr(e.ctx, e.ip.String())
+		for i, name := range names {
+			if i == spfLookupLimit {
+				break
+			}
+
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+
+			addrs, _ := e.resolver.LookupHost(e.ctx, name)
+			for _, addr := range addrs {
+				if net.ParseIP(addr).Equal(e.ip) {
+					return true, "", nil
+				}
+			}
+		}
+		return false, "", nil
+
+	case "exists":
+		target, err := e.expand(arg, domain)
+		if err == nil {
+			err = e.count()
+		}
+		if err != nil {
+			return false, SPFPermError, err
+		}
+
+		addrs, err := e.resolver.LookupHost(e.ctx, target)
+		if err != nil && !isNotFound(err) {
+			result, err := spfErr(SPFTempError, "lookup of %s failed: %s", target, err)
+			return false, result, err
+		}
+		return len(addrs) > 0, "", nil
+	}
+
+	result, err := spfErr(SPFPermError, "unknown mechanism %q", term)
+	return false, result, err
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// parseSPFNetwork parses the address and optional prefix length of an ip4 or
+// ip6 mechanism.
+func parseSPFNetwork(arg string, v6 bool) (*net.IPNet, error) {
+	if !strings.Contains(arg, "/") {
+		if v6 {
+			arg += "/128"
+		} else {
+			arg += "/32"
+		}
+	}
+
+	ip, ipNet, err := net.ParseCIDR(arg)
+	if err != nil || (ip.To4() == nil) != v6 {
+		return nil, fmt.Errorf("invalid network %q", arg)
+	}
+
+	return ipNet, nil
+}
+
+// parseSPFCIDRs parses the "/n", "//m" or "/n//m" suffix of a and mx.
+func parseSPFCIDRs(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+
+	v4, v6, dual := strings.Cut(s, "//")
+	if !dual && strings.HasPrefix(s, "//") {
+		v4, v6, dual = "", s[2:], true
+	}
+
+	var err error
+	if len(v4) > 0 {
+		if cidr4, err = strconv.Atoi(strings.TrimPrefix(v4, "/")); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return 0, 0, fmt.Errorf("invalid prefix %q", s)
+		}
+	}
+
+	if dual {
+		if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return 0, 0, fmt.Errorf("invalid prefix %q", s)
+		}
+	}
+
+	return cidr4, cidr6, nil
+}
+
+func spfAddrMatch(addr net.IP, ip net.IP, cidr4, cidr6 int) bool {
+	if addr == nil {
+		return false
+	}
+
+	if addr4, ip4 := addr.To4(), ip.To4(); addr4 != nil || ip4 != nil {
+		if addr4 == nil || ip4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 32)
+		return addr4.Mask(mask).Equal(ip4.Mask(mask))
+	}
+
+	mask := net.CIDRMask(cidr6, 128)
+	return addr.Mask(mask).Equal(ip.Mask(mask))
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (e *spfEvaluation) expand(spec string, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return strings.ToLower(strings.TrimSuffix(spec, ".")), nil
+	}
+
+	local, senderDomain, _ := strings.Cut(e.sender, "@")
+	var b strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("rmailer: SPF permerror: invalid macro in %q", spec)
+		}
+
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("rmailer: SPF permerror: invalid macro in %q", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("rmailer: SPF permerror: invalid macro in %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch macro[0] {
+		case 's', 'S':
+			value = e.sender
+		case 'l', 'L':
+			value = local
+		case 'o', 'O':
+			value = senderDomain
+		case 'd', 'D':
+			value = domain
+		case 'i', 'I':
+			value = spfMacroIP(e.ip)
+		case 'v', 'V':
+			value = "in-addr"
+			if e.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h', 'H', 'p', 'P':
+			value = "unknown"
+		default:
+			return "", fmt.Errorf("rmailer: SPF permerror: unknown macro %q in %q", macro, spec)
+		}
+
+		b.WriteString(transformSPFMacro(value, macro[1:]))
+	}
+
+	return strings.ToLower(strings.TrimSuffix(b.String(), ".")), nil
+}
+
+// spfMacroIP formats ip for the i macro: dotted quads, or dot-separated
+// nibbles for IPv6.
+func spfMacroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// transformSPFMacro applies the transformers of a macro, e.g. "2r" or "-",
+// to value.
+func transformSPFMacro(value string, transformers string) string {
+	digits := 0
+	for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+		digits = digits*10 + int(transformers[0]-'0')
+		transformers = transformers[1:]
+	}
+
+	reverse := false
+	if len(transformers) > 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+		reverse, transformers = true, transformers[1:]
+	}
+
+	delimiters := transformers
+	if len(delimiters) == 0 {
+		delimiters = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// SPFPolicy decides what SPFCheck does with the results other than pass.
+type SPFPolicy int
+
+const (
+	// SPFWarn logs the results other than pass and sends anyway.
+	SPFWarn SPFPolicy = iota
+	// SPFRefuseFail refuses to send on fail, which receivers reject.
+	SPFRefuseFail
+	// SPFRefuseSoftFail refuses to send on fail and softfail.
+	SPFRefuseSoftFail
+)
+
+// SPFCheck evaluates, before each transaction, whether the sending IP is
+// permitted by the SPF record of the envelope-from domain. It is meant for
+// Senders delivering directly to the recipients' MX, SPF being evaluated by
+// the receivers against the IP of the last hop.
+type SPFCheck struct {
+	Policy SPFPolicy
+	// SourceIP is the public IP of the outgoing mail, the local address of
+	// the connection when nil.
+	SourceIP net.IP
+	// Resolver looks up the records, net.DefaultResolver when nil.
+	Resolver DNSResolver
+}
+
+// SPFError reports a send refused by an SPFCheck.
+type SPFError struct {
+	IP     net.IP
+	Domain string
+	Result SPFResult
+}
+
+func (e *SPFError) Error() string {
+	return fmt.Sprintf("rmailer: SPF %s for %s sending as %s", e.Result, e.IP, e.Domain)
+}
+
+// checkSPF runs the SPF check, if any, of a session about to send as from.
+func (s *Sender) checkSPF(c *session, from string) error {
+	if s.SPF == nil {
+		return nil
+	}
+
+	domain, sender := addressDomain(from), from
+	if len(from) == 0 {
+		// bounces are checked against the HELO identity
+		domain, sender = s.LocalName, ""
+	}
+	if len(domain) == 0 {
+		return nil
+	}
+
+	ip := s.SPF.SourceIP
+	if ip == nil {
+		addr, ok := c.conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil
+		}
+		ip = addr.IP
+	}
+
+	result, err := CheckSPF(context.Background(), s.SPF.Resolver, ip, domain, sender)
+
+	refused := result == SPFFail && s.SPF.Policy >= SPFRefuseFail ||
+		result == SPFSoftFail && s.SPF.Policy >= SPFRefuseSoftFail
+	if refused {
+		return &SPFError{IP: ip, Domain: domain, Result: result}
+	}
+
+	if result != SPFPass {
+		if err != nil {
+			logf("SMTP SPF %s for %s sending as %s: %s", result, ip, domain, err)
+		} else {
+			logf("SMTP SPF %s for %s sending as %s", result, ip, domain)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package rmailer_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+// fakeDNS answers from its maps, the names missing being not found.
+type fakeDNS struct {
+	txt   map[string][]string
+	hosts map[string][]string
+	mx    map[string][]*net.MX
+	ptr   map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (d *fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := d.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (d *fakeDNS) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := d.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+func (d *fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := d.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, notFound(name)
+}
+
+func (d *fakeDNS) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := d.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+func TestCheckSPF(t *testing.T) {
+	dns := &fakeDNS{
+		txt: map[string][]string{
+			"toto.fr":          {"google-site-verification=x", "v=spf1 ip4:192.0.2.0/24 include:_spf.relay.fr mx -all"},
+			"_spf.relay.fr":    {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.fr":          {"v=spf1 a:mail.soft.fr/28 ~all"},
+			"redirected.fr":    {"v=spf1 redirect=toto.fr"},
+			"macro.fr":         {"v=spf1 exists:%{l}.%{d}.allow.fr -all"},
+			"twice.fr":         {"v=spf1 -all", "v=spf1 +all"},
+			"broken.fr":        {"v=spf1 ip4:not-an-ip -all"},
+			"loop.fr":          {"v=spf1 include:loop.fr -all"},
+			"neutral.fr":       {"v=spf1 ?all"},
+			"norecord.fr":      {"hello"},
+			"dangling.fr":      {"v=spf1 include:nowhere.fr -all"},
+			"ptr.fr":           {"v=spf1 ptr -all"},
+			"mixedcase.fr":     {"v=spf1 IP4:192.0.2.1 -ALL"},
+			"emptyredirect.fr": {"v=spf1 redirect=nowhere.fr"},
+		},
+		hosts: map[string][]string{
+			"mail.soft.fr":         {"198.51.100.1"},
+			"mx.toto.fr":           {"203.0.113.7"},
+			"me.macro.fr.allow.fr": {"127.0.0.2"},
+			"mail.ptr.fr":          {"203.0.113.9"},
+		},
+		mx: map[string][]*net.MX{
+			"toto.fr": {{Host: "mx.toto.fr", Pref: 10}},
+		},
+		ptr: map[string][]string{
+			"203.0.113.9": {"mail.ptr.fr."},
+		},
+	}
+
+	for _, c := range []struct {
+		ip, domain, sender string
+		want               rmailer.SPFResult
+	}{
+		{"192.0.2.10", "toto.fr", "", rmailer.SPFPass},
+		{"2001:db8::1", "toto.fr", "", rmailer.SPFPass},
+		{"203.0.113.7", "toto.fr", "", rmailer.SPFPass},
+		{"198.51.100.1", "toto.fr", "", rmailer.SPFFail},
+		{"198.51.100.14", "soft.fr", "", rmailer.SPFPass},
+		{"198.51.100.17", "soft.fr", "", rmailer.SPFSoftFail},
+		{"192.0.2.10", "redirected.fr", "", rmailer.SPFPass},
+		{"198.51.100.1", "redirected.fr", "", rmailer.SPFFail},
+		{"192.0.2.1", "macro.fr", "me@macro.fr", rmailer.SPFPass},
+		{"192.0.2.1", "macro.fr", "you@macro.fr", rmailer.SPFFail},
+		{"203.0.113.9", "ptr.fr", "", rmailer.SPFPass},
+		{"203.0.113.10", "ptr.fr", "", rmailer.SPFFail},
+		{"192.0.2.1", "MixedCase.fr.", "", rmailer.SPFPass},
+		{"192.0.2.1", "neutral.fr", "", rmailer.SPFNeutral},
+		{"192.0.2.1", "norecord.fr", "", rmailer.SPFNone},
+		{"192.0.2.1", "unknown.fr", "", rmailer.SPFNone},
+		{"192.0.2.1", "twice.fr", "", rmailer.SPFPermError},
+		{"192.0.2.1", "broken.fr", "", rmailer.SPFPermError},
+		{"192.0.2.1", "loop.fr", "", rmailer.SPFPermError},
+		{"192.0.2.1", "dangling.fr", "", rmailer.SPFPermError},
+		{"192.0.2.1", "emptyredirect.fr", "", rmailer.SPFPermError},
+	} {
+		got, err := rmailer.CheckSPF(context.Background(), dns, net.ParseIP(c.ip), c.domain, c.sender)
+		if got != c.want {
+			t.Errorf("CheckSPF(%s, %s, %q) = %s, %v, want %s", c.ip, c.domain, c.sender, got, err, c.want)
+		}
+		if (err != nil) != (got == rmailer.SPFPermError || got == rmailer.SPFTempError) {
+			t.Errorf("CheckSPF(%s, %s) = %s with error %v", c.ip, c.domain, got, err)
+		}
+	}
+}
+
+func TestSenderRefusesSPFFail(t *testing.T) {
+	srv := newTestServer(t)
+	dns := &fakeDNS{txt: map[string][]string{
+		"toto.fr":  {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"local.fr": {"v=spf1 ip4:127.0.0.0/8 -all"},
+	}}
+
+	for _, c := range []struct {
+		from   string
+		policy rmailer.SPFPolicy
+		sent   bool
+	}{
+		{"me@toto.fr", rmailer.SPFRefuseFail, false},
+		{"me@toto.fr", rmailer.SPFWarn, true},
+		{"me@local.fr", rmailer.SPFRefuseSoftFail, true},
+	} {
+		srv.Reset()
+
+		sender := rmailer.NewSender(c.from, "", srv.Addr)
+		sender.SPF = &rmailer.SPFCheck{Policy: c.policy, Resolver: dns}
+
+		err := sender.Send(newTestMessage("a@toto.fr"))
+
+		var spfErr *rmailer.SPFError
+		if c.sent && err != nil || !c.sent && (!errors.As(err, &spfErr) || spfErr.Result != rmailer.SPFFail) {
+			t.Errorf("sending as %s with policy %d: %v", c.from, c.policy, err)
+		}
+		if sent := len(srv.Messages()) == 1; sent != c.sent {
+			t.Errorf("sending as %s with policy %d: sent = %t, want %t", c.from, c.policy, sent, c.sent)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package rmailer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// spillBufferSize is the write buffer of the messages spilled to disk.
+const spillBufferSize = 64 << 10
+
+// renderedMessage is a message rendered for sending, in memory or spilled to
+// a temporary file.
+type renderedMessage struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// render renders m in memory, or to a temporary file when it is larger than
+// the Sender's MemoryBudget. A Strict message spilled is checked as it is
+// written.
+func (s *Sender) render(m *Message) (*renderedMessage, error) {
+	if s.MemoryBudget <= 0 || m.SizeHint() <= s.MemoryBudget {
+		raw, err := m.render()
+		if err != nil {
+			return nil, err
+		}
+		return &renderedMessage{data: raw, size: int64(len(raw))}, nil
+	}
+
+	file, err := os.CreateTemp(s.SpillDir, "rmailer-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("rmailer: spilling message: %w", err)
+	}
+
+	r := &renderedMessage{file: file}
+
+	w := bufio.NewWriterSize(file, spillBufferSize)
+	cw := &countingWriter{w: w}
+
+	var checker *complianceChecker
+	if m.Strict {
+		checker = &complianceChecker{}
+		cw.w = io.MultiWriter(w, checker)
+	}
+
+	err = m.writeTo(cw)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && checker != nil {
+		err = checker.check()
+	}
+	r.size = cw.n
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reader returns a reader of the whole message, one per transaction.
+func (r *renderedMessage) reader() io.Reader {
+	if r.file != nil {
+		return io.NewSectionReader(r.file, 0, r.size)
+	}
+
+	return bytes.NewReader(r.data)
+}
+
+// close removes the temporary file, if any.
+func (r *renderedMessage) close() {
+	if r == nil || r.file == nil {
+		return
+	}
+
+	r.file.Close()
+	os.Remove(r.file.Name())
+	r.file = nil
+}
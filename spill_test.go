@@ -0,0 +1,131 @@
+package rmailer_test
+
+import (
+	"bytes"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("%s holds %d file(s) after the send", dir, len(entries))
+	}
+}
+
+func TestSenderSpillsLargeMessages(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.MemoryBudget = 1 << 10
+	sender.SpillDir = dir
+
+	content := bytes.Repeat([]byte("spilled content "), 8<<10)
+	m := newTestMessage("a@toto.fr")
+	m.AttachBytes("large.txt", content)
+
+	if err := sender.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, dir)
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("%d message(s) received, want 1", len(msgs))
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mimeStructure(t, msg.Header, msg.Body); got != "mixed(text/plain,text/plain)" {
+		t.Errorf("structure = %s", got)
+	}
+}
+
+func TestSenderRemovesSpilledFileOnFailure(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.MemoryBudget = 1 << 10
+	sender.SpillDir = dir
+
+	m := newTestMessage("a@toto.fr")
+	m.AttachBytes("large.txt", bytes.Repeat([]byte("x"), 64<<10))
+
+	srv.FailNext("DATA", "554 5.6.0 message refused")
+	if err := sender.Send(m); err == nil {
+		t.Fatal("Send succeeded, want the DATA failure")
+	}
+	assertEmptyDir(t, dir)
+}
+
+func TestSenderChecksSpilledStrictMessages(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+
+	// a file streamed as 8bit is written as is, bare LF and long line included
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("bare\nLF\r\n"+strings.Repeat("x", 2<<10)+"\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, budget := range map[string]int64{"in memory": 0, "spilled": 1 << 10} {
+		t.Run(name, func(t *testing.T) {
+			sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+			sender.MemoryBudget = budget
+			sender.SpillDir = dir
+
+			m := newTestMessage("a@toto.fr")
+			m.Strict = true
+			m.Attachments = append(m.Attachments, rmailer.Attachment{Name: "data.txt", Path: path, Encoding: rmailer.Encoding8Bit})
+
+			var compliance *rmailer.ComplianceError
+			if err := sender.Send(m); !errors.As(err, &compliance) {
+				t.Fatalf("Send = %v, want a *ComplianceError", err)
+			}
+			if got := strings.Join(compliance.Problems, "; "); !strings.Contains(got, "bare LF") || !strings.Contains(got, "octets long") {
+				t.Errorf("problems = %s", got)
+			}
+			if n := len(srv.Messages()); n != 0 {
+				t.Errorf("%d message(s) sent", n)
+			}
+			assertEmptyDir(t, dir)
+		})
+	}
+}
+
+func TestSenderSpillsStrictMessages(t *testing.T) {
+	srv := newTestServer(t)
+
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+	sender.MemoryBudget = 1 << 10
+	sender.SpillDir = filepath.Join(t.TempDir(), "missing")
+
+	m := newTestMessage("a@toto.fr")
+	m.Strict = true
+	m.AttachBytes("large.txt", bytes.Repeat([]byte("x"), 64<<10))
+
+	// the spill directory is missing: the message was not rendered in memory
+	if err := sender.Send(m); err == nil || !strings.Contains(err.Error(), "spilling message") {
+		t.Fatalf("Send = %v, want a spilling error", err)
+	}
+
+	sender.SpillDir = t.TempDir()
+	if err := sender.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, sender.SpillDir)
+}
@@ -0,0 +1,163 @@
+package rmailer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// uniqueHeaders may appear at most once in a message (RFC 5322 section 3.6).
+var uniqueHeaders = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Message-ID",
+	"In-Reply-To", "References", "Subject",
+}
+
+// ComplianceError lists the deviations from RFC 5322 found in a message
+// rendered in strict mode.
+type ComplianceError struct {
+	Problems []string
+}
+
+func (e *ComplianceError) Error() string {
+	return "rmailer: message is not RFC 5322 compliant: " + strings.Join(e.Problems, "; ")
+}
+
+// CheckRFC5322 verifies a rendered message: CRLF line endings, lines within
+// 998 octets, ASCII header fields, a single Date and From and no duplicate
+// unique header. It returns a *ComplianceError listing the problems found.
+func CheckRFC5322(raw []byte) error {
+	c := &complianceChecker{}
+	c.Write(raw)
+	return c.check()
+}
+
+// complianceChecker runs the checks of CheckRFC5322 on a message as it is
+// written, holding its header only.
+type complianceChecker struct {
+	header     []byte
+	headerDone bool
+
+	bareLF, bareCR bool
+	// cr is set when the last byte written is a CR.
+	cr           bool
+	line, length int
+	long         []string
+}
+
+func (c *complianceChecker) Write(p []byte) (int, error) {
+	if !c.headerDone {
+		from := max(0, len(c.header)-3)
+		c.header = append(c.header, p...)
+
+		if bytes.HasPrefix(c.header, []byte("\r\n")) {
+			c.header, c.headerDone = c.header[:2], true
+		} else if i := bytes.Index(c.header[from:], []byte("\r\n\r\n")); i >= 0 {
+			c.header, c.headerDone = c.header[:from+i+4], true
+		}
+	}
+
+	for _, b := range p {
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				c.endLine()
+				continue
+			}
+			c.bareCR = true
+			c.length++
+		}
+
+		switch b {
+		case '\r':
+			c.cr = true
+		case '\n':
+			c.bareLF = true
+			c.length++
+		default:
+			c.length++
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *complianceChecker) endLine() {
+	if c.length > maxWireLineLength {
+		c.long = append(c.long, fmt.Sprintf("line %d is %d octets long", c.line+1, c.length))
+	}
+	c.line++
+	c.length = 0
+}
+
+// check returns the problems of the message written, as CheckRFC5322 does.
+func (c *complianceChecker) check() error {
+	if c.cr {
+		c.cr = false
+		c.bareCR = true
+		c.length++
+	}
+	c.endLine()
+
+	var problems []string
+
+	if c.bareLF {
+		problems = append(problems, "bare LF")
+	}
+	if c.bareCR {
+		problems = append(problems, "bare CR")
+	}
+	problems = append(problems, c.long...)
+
+	fields, _, err := splitMessage(c.header)
+	if err != nil {
+		return &ComplianceError{Problems: append(problems, err.Error())}
+	}
+
+	counts := make(map[string]int)
+
+	for _, f := range fields {
+		if !validFieldName(f.name) {
+			problems = append(problems, fmt.Sprintf("invalid header name %q", f.name))
+		}
+
+		if !isASCII(f.raw) {
+			problems = append(problems, fmt.Sprintf("unencoded 8-bit data in %s", f.name))
+		}
+
+		counts[strings.ToLower(f.name)]++
+	}
+
+	for _, name := range []string{"Date", "From"} {
+		if counts[strings.ToLower(name)] == 0 {
+			problems = append(problems, "missing "+name)
+		}
+	}
+
+	for _, name := range uniqueHeaders {
+		if n := counts[strings.ToLower(name)]; n > 1 {
+			problems = append(problems, fmt.Sprintf("%s appears %d times", name, n))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ComplianceError{Problems: problems}
+	}
+
+	return nil
+}
+
+// validFieldName reports whether name is made of printable ASCII characters
+// other than colon (RFC 5322 section 3.6.8).
+func validFieldName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+
+	return true
+}
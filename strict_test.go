@@ -0,0 +1,107 @@
+package rmailer_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestCheckRFC5322(t *testing.T) {
+	valid := "Date: Mon, 02 Mar 2026 10:00:00 +0000\r\nFrom: me@toto.fr\r\nSubject: Hello\r\n\r\nHello\r\n"
+
+	for _, c := range []struct {
+		name     string
+		raw      string
+		problems []string
+	}{
+		{name: "valid", raw: valid},
+		{name: "folded", raw: "Date: Mon, 02 Mar 2026 10:00:00 +0000\r\nFrom: me@toto.fr\r\nSubject: Hello\r\n world\r\n\r\nHello\r\n"},
+		{name: "bare LF", raw: valid + "bare\nLF\r\n", problems: []string{"bare LF"}},
+		{name: "bare CR", raw: valid + "\r", problems: []string{"bare CR"}},
+		{
+			name: "long line", raw: valid + strings.Repeat("x", 999) + "\r\n",
+			problems: []string{"line 6 is 999 octets long"},
+		},
+		{
+			name: "8-bit header", raw: strings.Replace(valid, "Subject: Hello", "Subject: Caf\xc3\xa9", 1),
+			problems: []string{"unencoded 8-bit data in Subject"},
+		},
+		{
+			name: "missing From and Date", raw: "Subject: Hello\r\n\r\nHello\r\n",
+			problems: []string{"missing Date", "missing From"},
+		},
+		{
+			name: "duplicates", raw: "Subject: Again\r\n" + valid,
+			problems: []string{"Subject appears 2 times"},
+		},
+		{
+			name: "invalid name", raw: "Bad Name: x\r\n" + valid,
+			problems: []string{`invalid header name "Bad Name"`},
+		},
+		{
+			name: "unterminated header", raw: "From: me@toto.fr",
+			problems: []string{"rmailer: message header is not CRLF terminated"},
+		},
+	} {
+		err := rmailer.CheckRFC5322([]byte(c.raw))
+
+		var compliance *rmailer.ComplianceError
+		switch {
+		case len(c.problems) == 0 && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case len(c.problems) > 0 && !errors.As(err, &compliance):
+			t.Errorf("%s: CheckRFC5322 = %v, want a *ComplianceError", c.name, err)
+		case len(c.problems) > 0 && !reflect.DeepEqual(compliance.Problems, c.problems):
+			t.Errorf("%s: problems = %q, want %q", c.name, compliance.Problems, c.problems)
+		}
+	}
+}
+
+func TestStrictMessageRefusesNonCompliantRendering(t *testing.T) {
+	srv := newTestServer(t)
+	sender := rmailer.NewSender("me@toto.fr", "", srv.Addr)
+
+	for name, setup := range map[string]func(m *rmailer.Message){
+		"duplicate Message-ID": func(m *rmailer.Message) {
+			m.AddHeader("Message-ID", "<1@toto.fr>")
+			m.AddHeader("Message-ID", "<2@toto.fr>")
+		},
+		// address headers are written as is (RFC 6532)
+		"8-bit Reply-To": func(m *rmailer.Message) { m.AddHeader("Reply-To", "zoé@toto.fr") },
+	} {
+		m := newTestMessage("a@toto.fr")
+		setup(m)
+
+		// the same message is rendered when not strict
+		if _, err := m.WriteTo(io.Discard); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		m.Strict = true
+
+		var compliance *rmailer.ComplianceError
+		if _, err := m.WriteTo(io.Discard); !errors.As(err, &compliance) {
+			t.Errorf("%s: WriteTo = %v, want a *ComplianceError", name, err)
+		}
+		if b := m.ToBytes(); b != nil {
+			t.Errorf("%s: ToBytes returned %d bytes, want nil", name, len(b))
+		}
+		if err := sender.Send(m); !errors.As(err, &compliance) {
+			t.Errorf("%s: Send = %v, want a *ComplianceError", name, err)
+		}
+	}
+
+	if n := len(srv.Messages()); n != 0 {
+		t.Errorf("%d non-compliant message(s) sent", n)
+	}
+
+	m := newTestMessage("a@toto.fr")
+	m.Strict = true
+	if err := sender.Send(m); err != nil {
+		t.Errorf("compliant message refused: %v", err)
+	}
+}
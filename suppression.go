@@ -0,0 +1,152 @@
+package rmailer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SuppressionReason tells why an address must not be mailed anymore.
+type SuppressionReason string
+
+const (
+	SuppressedBounce      SuppressionReason = "bounce"
+	SuppressedComplaint   SuppressionReason = "complaint"
+	SuppressedUnsubscribe SuppressionReason = "unsubscribe"
+)
+
+var errAllSuppressed = errors.New("rmailer: all recipients are suppressed")
+
+// SuppressionStore holds the addresses which bounced, complained or
+// unsubscribed. Sender skips them at RCPT time and reports them in the
+// SendResult.
+type SuppressionStore interface {
+	// Suppressed returns the reason address is suppressed, or an empty
+	// reason.
+	Suppressed(address string) (SuppressionReason, error)
+	Suppress(address string, reason SuppressionReason) error
+	Unsuppress(address string) error
+}
+
+// MemorySuppressions is an in-memory SuppressionStore.
+type MemorySuppressions struct {
+	mu        sync.RWMutex
+	addresses map[string]SuppressionReason
+}
+
+func NewMemorySuppressions() *MemorySuppressions {
+	return &MemorySuppressions{addresses: make(map[string]SuppressionReason)}
+}
+
+func (s *MemorySuppressions) Suppressed(address string) (SuppressionReason, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.addresses[suppressionKey(address)], nil
+}
+
+func (s *MemorySuppressions) Suppress(address string, reason SuppressionReason) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addresses == nil {
+		s.addresses = make(map[string]SuppressionReason)
+	}
+	s.addresses[suppressionKey(address)] = reason
+
+	return nil
+}
+
+func (s *MemorySuppressions) Unsuppress(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.addresses, suppressionKey(address))
+	return nil
+}
+
+// FileSuppressions is a SuppressionStore kept in memory and persisted to an
+// append-only file of "address<TAB>reason" lines, a "-" reason recording a
+// removal.
+type FileSuppressions struct {
+	MemorySuppressions
+
+	path string
+	fmu  sync.Mutex
+}
+
+// NewFileSuppressions loads the store at path, which is created when it
+// does not exist.
+func NewFileSuppressions(path string) (*FileSuppressions, error) {
+	s := &FileSuppressions{path: path}
+	s.addresses = make(map[string]SuppressionReason)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		address, reason, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+
+		if reason == "-" {
+			delete(s.addresses, address)
+		} else {
+			s.addresses[address] = SuppressionReason(reason)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("rmailer: reading %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *FileSuppressions) Suppress(address string, reason SuppressionReason) error {
+	if err := s.append(address, string(reason)); err != nil {
+		return err
+	}
+
+	return s.MemorySuppressions.Suppress(address, reason)
+}
+
+func (s *FileSuppressions) Unsuppress(address string) error {
+	if err := s.append(address, "-"); err != nil {
+		return err
+	}
+
+	return s.MemorySuppressions.Unsuppress(address)
+}
+
+func (s *FileSuppressions) append(address string, reason string) error {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(file, "%s\t%s\n", suppressionKey(address), reason); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func suppressionKey(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
@@ -0,0 +1,126 @@
+package rmailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Renderer is a compiled template. *text/template.Template and
+// *html/template.Template implement it.
+type Renderer interface {
+	Execute(w io.Writer, data any) error
+}
+
+// TemplateEngine compiles template sources into Renderers, letting other
+// template languages (mustache, pongo2, MJML...) be used in place of the Go
+// templates. html reports whether source produces the HTML body.
+type TemplateEngine interface {
+	Compile(name string, source string, html bool, funcs FuncMap) (Renderer, error)
+}
+
+// GoTemplates is the default TemplateEngine, compiling the HTML body with
+// html/template and the subject and text body with text/template.
+var GoTemplates TemplateEngine = goTemplateEngine{}
+
+type goTemplateEngine struct{}
+
+func (goTemplateEngine) Compile(name string, source string, html bool, funcs FuncMap) (Renderer, error) {
+	if html {
+		return htmltemplate.New(name).Funcs(htmltemplate.FuncMap(funcs)).Parse(source)
+	}
+
+	return texttemplate.New(name).Funcs(texttemplate.FuncMap(funcs)).Parse(source)
+}
+
+// Template renders Messages from a subject, a text body and an HTML body
+// template, all evaluated against the same data. Nil templates are skipped.
+type Template struct {
+	Subject Renderer
+	Text    Renderer
+	Html    Renderer
+}
+
+// NewTemplate parses the given templates, an empty string leaving the
+// corresponding template unset.
+func NewTemplate(subject, text, html string) (*Template, error) {
+	return NewTemplateFuncs(subject, text, html, nil)
+}
+
+// NewTemplateFuncs is like NewTemplate with additional template functions,
+// which take precedence over the built-in ones.
+func NewTemplateFuncs(subject, text, html string, funcs FuncMap) (*Template, error) {
+	return CompileTemplate(GoTemplates, subject, text, html, funcs)
+}
+
+// CompileTemplate is like NewTemplateFuncs with the given engine. A nil
+// engine means GoTemplates.
+func CompileTemplate(engine TemplateEngine, subject, text, html string, funcs FuncMap) (*Template, error) {
+	if engine == nil {
+		engine = GoTemplates
+	}
+
+	t := &Template{}
+	fm := mergeFuncs(funcs)
+	var err error
+
+	if len(subject) > 0 {
+		if t.Subject, err = engine.Compile("subject", subject, false, fm); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(text) > 0 {
+		if t.Text, err = engine.Compile("text", text, false, fm); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(html) > 0 {
+		if t.Html, err = engine.Compile("html", html, true, fm); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// Render executes the templates against data and returns the resulting
+// Message. Line breaks produced by the subject template are folded into
+// spaces.
+func (t *Template) Render(data any) (*Message, error) {
+	var subject, text, html string
+	var err error
+
+	if t.Subject != nil {
+		if subject, err = execute(t.Subject, data); err != nil {
+			return nil, err
+		}
+		subject = strings.Join(strings.Fields(subject), " ")
+	}
+
+	if t.Text != nil {
+		if text, err = execute(t.Text, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Html != nil {
+		if html, err = execute(t.Html, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewMessage(subject, text, html), nil
+}
+
+func execute(t Renderer, data any) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
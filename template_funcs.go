@@ -0,0 +1,103 @@
+package rmailer
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"time"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// FuncMap holds functions made available to templates, in addition to the
+// built-in ones:
+//
+//	{{ .At | date "2006-01-02" }}
+//	{{ .Total | currency "EUR" }}
+//	{{ .Count | pluralize "item" "items" }}
+//	{{ .Query | urlencode }}
+//	{{ .Snippet | safeHTML }}
+type FuncMap map[string]any
+
+func builtinFuncs() FuncMap {
+	return FuncMap{
+		"date":      templateDate,
+		"currency":  templateCurrency,
+		"pluralize": templatePluralize,
+		"urlencode": url.QueryEscape,
+		"safeHTML":  func(s string) htmltemplate.HTML { return htmltemplate.HTML(s) },
+	}
+}
+
+// mergeFuncs returns the built-in functions overridden by funcs.
+func mergeFuncs(funcs FuncMap) FuncMap {
+	merged := builtinFuncs()
+	for name, fn := range funcs {
+		merged[name] = fn
+	}
+
+	return merged
+}
+
+func templateDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+func templateCurrency(code string, amount any) (string, error) {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return "", err
+	}
+
+	v, err := toFloat(amount)
+	if err != nil {
+		return "", err
+	}
+
+	return message.NewPrinter(language.English).Sprint(currency.Symbol(unit.Amount(v))), nil
+}
+
+func templatePluralize(singular, plural string, count any) (string, error) {
+	v, err := toFloat(count)
+	if err != nil {
+		return "", err
+	}
+
+	if v == 1 {
+		return singular, nil
+	}
+	return plural, nil
+}
+
+func toFloat(v any) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case int8:
+		return float64(n), nil
+	case int16:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint8:
+		return float64(n), nil
+	case uint16:
+		return float64(n), nil
+	case uint32:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case float32:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("rmailer: %v is not a number", v)
+	}
+}
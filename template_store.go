@@ -0,0 +1,161 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	TemplateSubjectFile = "subject.tmpl"
+	TemplateTextFile    = "text.tmpl"
+	TemplateHtmlFile    = "html.tmpl"
+)
+
+// TemplateStore loads named templates from a file system, each template
+// being a directory holding subject.tmpl, text.tmpl and html.tmpl (any of
+// them may be missing) and optionally one sub-directory per locale holding
+// the same files. Parsed templates are cached unless Reload is set.
+type TemplateStore struct {
+	FS fs.FS
+	// Reload parses the files again on every Render, useful with os.DirFS
+	// while editing templates.
+	Reload bool
+	// Funcs are made available to the templates in addition to the
+	// built-in functions.
+	Funcs FuncMap
+	// Catalog provides the translations of the t template function.
+	Catalog Catalog
+	// Engine compiles the template files, GoTemplates when nil.
+	Engine TemplateEngine
+
+	mu    sync.Mutex
+	cache map[string]*Template
+}
+
+func NewTemplateStore(fsys fs.FS) *TemplateStore {
+	return &TemplateStore{
+		FS:    fsys,
+		cache: make(map[string]*Template),
+	}
+}
+
+// Get returns the template called name.
+func (s *TemplateStore) Get(name string) (*Template, error) {
+	return s.GetLocale(name, "")
+}
+
+// GetLocale returns the variant of the template called name for locale,
+// read from the name/locale directory. It falls back to the base language
+// ("fr" for "fr-CA") then to the default variant in the name directory.
+func (s *TemplateStore) GetLocale(name string, locale string) (*Template, error) {
+	if s.Reload {
+		return s.loadLocale(name, locale)
+	}
+
+	key := name + "\x00" + locale
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.cache[key]; ok {
+		return t, nil
+	}
+
+	t, err := s.loadLocale(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cache == nil {
+		s.cache = make(map[string]*Template)
+	}
+	s.cache[key] = t
+
+	return t, nil
+}
+
+// Render renders the template called name against data.
+func (s *TemplateStore) Render(name string, data any) (*Message, error) {
+	return s.RenderLocale(name, "", data)
+}
+
+// RenderLocale renders the variant of the template called name for locale,
+// with the catalog translations of that locale available through the t
+// template function:
+//
+//	{{ t "welcome.title" .Name }}
+func (s *TemplateStore) RenderLocale(name string, locale string, data any) (*Message, error) {
+	t, err := s.GetLocale(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Render(data)
+}
+
+func (s *TemplateStore) loadLocale(name string, locale string) (*Template, error) {
+	for _, variant := range localeFallbacks(locale) {
+		t, err := s.load(path.Join(name, variant), locale)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		return t, err
+	}
+
+	return nil, fmt.Errorf("rmailer: template %s: %w", name, fs.ErrNotExist)
+}
+
+func (s *TemplateStore) load(dir string, locale string) (*Template, error) {
+	var sources [3]string
+	found := false
+
+	for i, file := range []string{TemplateSubjectFile, TemplateTextFile, TemplateHtmlFile} {
+		b, err := fs.ReadFile(s.FS, path.Join(dir, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sources[i] = string(b)
+		found = true
+	}
+
+	if !found {
+		return nil, fmt.Errorf("rmailer: template %s: %w", dir, fs.ErrNotExist)
+	}
+
+	funcs := FuncMap{
+		"t": func(key string, args ...any) string {
+			if s.Catalog == nil {
+				return key
+			}
+			return s.Catalog.Translate(locale, key, args...)
+		},
+	}
+	for name, fn := range s.Funcs {
+		funcs[name] = fn
+	}
+
+	return CompileTemplate(s.Engine, sources[0], sources[1], sources[2], funcs)
+}
+
+// localeFallbacks lists the variants to try for locale, most specific first,
+// ending with the default variant.
+func localeFallbacks(locale string) []string {
+	if len(locale) == 0 {
+		return []string{""}
+	}
+
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		return []string{locale, locale[:i], ""}
+	}
+
+	return []string{locale, ""}
+}
@@ -0,0 +1,179 @@
+package rmailer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tenant is a customer sent on behalf of, with a relay, credentials and
+// limits of its own.
+type Tenant struct {
+	// Mailer sends the messages of the tenant, through the relay and with
+	// the credentials of its Sender.
+	Mailer *Mailer
+	// Rate, when set, delays sends beyond Rate.Count messages per Rate.Per.
+	Rate *DomainLimit
+	// Quota, when set, refuses messages beyond Quota.Count per Quota.Per
+	// with a *QuotaError.
+	Quota *DomainLimit
+}
+
+// QuotaError is returned when a tenant has used up its quota. The message
+// may be sent again at Until.
+type QuotaError struct {
+	Tenant string
+	Until  time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("rmailer: quota of tenant %q reached until %s", e.Tenant, e.Until.Format(time.RFC3339))
+}
+
+// TenantStats counts the messages of a tenant since it was registered.
+type TenantStats struct {
+	// Sent is the number of messages accepted for at least one recipient.
+	Sent int64
+	// Failed is the number of messages which could not be sent.
+	Failed int64
+	// Refused is the number of messages refused over the quota.
+	Refused int64
+	// Recipients is the number of recipients which accepted a message.
+	Recipients int64
+}
+
+// TenantRegistry routes messages to the Mailer of the tenant they are sent
+// for, applying its limits and counting its sends.
+type TenantRegistry struct {
+	// Clock times the limits, SystemClock when nil.
+	Clock Clock
+
+	mu      sync.RWMutex
+	tenants map[string]*tenantEntry
+}
+
+type tenantEntry struct {
+	Tenant
+
+	rate  *DomainThrottle
+	quota *DomainThrottle
+
+	mu    sync.Mutex
+	stats TenantStats
+}
+
+func NewTenantRegistry() *TenantRegistry {
+	return &TenantRegistry{tenants: make(map[string]*tenantEntry)}
+}
+
+// Register registers t under id, replacing any tenant already registered
+// with that id and resetting its limits and stats.
+func (r *TenantRegistry) Register(id string, t Tenant) {
+	entry := &tenantEntry{Tenant: t}
+
+	if t.Rate != nil {
+		entry.rate = &DomainThrottle{Default: t.Rate, Clock: r.Clock}
+	}
+	if t.Quota != nil {
+		entry.quota = &DomainThrottle{Default: t.Quota, Clock: r.Clock}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tenants == nil {
+		r.tenants = make(map[string]*tenantEntry)
+	}
+	r.tenants[id] = entry
+}
+
+func (r *TenantRegistry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tenants, id)
+}
+
+// Tenant returns the tenant registered under id.
+func (r *TenantRegistry) Tenant(id string) (Tenant, bool) {
+	entry, ok := r.entry(id)
+	if !ok {
+		return Tenant{}, false
+	}
+
+	return entry.Tenant, true
+}
+
+// Stats returns the counters of the tenant registered under id.
+func (r *TenantRegistry) Stats(id string) (TenantStats, bool) {
+	entry, ok := r.entry(id)
+	if !ok {
+		return TenantStats{}, false
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	return entry.stats, true
+}
+
+func (r *TenantRegistry) Send(tenant string, m *Message) error {
+	_, err := r.SendWithResult(tenant, m)
+	return err
+}
+
+// SendWithResult sends m with the Mailer of tenant, once its quota and rate
+// allow it.
+func (r *TenantRegistry) SendWithResult(tenant string, m *Message) (*SendResult, error) {
+	entry, ok := r.entry(tenant)
+	if !ok {
+		return nil, fmt.Errorf("rmailer: unknown tenant %q", tenant)
+	}
+
+	if entry.quota != nil {
+		if delay := entry.quota.reserve(tenant, *entry.Quota); delay > 0 {
+			entry.count(func(stats *TenantStats) { stats.Refused++ })
+			return nil, &QuotaError{Tenant: tenant, Until: clockOf(r.Clock).Now().Add(delay)}
+		}
+	}
+
+	if entry.rate != nil {
+		if err := entry.rate.Wait(context.Background(), tenant); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := entry.Mailer.SendWithResult(m)
+
+	entry.count(func(stats *TenantStats) {
+		if err != nil {
+			stats.Failed++
+			return
+		}
+
+		stats.Sent++
+		for _, status := range result.Recipients {
+			if status.Accepted() {
+				stats.Recipients++
+			}
+		}
+	})
+
+	return result, err
+}
+
+func (r *TenantRegistry) entry(id string) (*tenantEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.tenants[id]
+	return entry, ok
+}
+
+func (e *tenantEntry) count(update func(stats *TenantStats)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	update(&e.stats)
+}
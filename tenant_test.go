@@ -0,0 +1,65 @@
+package rmailer_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+)
+
+func TestTenantRegistryEnforcesQuota(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("gone@toto.fr", "550 5.1.1 no such user")
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+
+	r := rmailer.NewTenantRegistry()
+	r.Clock = clock
+	for _, id := range []string{"acme", "globex"} {
+		r.Register(id, rmailer.Tenant{
+			Mailer: rmailer.NewMailer(rmailer.NewSender(id+"@toto.fr", "", srv.Addr)),
+			Quota:  &rmailer.DomainLimit{Count: 2, Per: time.Hour},
+		})
+	}
+
+	if err := r.Send("acme", newTestMessage("a@toto.fr", "b@toto.fr")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Minute)
+	// a failed send counts against the quota
+	if err := r.Send("acme", newTestMessage("gone@toto.fr")); err == nil {
+		t.Fatal("send to a refused recipient succeeded")
+	}
+
+	var quota *rmailer.QuotaError
+	err := r.Send("acme", newTestMessage("a@toto.fr"))
+	if !errors.As(err, &quota) || quota.Tenant != "acme" || !quota.Until.Equal(clock.Now().Add(50*time.Minute)) {
+		t.Fatalf("Send over the quota = %v, want a *QuotaError until 11:00", err)
+	}
+
+	// the quotas of the tenants are separate
+	if err := r.Send("globex", newTestMessage("a@toto.fr")); err != nil {
+		t.Errorf("globex: %v", err)
+	}
+
+	clock.Advance(50 * time.Minute)
+	if err := r.Send("acme", newTestMessage("a@toto.fr")); err != nil {
+		t.Errorf("Send once the first send left the window: %v", err)
+	}
+
+	stats, ok := r.Stats("acme")
+	if want := (rmailer.TenantStats{Sent: 2, Failed: 1, Refused: 1, Recipients: 3}); !ok || stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+	if n := len(srv.Messages()); n != 3 {
+		t.Errorf("%d message(s) sent, want 3", n)
+	}
+
+	if err := r.Send("initech", newTestMessage("a@toto.fr")); err == nil {
+		t.Error("send for an unknown tenant succeeded")
+	}
+	r.Remove("globex")
+	if _, ok := r.Tenant("globex"); ok {
+		t.Error("removed tenant still registered")
+	}
+}
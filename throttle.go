@@ -0,0 +1,164 @@
+package rmailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainLimit allows Count messages per period Per.
+type DomainLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// DomainThrottle rate limits sends per recipient domain, to respect the
+// policies of receivers such as "at most 10 messages a minute to yahoo.com".
+// A limit configured for a domain also applies to its subdomains.
+type DomainThrottle struct {
+	Limits map[string]DomainLimit
+	// Default, when set, applies to the domains without a limit of their own.
+	Default *DomainLimit
+	// Clock times the limits, SystemClock when nil.
+	Clock Clock
+
+	mu    sync.Mutex
+	sends map[string][]time.Time
+}
+
+// ThrottleError is returned for a queued message over the limit of Domain,
+// which is deferred until Until rather than holding a worker.
+type ThrottleError struct {
+	Domain string
+	Until  time.Time
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("rmailer: rate limit of %s reached, deferred until %s", e.Domain, e.Until.Format(time.RFC3339))
+}
+
+func NewDomainThrottle(limits map[string]DomainLimit) *DomainThrottle {
+	return &DomainThrottle{Limits: limits}
+}
+
+// Wait blocks until a message may be sent to domain, or ctx is done.
+func (t *DomainThrottle) Wait(ctx context.Context, domain string) error {
+	key, limit, ok := t.limit(domain)
+	if !ok {
+		return nil
+	}
+
+	for {
+		delay := t.reserve(key, limit)
+		if delay == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clockOf(t.Clock).After(delay):
+		}
+	}
+}
+
+// limit returns the configured domain matching domain and its limit.
+func (t *DomainThrottle) limit(domain string) (string, DomainLimit, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	for d := domain; len(d) > 0; {
+		if limit, ok := t.Limits[d]; ok && limit.Count > 0 {
+			return d, limit, true
+		}
+
+		_, parent, found := strings.Cut(d, ".")
+		if !found {
+			break
+		}
+		d = parent
+	}
+
+	if t.Default != nil && t.Default.Count > 0 {
+		return domain, *t.Default, true
+	}
+
+	return "", DomainLimit{}, false
+}
+
+// reserveAll records a send to each of domains if their limits all allow it
+// now, or records none and returns a *ThrottleError for the domain waited
+// for the longest. The domains sharing a limit count once.
+func (t *DomainThrottle) reserveAll(domains []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clockOf(t.Clock).Now()
+	limits := make(map[string]DomainLimit)
+	var throttled *ThrottleError
+
+	for _, domain := range domains {
+		key, limit, ok := t.limit(domain)
+		if !ok {
+			continue
+		}
+		limits[key] = limit
+
+		if delay := t.delay(key, limit, now); delay > 0 && (throttled == nil || now.Add(delay).After(throttled.Until)) {
+			throttled = &ThrottleError{Domain: key, Until: now.Add(delay)}
+		}
+	}
+
+	if throttled != nil {
+		return throttled
+	}
+
+	for key := range limits {
+		t.record(key, now)
+	}
+
+	return nil
+}
+
+// reserve records a send to key if the limit allows it now, and returns 0,
+// or returns how long to wait before trying again.
+func (t *DomainThrottle) reserve(key string, limit DomainLimit) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := clockOf(t.Clock).Now()
+	if delay := t.delay(key, limit, now); delay > 0 {
+		return delay
+	}
+	t.record(key, now)
+
+	return 0
+}
+
+// delay returns how long a send to key must wait at now, t.mu being held.
+func (t *DomainThrottle) delay(key string, limit DomainLimit, now time.Time) time.Duration {
+	// forget the sends which left the window
+	sends := t.sends[key]
+	for len(sends) > 0 && now.Sub(sends[0]) >= limit.Per {
+		sends = sends[1:]
+	}
+
+	if len(sends) < len(t.sends[key]) {
+		t.sends[key] = sends
+	}
+
+	if len(sends) >= limit.Count {
+		return sends[0].Add(limit.Per).Sub(now)
+	}
+
+	return 0
+}
+
+// record adds a send to key at now, t.mu being held.
+func (t *DomainThrottle) record(key string, now time.Time) {
+	if t.sends == nil {
+		t.sends = make(map[string][]time.Time)
+	}
+	t.sends[key] = append(t.sends[key], now)
+}
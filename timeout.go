@@ -0,0 +1,83 @@
+package rmailer
+
+import (
+	"io"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// Timeouts bound the wait for the reply to each SMTP command, independently
+// of how long the whole session lasts, so that a relay which accepts the
+// connection but stalls is detected quickly. A zero value means no timeout.
+// A timeout ends the session with a net.Error, which is retried as a
+// temporary failure.
+type Timeouts struct {
+	// Greeting covers the TLS handshake and the 220 banner.
+	Greeting time.Duration
+	// Hello covers EHLO, or HELO when EHLO is rejected.
+	Hello time.Duration
+	// Auth covers the whole AUTH exchange.
+	Auth time.Duration
+	// Mail covers MAIL FROM, and RSET or QUIT.
+	Mail time.Duration
+	// Rcpt covers each RCPT TO.
+	Rcpt time.Duration
+	// Data covers the DATA command, each write of the content and the final
+	// reply, or each BDAT chunk. A slow upload is not cut as long as it
+	// progresses.
+	Data time.Duration
+}
+
+// session is an SMTP client along with its connection, whose deadline is set
+// before each command when timed.
+type session struct {
+	*smtp.Client
+	conn     net.Conn
+	timed    bool
+	timeouts Timeouts
+}
+
+func (s *Sender) newSession(c *smtp.Client, conn net.Conn) *session {
+	sess := &session{Client: c, conn: conn, timed: s.Timeouts != nil}
+	if sess.timed {
+		sess.timeouts = *s.Timeouts
+	}
+
+	return sess
+}
+
+// expect sets the deadline of the next exchange to d from now, clearing it
+// when d is zero.
+func (c *session) expect(d time.Duration) {
+	if c.timed {
+		setDeadline(c.conn, d)
+	}
+}
+
+// quit ends the session, waiting for the reply within the Mail timeout.
+func (c *session) quit() error {
+	c.expect(c.timeouts.Mail)
+	return c.Quit()
+}
+
+func setDeadline(conn net.Conn, d time.Duration) {
+	if d <= 0 {
+		conn.SetDeadline(time.Time{})
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(d))
+}
+
+// progressWriter pushes the deadline of the session back before each write.
+type progressWriter struct {
+	w io.Writer
+	c *session
+	d time.Duration
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.c.expect(pw.d)
+	return pw.w.Write(p)
+}
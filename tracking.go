@@ -0,0 +1,62 @@
+package rmailer
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// HtmlProcessor rewrites the HTML body of a message being sent, e.g. for
+// click and open tracking. The message is a copy owned by the Mailer and
+// must not be modified.
+type HtmlProcessor interface {
+	ProcessHtml(m *Message, body string) (string, error)
+}
+
+// HtmlProcessorFunc adapts a function to the HtmlProcessor interface.
+type HtmlProcessorFunc func(m *Message, body string) (string, error)
+
+func (f HtmlProcessorFunc) ProcessHtml(m *Message, body string) (string, error) {
+	return f(m, body)
+}
+
+// linkHrefPattern matches the href attribute of a elements.
+var linkHrefPattern = regexp.MustCompile(`(?is)(<a\b[^>]*?\bhref\s*=\s*)("[^"]*"|'[^']*')`)
+
+// LinkTracker is an HtmlProcessor rewriting links through a click tracking
+// URL and adding an open tracking pixel.
+type LinkTracker struct {
+	// ClickURL returns the tracking URL redirecting to link, or link itself
+	// to leave it alone. Only http and https links are passed.
+	ClickURL func(m *Message, link string) string
+	// PixelURL returns the URL of the open tracking image, none when nil or
+	// empty.
+	PixelURL func(m *Message) string
+}
+
+func (t *LinkTracker) ProcessHtml(m *Message, body string) (string, error) {
+	if t.ClickURL != nil {
+		body = linkHrefPattern.ReplaceAllStringFunc(body, func(match string) string {
+			groups := linkHrefPattern.FindStringSubmatch(match)
+			quoted := groups[2]
+			link := html.UnescapeString(quoted[1 : len(quoted)-1])
+
+			lower := strings.ToLower(strings.TrimSpace(link))
+			if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+				return match
+			}
+
+			return groups[1] + `"` + html.EscapeString(t.ClickURL(m, link)) + `"`
+		})
+	}
+
+	if t.PixelURL != nil {
+		if src := t.PixelURL(m); len(src) > 0 {
+			pixel := `<img src="` + html.EscapeString(src) + `" width="1" height="1" alt="" style="display:none">`
+
+			body = appendHtml(body, pixel)
+		}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,77 @@
+package rmailer
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Unsubscribe configures the unsubscribe links a Mailer adds to bulk
+// messages.
+type Unsubscribe struct {
+	// URL returns the unsubscribe page of the message recipient.
+	URL func(m *Message) string
+	// Mailto is an optional unsubscribe address for List-Unsubscribe.
+	Mailto string
+	// OneClick adds List-Unsubscribe-Post (RFC 8058), URL then being
+	// expected to accept a POST from the mailbox provider.
+	OneClick bool
+	// TextFooter and HtmlFooter are appended to the bodies, with %s
+	// replaced by the unsubscribe URL.
+	TextFooter string
+	HtmlFooter string
+}
+
+// WithBulk flags the message as bulk mail, see Mailer.Unsubscribe.
+func WithBulk() MessageOption {
+	return func(m *Message) {
+		m.Bulk = true
+	}
+}
+
+func (u *Unsubscribe) apply(m *Message) error {
+	var link string
+	if u.URL != nil {
+		link = u.URL(m)
+	}
+
+	if len(link) == 0 && len(u.Mailto) == 0 {
+		return errors.New("rmailer: bulk message has no unsubscribe link")
+	}
+
+	var targets []string
+	if len(link) > 0 {
+		targets = append(targets, "<"+link+">")
+	}
+	if len(u.Mailto) > 0 {
+		targets = append(targets, "<mailto:"+u.Mailto+">")
+	}
+
+	if err := m.SetHeader("List-Unsubscribe", strings.Join(targets, ", ")); err != nil {
+		return err
+	}
+
+	if u.OneClick && strings.HasPrefix(link, "https://") {
+		if err := m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click"); err != nil {
+			return err
+		}
+	}
+
+	if len(link) == 0 {
+		return nil
+	}
+
+	if len(u.TextFooter) > 0 && len(m.BodyText) > 0 && !strings.Contains(m.BodyText, link) {
+		m.BodyText = strings.TrimRight(m.BodyText, "\r\n") + "\n\n" + fmt.Sprintf(u.TextFooter, link)
+	}
+
+	escaped := html.EscapeString(link)
+	if len(u.HtmlFooter) > 0 && len(m.BodyHtml) > 0 && !strings.Contains(m.BodyHtml, escaped) {
+		footer := fmt.Sprintf(u.HtmlFooter, escaped)
+
+		m.BodyHtml = appendHtml(m.BodyHtml, footer)
+	}
+
+	return nil
+}
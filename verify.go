@@ -0,0 +1,291 @@
+package rmailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeliverabilityStatus is the verdict of an address verification.
+type DeliverabilityStatus string
+
+const (
+	// Deliverable reports a recipient accepted by the domain's mail
+	// exchanger, which likely exists: servers accepting any address, or
+	// bouncing after the transaction, accept it too.
+	Deliverable DeliverabilityStatus = "deliverable"
+	// Undeliverable reports a recipient refused permanently, or a domain
+	// receiving no mail.
+	Undeliverable DeliverabilityStatus = "undeliverable"
+	// DeliverabilityUnknown reports a probe which did not conclude, e.g.
+	// greylisted or with no mail exchanger reachable.
+	DeliverabilityUnknown DeliverabilityStatus = "unknown"
+)
+
+// Deliverability is the outcome of VerifyDeliverability.
+type Deliverability struct {
+	Address string
+	Status  DeliverabilityStatus
+	// MX is the mail exchanger which answered, if any.
+	MX string
+	// Code and Message are its reply to RCPT TO.
+	Code    int
+	Message string
+}
+
+// defaultVerifyTimeout bounds a probe of one mail exchanger.
+const defaultVerifyTimeout = 30 * time.Second
+
+// Verifier checks whether addresses likely exist by asking their mail
+// exchanger, through a transaction abandoned after RCPT TO (an "SMTP
+// callback"). Verdicts are cached, and probes can be rate limited per domain
+// as receivers blocklist hosts probing too often. Probes need outgoing port
+// 25, which most cloud providers block.
+type Verifier struct {
+	// From is the MAIL FROM of the probes, the null reverse path when empty.
+	// Some receivers refuse probes from a null path.
+	From string
+	// LocalName is the HELO name, "localhost" when empty, which many
+	// receivers distrust.
+	LocalName string
+	// Resolver looks up the mail exchangers, net.DefaultResolver when nil.
+	Resolver Resolver
+	// Port is the SMTP port of the mail exchangers, "25" when empty.
+	Port string
+	// Timeout bounds the probe of each mail exchanger, 30s when zero.
+	Timeout time.Duration
+	// Throttle, when set, limits the probes per domain.
+	Throttle *DomainThrottle
+	// CacheTTL is how long deliverable and undeliverable verdicts are kept.
+	// Unknown verdicts are not cached.
+	CacheTTL time.Duration
+	// Clock times the cache entries, SystemClock when nil.
+	Clock Clock
+
+	mu    sync.Mutex
+	cache map[string]cachedDeliverability
+	// swept is the number of entries left by the last sweep of the expired
+	// ones, the next being due once the cache has doubled.
+	swept int
+}
+
+type cachedDeliverability struct {
+	result  Deliverability
+	expires time.Time
+}
+
+// NewVerifier returns a Verifier probing from the MAIL FROM address from,
+// the null reverse path when empty, and caching its verdicts for cacheTTL.
+// Probes are not rate limited until Throttle is set.
+func NewVerifier(from string, cacheTTL time.Duration) *Verifier {
+	return &Verifier{From: from, CacheTTL: cacheTTL}
+}
+
+var defaultVerifier = &Verifier{
+	CacheTTL: time.Hour,
+	Throttle: &DomainThrottle{Default: &DomainLimit{Count: 10, Per: time.Minute}},
+}
+
+// VerifyDeliverability verifies address with a Verifier probing from the
+// null reverse path, caching verdicts for an hour and probing each domain 10
+// times a minute at most.
+func VerifyDeliverability(ctx context.Context, address string) (*Deliverability, error) {
+	return defaultVerifier.VerifyDeliverability(ctx, address)
+}
+
+// VerifyDeliverability resolves the mail exchangers of the domain of
+// address, and asks them in turn whether they accept it as a recipient. An
+// error is returned when address is invalid or the wait for the throttle is
+// cancelled; probes failing to conclude report DeliverabilityUnknown.
+func (v *Verifier) VerifyDeliverability(ctx context.Context, address string) (*Deliverability, error) {
+	domain := strings.ToLower(strings.TrimSuffix(addressDomain(address), "."))
+	if len(domain) == 0 || strings.ContainsAny(address, " <>\r\n") {
+		return nil, fmt.Errorf("rmailer: invalid address %q", address)
+	}
+
+	key := strings.ToLower(address)
+
+	if result, ok := v.cached(key); ok {
+		return &result, nil
+	}
+
+	if v.Throttle != nil {
+		if err := v.Throttle.Wait(ctx, domain); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := v.probe(ctx, address, domain)
+	if err != nil {
+		logf("SMTP verification of %s failed: %s", address, err)
+	}
+
+	if result.Status != DeliverabilityUnknown && v.CacheTTL > 0 {
+		v.store(key, result)
+	}
+
+	return &result, nil
+}
+
+func (v *Verifier) store(key string, result Deliverability) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cache == nil {
+		v.cache = make(map[string]cachedDeliverability)
+	}
+
+	now := clockOf(v.Clock).Now()
+	v.cache[key] = cachedDeliverability{result: result, expires: now.Add(v.CacheTTL)}
+
+	// the addresses not verified again are swept once the cache has
+	// doubled, as MemoryDedup does
+	if len(v.cache) >= max(1024, 2*v.swept) {
+		for k, cached := range v.cache {
+			if !now.Before(cached.expires) {
+				delete(v.cache, k)
+			}
+		}
+		v.swept = len(v.cache)
+	}
+}
+
+func (v *Verifier) cached(key string) (Deliverability, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cached, ok := v.cache[key]
+	if !ok {
+		return Deliverability{}, false
+	}
+
+	if !clockOf(v.Clock).Now().Before(cached.expires) {
+		delete(v.cache, key)
+		return Deliverability{}, false
+	}
+
+	return cached.result, true
+}
+
+// probe asks the mail exchangers of domain about address, the next one being
+// tried when one is unreachable or fails before RCPT TO.
+func (v *Verifier) probe(ctx context.Context, address string, domain string) (Deliverability, error) {
+	result := Deliverability{Address: address, Status: DeliverabilityUnknown}
+
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+
+	var hosts []string
+	switch {
+	case err != nil && !isNotFound(err):
+		return result, err
+	case len(mxs) == 1 && (mxs[0].Host == "." || len(mxs[0].Host) == 0):
+		// null MX (RFC 7505)
+		result.Status, result.Message = Undeliverable, "the domain accepts no mail"
+		return result, nil
+	case len(mxs) == 0:
+		// implicit MX (RFC 5321 section 5.1)
+		if addrs, _ := resolver.LookupHost(ctx, domain); len(addrs) == 0 {
+			result.Status, result.Message = Undeliverable, "the domain has no mail exchanger"
+			return result, nil
+		}
+		hosts = []string{domain}
+	default:
+		for _, mx := range mxs {
+			hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+		}
+	}
+
+	var lastErr error
+	for _, host := range hosts {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		code, msg, err := v.ask(ctx, host, address)
+		if code == 0 {
+			lastErr = err
+			continue
+		}
+
+		result.MX, result.Code, result.Message = host, code, msg
+		switch {
+		case code/100 == 2:
+			result.Status = Deliverable
+		case code/100 == 5:
+			result.Status = Undeliverable
+		}
+
+		return result, nil
+	}
+
+	return result, lastErr
+}
+
+// ask runs the probe transaction with host, and returns the reply to RCPT
+// TO, or a zero code when the transaction failed before it.
+func (v *Verifier) ask(ctx context.Context, host string, address string) (int, string, error) {
+	port := v.Port
+	if len(port) == 0 {
+		port = "25"
+	}
+
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = defaultVerifyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return 0, "", err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return 0, "", err
+	}
+	defer c.Close()
+
+	name := v.LocalName
+	if len(name) == 0 {
+		name = "localhost"
+	}
+
+	if err := c.Hello(name); err != nil {
+		return 0, "", err
+	}
+
+	if err := c.Mail(v.From); err != nil {
+		return 0, "", err
+	}
+
+	code, msg := 250, ""
+	if err := c.Rcpt(address); err != nil {
+		code, msg = replyCode(err)
+		if code == 0 {
+			return 0, "", err
+		}
+	}
+
+	if err := c.Reset(); err == nil {
+		c.Quit()
+	}
+
+	return code, msg, nil
+}
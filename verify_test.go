@@ -0,0 +1,116 @@
+package rmailer_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RaoH37/rmailer"
+	"github.com/RaoH37/rmailer/rmailertest"
+)
+
+// newTestVerifier returns a Verifier probing srv, the mail exchanger of
+// toto.fr, with its cache timed by clock.
+func newTestVerifier(t *testing.T, srv *rmailertest.Server, clock rmailer.Clock) *rmailer.Verifier {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := rmailer.NewVerifier("probe@relay.fr", time.Hour)
+	v.Port = port
+	v.Clock = clock
+	v.Resolver = &fakeDNS{
+		mx: map[string][]*net.MX{
+			"toto.fr": {{Host: host + ".", Pref: 10}},
+			"null.fr": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"localhost": {host}},
+	}
+
+	return v
+}
+
+func verify(t *testing.T, v *rmailer.Verifier, address string) *rmailer.Deliverability {
+	t.Helper()
+
+	result, err := v.VerifyDeliverability(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestVerifyDeliverability(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectRecipient("gone@toto.fr", "550 5.1.1 no such user")
+
+	v := newTestVerifier(t, srv, nil)
+
+	for _, c := range []struct {
+		address string
+		status  rmailer.DeliverabilityStatus
+		code    int
+	}{
+		{"a@toto.fr", rmailer.Deliverable, 250},
+		{"gone@toto.fr", rmailer.Undeliverable, 550},
+		// null MX (RFC 7505): no probe
+		{"a@null.fr", rmailer.Undeliverable, 0},
+		// implicit MX: the domain itself is probed
+		{"a@localhost", rmailer.Deliverable, 250},
+		// neither MX nor address
+		{"a@nowhere.fr", rmailer.Undeliverable, 0},
+	} {
+		result := verify(t, v, c.address)
+		if result.Status != c.status || result.Code != c.code {
+			t.Errorf("%s: %+v, want %s with code %d", c.address, result, c.status, c.code)
+		}
+		if (c.code == 0) != (len(result.MX) == 0) {
+			t.Errorf("%s: probed %q", c.address, result.MX)
+		}
+	}
+
+	if _, err := v.VerifyDeliverability(context.Background(), "a@toto.fr\r\nRCPT TO:<b@toto.fr>"); err == nil {
+		t.Error("address with a line break verified")
+	}
+}
+
+func TestVerifierCachesVerdicts(t *testing.T) {
+	srv := newTestServer(t)
+	clock := &testClock{now: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	v := newTestVerifier(t, srv, clock)
+
+	if result := verify(t, v, "a@toto.fr"); result.Status != rmailer.Deliverable {
+		t.Fatalf("first verification = %+v", result)
+	}
+
+	// the mailbox is removed: the verdict is kept until it expires
+	srv.RejectRecipient("a@toto.fr", "550 5.1.1 no such user")
+
+	clock.Advance(59 * time.Minute)
+	if result := verify(t, v, "A@toto.fr"); result.Status != rmailer.Deliverable {
+		t.Errorf("cached verification = %+v, want the first verdict", result)
+	}
+
+	clock.Advance(time.Minute)
+	if result := verify(t, v, "a@toto.fr"); result.Status != rmailer.Undeliverable {
+		t.Errorf("expired verification = %+v, want a new probe", result)
+	}
+}
+
+func TestVerifierDoesNotCacheUnknownVerdicts(t *testing.T) {
+	srv := newTestServer(t)
+	v := newTestVerifier(t, srv, nil)
+
+	srv.FailNext("RCPT", "451 4.7.1 greylisted, try again later")
+	if result := verify(t, v, "a@toto.fr"); result.Status != rmailer.DeliverabilityUnknown || result.Code != 451 {
+		t.Fatalf("greylisted verification = %+v", result)
+	}
+
+	if result := verify(t, v, "a@toto.fr"); result.Status != rmailer.Deliverable {
+		t.Errorf("second verification = %+v, want a new probe", result)
+	}
+}
@@ -0,0 +1,100 @@
+package rmailer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// WarmUp caps the daily volume of a new sending IP according to a ramp, the
+// messages over the cap being deferred to the next day.
+type WarmUp struct {
+	// Start is the first day of the schedule, days being counted in its
+	// location.
+	Start time.Time
+	// Curve holds the number of recipients allowed on each day from Start.
+	Curve []int
+	// After is the daily cap once the curve is over, none when zero.
+	After int
+	// Clock tells the current day, SystemClock when nil.
+	Clock Clock
+
+	mu    sync.Mutex
+	day   int
+	count int
+}
+
+// WarmUpError is returned when the daily volume is reached. The message
+// should be queued again at Until.
+type WarmUpError struct {
+	Until time.Time
+}
+
+func (e *WarmUpError) Error() string {
+	return fmt.Sprintf("rmailer: warm-up volume reached, deferred until %s", e.Until.Format(time.RFC3339))
+}
+
+// GeometricCurve returns a warm-up curve of days days starting at first
+// recipients and growing by factor each day, e.g. 50 doubling over 14 days.
+func GeometricCurve(first int, factor float64, days int) []int {
+	curve := make([]int, days)
+	volume := float64(first)
+
+	for i := range curve {
+		curve[i] = int(math.Round(volume))
+		volume *= factor
+	}
+
+	return curve
+}
+
+// Reserve accounts for a message to n recipients, returning a *WarmUpError
+// if it would exceed today's volume. The first message of a day is always
+// accepted, so that one larger than the cap is not deferred forever.
+func (w *WarmUp) Reserve(n int) error {
+	now := clockOf(w.Clock).Now().In(w.Start.Location())
+	day := w.dayIndex(now)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if day != w.day {
+		w.day, w.count = day, 0
+	}
+
+	if day < 0 {
+		y, m, d := w.Start.Date()
+		return &WarmUpError{Until: time.Date(y, m, d, 0, 0, 0, 0, w.Start.Location())}
+	}
+
+	limit := w.limit(day)
+	if limit > 0 && w.count > 0 && w.count+n > limit {
+		y, m, d := now.Date()
+		return &WarmUpError{Until: time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())}
+	}
+
+	w.count += n
+	return nil
+}
+
+// limit returns the cap of the given day, 0 when unlimited.
+func (w *WarmUp) limit(day int) int {
+	switch {
+	case day < len(w.Curve):
+		return w.Curve[day]
+	default:
+		return w.After
+	}
+}
+
+func (w *WarmUp) dayIndex(t time.Time) int {
+	y, m, d := w.Start.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, w.Start.Location())
+
+	y, m, d = t.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	// rounded, as days are not all 24 hours long across DST changes
+	return int(math.Round(today.Sub(start).Hours() / 24))
+}